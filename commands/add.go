@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/openpubkey/opkssh/policy"
 )
@@ -34,6 +35,10 @@ type AddCmd struct {
 	//
 	// See AddCmd.LoadPolicy for more details.
 	Username string
+
+	// Comment is an optional annotation, such as a ticket number, stored with
+	// the policy entry so that operators can see why the entry exists
+	Comment string
 }
 
 // LoadPolicy reads the opkssh policy at the policy.SystemDefaultPolicyPath. If
@@ -89,12 +94,21 @@ func (a *AddCmd) GetPolicyPath(principal string, userEmail string, issuer string
 	return policy.SystemDefaultPolicyPath, true, nil
 }
 
+// ErrAddConflict is returned by Run when the policy contains an entry that
+// contradicts the principal being allowed, see policy.AddConflict
+var ErrAddConflict = errors.New("entry conflicts with the policy")
+
 // Run adds a new allowed principal to the user whose email is equal to
 // userEmail. The policy file is read and modified.
 //
 // If successful, returns the policy filepath updated. Otherwise, returns a
-// non-nil error
+// non-nil error. If Check would report a conflict, Run returns
+// ErrAddConflict with the same reason and does not change the policy file.
 func (a *AddCmd) Run(principal string, userEmail string, issuer string) (string, error) {
+	if strings.ContainsAny(a.Comment, "\r\n") {
+		return "", fmt.Errorf("comment must be a single line")
+	}
+
 	policyPath, useSystemPolicy, err := a.GetPolicyPath(principal, userEmail, issuer)
 	if err != nil {
 		return "", fmt.Errorf("failed to load policy: %w", err)
@@ -118,8 +132,12 @@ func (a *AddCmd) Run(principal string, userEmail string, issuer string) (string,
 		return "", fmt.Errorf("failed to load current policy: %w", err)
 	}
 
+	if status, reason := currentPolicy.CheckAllowedPrincipal(principal, userEmail, issuer); status == policy.AddConflict {
+		return "", fmt.Errorf("%w: %s", ErrAddConflict, reason)
+	}
+
 	// Update policy
-	currentPolicy.AddAllowedPrincipal(principal, userEmail, issuer)
+	currentPolicy.AddAllowedPrincipalWithComment(principal, userEmail, issuer, strings.TrimSpace(a.Comment))
 
 	// Dump contents back to disk
 	err = policyLoader.Dump(currentPolicy, policyFilePath)
@@ -129,3 +147,38 @@ func (a *AddCmd) Run(principal string, userEmail string, issuer string) (string,
 
 	return policyFilePath, nil
 }
+
+// AddCheckResult is the outcome of AddCmd.Check
+type AddCheckResult struct {
+	Status policy.AddStatus
+	// PolicyPath is the path of the policy file that was checked
+	PolicyPath string
+	// Reason describes the conflicting entry if Status is policy.AddConflict
+	Reason string
+}
+
+// Check reports whether Run would add the principal, whether it is already
+// present, or whether it conflicts with an existing entry, without writing
+// the policy file.
+func (a *AddCmd) Check(principal string, userEmail string, issuer string) (*AddCheckResult, error) {
+	policyPath, useSystemPolicy, err := a.GetPolicyPath(principal, userEmail, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policy: %w", err)
+	}
+
+	currentPolicy := &policy.Policy{}
+	policyLoader := a.SystemPolicyLoader.PolicyLoader
+	if !useSystemPolicy {
+		policyLoader = a.HomePolicyLoader.PolicyLoader
+	}
+	// Run creates a missing home policy file, which is the same as checking
+	// against an empty policy
+	if _, err := policyLoader.FileLoader.Fs.Stat(policyPath); err == nil || useSystemPolicy {
+		if currentPolicy, policyPath, err = a.LoadPolicy(); err != nil {
+			return nil, fmt.Errorf("failed to load current policy: %w", err)
+		}
+	}
+
+	status, reason := currentPolicy.CheckAllowedPrincipal(principal, userEmail, issuer)
+	return &AddCheckResult{Status: status, PolicyPath: policyPath, Reason: reason}, nil
+}
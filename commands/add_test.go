@@ -114,3 +114,125 @@ func TestAddErrors(t *testing.T) {
 	expectedPolicyContent := principal + " " + userEmail + " " + issuer + "\n"
 	require.Equal(t, expectedPolicyContent, string(policyContent))
 }
+
+func TestAddComment(t *testing.T) {
+	mockFs := afero.NewMemMapFs()
+	_, err := mockFs.Create(policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.NoError(t, mockFs.Chmod(policy.SystemDefaultPolicyPath, 0640))
+
+	addCmd := MockAddCmd(mockFs)
+	addCmd.Comment = "JIRA-123 access granted by bob"
+	_, err = addCmd.Run("root", "alice@example.com", "https://accounts.google.com")
+	require.NoError(t, err)
+
+	// Adding another entry without a comment must keep the existing comment
+	addCmd = MockAddCmd(mockFs)
+	_, err = addCmd.Run("dev", "bob@example.com", "https://accounts.google.com")
+	require.NoError(t, err)
+
+	policyContent, err := afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Equal(t, "root alice@example.com https://accounts.google.com # JIRA-123 access granted by bob\n"+
+		"dev bob@example.com https://accounts.google.com\n", string(policyContent))
+
+	// The comment is listed with the entry
+	currentPolicy, _, err := addCmd.LoadPolicy()
+	require.NoError(t, err)
+	require.Equal(t, "JIRA-123 access granted by bob", currentPolicy.Users[0].Comment)
+	listed, err := currentPolicy.ToTable()
+	require.NoError(t, err)
+	require.Contains(t, string(listed), "root alice@example.com https://accounts.google.com # JIRA-123 access granted by bob")
+
+	addCmd.Comment = "multi\nline"
+	_, err = addCmd.Run("root", "carol@example.com", "https://accounts.google.com")
+	require.ErrorContains(t, err, "comment must be a single line")
+}
+
+func TestAddCheck(t *testing.T) {
+	policyContent := "root alice@example.com https://accounts.google.com\n" +
+		"* mallory@example.com https://accounts.google.com deny\n" +
+		"backup bob@example.com https://accounts.google.com command=/usr/bin/backup\n"
+
+	mockFs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(mockFs, policy.SystemDefaultPolicyPath, []byte(policyContent), 0640))
+
+	tests := []struct {
+		name           string
+		principal      string
+		identity       string
+		issuer         string
+		expectedStatus policy.AddStatus
+		expectedReason string
+	}{
+		{
+			name:           "Already present",
+			principal:      "root",
+			identity:       "alice@example.com",
+			issuer:         "https://accounts.google.com",
+			expectedStatus: policy.AddPresent,
+		},
+		{
+			name:           "New principal for existing identity",
+			principal:      "dev",
+			identity:       "alice@example.com",
+			issuer:         "https://accounts.google.com",
+			expectedStatus: policy.AddWouldAdd,
+		},
+		{
+			name:           "Same identity different issuer",
+			principal:      "root",
+			identity:       "alice@example.com",
+			issuer:         "https://gitlab.com",
+			expectedStatus: policy.AddWouldAdd,
+		},
+		{
+			name:           "Denied identity",
+			principal:      "root",
+			identity:       "mallory@example.com",
+			issuer:         "https://accounts.google.com",
+			expectedStatus: policy.AddConflict,
+			expectedReason: "a deny rule for the principal * denies mallory@example.com",
+		},
+		{
+			name:           "Command restricted entry",
+			principal:      "backup",
+			identity:       "bob@example.com",
+			issuer:         "https://accounts.google.com",
+			expectedStatus: policy.AddConflict,
+			expectedReason: "bob@example.com is already allowed the principal backup but only to run /usr/bin/backup",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addCmd := MockAddCmd(mockFs)
+			result, err := addCmd.Check(tt.principal, tt.identity, tt.issuer)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, result.Status)
+			require.Equal(t, tt.expectedReason, result.Reason)
+			require.Equal(t, policy.SystemDefaultPolicyPath, result.PolicyPath)
+
+			// The policy file is never written
+			content, err := afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+			require.NoError(t, err)
+			require.Equal(t, policyContent, string(content))
+
+			// Run refuses the entries Check reports as conflicts, and
+			// leaves the policy file as it was
+			if tt.expectedStatus == policy.AddConflict {
+				_, err := MockAddCmd(mockFs).Run(tt.principal, tt.identity, tt.issuer)
+				require.ErrorIs(t, err, ErrAddConflict)
+				require.ErrorContains(t, err, tt.expectedReason)
+				content, err := afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+				require.NoError(t, err)
+				require.Equal(t, policyContent, string(content))
+			}
+		})
+	}
+
+	// Errors reading the policy are returned
+	addCmd := MockAddCmd(afero.NewMemMapFs())
+	result, err := addCmd.Check("root", "alice@example.com", "https://accounts.google.com")
+	require.ErrorContains(t, err, "file does not exist")
+	require.Nil(t, result)
+}
@@ -0,0 +1,128 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/openpubkey/opkssh/policy"
+)
+
+// AddFileResult is the outcome of a single line of the file passed to
+// AddCmd.RunFromFile
+type AddFileResult struct {
+	// Line is the line number in the file, starting at 1
+	Line      int
+	Principal string
+	Identity  string
+	// Status is what adding the entry did to the policy, it is only set if
+	// Err is nil
+	Status policy.AddStatus
+	// Reason describes the conflicting entry if Status is policy.AddConflict
+	Reason string
+	// Err is set if the line is malformed and was skipped
+	Err error
+}
+
+// ParseAddFile parses a file of email,principal pairs, one per line. Blank
+// lines, lines starting with # and a header line of email,principal are
+// ignored. The email may be any identity accepted by opkssh add, such as a
+// sub or oidc:groups:<group>. Malformed lines are returned as results with
+// Err set.
+func ParseAddFile(content []byte) []AddFileResult {
+	results := []AddFileResult{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if lineNumber == 1 && strings.EqualFold(strings.ReplaceAll(line, " ", ""), "email,principal") {
+			continue
+		}
+
+		result := AddFileResult{Line: lineNumber}
+		fields := strings.Split(line, ",")
+		if len(fields) != 2 {
+			result.Err = fmt.Errorf("expected email,principal but got %d fields", len(fields))
+			results = append(results, result)
+			continue
+		}
+		result.Identity = strings.TrimSpace(fields[0])
+		result.Principal = strings.TrimSpace(fields[1])
+		if result.Identity == "" {
+			result.Err = fmt.Errorf("email is empty")
+		} else if strings.ContainsAny(result.Identity, " \t#\"") {
+			result.Err = fmt.Errorf("invalid email %q, emails can not contain whitespace, # or quotes", result.Identity)
+		} else if err := validatePrincipal(result.Principal); err != nil {
+			result.Err = err
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// RunFromFile adds every entry in the file content, see ParseAddFile, to the
+// system policy for issuer. All entries are written in a single atomic update
+// of the policy file, so a failure leaves the policy unchanged. Malformed
+// lines are skipped, unless strict is true in which case the policy is not
+// updated at all.
+//
+// Returns the result for each line and the policy filepath updated. The
+// results are returned even if the policy was not updated because of a
+// malformed line.
+func (a *AddCmd) RunFromFile(content []byte, issuer string, strict bool) ([]AddFileResult, string, error) {
+	if strings.ContainsAny(a.Comment, "\r\n") {
+		return nil, "", fmt.Errorf("comment must be a single line")
+	}
+
+	results := ParseAddFile(content)
+	if strict {
+		for _, result := range results {
+			if result.Err != nil {
+				return results, "", fmt.Errorf("line %d is malformed: %w", result.Line, result.Err)
+			}
+		}
+	}
+
+	// Entries are for many principals, so unlike Run there is no home policy
+	// to fall back to
+	currentPolicy, _, err := a.SystemPolicyLoader.LoadSystemPolicy()
+	if err != nil {
+		return results, "", fmt.Errorf("failed to load system policy: %w", err)
+	}
+
+	comment := strings.TrimSpace(a.Comment)
+	for i := range results {
+		result := &results[i]
+		if result.Err != nil {
+			continue
+		}
+		result.Status, result.Reason = currentPolicy.CheckAllowedPrincipal(result.Principal, result.Identity, issuer)
+		currentPolicy.AddAllowedPrincipalWithComment(result.Principal, result.Identity, issuer, comment)
+	}
+
+	if err := a.SystemPolicyLoader.DumpAtomic(currentPolicy, policy.SystemDefaultPolicyPath); err != nil {
+		return results, "", fmt.Errorf("failed to write updated policy: %w", err)
+	}
+	return results, policy.SystemDefaultPolicyPath, nil
+}
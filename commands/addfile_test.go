@@ -0,0 +1,98 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const testAddFile = `email,principal
+alice@example.com,root
+# contractors
+bob@example.com, dev
+
+carol@example.com
+oidc:groups:developer,dev
+dave@example.com,bad principal
+alice@example.com,root
+`
+
+func TestParseAddFile(t *testing.T) {
+	results := ParseAddFile([]byte(testAddFile))
+	require.Len(t, results, 6)
+
+	require.Equal(t, AddFileResult{Line: 2, Principal: "root", Identity: "alice@example.com"}, results[0])
+	require.Equal(t, AddFileResult{Line: 4, Principal: "dev", Identity: "bob@example.com"}, results[1])
+	require.Equal(t, 6, results[2].Line)
+	require.ErrorContains(t, results[2].Err, "expected email,principal but got 1 fields")
+	require.Equal(t, AddFileResult{Line: 7, Principal: "dev", Identity: "oidc:groups:developer"}, results[3])
+	require.Equal(t, 8, results[4].Line)
+	require.ErrorContains(t, results[4].Err, "principals can not contain whitespace")
+	require.Equal(t, 9, results[5].Line)
+	require.NoError(t, results[5].Err)
+
+	results = ParseAddFile([]byte("alice@example.com,root,extra\n,root\nalice example.com,root\n"))
+	require.Len(t, results, 3)
+	require.ErrorContains(t, results[0].Err, "got 3 fields")
+	require.ErrorContains(t, results[1].Err, "email is empty")
+	require.ErrorContains(t, results[2].Err, "can not contain whitespace")
+}
+
+func TestAddRunFromFile(t *testing.T) {
+	issuer := "https://accounts.google.com"
+	mockFs := afero.NewMemMapFs()
+	existing := "root alice@example.com https://accounts.google.com\n"
+	require.NoError(t, afero.WriteFile(mockFs, policy.SystemDefaultPolicyPath, []byte(existing), 0640))
+
+	// Strict mode fails on the malformed lines without changing the policy
+	addCmd := MockAddCmd(mockFs)
+	results, policyPath, err := addCmd.RunFromFile([]byte(testAddFile), issuer, true)
+	require.ErrorContains(t, err, "line 6 is malformed")
+	require.Empty(t, policyPath)
+	require.Len(t, results, 6)
+	policyContent, err := afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Equal(t, existing, string(policyContent))
+
+	// Otherwise malformed lines are skipped and the rest are added
+	addCmd = MockAddCmd(mockFs)
+	addCmd.Comment = "JIRA-123 onboarding"
+	results, policyPath, err = addCmd.RunFromFile([]byte(testAddFile), issuer, false)
+	require.NoError(t, err)
+	require.Equal(t, policy.SystemDefaultPolicyPath, policyPath)
+	require.Equal(t, policy.AddPresent, results[0].Status)
+	require.Equal(t, policy.AddWouldAdd, results[1].Status)
+	require.Error(t, results[2].Err)
+	require.Equal(t, policy.AddWouldAdd, results[3].Status)
+	require.Error(t, results[4].Err)
+	require.Equal(t, policy.AddPresent, results[5].Status)
+
+	policyContent, err = afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Equal(t, "root alice@example.com https://accounts.google.com\n"+
+		"dev bob@example.com https://accounts.google.com # JIRA-123 onboarding\n"+
+		"dev oidc:groups:developer https://accounts.google.com # JIRA-123 onboarding\n", string(policyContent))
+
+	// Adding from a file never falls back to a home policy
+	addCmd = MockAddCmd(afero.NewMemMapFs())
+	_, _, err = addCmd.RunFromFile([]byte(testAddFile), issuer, false)
+	require.ErrorContains(t, err, "failed to load system policy")
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"crypto"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// addToAgent adds the private key and SSH cert to the running ssh-agent. The
+// cert added by a previous call is removed, so a refreshed cert replaces the
+// one it refreshes rather than piling up in the agent. With --agent-confirm
+// the agent asks the user to confirm each use of the key.
+func (l *LoginCmd) addToAgent(signer crypto.Signer, certBytes []byte) error {
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse SSH cert: %w", err)
+	}
+	cert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("expected an SSH cert, got %s", pubkey.Type())
+	}
+
+	dial := l.agentDialer
+	if dial == nil {
+		dial = dialAgent
+	}
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	agentClient := agent.NewClient(conn)
+
+	if l.agentCert != nil {
+		// The previous cert may have been removed by the user already
+		_ = agentClient.Remove(l.agentCert)
+	}
+	if err := agentClient.Add(agent.AddedKey{
+		PrivateKey:       signer,
+		Certificate:      cert,
+		Comment:          l.keyComment(),
+		ConfirmBeforeUse: l.agentConfirmArg,
+	}); err != nil {
+		return fmt.Errorf("failed to add key to ssh-agent: %w", err)
+	}
+	l.agentCert = cert
+	return nil
+}
+
+// removeOpkKeysFromAgent removes every key opkssh added to the running
+// ssh-agent, including those added by other logins, and returns how many
+// were removed
+func (l *LoginCmd) removeOpkKeysFromAgent() (int, error) {
+	dial := l.agentDialer
+	if dial == nil {
+		dial = dialAgent
+	}
+	conn, err := dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	agentClient := agent.NewClient(conn)
+
+	keys, err := agentClient.List()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list ssh-agent keys: %w", err)
+	}
+	removed := 0
+	for _, key := range keys {
+		if !isOpkKeyComment(key.Comment) {
+			continue
+		}
+		if err := agentClient.Remove(key); err != nil {
+			return removed, fmt.Errorf("failed to remove key from ssh-agent: %w", err)
+		}
+		removed++
+	}
+	l.agentCert = nil
+	return removed, nil
+}
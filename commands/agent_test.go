@@ -0,0 +1,236 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keyringDialer returns an agentDialer that connects to an in-memory agent
+// backed by keyring
+func keyringDialer(keyring agent.Agent) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go func() {
+			_ = agent.ServeAgent(keyring, server)
+			server.Close()
+		}()
+		return client, nil
+	}
+}
+
+func TestLoginAddToAgent(t *testing.T) {
+	pkt, signer, mockOp := Mocks(t)
+	keyring := agent.NewKeyring()
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{
+		Fs:                    mockFs,
+		disableBrowserOpenArg: true,
+		addToAgentArg:         true,
+		agentDialer:           keyringDialer(keyring),
+	}
+	require.NoError(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"))
+
+	keys, err := keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "openpubkey", keys[0].Comment)
+	agentCert, err := ssh.ParsePublicKey(keys[0].Blob)
+	require.NoError(t, err)
+	cert, ok := agentCert.(*ssh.Certificate)
+	require.True(t, ok, "expected the agent to hold an SSH cert")
+	require.Equal(t, "arthur.aardvark@example.com https://accounts.example.com", cert.KeyId)
+
+	// The cert added to the agent is the one written to disk
+	pubkeyBytes, err := afero.ReadFile(mockFs, "/keys/opkssh.pub")
+	require.NoError(t, err)
+	diskCert, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
+	require.NoError(t, err)
+	require.Equal(t, diskCert.Marshal(), cert.Marshal())
+
+	// A refreshed cert replaces the previous one
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{"root"})
+	require.NoError(t, err)
+	require.NoError(t, loginCmd.addToAgent(signer, certBytes))
+	keys, err = keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	agentCert, err = ssh.ParsePublicKey(keys[0].Blob)
+	require.NoError(t, err)
+	require.Equal(t, []string{"root"}, agentCert.(*ssh.Certificate).ValidPrincipals)
+}
+
+// recordingAgent is an agent.Agent that records the keys added to it, as the
+// in-memory keyring does not keep the constraints of added keys
+type recordingAgent struct {
+	agent.Agent
+	added []agent.AddedKey
+}
+
+func (a *recordingAgent) Add(key agent.AddedKey) error {
+	a.added = append(a.added, key)
+	return a.Agent.Add(key)
+}
+
+func TestLoginAgentConfirm(t *testing.T) {
+	for _, confirm := range []bool{false, true} {
+		t.Run(fmt.Sprintf("confirm=%t", confirm), func(t *testing.T) {
+			_, _, mockOp := Mocks(t)
+			recorder := &recordingAgent{Agent: agent.NewKeyring()}
+
+			loginCmd := LoginCmd{
+				Fs:                    afero.NewMemMapFs(),
+				disableBrowserOpenArg: true,
+				addToAgentArg:         true,
+				agentConfirmArg:       confirm,
+				agentDialer:           keyringDialer(recorder),
+			}
+			require.NoError(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"))
+			require.Len(t, recorder.added, 1)
+			require.Equal(t, confirm, recorder.added[0].ConfirmBeforeUse)
+		})
+	}
+}
+
+func TestLoginAgentCertCommentPrefix(t *testing.T) {
+	_, _, mockOp := Mocks(t)
+	keyring := agent.NewKeyring()
+
+	loginCmd := LoginCmd{
+		Fs:                    afero.NewMemMapFs(),
+		disableBrowserOpenArg: true,
+		addToAgentArg:         true,
+		certCommentPrefixArg:  "openpubkey/opkssh-1.2",
+		agentDialer:           keyringDialer(keyring),
+	}
+	require.NoError(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"))
+	keys, err := keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "openpubkey/opkssh-1.2", keys[0].Comment)
+
+	// Keys with a prefixed comment are recognised as added by opkssh
+	removed, err := loginCmd.removeOpkKeysFromAgent()
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+}
+
+func TestLoginAddToAgentUnavailable(t *testing.T) {
+	_, _, mockOp := Mocks(t)
+
+	// Without an agent the keys are still written to disk
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{
+		Fs:                    mockFs,
+		disableBrowserOpenArg: true,
+		addToAgentArg:         true,
+		agentDialer: func() (io.ReadWriteCloser, error) {
+			return nil, fmt.Errorf("no ssh-agent running")
+		},
+	}
+	require.NoError(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"))
+	exists, err := afero.Exists(mockFs, "/keys/opkssh")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// The key of a custom signer is not available to add to the agent
+	loginCmd = LoginCmd{
+		Fs:                    afero.NewMemMapFs(),
+		disableBrowserOpenArg: true,
+		addToAgentArg:         true,
+		signerArg:             hsmSigner{},
+	}
+	require.ErrorContains(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"), "can not be added to ssh-agent")
+}
+
+func TestLoginForceNewKey(t *testing.T) {
+	pkt, signer, mockOp := Mocks(t)
+	keyring := agent.NewKeyring()
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: otherSigner, Comment: "other"}))
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{
+		Fs:                    mockFs,
+		disableBrowserOpenArg: true,
+		addToAgentArg:         true,
+		agentDialer:           keyringDialer(keyring),
+	}
+	require.NoError(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"))
+	priorKey, err := afero.ReadFile(mockFs, "/keys/opkssh")
+	require.NoError(t, err)
+	priorCert, err := afero.ReadFile(mockFs, "/keys/opkssh.pub")
+	require.NoError(t, err)
+	keys, err := keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	loginCmd = LoginCmd{
+		Fs:                    mockFs,
+		disableBrowserOpenArg: true,
+		forceNewKeyArg:        true,
+		agentDialer:           keyringDialer(keyring),
+	}
+	require.NoError(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"))
+
+	// The new key differs from the prior one
+	newKey, err := afero.ReadFile(mockFs, "/keys/opkssh")
+	require.NoError(t, err)
+	require.NotEqual(t, priorKey, newKey)
+	newCert, err := afero.ReadFile(mockFs, "/keys/opkssh.pub")
+	require.NoError(t, err)
+	priorPubkey, _, _, _, err := ssh.ParseAuthorizedKey(priorCert)
+	require.NoError(t, err)
+	newPubkey, _, _, _, err := ssh.ParseAuthorizedKey(newCert)
+	require.NoError(t, err)
+	require.NotEqual(t, priorPubkey.(*ssh.Certificate).Key.Marshal(), newPubkey.(*ssh.Certificate).Key.Marshal())
+
+	// Only the key added by opkssh was removed from the agent
+	keys, err = keyring.List()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "other", keys[0].Comment)
+
+	// A key that is the same as the key of the cert it replaces is rejected
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, nil)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(mockFs, "/keys/same.pub", certBytes, 0644))
+	require.ErrorContains(t, loginCmd.checkNewKey(signer, "/keys/same"), "the generated key is the same as the key of the previous opkssh cert /keys/same.pub")
+	require.NoError(t, loginCmd.checkNewKey(otherSigner, "/keys/same"))
+
+	// The key of a custom signer never changes
+	loginCmd = LoginCmd{
+		Fs:                    afero.NewMemMapFs(),
+		disableBrowserOpenArg: true,
+		forceNewKeyArg:        true,
+		signerArg:             hsmSigner{},
+	}
+	require.ErrorContains(t, loginCmd.Login(context.Background(), mockOp, false, "/keys/opkssh"), "a new key can not be forced with a custom signer")
+}
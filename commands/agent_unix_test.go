@@ -0,0 +1,56 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !windows
+
+package commands
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestDialAgentUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	keyring := agent.NewKeyring()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = agent.ServeAgent(keyring, conn)
+		conn.Close()
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	conn, err := dialAgent()
+	require.NoError(t, err)
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, err = dialAgent()
+	require.ErrorContains(t, err, "SSH_AUTH_SOCK is not set")
+}
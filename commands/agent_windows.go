@@ -0,0 +1,45 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build windows
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// windowsAgentPipe is the named pipe of the OpenSSH for Windows ssh-agent
+// service
+const windowsAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent connects to the ssh-agent listening on the named pipe in
+// SSH_AUTH_SOCK, or on the pipe of the OpenSSH for Windows ssh-agent service
+// if it is not set. Other agents with a named pipe, such as Pageant, can be
+// used by pointing SSH_AUTH_SOCK at their pipe.
+func dialAgent() (io.ReadWriteCloser, error) {
+	pipe := os.Getenv("SSH_AUTH_SOCK")
+	if pipe == "" {
+		pipe = windowsAgentPipe
+	}
+	conn, err := os.OpenFile(pipe, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh-agent pipe %s, is the ssh-agent service running?: %w", pipe, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// auditChainGenesisHash is the prev_hash of the first entry of an audit chain
+var auditChainGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditChainMu serializes appends from the same process, the file lock only
+// serializes appends from different processes on files that support locking
+var auditChainMu sync.Mutex
+
+// AuditChainEntry is a record in the audit chain of an SSH cert that verify
+// accepted. Entries are written one per line as JSON. Each entry includes the
+// hash of the previous entry and its own hash, so removing or editing an
+// entry breaks the chain from that entry onwards.
+type AuditChainEntry struct {
+	Seq             uint64 `json:"seq"`
+	Time            string `json:"time"`
+	Principal       string `json:"principal"`
+	Issuer          string `json:"issuer"`
+	Subject         string `json:"sub"`
+	Email           string `json:"email"`
+	CertKeyID       string `json:"cert_key_id"`
+	CertFingerprint string `json:"cert_fingerprint"`
+	PrevHash        string `json:"prev_hash"`
+	Hash            string `json:"hash,omitempty"`
+}
+
+// computeHash returns the hex encoded SHA-256 hash of the JSON encoding of
+// the entry without its hash
+func (e AuditChainEntry) computeHash() (string, error) {
+	e.Hash = ""
+	entryJson, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(entryJson)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newAuditChainEntry returns the audit chain entry, without its position in
+// the chain, for a cert accepted for principal
+func newAuditChainEntry(result *VerifyResult, principal string, now time.Time) AuditChainEntry {
+	return AuditChainEntry{
+		Time:            now.UTC().Format(time.RFC3339),
+		Principal:       principal,
+		Issuer:          result.Issuer,
+		Subject:         result.Subject,
+		Email:           result.Email,
+		CertKeyID:       result.Cert.KeyId,
+		CertFingerprint: ssh.FingerprintSHA256(result.Cert.Key),
+	}
+}
+
+// appendAuditChain links entry to the last entry of the audit chain at path
+// and appends it, creating the file if it does not exist. The file is locked
+// while the last entry is read and the new one written, so that concurrent
+// verify processes do not fork the chain.
+func appendAuditChain(fs afero.Fs, path string, entry AuditChainEntry) error {
+	auditChainMu.Lock()
+	defer auditChainMu.Unlock()
+
+	file, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit chain: %w", err)
+	}
+	defer file.Close()
+	unlock, err := lockFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to lock audit chain: %w", err)
+	}
+	defer unlock()
+
+	content, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return fmt.Errorf("failed to read audit chain: %w", err)
+	}
+	entry.Seq = 1
+	entry.PrevHash = auditChainGenesisHash
+	if trimmed := bytes.TrimRight(content, "\n"); len(trimmed) > 0 {
+		lastLine := trimmed[bytes.LastIndexByte(trimmed, '\n')+1:]
+		var last AuditChainEntry
+		if err := json.Unmarshal(lastLine, &last); err != nil {
+			return fmt.Errorf("failed to parse last entry of audit chain: %w", err)
+		}
+		entry.Seq = last.Seq + 1
+		entry.PrevHash = last.Hash
+	}
+	if entry.Hash, err = entry.computeHash(); err != nil {
+		return err
+	}
+
+	entryJson, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(entryJson, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit chain: %w", err)
+	}
+	return nil
+}
+
+// VerifyAuditChain checks that each entry of the audit chain read from r is
+// unmodified and follows the previous entry, and returns the number of entries
+// and the hash of the last one. Entries removed from the end of the chain can
+// not be detected this way, compare the returned count and hash with a copy
+// kept elsewhere to detect them.
+func VerifyAuditChain(r io.Reader) (uint64, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	count := uint64(0)
+	prevHash := auditChainGenesisHash
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var entry AuditChainEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, prevHash, fmt.Errorf("line %d: failed to parse entry: %w", lineNumber, err)
+		}
+		if entry.Seq != count+1 {
+			return count, prevHash, fmt.Errorf("line %d: expected entry %d but found entry %d, entries were removed or reordered", lineNumber, count+1, entry.Seq)
+		}
+		if entry.PrevHash != prevHash {
+			return count, prevHash, fmt.Errorf("line %d: entry %d does not follow the previous entry, the chain was modified", lineNumber, entry.Seq)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return count, prevHash, err
+		}
+		if entry.Hash != hash {
+			return count, prevHash, fmt.Errorf("line %d: entry %d does not match its hash, it was modified", lineNumber, entry.Seq)
+		}
+		count++
+		prevHash = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return count, prevHash, fmt.Errorf("failed to read audit chain: %w", err)
+	}
+	return count, prevHash, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const auditChainPath = "/var/log/opkssh/audit-chain.jsonl"
+
+func testAuditChainEntry(i int) AuditChainEntry {
+	return AuditChainEntry{
+		Time:            time.Unix(int64(i), 0).UTC().Format(time.RFC3339),
+		Principal:       "root",
+		Issuer:          "https://accounts.example.com",
+		Subject:         fmt.Sprintf("user%d", i),
+		Email:           fmt.Sprintf("user%d@example.com", i),
+		CertKeyID:       fmt.Sprintf("user%d@example.com https://accounts.example.com", i),
+		CertFingerprint: "SHA256:test",
+	}
+}
+
+func TestAuditChainAppend(t *testing.T) {
+	mockFs := afero.NewMemMapFs()
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, appendAuditChain(mockFs, auditChainPath, testAuditChainEntry(i)))
+	}
+
+	content, err := afero.ReadFile(mockFs, auditChainPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 3)
+	prevHash := auditChainGenesisHash
+	for i, line := range lines {
+		var entry AuditChainEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		require.Equal(t, uint64(i+1), entry.Seq)
+		require.Equal(t, prevHash, entry.PrevHash)
+		require.Equal(t, fmt.Sprintf("user%d@example.com", i+1), entry.Email)
+		prevHash = entry.Hash
+	}
+
+	count, lastHash, err := VerifyAuditChain(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+	require.Equal(t, prevHash, lastHash)
+
+	// An empty chain is valid
+	count, lastHash, err = VerifyAuditChain(strings.NewReader(""))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), count)
+	require.Equal(t, auditChainGenesisHash, lastHash)
+}
+
+func TestAuditChainConcurrentAppend(t *testing.T) {
+	mockFs := afero.NewMemMapFs()
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, appendAuditChain(mockFs, auditChainPath, testAuditChainEntry(i)))
+		}(i)
+	}
+	wg.Wait()
+
+	content, err := afero.ReadFile(mockFs, auditChainPath)
+	require.NoError(t, err)
+	count, _, err := VerifyAuditChain(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), count)
+}
+
+func TestAuditChainTamperDetection(t *testing.T) {
+	mockFs := afero.NewMemMapFs()
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, appendAuditChain(mockFs, auditChainPath, testAuditChainEntry(i)))
+	}
+	content, err := afero.ReadFile(mockFs, auditChainPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+
+	// rehash replaces the hash of an edited entry, as someone covering their
+	// tracks would
+	rehash := func(line string) string {
+		var entry AuditChainEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entry.Hash, err = entry.computeHash()
+		require.NoError(t, err)
+		entryJson, err := json.Marshal(entry)
+		require.NoError(t, err)
+		return string(entryJson)
+	}
+	edited := strings.Replace(lines[1], "user2@example.com", "mallory@example.com", 1)
+
+	tests := []struct {
+		name        string
+		lines       []string
+		count       uint64
+		errorString string
+	}{
+		{name: "Edited entry", lines: []string{lines[0], edited, lines[2]}, count: 1, errorString: "line 2: entry 2 does not match its hash"},
+		{name: "Edited entry with new hash", lines: []string{lines[0], rehash(edited), lines[2]}, count: 2, errorString: "line 3: entry 3 does not follow the previous entry"},
+		{name: "Removed entry", lines: []string{lines[0], lines[2]}, count: 1, errorString: "line 2: expected entry 2 but found entry 3"},
+		{name: "Reordered entries", lines: []string{lines[1], lines[0], lines[2]}, count: 0, errorString: "line 1: expected entry 1 but found entry 2"},
+		{name: "Garbage", lines: []string{lines[0], "not json"}, count: 1, errorString: "line 2: failed to parse entry"},
+		// Removing entries from the end can only be detected by comparing
+		// the count and last hash with a copy kept elsewhere
+		{name: "Truncated", lines: lines[:2], count: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, _, err := VerifyAuditChain(strings.NewReader(strings.Join(tt.lines, "\n") + "\n"))
+			require.Equal(t, tt.count, count)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandAuditChain(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	verPkt, err := verifier.New(op, verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, nil)
+	require.NoError(t, err)
+	typeArg := strings.Split(string(certBytes), " ")[0]
+	certB64Arg := strings.Split(string(certBytes), " ")[1]
+
+	mockFs := afero.NewMemMapFs()
+	ver := VerifyCmd{
+		Fs:           mockFs,
+		PktVerifier:  *verPkt,
+		CheckPolicy:  AllowAllPolicyEnforcer,
+		serverConfig: &config.ServerConfig{AuditChain: &config.AuditChainConfig{Path: auditChainPath}},
+	}
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+	require.NoError(t, err)
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "dev", typeArg, certB64Arg)
+	require.NoError(t, err)
+
+	content, err := afero.ReadFile(mockFs, auditChainPath)
+	require.NoError(t, err)
+	count, _, err := VerifyAuditChain(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), count)
+	var entry AuditChainEntry
+	require.NoError(t, json.Unmarshal([]byte(strings.Split(string(content), "\n")[1]), &entry))
+	require.Equal(t, "dev", entry.Principal)
+	require.Equal(t, "arthur.aardvark@example.com", entry.Email)
+	require.Equal(t, "me", entry.Subject)
+	require.Equal(t, "https://accounts.example.com", entry.Issuer)
+	require.True(t, strings.HasPrefix(entry.CertFingerprint, "SHA256:"))
+
+	// A cert that can't be recorded is denied
+	ver.Fs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+	authKey, err := ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+	require.ErrorContains(t, err, "failed to record login in audit chain")
+	require.Empty(t, authKey)
+}
@@ -0,0 +1,123 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultBundleValidFor is how long an exported verification bundle is
+// valid for by default
+const DefaultBundleValidFor = 24 * time.Hour
+
+// BundleExportCmd exports a signed verification bundle containing the
+// trusted providers and their discovery documents and JWKS so that verify
+// can verify PK Tokens offline
+type BundleExportCmd struct {
+	Fs                afero.Fs
+	providersPathArg  string
+	configPathArg     string
+	signingKeyPathArg string
+	outputPathArg     string
+	validForArg       time.Duration
+	httpClient        *http.Client // Used to fetch from the issuers, defaults to http.DefaultClient
+}
+
+func NewBundleExportCmd(providersPathArg string, configPathArg string, signingKeyPathArg string, outputPathArg string, validForArg time.Duration) *BundleExportCmd {
+	return &BundleExportCmd{
+		Fs:                afero.NewOsFs(),
+		providersPathArg:  providersPathArg,
+		configPathArg:     configPathArg,
+		signingKeyPathArg: signingKeyPathArg,
+		outputPathArg:     outputPathArg,
+		validForArg:       validForArg,
+	}
+}
+
+// Run fetches the discovery document and JWKS of every provider in the
+// providers file, signs the bundle with the signing key and writes it to the
+// output path. It returns the exported bundle. Discovery documents are
+// fetched from the discovery_urls in the server config at the config path,
+// if it exists.
+func (b *BundleExportCmd) Run(ctx context.Context) (*policy.VerificationBundle, error) {
+	signingKeyPem, err := afero.ReadFile(b.Fs, b.signingKeyPathArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(signingKeyPem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", b.signingKeyPathArg, err)
+	}
+
+	providersContent, err := afero.ReadFile(b.Fs, b.providersPathArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read providers file: %w", err)
+	}
+	providerPolicy := (&policy.ProvidersFileLoader{}).FromTable(providersContent, b.providersPathArg)
+	if err := b.setDiscoveryURLs(providerPolicy); err != nil {
+		return nil, err
+	}
+
+	bundle, err := policy.ExportVerificationBundle(ctx, providerPolicy, b.httpClient, b.validForArg)
+	if err != nil {
+		return nil, err
+	}
+	signedBundle, err := bundle.Sign(signer)
+	if err != nil {
+		return nil, err
+	}
+	// The bundle holds only public information and is protected by its
+	// signature, so it does not need to be kept secret
+	if err := writeFileAtomic(b.Fs, b.outputPathArg, signedBundle, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write verification bundle: %w", err)
+	}
+	return bundle, nil
+}
+
+// setDiscoveryURLs sets the discovery_urls of the server config at
+// configPathArg on providerPolicy. The bundle is exported on a machine that
+// is trusted with the signing key, so unlike verify the permissions of the
+// config are not checked.
+func (b *BundleExportCmd) setDiscoveryURLs(providerPolicy *policy.ProviderPolicy) error {
+	if b.configPathArg == "" {
+		return nil
+	}
+	configBytes, err := afero.ReadFile(b.Fs, b.configPathArg)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	serverConfig, err := config.NewServerConfig(configBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := providerPolicy.SetDiscoveryURLs(serverConfig.DiscoveryURLs); err != nil {
+		return fmt.Errorf("invalid discovery_urls in server config: %w", err)
+	}
+	return nil
+}
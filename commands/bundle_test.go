@@ -0,0 +1,127 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestBundleExportAndVerifyOffline(t *testing.T) {
+	// Serve the discovery document and JWKS of a mock OP
+	var jwks []byte
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	})
+	opts := providers.DefaultMockProviderOpts()
+	opts.Issuer = srv.URL
+	op, backend, _, err := providers.NewMockProvider(opts)
+	require.NoError(t, err)
+	jwks, err = backend.GetPublicKeyFinder().JwksFunc(context.Background(), srv.URL)
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	pubkey, seckey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	seckeyPem, err := ssh.MarshalPrivateKey(seckey, "")
+	require.NoError(t, err)
+	sshPubkey, err := ssh.NewPublicKey(pubkey)
+	require.NoError(t, err)
+
+	mockFs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(mockFs, "/online/providers", []byte(srv.URL+" test_client_id 24h\n"), 0640))
+	require.NoError(t, afero.WriteFile(mockFs, "/online/bundle_ed25519", pem.EncodeToMemory(seckeyPem), 0600))
+
+	exportCmd := BundleExportCmd{
+		Fs:                mockFs,
+		providersPathArg:  "/online/providers",
+		signingKeyPathArg: "/online/bundle_ed25519",
+		outputPathArg:     "/offline/bundle.json",
+		validForArg:       DefaultBundleValidFor,
+		httpClient:        srv.Client(),
+	}
+	require.NoError(t, mockFs.MkdirAll("/offline", 0755))
+	bundle, err := exportCmd.Run(context.Background())
+	require.NoError(t, err)
+	require.Len(t, bundle.Issuers, 1)
+	srv.Close()
+
+	// Verify uses the bundle rather than /etc/opk/providers, which does not exist
+	verifyCmd := VerifyCmd{
+		Fs: mockFs,
+		serverConfig: &config.ServerConfig{
+			VerificationBundle: &config.VerificationBundleConfig{
+				Path:      "/offline/bundle.json",
+				PublicKey: string(ssh.MarshalAuthorizedKey(sshPubkey)),
+			},
+		},
+	}
+	providerPolicy, pktVerifier, err := verifyCmd.LoadProviderPolicy("/etc/opk/providers")
+	require.NoError(t, err)
+	require.Contains(t, providerPolicy.ToString(), srv.URL+" test_client_id 24h")
+	require.NoError(t, pktVerifier.VerifyPKToken(context.Background(), pkt))
+
+	// A bundle signed by another key is rejected
+	otherPubkey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherSshPubkey, err := ssh.NewPublicKey(otherPubkey)
+	require.NoError(t, err)
+	verifyCmd.serverConfig.VerificationBundle.PublicKey = string(ssh.MarshalAuthorizedKey(otherSshPubkey))
+	_, _, err = verifyCmd.LoadProviderPolicy("/etc/opk/providers")
+	require.ErrorContains(t, err, "verification bundle signature is invalid")
+
+	verifyCmd.serverConfig.VerificationBundle.PublicKey = ""
+	_, _, err = verifyCmd.LoadProviderPolicy("/etc/opk/providers")
+	require.ErrorContains(t, err, "must set both path and public_key")
+
+	exportCmd.validForArg = -time.Hour
+	_, err = exportCmd.Run(context.Background())
+	require.ErrorContains(t, err, "bundle validity must be positive")
+	exportCmd.validForArg = DefaultBundleValidFor
+
+	// The discovery_urls of the server config are used if it exists
+	exportCmd.configPathArg = "/online/config.yml"
+	require.NoError(t, afero.WriteFile(mockFs, "/online/config.yml", []byte("discovery_urls:\n  "+srv.URL+": http://example.com/discovery\n"), 0600))
+	_, err = exportCmd.Run(context.Background())
+	require.ErrorContains(t, err, "invalid discovery_urls in server config")
+	require.NoError(t, afero.WriteFile(mockFs, "/online/config.yml", []byte(";;;corrupted"), 0600))
+	_, err = exportCmd.Run(context.Background())
+	require.ErrorContains(t, err, "failed to parse config file")
+}
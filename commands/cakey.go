@@ -0,0 +1,63 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// caKeyPassphraseEnvVar is the environment variable the passphrase of an
+// encrypted --ca-key is read from
+const caKeyPassphraseEnvVar = "OPKSSH_CA_KEY_PASSPHRASE"
+
+// loadCAKey reads the private key at --ca-key that login signs SSH certs
+// with. Like ssh, it refuses a key other users can read. An encrypted key is
+// decrypted with the passphrase in OPKSSH_CA_KEY_PASSPHRASE.
+func (l *LoginCmd) loadCAKey() error {
+	info, err := l.Fs.Stat(l.caKeyPathArg)
+	if err != nil {
+		return fmt.Errorf("failed to read CA key: %w", err)
+	}
+	// Windows does not use the permission bits
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("CA key %s can be accessed by other users (mode %#o), it must only be readable by its owner", l.caKeyPathArg, info.Mode().Perm())
+	}
+	keyBytes, err := afero.ReadFile(l.Fs, l.caKeyPathArg)
+	if err != nil {
+		return fmt.Errorf("failed to read CA key: %w", err)
+	}
+
+	caSigner, err := ssh.ParsePrivateKey(keyBytes)
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		passphrase, ok := l.getenv(caKeyPassphraseEnvVar)
+		if !ok {
+			return fmt.Errorf("CA key %s is encrypted, set %s to its passphrase", l.caKeyPathArg, caKeyPassphraseEnvVar)
+		}
+		caSigner, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse CA key %s: %w", l.caKeyPathArg, err)
+	}
+	l.caSigner = caSigner
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// CertValidCmd checks whether the local opkssh key will remain valid for at
+// least a minimum duration
+type CertValidCmd struct {
+	Fs                  afero.Fs
+	keyPathArg          string
+	minValidArg         time.Duration
+	expirationPolicyArg string
+	now                 func() time.Time // Used in tests to control the current time
+}
+
+func NewCertValidCmd(keyPathArg string, minValidArg time.Duration, expirationPolicyArg string) *CertValidCmd {
+	return &CertValidCmd{
+		Fs:                  afero.NewOsFs(),
+		keyPathArg:          keyPathArg,
+		minValidArg:         minValidArg,
+		expirationPolicyArg: expirationPolicyArg,
+		now:                 time.Now,
+	}
+}
+
+// Run returns nil if the opkssh key is valid for at least the minimum
+// duration and an error otherwise
+func (c *CertValidCmd) Run() error {
+	identity, err := c.findIdentity()
+	if err != nil {
+		return err
+	}
+	validUntil, err := identityValidUntil(identity, c.expirationPolicyArg)
+	if err != nil {
+		return err
+	}
+
+	remaining := validUntil.Sub(c.now())
+	if remaining <= 0 {
+		return fmt.Errorf("opkssh key %s expired at %s", identity.PubkeyPath, validUntil.Format(time.RFC3339))
+	}
+	if remaining < c.minValidArg {
+		return fmt.Errorf("opkssh key %s expires at %s (in %s), less than the required %s", identity.PubkeyPath, validUntil.Format(time.RFC3339), remaining.Round(time.Second), c.minValidArg)
+	}
+	fmt.Printf("opkssh key %s is valid until %s (%s remaining)\n", identity.PubkeyPath, validUntil.Format(time.RFC3339), remaining.Round(time.Second))
+	return nil
+}
+
+// findIdentity reads the opkssh key at the key path argument or, if not set,
+// the first opkssh key at the default SSH key paths that login writes to
+func (c *CertValidCmd) findIdentity() (*LocalIdentity, error) {
+	return findLocalIdentity(c.Fs, c.keyPathArg)
+}
+
+// identityValidUntil returns when a server using the supplied expiration
+// policy will stop accepting the identity. The expiration policy uses the same
+// values as /etc/opk/providers.
+func identityValidUntil(identity *LocalIdentity, expirationPolicy string) (time.Time, error) {
+	switch expirationPolicy {
+	case "24h":
+		return identity.IssuedAt.Add(24 * time.Hour), nil
+	case "48h":
+		return identity.IssuedAt.Add(48 * time.Hour), nil
+	case "1week":
+		return identity.IssuedAt.Add(7 * 24 * time.Hour), nil
+	case "oidc":
+		return identity.ExpiresAt, nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid expiration policy: %s, must be one of 24h, 48h, 1week or oidc", expirationPolicy)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertValid(t *testing.T) {
+	pkt, signer, _ := Mocks(t)
+	certBytes, seckeyPem, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+
+	homePath, err := os.UserHomeDir()
+	require.NoError(t, err)
+	sshPath := filepath.Join(homePath, ".ssh")
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{Fs: mockFs}
+	require.NoError(t, loginCmd.writeKeys(filepath.Join(sshPath, "id_ed25519"), filepath.Join(sshPath, "id_ed25519.pub"), seckeyPem, certBytes))
+	require.NoError(t, loginCmd.writeKeys("/keys/opkssh_server_group1", "/keys/opkssh_server_group1.pub", seckeyPem, certBytes))
+	require.NoError(t, afero.WriteFile(mockFs, "/keys/not_opk.pub", []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAHSn0FL2JUCp2hC2LKhlh4Wuie5Bcl0kHVq+JFqAc2S alice@laptop"), 0644))
+
+	identity, err := readLocalIdentity(mockFs, filepath.Join(sshPath, "id_ed25519.pub"))
+	require.NoError(t, err)
+	issuedAt := identity.IssuedAt
+
+	tests := []struct {
+		name             string
+		keyPath          string
+		minValid         time.Duration
+		expirationPolicy string
+		now              time.Time
+		errorString      string
+	}{
+		{
+			name:             "Valid",
+			minValid:         10 * time.Minute,
+			expirationPolicy: "24h",
+			now:              issuedAt.Add(time.Hour),
+		},
+		{
+			name:             "Valid with key path",
+			keyPath:          "/keys/opkssh_server_group1",
+			minValid:         10 * time.Minute,
+			expirationPolicy: "48h",
+			now:              issuedAt.Add(30 * time.Hour),
+		},
+		{
+			name:             "Expiring soon",
+			minValid:         10 * time.Minute,
+			expirationPolicy: "24h",
+			now:              issuedAt.Add(24*time.Hour - 5*time.Minute),
+			errorString:      "(in 5m0s), less than the required 10m0s",
+		},
+		{
+			name:             "Expired",
+			minValid:         10 * time.Minute,
+			expirationPolicy: "24h",
+			now:              issuedAt.Add(25 * time.Hour),
+			errorString:      "expired at",
+		},
+		{
+			name:             "Expired under oidc policy",
+			expirationPolicy: "oidc",
+			now:              identity.ExpiresAt.Add(time.Second),
+			errorString:      "expired at",
+		},
+		{
+			name:             "Invalid expiration policy",
+			expirationPolicy: "1year",
+			now:              issuedAt,
+			errorString:      "invalid expiration policy: 1year",
+		},
+		{
+			name:             "Key not generated by opkssh",
+			keyPath:          "/keys/not_opk",
+			expirationPolicy: "24h",
+			now:              issuedAt,
+			errorString:      "/keys/not_opk.pub was not generated by opkssh",
+		},
+		{
+			name:             "Missing key",
+			keyPath:          "/keys/missing",
+			expirationPolicy: "24h",
+			now:              issuedAt,
+			errorString:      "failed to read: /keys/missing.pub",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certValid := NewCertValidCmd(tt.keyPath, tt.minValid, tt.expirationPolicy)
+			certValid.Fs = mockFs
+			certValid.now = func() time.Time { return tt.now }
+			err := certValid.Run()
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	// No opkssh key in the default locations
+	certValid := NewCertValidCmd("", time.Minute, "24h")
+	certValid.Fs = afero.NewMemMapFs()
+	err = certValid.Run()
+	require.ErrorContains(t, err, "no opkssh key found")
+}
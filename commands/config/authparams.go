@@ -0,0 +1,147 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+// reservedAuthParams are set by opkssh or the OIDC relying party when building
+// the authorization request and so can not be set in auth_params
+var reservedAuthParams = map[string]bool{
+	"client_id":             true,
+	"redirect_uri":          true,
+	"response_type":         true,
+	"scope":                 true,
+	"state":                 true,
+	"nonce":                 true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+	"prompt":                true,
+	"access_type":           true,
+	"hd":                    true,
+}
+
+// authParams returns the extra parameters to add to the authorization
+// request, built from AuthParams and HostedDomain
+func (p *ProviderConfig) authParams() (url.Values, error) {
+	params := url.Values{}
+	for k, v := range p.AuthParams {
+		if !isURLSafe(k, "") {
+			return nil, fmt.Errorf("invalid auth_params key (%s). Expected only letters, digits, '-', '.', '_' or '~'", k)
+		}
+		if reservedAuthParams[k] {
+			return nil, fmt.Errorf("invalid auth_params key (%s). This parameter is set by opkssh or its own provider config field", k)
+		}
+		// ':', '@' and '/' are allowed unescaped in a query string, so values
+		// such as an email login_hint can be used
+		if !isURLSafe(v, ":@/") {
+			return nil, fmt.Errorf("invalid auth_params value for %s (%s). Expected only letters, digits, '-', '.', '_', '~', ':', '@' or '/'", k, v)
+		}
+		params.Set(k, v)
+	}
+	if p.HostedDomain != "" {
+		params.Set("hd", p.HostedDomain)
+	}
+	return params, nil
+}
+
+// isURLSafe returns true if s is non-empty and only contains characters that
+// are unreserved in URLs (RFC 3986 section 2.3) or are in extra
+func isURLSafe(s string, extra string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-._~"+extra, c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// authParamsTransport adds extra query parameters to the authorization
+// endpoint advertised in the OP's discovery document. The OIDC relying party
+// builds the authorization URL from this endpoint, so the parameters end up
+// in the authorization request the user's browser is sent to.
+type authParamsTransport struct {
+	base   http.RoundTripper
+	params url.Values
+}
+
+func (t *authParamsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasSuffix(req.URL.Path, discoveryPath) {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var discovery map[string]any
+	if err := json.Unmarshal(body, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to parse discovery document: %w", err)
+	}
+	if authEndpoint, ok := discovery["authorization_endpoint"].(string); ok {
+		u, err := url.Parse(authEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authorization endpoint (%s): %w", authEndpoint, err)
+		}
+		query := u.Query()
+		for k, v := range t.params {
+			query[k] = v
+		}
+		u.RawQuery = query.Encode()
+		discovery["authorization_endpoint"] = u.String()
+		if body, err = json.Marshal(discovery); err != nil {
+			return nil, err
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+// withAuthParams returns an http.Client, based on httpClient if it is not
+// nil, that adds params to the authorization request sent to the OP
+func withAuthParams(httpClient *http.Client, params url.Values) *http.Client {
+	if len(params) == 0 {
+		return httpClient
+	}
+	authClient := &http.Client{}
+	if httpClient != nil {
+		*authClient = *httpClient
+	}
+	base := authClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	authClient.Transport = &authParamsTransport{base: base, params: params}
+	return authClient
+}
@@ -0,0 +1,165 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestProviderConfigAuthParams(t *testing.T) {
+	configYaml := `
+alias: example
+issuer: https://example.com
+client_id: client-id
+auth_params:
+  login_hint: alice@example.com
+  domain_hint: example.com
+`
+	var providerConfig ProviderConfig
+	require.NoError(t, yaml.Unmarshal([]byte(configYaml), &providerConfig))
+	require.Equal(t, map[string]string{
+		"login_hint":  "alice@example.com",
+		"domain_hint": "example.com",
+	}, providerConfig.AuthParams)
+
+	params, err := providerConfig.authParams()
+	require.NoError(t, err)
+	require.Equal(t, url.Values{
+		"login_hint":  {"alice@example.com"},
+		"domain_hint": {"example.com"},
+	}, params)
+
+	tests := []struct {
+		name        string
+		authParams  map[string]string
+		errorString string
+	}{
+		{
+			name:       "Valid",
+			authParams: map[string]string{"acr_values": "urn:mace:incommon:iap:silver"},
+		},
+		{
+			name:        "Unsafe key",
+			authParams:  map[string]string{"login hint": "alice"},
+			errorString: "invalid auth_params key (login hint)",
+		},
+		{
+			name:        "Empty key",
+			authParams:  map[string]string{"": "alice"},
+			errorString: "invalid auth_params key ()",
+		},
+		{
+			name:        "Unsafe value",
+			authParams:  map[string]string{"login_hint": "alice&client_id=evil"},
+			errorString: "invalid auth_params value for login_hint (alice&client_id=evil)",
+		},
+		{
+			name:        "Empty value",
+			authParams:  map[string]string{"login_hint": ""},
+			errorString: "invalid auth_params value for login_hint ()",
+		},
+		{
+			name:        "Reserved key",
+			authParams:  map[string]string{"redirect_uri": "http://evil.com"},
+			errorString: "invalid auth_params key (redirect_uri)",
+		},
+		{
+			name:        "Key with its own config field",
+			authParams:  map[string]string{"prompt": "none"},
+			errorString: "invalid auth_params key (prompt)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providerConfig := DefaultProviderConfig()
+			providerConfig.Issuer = "https://example.com"
+			providerConfig.ClientID = "client-id"
+			providerConfig.AuthParams = tt.authParams
+			_, err := providerConfig.ToProvider(false)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProviderConfigAuthParamsAuthURL(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	server := newTestDiscoveryServer(t, leaf, "test-kid")
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = server.URL
+	providerConfig.ClientID = "client-id"
+	providerConfig.CABundle = caBundlePath
+	providerConfig.RedirectURIs = []string{fmt.Sprintf("http://localhost:%d/login-callback", port)}
+	providerConfig.AuthParams = map[string]string{
+		"login_hint":  "alice@example.com",
+		"domain_hint": "example.com",
+	}
+
+	op, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	browserOp, ok := op.(providers.BrowserOpenIdProvider)
+	require.True(t, ok)
+	loginURICh := make(chan string, 1)
+	browserOp.ReuseBrowserWindowHook(loginURICh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	go func() {
+		_, _ = opkClient.Auth(ctx)
+	}()
+	loginURI := <-loginURICh
+
+	noRedirectClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := noRedirectClient.Get(loginURI)
+	require.NoError(t, err)
+	resp.Body.Close()
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/auth", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	require.Equal(t, "alice@example.com", authURL.Query().Get("login_hint"))
+	require.Equal(t, "example.com", authURL.Query().Get("domain_hint"))
+	require.Equal(t, "client-id", authURL.Query().Get("client_id"))
+}
@@ -0,0 +1,87 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// LoadCABundle reads a PEM encoded bundle of CA certificates from path and
+// returns the system cert pool with those CAs added. Every PEM block in the
+// file must be a parseable certificate, so that a truncated or mangled bundle
+// is reported rather than silently trusting fewer CAs than expected.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", path, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if err := AppendCABundle(pool, pemBytes); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pool, nil
+}
+
+// AppendCABundle parses a PEM encoded bundle of CA certificates and adds them to pool
+func AppendCABundle(pool *x509.CertPool, pemBytes []byte) error {
+	count := 0
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("invalid CA bundle: unexpected PEM block of type %s", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid CA bundle: failed to parse certificate %d: %w", count+1, err)
+		}
+		pool.AddCert(cert)
+		count++
+	}
+	if count == 0 {
+		return fmt.Errorf("invalid CA bundle: no PEM encoded certificates found")
+	}
+	return nil
+}
+
+// NewHttpClientWithCABundle returns an http.Client that additionally trusts
+// the CAs in the PEM bundle at path when making TLS connections to the
+// OpenID Provider
+func NewHttpClientWithCABundle(path string) (*http.Client, error) {
+	pool, err := LoadCABundle(path)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return &http.Client{Transport: transport}, nil
+}
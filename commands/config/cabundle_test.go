@@ -0,0 +1,208 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCA creates a self-signed CA and a TLS certificate for 127.0.0.1
+// signed by that CA. It returns the PEM encoded CA cert and the leaf cert.
+func newTestCA(t *testing.T) ([]byte, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "opkssh test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDer)
+	require.NoError(t, err)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, leafTemplate, caCert, &leafKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})
+	leaf := tls.Certificate{Certificate: [][]byte{leafDer}, PrivateKey: leafKey}
+	return caPem, leaf
+}
+
+// newTestDiscoveryServer starts a TLS server that serves an OIDC discovery
+// document and a JWKS containing a single key with the supplied kid
+func newTestDiscoveryServer(t *testing.T, leaf tls.Certificate, kid string) *httptest.Server {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwkKey, err := jwk.FromRaw(rsaKey.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, jwkKey.Set(jwk.KeyIDKey, kid))
+	require.NoError(t, jwkKey.Set(jwk.AlgorithmKey, "RS256"))
+	jwks := jwk.NewSet()
+	require.NoError(t, jwks.AddKey(jwkKey))
+	jwksJson, err := json.Marshal(jwks)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/auth",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(jwksJson)
+	})
+	server.Config.Handler = mux
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{leaf}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProviderWithCABundle(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	kid := "test-kid"
+	server := newTestDiscoveryServer(t, leaf, kid)
+
+	tempDir := t.TempDir()
+	caBundlePath := filepath.Join(tempDir, "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = server.URL
+	providerConfig.ClientID = "client-id"
+
+	// Without the CA bundle the server's certificate is not trusted
+	provider, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	_, err = provider.PublicKeyByKeyId(context.Background(), kid)
+	require.ErrorContains(t, err, "certificate")
+
+	providerConfig.CABundle = caBundlePath
+	provider, err = providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	pubkeyRecord, err := provider.PublicKeyByKeyId(context.Background(), kid)
+	require.NoError(t, err)
+	require.Equal(t, server.URL, pubkeyRecord.Issuer)
+}
+
+func TestLoadCABundle(t *testing.T) {
+	caPem, _ := newTestCA(t)
+	tempDir := t.TempDir()
+
+	tests := []struct {
+		name        string
+		content     []byte
+		errorString string
+	}{
+		{
+			name:    "Valid bundle",
+			content: caPem,
+		},
+		{
+			name:    "Valid bundle with two certs",
+			content: append(append([]byte{}, caPem...), caPem...),
+		},
+		{
+			name:        "Empty file",
+			content:     []byte{},
+			errorString: "no PEM encoded certificates found",
+		},
+		{
+			name:        "Not PEM",
+			content:     []byte("this is not a certificate"),
+			errorString: "no PEM encoded certificates found",
+		},
+		{
+			name:        "Wrong PEM type",
+			content:     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("abc")}),
+			errorString: "unexpected PEM block of type PRIVATE KEY",
+		},
+		{
+			name:        "Corrupt certificate",
+			content:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("abc")}),
+			errorString: "failed to parse certificate 1",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tempDir, "bundle"+string(rune('a'+i))+".pem")
+			require.NoError(t, os.WriteFile(path, tt.content, 0600))
+
+			pool, err := LoadCABundle(path)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Nil(t, pool)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, pool)
+			}
+		})
+	}
+
+	_, err := LoadCABundle(filepath.Join(tempDir, "does-not-exist.pem"))
+	require.ErrorContains(t, err, "failed to read CA bundle")
+
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = "https://example.com"
+	providerConfig.ClientID = "client-id"
+	providerConfig.CABundle = filepath.Join(tempDir, "does-not-exist.pem")
+	_, err = providerConfig.ToProvider(false)
+	require.ErrorContains(t, err, "failed to read CA bundle")
+}
@@ -0,0 +1,242 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/zitadel/oidc/v3/pkg/client/rp"
+	httphelper "github.com/zitadel/oidc/v3/pkg/http"
+	zoidc "github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// CallbackIdleTimeout is how long a connection to the login callback server
+// may take to send its request headers, or sit idle between requests, before
+// it is closed
+const CallbackIdleTimeout = 30 * time.Second
+
+// callbackServer runs the login callback server in place of the one run by
+// the openpubkey browser providers, which sets no timeouts, so that an
+// abandoned browser or a stalled connection can't hold on to the callback
+// port for the rest of the login. The login itself is the same authorization
+// code flow as the provider's.
+type callbackServer struct {
+	op *providers.StandardOp
+	// timeout is the ReadHeaderTimeout and IdleTimeout of the server
+	timeout      time.Duration
+	loginURIHook chan string
+	sessionHook  http.HandlerFunc
+}
+
+// withCallbackServer wraps op so that its login callback server is run by
+// callbackServer. Providers other than the openpubkey browser providers are
+// returned as they are.
+func withCallbackServer(op providers.OpenIdProvider) providers.OpenIdProvider {
+	switch o := op.(type) {
+	case *providers.StandardOpRefreshable:
+		return &callbackServerRefreshableOp{
+			browserRefreshableProvider: o,
+			callback:                   &callbackServer{op: &o.StandardOp, timeout: CallbackIdleTimeout},
+		}
+	case *providers.StandardOp:
+		return &callbackServerOp{
+			BrowserOpenIdProvider: o,
+			callback:              &callbackServer{op: o, timeout: CallbackIdleTimeout},
+		}
+	}
+	return op
+}
+
+func (c *callbackServer) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	cicHash, err := cic.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("error calculating client instance claim commitment: %w", err)
+	}
+	redirectURI, ln, err := providers.FindAvailablePort(c.op.RedirectURIs)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	cookieHandler, err := newCallbackCookieHandler()
+	if err != nil {
+		return nil, err
+	}
+	options := []rp.Option{
+		rp.WithCookieHandler(cookieHandler),
+		rp.WithSigningAlgsFromDiscovery(),
+		rp.WithVerifierOpts(
+			rp.WithIssuedAtOffset(c.op.IssuedAtOffset),
+			rp.WithNonce(func(context.Context) string { return string(cicHash) }),
+		),
+		rp.WithPKCE(cookieHandler),
+	}
+	if c.op.HttpClient != nil {
+		options = append(options, rp.WithHTTPClient(c.op.HttpClient))
+	}
+	relyingParty, err := rp.NewRelyingPartyOIDC(ctx, c.op.Issuer(), c.op.ClientID(), c.op.ClientSecret,
+		redirectURI.String(), c.op.Scopes, options...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating provider: %w", err)
+	}
+
+	tokensCh := make(chan *zoidc.Tokens[*zoidc.IDTokenClaims], 1)
+	mux := http.NewServeMux()
+	mux.Handle("/login", rp.AuthURLHandler(newCallbackState, relyingParty,
+		rp.WithURLParam("nonce", string(cicHash)),
+		rp.WithPromptURLParam(c.op.PromptType),
+		rp.WithURLParam("access_type", c.op.AccessType)),
+	)
+	mux.Handle(redirectURI.Path, rp.CodeExchangeHandler(func(w http.ResponseWriter, r *http.Request, tokens *zoidc.Tokens[*zoidc.IDTokenClaims], _ string, _ rp.RelyingParty) {
+		select {
+		case tokensCh <- tokens:
+		default:
+		}
+		if c.sessionHook != nil {
+			c.sessionHook(w, r)
+		} else if _, err := w.Write([]byte("You may now close this window")); err != nil {
+			log.Println("Failed to write login callback response:", err)
+		}
+	}, relyingParty))
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: c.timeout, IdleTimeout: c.timeout}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("Login callback server failed:", err)
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("Failed to shutdown login callback server:", err)
+		}
+	}()
+
+	loginURI := fmt.Sprintf("http://localhost:%s/login", redirectURI.Port())
+	if c.loginURIHook != nil {
+		c.loginURIHook <- loginURI
+	} else if c.op.OpenBrowser {
+		log.Printf("Opening browser to %s", loginURI)
+		if err := util.OpenUrl(loginURI); err != nil {
+			log.Printf("Failed to open url: %v", err)
+		}
+	} else {
+		log.Printf("Open your browser to: %s", loginURI)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case tokens := <-tokensCh:
+		idToken := []byte(tokens.IDToken)
+		if c.op.GQSign {
+			if idToken, err = providers.CreateGQToken(ctx, idToken, c.op); err != nil {
+				return nil, err
+			}
+		}
+		return &oidc.Tokens{
+			IDToken:      idToken,
+			RefreshToken: []byte(tokens.RefreshToken),
+			AccessToken:  []byte(tokens.AccessToken),
+		}, nil
+	}
+}
+
+// newCallbackCookieHandler returns the handler for the cookies that carry the
+// state and PKCE verifier of the login. The callback is a plain http
+// localhost URI so the cookies can not be marked secure.
+func newCallbackCookieHandler() (*httphelper.CookieHandler, error) {
+	hashKey := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, hashKey); err != nil {
+		return nil, fmt.Errorf("failed to generate random keys for cookie storage: %w", err)
+	}
+	blockKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, blockKey); err != nil {
+		return nil, fmt.Errorf("failed to generate random keys for cookie storage: %w", err)
+	}
+	return httphelper.NewCookieHandler(hashKey, blockKey, httphelper.WithUnsecure()), nil
+}
+
+// newCallbackState returns a random state for an authorization request
+func newCallbackState() string {
+	state := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, state); err != nil {
+		panic(fmt.Sprintf("failed to generate state: %v", err))
+	}
+	return hex.EncodeToString(state)
+}
+
+type callbackServerOp struct {
+	providers.BrowserOpenIdProvider
+	callback *callbackServer
+}
+
+var _ providers.BrowserOpenIdProvider = (*callbackServerOp)(nil)
+
+func (o *callbackServerOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	return o.callback.RequestTokens(ctx, cic)
+}
+
+func (o *callbackServerOp) HookHTTPSession(h http.HandlerFunc) {
+	o.callback.sessionHook = h
+}
+
+func (o *callbackServerOp) ReuseBrowserWindowHook(h chan string) {
+	o.callback.loginURIHook = h
+}
+
+// StandardOp returns the wrapped provider
+func (o *callbackServerOp) StandardOp() *providers.StandardOp {
+	return o.callback.op
+}
+
+type callbackServerRefreshableOp struct {
+	browserRefreshableProvider
+	callback *callbackServer
+}
+
+var _ providers.RefreshableOpenIdProvider = (*callbackServerRefreshableOp)(nil)
+var _ providers.BrowserOpenIdProvider = (*callbackServerRefreshableOp)(nil)
+
+func (o *callbackServerRefreshableOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	return o.callback.RequestTokens(ctx, cic)
+}
+
+func (o *callbackServerRefreshableOp) HookHTTPSession(h http.HandlerFunc) {
+	o.callback.sessionHook = h
+}
+
+func (o *callbackServerRefreshableOp) ReuseBrowserWindowHook(h chan string) {
+	o.callback.loginURIHook = h
+}
+
+// StandardOp returns the wrapped provider
+func (o *callbackServerRefreshableOp) StandardOp() *providers.StandardOp {
+	return o.callback.op
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackServerTimeout(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	server := newTestDiscoveryServer(t, leaf, "test-kid")
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = server.URL
+	providerConfig.ClientID = "client-id"
+	providerConfig.CABundle = caBundlePath
+	providerConfig.RedirectURIs = []string{fmt.Sprintf("http://localhost:%d/login-callback", port)}
+
+	op, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	callbackOp, ok := op.(*callbackServerOp)
+	require.True(t, ok, "provider should run opkssh's callback server")
+	callbackOp.callback.timeout = 100 * time.Millisecond
+	loginURICh := make(chan string, 1)
+	callbackOp.ReuseBrowserWindowHook(loginURICh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	go func() {
+		_, _ = opkClient.Auth(ctx)
+	}()
+	loginURI, err := url.Parse(<-loginURICh)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(port), loginURI.Port())
+
+	// A connection to the callback port that never sends its request is
+	// closed by the server
+	conn, err := net.Dial("tcp", loginURI.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err, "callback server should close the stalled connection")
+}
+
+func TestWithCallbackServer(t *testing.T) {
+	// The openpubkey browser providers keep refresh support when wrapped
+	op := withCallbackServer(providers.NewGoogleOpWithOptions(providers.GetDefaultGoogleOpOptions()))
+	_, ok := op.(providers.RefreshableOpenIdProvider)
+	require.True(t, ok)
+	_, ok = op.(providers.BrowserOpenIdProvider)
+	require.True(t, ok)
+
+	// Other providers are left as they are
+	mockOp, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	require.Equal(t, providers.OpenIdProvider(mockOp), withCallbackServer(mockOp))
+}
@@ -17,7 +17,10 @@
 package config
 
 import (
+	"bytes"
 	_ "embed"
+	"fmt"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -26,8 +29,18 @@ import (
 var DefaultClientConfig []byte
 
 type ClientConfig struct {
-	DefaultProvider string           `yaml:"default_provider"`
-	Providers       []ProviderConfig `yaml:"providers"`
+	DefaultProvider string `yaml:"default_provider"`
+	// DefaultPrincipal is a template, applied to the ID Token claims, giving
+	// the principal of the SSH cert when login is not given --principal
+	DefaultPrincipal string `yaml:"default_principal,omitempty"`
+	// AllowedPrincipals, if set, lists the principals login accepts with
+	// --principal. It is a guard against asking for the wrong principal by
+	// mistake, the server's policy still decides who may log in.
+	AllowedPrincipals []string         `yaml:"allowed_principals,omitempty"`
+	Providers         []ProviderConfig `yaml:"providers"`
+	// IssuerAliases adds to or overrides the short names for issuers that
+	// login --issuer-alias accepts, see WellKnownIssuers
+	IssuerAliases map[string]string `yaml:"issuer_aliases,omitempty"`
 }
 
 func NewClientConfig(c []byte) (*ClientConfig, error) {
@@ -42,3 +55,63 @@ func NewClientConfig(c []byte) (*ClientConfig, error) {
 func (c *ClientConfig) GetProvidersMap() (map[string]ProviderConfig, error) {
 	return CreateProvidersMap(c.Providers)
 }
+
+// SetDefaultProvider returns a copy of the client config file configBytes with
+// default_provider set to alias. The alias must be WEBCHOOSER or one of the
+// aliases of the configured providers. The file is edited as a yaml node tree
+// so that other fields and comments are kept.
+func SetDefaultProvider(configBytes []byte, alias string) ([]byte, error) {
+	clientConfig, err := NewClientConfig(configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if strings.ToUpper(alias) != WEBCHOOSER_ALIAS {
+		providerMap, err := clientConfig.GetProvidersMap()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := providerMap[alias]; !ok {
+			return nil, fmt.Errorf("no provider with alias %s found in config", alias)
+		}
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(configBytes, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file is not a yaml mapping")
+	}
+	root := doc.Content[0]
+
+	found := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "default_provider" {
+			root.Content[i+1].Kind = yaml.ScalarNode
+			root.Content[i+1].Tag = "!!str"
+			root.Content[i+1].Value = alias
+			found = true
+			break
+		}
+	}
+	if !found {
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "default_provider"}
+		valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: alias}
+		root.Content = append([]*yaml.Node{keyNode, valueNode}, root.Content...)
+	}
+
+	var buf bytes.Buffer
+	// yaml.v3 drops the document start marker, so we add it back if it was present
+	if bytes.HasPrefix(bytes.TrimSpace(configBytes), []byte("---")) {
+		buf.WriteString("---\n")
+	}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to encode config file: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode config file: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -17,6 +17,7 @@
 package config
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -39,3 +40,105 @@ func TestParseConfig(t *testing.T) {
 	require.ErrorContains(t, err, "yaml: unmarshal errors")
 	require.Nil(t, clientConfigDefault)
 }
+
+func TestSetDefaultProvider(t *testing.T) {
+	configWithComment := []byte(`---
+# The provider used when no alias is supplied
+default_provider: webchooser
+
+providers:
+  - alias: google
+    issuer: https://accounts.google.com
+    client_id: 206584157355-7cbe4s640tvm7naoludob4ut1emii7sf.apps.googleusercontent.com
+    client_secret: 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
+
+  - alias: azure microsoft # two aliases
+    issuer: https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0
+    client_id: 096ce0a3-5e72-4da8-9c86-12924b294a01
+`)
+	configNoDefault := []byte(`providers:
+  - alias: gitlab
+    issuer: https://gitlab.com
+    client_id: 8d8b7024572c7fd501f64374dec6bba37096783dfcd792b3988104be08cb6923
+`)
+
+	tests := []struct {
+		name        string
+		config      []byte
+		alias       string
+		wantDefault string
+		errorString string
+	}{
+		{
+			name:        "Set to configured alias",
+			config:      configWithComment,
+			alias:       "google",
+			wantDefault: "google",
+		},
+		{
+			name:        "Set to second alias of a provider",
+			config:      configWithComment,
+			alias:       "microsoft",
+			wantDefault: "microsoft",
+		},
+		{
+			name:        "Set to webchooser",
+			config:      configNoDefault,
+			alias:       "webchooser",
+			wantDefault: "webchooser",
+		},
+		{
+			name:        "Add missing default_provider",
+			config:      configNoDefault,
+			alias:       "gitlab",
+			wantDefault: "gitlab",
+		},
+		{
+			name:        "Default config",
+			config:      DefaultClientConfig,
+			alias:       "hello",
+			wantDefault: "hello",
+		},
+		{
+			name:        "Unknown alias",
+			config:      configWithComment,
+			alias:       "gitlab",
+			errorString: "no provider with alias gitlab found in config",
+		},
+		{
+			name:        "Invalid yaml",
+			config:      []byte("invalid yaml"),
+			alias:       "google",
+			errorString: "failed to parse config file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated, err := SetDefaultProvider(tt.config, tt.alias)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Nil(t, updated)
+				return
+			}
+			require.NoError(t, err)
+
+			updatedConfig, err := NewClientConfig(updated)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantDefault, updatedConfig.DefaultProvider)
+
+			// Everything other than the default provider should be unchanged
+			origConfig, err := NewClientConfig(tt.config)
+			require.NoError(t, err)
+			require.Equal(t, origConfig.Providers, updatedConfig.Providers)
+		})
+	}
+
+	// Comments and the document start marker are preserved
+	updated, err := SetDefaultProvider(configWithComment, "google")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(updated), "---\n"))
+	require.Contains(t, string(updated), "# The provider used when no alias is supplied")
+	require.Contains(t, string(updated), "# two aliases")
+	require.Contains(t, string(updated), "default_provider: google")
+}
@@ -0,0 +1,165 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EncryptedConfigHeader is the first line of a client config file that has
+// been encrypted with EncryptClientConfig
+const EncryptedConfigHeader = "# opkssh encrypted config v1"
+
+// configKeySize is the size in bytes of the AES-256 key used to encrypt the
+// client config
+const configKeySize = 32
+
+// The service and account the config key is stored under in the OS keyring
+const (
+	keyringService = "opkssh"
+	keyringAccount = "config-key"
+)
+
+// ErrConfigKeyNotFound is returned by a KeyStore when no config key has been
+// stored yet
+var ErrConfigKeyNotFound = errors.New("config key not found")
+
+// KeyStore stores the key used to encrypt the client config, such as in the
+// OS keyring
+type KeyStore interface {
+	// GetKey returns the stored key or ErrConfigKeyNotFound
+	GetKey() ([]byte, error)
+	SetKey(key []byte) error
+}
+
+// IsEncryptedConfig returns true if configBytes is a client config encrypted
+// with EncryptClientConfig
+func IsEncryptedConfig(configBytes []byte) bool {
+	firstLine, _, _ := bytes.Cut(configBytes, []byte("\n"))
+	return string(bytes.TrimSpace(firstLine)) == EncryptedConfigHeader
+}
+
+// EncryptClientConfig encrypts the client config file configBytes with
+// AES-256-GCM using the key in keyStore. A new random key is created and
+// stored if keyStore does not have one yet. The result starts with
+// EncryptedConfigHeader followed by the base64 encoded nonce and ciphertext.
+func EncryptClientConfig(configBytes []byte, keyStore KeyStore) ([]byte, error) {
+	if IsEncryptedConfig(configBytes) {
+		return nil, fmt.Errorf("config file is already encrypted")
+	}
+	if _, err := NewClientConfig(configBytes); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	key, err := keyStore.GetKey()
+	if errors.Is(err, ErrConfigKeyNotFound) {
+		key = make([]byte, configKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate config key: %w", err)
+		}
+		if err := keyStore.SetKey(key); err != nil {
+			return nil, fmt.Errorf("failed to store config key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get config key: %w", err)
+	}
+
+	aead, err := newConfigAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	// The header is authenticated so it can't be swapped for a later version
+	sealed := aead.Seal(nonce, nonce, configBytes, []byte(EncryptedConfigHeader))
+
+	encoded := base64.StdEncoding.EncodeToString(sealed)
+	var out strings.Builder
+	out.WriteString(EncryptedConfigHeader + "\n")
+	for len(encoded) > 76 {
+		out.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	out.WriteString(encoded + "\n")
+	return []byte(out.String()), nil
+}
+
+// DecryptClientConfig decrypts a client config file encrypted with
+// EncryptClientConfig using the key in keyStore
+func DecryptClientConfig(encryptedBytes []byte, keyStore KeyStore) ([]byte, error) {
+	if !IsEncryptedConfig(encryptedBytes) {
+		return nil, fmt.Errorf("config file is not encrypted")
+	}
+	_, body, _ := bytes.Cut(encryptedBytes, []byte("\n"))
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted config: %w", err)
+	}
+
+	key, err := keyStore.GetKey()
+	if errors.Is(err, ErrConfigKeyNotFound) {
+		return nil, fmt.Errorf("config file is encrypted but no config key was found in the keyring")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get config key: %w", err)
+	}
+
+	aead, err := newConfigAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted config is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	configBytes, err := aead.Open(nil, nonce, ciphertext, []byte(EncryptedConfigHeader))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt config, it was modified or encrypted with a different key: %w", err)
+	}
+	return configBytes, nil
+}
+
+// LoadClientConfig parses the client config file configBytes, decrypting it
+// first with the key in keyStore if it is encrypted
+func LoadClientConfig(configBytes []byte, keyStore KeyStore) (*ClientConfig, error) {
+	if IsEncryptedConfig(configBytes) {
+		var err error
+		if configBytes, err = DecryptClientConfig(configBytes, keyStore); err != nil {
+			return nil, err
+		}
+	}
+	return NewClientConfig(configBytes)
+}
+
+func newConfigAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != configKeySize {
+		return nil, fmt.Errorf("config key must be %d bytes, got %d", configKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
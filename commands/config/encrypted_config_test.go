@@ -0,0 +1,114 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memKeyStore is a KeyStore that keeps the config key in memory
+type memKeyStore struct {
+	key []byte
+}
+
+func (m *memKeyStore) GetKey() ([]byte, error) {
+	if m.key == nil {
+		return nil, ErrConfigKeyNotFound
+	}
+	return m.key, nil
+}
+
+func (m *memKeyStore) SetKey(key []byte) error {
+	m.key = key
+	return nil
+}
+
+func TestEncryptClientConfigRoundTrip(t *testing.T) {
+	keyStore := &memKeyStore{}
+
+	encrypted, err := EncryptClientConfig(DefaultClientConfig, keyStore)
+	require.NoError(t, err)
+	require.True(t, IsEncryptedConfig(encrypted))
+	require.False(t, IsEncryptedConfig(DefaultClientConfig))
+	require.True(t, strings.HasPrefix(string(encrypted), EncryptedConfigHeader+"\n"))
+	require.Len(t, keyStore.key, configKeySize)
+	require.NotContains(t, string(encrypted), "client_id")
+
+	decrypted, err := DecryptClientConfig(encrypted, keyStore)
+	require.NoError(t, err)
+	require.Equal(t, DefaultClientConfig, decrypted)
+
+	clientConfig, err := LoadClientConfig(encrypted, keyStore)
+	require.NoError(t, err)
+	expected, err := NewClientConfig(DefaultClientConfig)
+	require.NoError(t, err)
+	require.Equal(t, expected, clientConfig)
+
+	// Encrypting again reuses the stored key and a fresh nonce
+	key := keyStore.key
+	encryptedAgain, err := EncryptClientConfig(DefaultClientConfig, keyStore)
+	require.NoError(t, err)
+	require.Equal(t, key, keyStore.key)
+	require.NotEqual(t, encrypted, encryptedAgain)
+
+	// A plaintext config is loaded as is
+	clientConfig, err = LoadClientConfig(DefaultClientConfig, &memKeyStore{})
+	require.NoError(t, err)
+	require.Equal(t, expected, clientConfig)
+}
+
+func TestEncryptClientConfigErrors(t *testing.T) {
+	keyStore := &memKeyStore{}
+	encrypted, err := EncryptClientConfig(DefaultClientConfig, keyStore)
+	require.NoError(t, err)
+
+	_, err = EncryptClientConfig(encrypted, keyStore)
+	require.ErrorContains(t, err, "config file is already encrypted")
+
+	_, err = EncryptClientConfig([]byte("providers: [not: valid"), keyStore)
+	require.ErrorContains(t, err, "failed to parse config file")
+
+	_, err = DecryptClientConfig(DefaultClientConfig, keyStore)
+	require.ErrorContains(t, err, "config file is not encrypted")
+
+	_, err = DecryptClientConfig(encrypted, &memKeyStore{})
+	require.ErrorContains(t, err, "no config key was found")
+
+	otherKey := bytes.Repeat([]byte{1}, configKeySize)
+	_, err = DecryptClientConfig(encrypted, &memKeyStore{key: otherKey})
+	require.ErrorContains(t, err, "failed to decrypt config")
+
+	// Flip a bit in the ciphertext
+	_, body, _ := strings.Cut(string(encrypted), "\n")
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	require.NoError(t, err)
+	sealed[len(sealed)-1] ^= 1
+	tampered := EncryptedConfigHeader + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n"
+	_, err = DecryptClientConfig([]byte(tampered), keyStore)
+	require.ErrorContains(t, err, "failed to decrypt config")
+
+	_, err = DecryptClientConfig([]byte(EncryptedConfigHeader+"\nAAAA\n"), keyStore)
+	require.ErrorContains(t, err, "encrypted config is too short")
+
+	_, err = DecryptClientConfig([]byte(EncryptedConfigHeader+"\n!!!\n"), keyStore)
+	require.ErrorContains(t, err, "failed to decode encrypted config")
+}
@@ -0,0 +1,61 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// GitlabIssuer is the issuer of gitlab.com
+const GitlabIssuer = "https://gitlab.com"
+
+// GitlabIssuerFromURL returns the issuer of the GitLab instance at baseURL.
+// GitLab uses the base URL of the instance, including the relative URL root
+// if GitLab is served from a path, as its issuer. The scheme may be omitted,
+// e.g. gitlab.example.com, but must be https if given.
+func GitlabIssuerFromURL(baseURL string) (string, error) {
+	if baseURL == "" {
+		return "", fmt.Errorf("GitLab URL is empty")
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid GitLab URL (%s): %w", baseURL, err)
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("invalid GitLab URL (%s), expected it to start with 'https://'", baseURL)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid GitLab URL (%s), missing host", baseURL)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid GitLab URL (%s), expected only a scheme, host and optional path", baseURL)
+	}
+	// ID Tokens never have a trailing slash on the issuer, so one here
+	// would stop every ID Token from the instance matching
+	return "https://" + strings.ToLower(u.Host) + strings.TrimRight(u.Path, "/"), nil
+}
+
+// IsGitlab returns true if the provider is gitlab.com or a self-hosted
+// GitLab instance configured with gitlab_url
+func (p *ProviderConfig) IsGitlab() bool {
+	return p.GitlabURL != "" || p.Issuer == GitlabIssuer
+}
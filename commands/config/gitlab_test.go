@@ -0,0 +1,105 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGitlabIssuerFromURL(t *testing.T) {
+	tests := []struct {
+		name           string
+		gitlabURL      string
+		expectedIssuer string
+		errorString    string
+	}{
+		{name: "Host only", gitlabURL: "gitlab.example.com", expectedIssuer: "https://gitlab.example.com"},
+		{name: "Full URL", gitlabURL: "https://gitlab.example.com", expectedIssuer: "https://gitlab.example.com"},
+		{name: "Trailing slash", gitlabURL: "https://gitlab.example.com/", expectedIssuer: "https://gitlab.example.com"},
+		{name: "Port", gitlabURL: "https://gitlab.example.com:8443", expectedIssuer: "https://gitlab.example.com:8443"},
+		{name: "Relative URL root", gitlabURL: "https://example.com/gitlab/", expectedIssuer: "https://example.com/gitlab"},
+		{name: "Upper case host", gitlabURL: "https://GitLab.Example.com", expectedIssuer: "https://gitlab.example.com"},
+		{name: "Empty", gitlabURL: "", errorString: "GitLab URL is empty"},
+		{name: "HTTP", gitlabURL: "http://gitlab.example.com", errorString: "expected it to start with 'https://'"},
+		{name: "No host", gitlabURL: "https:///gitlab", errorString: "missing host"},
+		{name: "Query", gitlabURL: "https://gitlab.example.com?a=b", errorString: "expected only a scheme, host and optional path"},
+		{name: "User info", gitlabURL: "https://alice@gitlab.example.com", errorString: "expected only a scheme, host and optional path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := GitlabIssuerFromURL(tt.gitlabURL)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedIssuer, issuer)
+		})
+	}
+}
+
+func TestProviderConfigGitlabURL(t *testing.T) {
+	var providerConfig ProviderConfig
+	err := yaml.Unmarshal([]byte(`
+alias: gitlab
+gitlab_url: https://gitlab.example.com/
+client_id: abc123
+`), &providerConfig)
+	require.NoError(t, err)
+	require.Equal(t, "https://gitlab.example.com", providerConfig.Issuer)
+	require.True(t, providerConfig.IsGitlab())
+	// The email claim is requested by default, which policies match against
+	require.Contains(t, providerConfig.Scopes, "email")
+
+	provider, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	require.Equal(t, "https://gitlab.example.com", provider.Issuer())
+
+	// An issuer that matches gitlab_url is allowed
+	err = yaml.Unmarshal([]byte(`
+alias: gitlab
+issuer: https://gitlab.example.com
+gitlab_url: gitlab.example.com
+client_id: abc123
+`), &providerConfig)
+	require.NoError(t, err)
+	require.Equal(t, "https://gitlab.example.com", providerConfig.Issuer)
+
+	err = yaml.Unmarshal([]byte(`
+alias: gitlab
+issuer: https://gitlab.other.com
+gitlab_url: https://gitlab.example.com
+client_id: abc123
+`), &providerConfig)
+	require.ErrorContains(t, err, "does not match the issuer (https://gitlab.example.com) of gitlab_url")
+
+	err = yaml.Unmarshal([]byte(`
+alias: gitlab
+gitlab_url: http://gitlab.example.com
+client_id: abc123
+`), &providerConfig)
+	require.ErrorContains(t, err, "expected it to start with 'https://'")
+
+	// Issuers that merely start with gitlab.com are not GitLab
+	providerConfig = ProviderConfig{Issuer: "https://gitlab.company.com"}
+	require.False(t, providerConfig.IsGitlab())
+	providerConfig = ProviderConfig{Issuer: GitlabIssuer}
+	require.True(t, providerConfig.IsGitlab())
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+// browserRefreshableProvider is an OpenID Provider, such as Google, that logs
+// the user in via a browser and supports refreshing the ID Token
+type browserRefreshableProvider interface {
+	providers.BrowserOpenIdProvider
+	RefreshTokens(ctx context.Context, refreshToken []byte) (*oidc.Tokens, error)
+	VerifyRefreshedIDToken(ctx context.Context, origIdt []byte, reIdt []byte) error
+}
+
+// hostedDomainOp wraps a Google OP and rejects ID Tokens whose hd claim does
+// not match the hosted domain. Google only uses the hd authorization
+// parameter to choose which accounts to offer, so the claim must be checked
+// to stop a user completing the login with an account outside the domain.
+type hostedDomainOp struct {
+	browserRefreshableProvider
+	hostedDomain string
+}
+
+var _ providers.RefreshableOpenIdProvider = (*hostedDomainOp)(nil)
+var _ providers.BrowserOpenIdProvider = (*hostedDomainOp)(nil)
+
+func (h *hostedDomainOp) RequestTokens(ctx context.Context, cic *clientinstance.Claims) (*oidc.Tokens, error) {
+	tokens, err := h.browserRefreshableProvider.RequestTokens(ctx, cic)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckHostedDomain(tokens.IDToken, h.hostedDomain); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (h *hostedDomainOp) RefreshTokens(ctx context.Context, refreshToken []byte) (*oidc.Tokens, error) {
+	tokens, err := h.browserRefreshableProvider.RefreshTokens(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckHostedDomain(tokens.IDToken, h.hostedDomain); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CheckHostedDomain returns an error if the hd claim in the ID Token does not
+// match hostedDomain
+func CheckHostedDomain(idToken []byte, hostedDomain string) error {
+	msg, err := jws.Parse(idToken)
+	if err != nil {
+		return fmt.Errorf("failed to parse ID Token: %w", err)
+	}
+	var claims struct {
+		HostedDomain *string `json:"hd"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &claims); err != nil {
+		return fmt.Errorf("failed to parse ID Token payload: %w", err)
+	}
+	if claims.HostedDomain == nil {
+		return fmt.Errorf("ID Token has no hd claim but hosted domain %s is required, the account is not part of a Google Workspace domain", hostedDomain)
+	}
+	if !strings.EqualFold(*claims.HostedDomain, hostedDomain) {
+		return fmt.Errorf("ID Token hd claim (%s) does not match the required hosted domain (%s)", *claims.HostedDomain, hostedDomain)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+)
+
+// mockBrowserRefreshableOp makes the mock provider look like Google
+type mockBrowserRefreshableOp struct {
+	*providers.MockProvider
+}
+
+func (m *mockBrowserRefreshableOp) HookHTTPSession(h http.HandlerFunc) {}
+func (m *mockBrowserRefreshableOp) ReuseBrowserWindowHook(chan string) {}
+
+func TestHostedDomain(t *testing.T) {
+	tests := []struct {
+		name         string
+		claims       map[string]any
+		hostedDomain string
+		errorString  string
+	}{
+		{
+			name:         "Matching hd",
+			claims:       map[string]any{"hd": "example.com"},
+			hostedDomain: "example.com",
+		},
+		{
+			name:         "Matching hd different case",
+			claims:       map[string]any{"hd": "Example.com"},
+			hostedDomain: "example.com",
+		},
+		{
+			name:         "Mismatched hd",
+			claims:       map[string]any{"hd": "evil.com"},
+			hostedDomain: "example.com",
+			errorString:  "ID Token hd claim (evil.com) does not match the required hosted domain (example.com)",
+		},
+		{
+			name:         "Missing hd",
+			hostedDomain: "example.com",
+			errorString:  "ID Token has no hd claim",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockOp, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+			require.NoError(t, err)
+			idtTemplate.ExtraClaims = tt.claims
+			op := &hostedDomainOp{
+				browserRefreshableProvider: &mockBrowserRefreshableOp{MockProvider: mockOp},
+				hostedDomain:               tt.hostedDomain,
+			}
+
+			opkClient, err := client.New(op)
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Nil(t, pkt)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, pkt)
+			}
+
+			// The hd claim is also checked on refreshed ID Tokens
+			_, err = op.RefreshTokens(context.Background(), []byte("refresh-token"))
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProviderConfigHostedDomain(t *testing.T) {
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = "https://accounts.google.com"
+	providerConfig.ClientID = "client-id"
+	providerConfig.ClientSecret = "client-secret"
+	providerConfig.HostedDomain = "example.com"
+	op, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	require.IsType(t, &hostedDomainOp{}, op)
+	_, ok := op.(providers.RefreshableOpenIdProvider)
+	require.True(t, ok)
+
+	providerConfig.Issuer = "https://gitlab.com"
+	_, err = providerConfig.ToProvider(false)
+	require.ErrorContains(t, err, "hd is only supported by Google")
+}
+
+func TestHostedDomainAuthURL(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	server := newTestDiscoveryServer(t, leaf, "test-kid")
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+	httpClient, err := NewHttpClientWithCABundle(caBundlePath)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	opts := providers.GetDefaultStandardOpOptions(server.URL, "client-id")
+	opts.RedirectURIs = []string{fmt.Sprintf("http://localhost:%d/login-callback", port)}
+	opts.OpenBrowser = false
+	opts.HttpClient = withAuthParams(httpClient, url.Values{"hd": {"example.com"}})
+	op := providers.NewStandardOpWithOptions(opts)
+	loginURICh := make(chan string, 1)
+	op.ReuseBrowserWindowHook(loginURICh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	go func() {
+		_, _ = opkClient.Auth(ctx)
+	}()
+	loginURI := <-loginURICh
+
+	noRedirectClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := noRedirectClient.Get(loginURI)
+	require.NoError(t, err)
+	resp.Body.Close()
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/auth", authURL.Scheme+"://"+authURL.Host+authURL.Path)
+	require.Equal(t, "example.com", authURL.Query().Get("hd"))
+	require.Equal(t, "client-id", authURL.Query().Get("client_id"))
+}
@@ -0,0 +1,61 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WellKnownIssuers maps short names to the issuers of well known public
+// OpenID Providers, e.g. google to https://accounts.google.com
+var WellKnownIssuers = map[string]string{
+	"google": "https://accounts.google.com",
+	// Microsoft personal accounts, who is going to remember this?
+	"azure":     "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0",
+	"microsoft": "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0",
+	"gitlab":    GitlabIssuer,
+	"hello":     "https://issuer.hello.coop",
+}
+
+// ResolveIssuerAlias returns the issuer for the short name alias. Aliases in
+// overrides, read from issuer_aliases in the client config, take precedence
+// over WellKnownIssuers. Unknown aliases are an error.
+func ResolveIssuerAlias(alias string, overrides map[string]string) (string, error) {
+	if issuer, ok := overrides[alias]; ok {
+		if !strings.HasPrefix(issuer, "https://") {
+			return "", fmt.Errorf("invalid issuer (%s) for issuer alias %s, expected it to start with 'https://'", issuer, alias)
+		}
+		return issuer, nil
+	}
+	if issuer, ok := WellKnownIssuers[alias]; ok {
+		return issuer, nil
+	}
+
+	var known []string
+	for name := range WellKnownIssuers {
+		known = append(known, name)
+	}
+	for name := range overrides {
+		if _, ok := WellKnownIssuers[name]; !ok {
+			known = append(known, name)
+		}
+	}
+	sort.Strings(known)
+	return "", fmt.Errorf("unknown issuer alias %s, expected one of: %s", alias, strings.Join(known, ", "))
+}
@@ -0,0 +1,60 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveIssuerAlias(t *testing.T) {
+	overrides := map[string]string{
+		"corp":   "https://sso.example.com",
+		"google": "https://accounts.example.com",
+		"bad":    "http://sso.example.com",
+	}
+	tests := []struct {
+		name           string
+		alias          string
+		overrides      map[string]string
+		expectedIssuer string
+		errorString    string
+	}{
+		{name: "Google", alias: "google", expectedIssuer: "https://accounts.google.com"},
+		{name: "Microsoft", alias: "microsoft", expectedIssuer: "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0"},
+		{name: "GitLab", alias: "gitlab", expectedIssuer: "https://gitlab.com"},
+		{name: "Well known with overrides", alias: "hello", overrides: overrides, expectedIssuer: "https://issuer.hello.coop"},
+		{name: "Added by config", alias: "corp", overrides: overrides, expectedIssuer: "https://sso.example.com"},
+		{name: "Overridden by config", alias: "google", overrides: overrides, expectedIssuer: "https://accounts.example.com"},
+		{name: "Unknown", alias: "yahoo", errorString: "unknown issuer alias yahoo, expected one of: azure, gitlab, google, hello, microsoft"},
+		{name: "Unknown lists config aliases", alias: "yahoo", overrides: overrides, errorString: "expected one of: azure, bad, corp, gitlab, google, hello, microsoft"},
+		{name: "Issuer URL is not an alias", alias: "https://accounts.google.com", errorString: "unknown issuer alias"},
+		{name: "Config issuer not https", alias: "bad", overrides: overrides, errorString: "expected it to start with 'https://'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := ResolveIssuerAlias(tt.alias, tt.overrides)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedIssuer, issuer)
+		})
+	}
+}
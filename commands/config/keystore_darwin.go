@@ -0,0 +1,62 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// osKeyStore stores the config key in the macOS login keychain using the
+// security command
+type osKeyStore struct{}
+
+// NewOSKeyStore returns a KeyStore that stores the config key in the OS
+// keyring
+func NewOSKeyStore() KeyStore {
+	return osKeyStore{}
+}
+
+func (osKeyStore) GetKey() ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", keyringService, "-a", keyringAccount, "-w").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+		// 44 is errSecItemNotFound
+		return nil, ErrConfigKeyNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the keychain: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (osKeyStore) SetKey(key []byte) error {
+	// Commands are passed on stdin in interactive mode so that the key does
+	// not appear in the arguments of the process
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		keyringService, keyringAccount, base64.StdEncoding.EncodeToString(key)))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write the keychain: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
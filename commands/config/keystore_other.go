@@ -0,0 +1,67 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !darwin && !windows
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// osKeyStore stores the config key in the Secret Service keyring, such as
+// GNOME Keyring or KWallet, using the secret-tool command from libsecret
+type osKeyStore struct{}
+
+// NewOSKeyStore returns a KeyStore that stores the config key in the OS
+// keyring
+func NewOSKeyStore() KeyStore {
+	return osKeyStore{}
+}
+
+func (osKeyStore) GetKey() ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", keyringService, "account", keyringAccount).Output()
+	var exitErr *exec.ExitError
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("secret-tool not found, install libsecret to use the OS keyring: %w", err)
+	} else if errors.As(err, &exitErr) && len(out) == 0 && len(bytes.TrimSpace(exitErr.Stderr)) == 0 {
+		// secret-tool exits with 1 and prints nothing when there is no match
+		return nil, ErrConfigKeyNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the keyring: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (osKeyStore) SetKey(key []byte) error {
+	// secret-tool reads the secret from stdin so that the key does not appear
+	// in the arguments of the process
+	cmd := exec.Command("secret-tool", "store", "--label=opkssh config key", "service", keyringService, "account", keyringAccount)
+	cmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(key))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("secret-tool not found, install libsecret to use the OS keyring: %w", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to write the keyring: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build windows
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// osKeyStore stores the config key in a file protected with the Windows Data
+// Protection API, so that only the current user can decrypt it
+type osKeyStore struct{}
+
+// NewOSKeyStore returns a KeyStore that stores the config key in the OS
+// keyring
+func NewOSKeyStore() KeyStore {
+	return osKeyStore{}
+}
+
+func keyFilePath() (string, error) {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home dir: %w", err)
+	}
+	return filepath.Join(dir, ".opk", keyringAccount), nil
+}
+
+func (osKeyStore) GetKey() ([]byte, error) {
+	path, err := keyFilePath()
+	if err != nil {
+		return nil, err
+	}
+	protected, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrConfigKeyNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config key: %w", err)
+	}
+
+	var out windows.DataBlob
+	if err := windows.CryptUnprotectData(newDataBlob(protected), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return nil, fmt.Errorf("failed to unprotect config key: %w", err)
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+	return append([]byte(nil), unsafe.Slice(out.Data, out.Size)...), nil
+}
+
+func (osKeyStore) SetKey(key []byte) error {
+	path, err := keyFilePath()
+	if err != nil {
+		return err
+	}
+
+	var out windows.DataBlob
+	if err := windows.CryptProtectData(newDataBlob(key), nil, nil, 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out); err != nil {
+		return fmt.Errorf("failed to protect config key: %w", err)
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(out.Data)))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config key directory: %w", err)
+	}
+	return os.WriteFile(path, unsafe.Slice(out.Data, out.Size), 0600)
+}
+
+func newDataBlob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
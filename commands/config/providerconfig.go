@@ -18,10 +18,13 @@ package config
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
 	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/opkssh/policy"
 	"gopkg.in/yaml.v3"
 )
 
@@ -29,6 +32,10 @@ const WEBCHOOSER_ALIAS = "WEBCHOOSER"
 const OPKSSH_DEFAULT_ENVVAR = "OPKSSH_DEFAULT"
 const OPKSSH_PROVIDERS_ENVVAR = "OPKSSH_PROVIDERS"
 
+// OPKSSH_FORCE_CHOOSER_ENVVAR, if set to true, makes login open the web
+// chooser even if a default provider is configured
+const OPKSSH_FORCE_CHOOSER_ENVVAR = "OPKSSH_FORCE_CHOOSER"
+
 type ProviderConfig struct {
 	AliasList    []string `yaml:"alias"`
 	Issuer       string   `yaml:"issuer"`
@@ -38,18 +45,73 @@ type ProviderConfig struct {
 	AccessType   string   `yaml:"access_type,omitempty"`
 	Prompt       string   `yaml:"prompt,omitempty"`
 	RedirectURIs []string `yaml:"redirect_uris"`
+	// RedirectPath, if set, replaces the path of each redirect URI. This is
+	// the path the local callback server listens on.
+	RedirectPath string `yaml:"redirect_path,omitempty"`
+	CABundle     string `yaml:"ca_bundle,omitempty"`
+	// HostedDomain restricts Google logins to accounts in the hosted
+	// (Google Workspace) domain
+	HostedDomain string `yaml:"hd,omitempty"`
+	// AuthParams are extra query parameters added to the authorization
+	// request, for IdP specific parameters such as login_hint
+	AuthParams map[string]string `yaml:"auth_params,omitempty"`
+	// GitlabURL is the base URL of a self-hosted GitLab instance. The issuer
+	// is derived from it and the provider is set up as GitLab.
+	GitlabURL string `yaml:"gitlab_url,omitempty"`
+	// OfflineScope is the scope requested to get a refresh token when logging
+	// in with --auto-refresh, for providers that name it something other
+	// than offline_access
+	OfflineScope string `yaml:"offline_scope,omitempty"`
+	// TokenEndpointAuthMethod is how the client authenticates to the token
+	// endpoint: client_secret_basic, client_secret_post or none. If it is
+	// not set, the client secret is sent in the Authorization header and
+	// then in the request body if the OP rejects that.
+	TokenEndpointAuthMethod string `yaml:"token_endpoint_auth_method,omitempty"`
+	// UserAgent overrides the User-Agent header sent on requests to the OP,
+	// see DefaultUserAgent
+	UserAgent string `yaml:"user_agent,omitempty"`
+	// DisplayName is the name the web chooser shows the provider by, see
+	// ChooserName
+	DisplayName string `yaml:"display_name,omitempty"`
+	// DiscoveryURL overrides the URL the OpenID Connect discovery document
+	// is fetched from, for OPs that do not serve it at
+	// .well-known/openid-configuration under the issuer. The issuer in the
+	// document must still match Issuer.
+	DiscoveryURL string `yaml:"discovery_url,omitempty"`
+}
+
+// ChooserName returns the name the web chooser shows the provider by, which
+// is its display_name, or if that is not set its first alias or its issuer
+func (p *ProviderConfig) ChooserName() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	if len(p.AliasList) > 0 {
+		return p.AliasList[0]
+	}
+	return p.Issuer
 }
 
 func (p *ProviderConfig) UnmarshalYAML(value *yaml.Node) error {
 	var tmp struct {
-		AliasList    string   `yaml:"alias"`
-		Issuer       string   `yaml:"issuer"`
-		ClientID     string   `yaml:"client_id"`
-		ClientSecret string   `yaml:"client_secret"`
-		Scopes       string   `yaml:"scopes"`
-		AccessType   string   `yaml:"access_type"`
-		Prompt       string   `yaml:"prompt"`
-		RedirectURIs []string `yaml:"redirect_uris"`
+		AliasList               string            `yaml:"alias"`
+		Issuer                  string            `yaml:"issuer"`
+		ClientID                string            `yaml:"client_id"`
+		ClientSecret            string            `yaml:"client_secret"`
+		Scopes                  string            `yaml:"scopes"`
+		AccessType              string            `yaml:"access_type"`
+		Prompt                  string            `yaml:"prompt"`
+		RedirectURIs            []string          `yaml:"redirect_uris"`
+		RedirectPath            string            `yaml:"redirect_path"`
+		CABundle                string            `yaml:"ca_bundle"`
+		HostedDomain            string            `yaml:"hd"`
+		AuthParams              map[string]string `yaml:"auth_params"`
+		GitlabURL               string            `yaml:"gitlab_url"`
+		OfflineScope            string            `yaml:"offline_scope"`
+		TokenEndpointAuthMethod string            `yaml:"token_endpoint_auth_method"`
+		UserAgent               string            `yaml:"user_agent"`
+		DisplayName             string            `yaml:"display_name"`
+		DiscoveryURL            string            `yaml:"discovery_url"`
 	}
 
 	// Set default values
@@ -66,18 +128,78 @@ func (p *ProviderConfig) UnmarshalYAML(value *yaml.Node) error {
 		return err
 	}
 	*p = ProviderConfig{
-		AliasList:    strings.Fields(tmp.AliasList),
-		Issuer:       tmp.Issuer,
-		ClientID:     tmp.ClientID,
-		ClientSecret: tmp.ClientSecret,
-		Scopes:       strings.Fields(tmp.Scopes),
-		AccessType:   tmp.AccessType,
-		Prompt:       tmp.Prompt,
-		RedirectURIs: tmp.RedirectURIs,
+		AliasList:               strings.Fields(tmp.AliasList),
+		Issuer:                  tmp.Issuer,
+		ClientID:                tmp.ClientID,
+		ClientSecret:            tmp.ClientSecret,
+		Scopes:                  strings.Fields(tmp.Scopes),
+		AccessType:              tmp.AccessType,
+		Prompt:                  tmp.Prompt,
+		RedirectURIs:            tmp.RedirectURIs,
+		RedirectPath:            tmp.RedirectPath,
+		CABundle:                tmp.CABundle,
+		HostedDomain:            tmp.HostedDomain,
+		AuthParams:              tmp.AuthParams,
+		GitlabURL:               tmp.GitlabURL,
+		OfflineScope:            tmp.OfflineScope,
+		TokenEndpointAuthMethod: tmp.TokenEndpointAuthMethod,
+		UserAgent:               tmp.UserAgent,
+		DisplayName:             tmp.DisplayName,
+		DiscoveryURL:            tmp.DiscoveryURL,
+	}
+	if p.GitlabURL != "" {
+		gitlabIssuer, err := GitlabIssuerFromURL(p.GitlabURL)
+		if err != nil {
+			return err
+		}
+		if p.Issuer != "" && p.Issuer != gitlabIssuer {
+			return fmt.Errorf("issuer (%s) does not match the issuer (%s) of gitlab_url (%s), set only gitlab_url", p.Issuer, gitlabIssuer, p.GitlabURL)
+		}
+		p.Issuer = gitlabIssuer
 	}
 	return nil
 }
 
+// Redacted is shown in place of secrets, such as client secrets, when configs
+// are logged
+const Redacted = "***"
+
+// String implements fmt.Stringer so that logging a provider config does not
+// reveal the client secret
+func (p ProviderConfig) String() string {
+	// providerConfig has no String method, so formatting it does not recurse
+	type providerConfig ProviderConfig
+	return fmt.Sprintf("%+v", providerConfig(p.redacted()))
+}
+
+// GoString implements fmt.GoStringer so that formatting a provider config
+// with %#v does not reveal the client secret
+func (p ProviderConfig) GoString() string {
+	type providerConfig ProviderConfig
+	return fmt.Sprintf("%#v", providerConfig(p.redacted()))
+}
+
+func (p ProviderConfig) redacted() ProviderConfig {
+	if p.ClientSecret != "" {
+		p.ClientSecret = Redacted
+	}
+	return p
+}
+
+// RedactProviderConfigString returns the provider config string, see
+// NewProviderConfigFromString, with the client secret replaced by Redacted
+func RedactProviderConfigString(configStr string, hasAlias bool) string {
+	secretIndex := 2
+	if hasAlias {
+		secretIndex = 3
+	}
+	parts := strings.Split(configStr, ",")
+	if len(parts) > secretIndex && parts[secretIndex] != "" {
+		parts[secretIndex] = Redacted
+	}
+	return strings.Join(parts, ",")
+}
+
 // TODO: Move this into OpenPubkey providers package
 func DefaultProviderConfig() ProviderConfig {
 	return ProviderConfig{
@@ -162,9 +284,50 @@ func (p *ProviderConfig) ToProvider(openBrowser bool) (providers.OpenIdProvider,
 	if p.ClientID == "" {
 		return nil, fmt.Errorf("invalid provider client-ID value got (%s)", p.ClientID)
 	}
+	redirectURIs, err := p.redirectURIs()
+	if err != nil {
+		return nil, err
+	}
+
+	// If a CA bundle is configured, use an HTTP client that trusts it for
+	// discovery, JWKS and token requests to the OP
+	var httpClient *http.Client
+	if p.CABundle != "" {
+		if httpClient, err = NewHttpClientWithCABundle(p.CABundle); err != nil {
+			return nil, err
+		}
+	}
+	// Fetch the discovery document from discovery_url. This is the innermost
+	// transport so that the others see the request for the usual location.
+	if p.DiscoveryURL != "" {
+		if httpClient, err = policy.WithDiscoveryURL(httpClient, p.Issuer, p.DiscoveryURL); err != nil {
+			return nil, err
+		}
+	}
+
+	isGoogle := strings.HasPrefix(p.Issuer, "https://accounts.google.com")
+	if p.HostedDomain != "" && !isGoogle {
+		return nil, fmt.Errorf("invalid provider config. hd is only supported by Google but issuer is (%s)", p.Issuer)
+	}
+
+	authParams, err := p.authParams()
+	if err != nil {
+		return nil, err
+	}
+	httpClient = withAuthParams(httpClient, authParams)
+	if err := p.validateTokenEndpointAuthMethod(); err != nil {
+		return nil, err
+	}
+	httpClient = withTokenEndpointAuth(httpClient, p.TokenEndpointAuthMethod, p.ClientID, p.ClientSecret)
+	userAgent, err := p.userAgent()
+	if err != nil {
+		return nil, err
+	}
+	httpClient = withUserAgent(httpClient, userAgent)
+
 	var provider providers.OpenIdProvider
 
-	if strings.HasPrefix(p.Issuer, "https://accounts.google.com") {
+	if isGoogle {
 		opts := providers.GetDefaultGoogleOpOptions()
 		opts.Issuer = p.Issuer
 		opts.ClientID = p.ClientID
@@ -175,9 +338,17 @@ func (p *ProviderConfig) ToProvider(openBrowser bool) (providers.OpenIdProvider,
 		}
 		opts.PromptType = p.Prompt
 		opts.AccessType = p.AccessType
-		opts.RedirectURIs = p.RedirectURIs
+		opts.RedirectURIs = redirectURIs
 		opts.OpenBrowser = openBrowser
-		provider = providers.NewGoogleOpWithOptions(opts)
+		opts.HttpClient = httpClient
+		provider = withCallbackServer(providers.NewGoogleOpWithOptions(opts))
+		if p.HostedDomain != "" {
+			googleOp, ok := provider.(browserRefreshableProvider)
+			if !ok {
+				return nil, fmt.Errorf("google provider does not support refresh, can not check hd claim")
+			}
+			provider = &hostedDomainOp{browserRefreshableProvider: googleOp, hostedDomain: p.HostedDomain}
+		}
 	} else if strings.HasPrefix(p.Issuer, "https://login.microsoftonline.com") {
 		opts := providers.GetDefaultAzureOpOptions()
 		opts.Issuer = p.Issuer
@@ -188,10 +359,11 @@ func (p *ProviderConfig) ToProvider(openBrowser bool) (providers.OpenIdProvider,
 		}
 		opts.PromptType = p.Prompt
 		opts.AccessType = p.AccessType
-		opts.RedirectURIs = p.RedirectURIs
+		opts.RedirectURIs = redirectURIs
 		opts.OpenBrowser = openBrowser
-		provider = providers.NewAzureOpWithOptions(opts)
-	} else if strings.HasPrefix(p.Issuer, "https://gitlab.com") {
+		opts.HttpClient = httpClient
+		provider = withCallbackServer(providers.NewAzureOpWithOptions(opts))
+	} else if p.IsGitlab() {
 		opts := providers.GetDefaultGitlabOpOptions()
 		opts.Issuer = p.Issuer
 		opts.ClientID = p.ClientID
@@ -201,9 +373,10 @@ func (p *ProviderConfig) ToProvider(openBrowser bool) (providers.OpenIdProvider,
 		}
 		opts.PromptType = p.Prompt
 		opts.AccessType = p.AccessType
-		opts.RedirectURIs = p.RedirectURIs
+		opts.RedirectURIs = redirectURIs
 		opts.OpenBrowser = openBrowser
-		provider = providers.NewGitlabOpWithOptions(opts)
+		opts.HttpClient = httpClient
+		provider = withCallbackServer(providers.NewGitlabOpWithOptions(opts))
 	} else if p.Issuer == "https://issuer.hello.coop" {
 		opts := providers.GetDefaultHelloOpOptions()
 		opts.Issuer = p.Issuer
@@ -214,27 +387,50 @@ func (p *ProviderConfig) ToProvider(openBrowser bool) (providers.OpenIdProvider,
 		}
 		opts.PromptType = p.Prompt
 		opts.AccessType = p.AccessType
-		opts.RedirectURIs = p.RedirectURIs
+		opts.RedirectURIs = redirectURIs
 		opts.OpenBrowser = openBrowser
-		provider = providers.NewHelloOpWithOptions(opts)
+		opts.HttpClient = httpClient
+		provider = withCallbackServer(providers.NewHelloOpWithOptions(opts))
 	} else {
 		// Generic provider
 		opts := providers.GetDefaultStandardOpOptions(p.Issuer, p.ClientID)
 		opts.ClientSecret = p.ClientSecret
 		opts.PromptType = p.Prompt
 		opts.AccessType = p.AccessType
-		opts.RedirectURIs = p.RedirectURIs
+		opts.RedirectURIs = redirectURIs
 		opts.GQSign = false
 		if p.hasScopes() {
 			opts.Scopes = p.Scopes
 		}
 		opts.OpenBrowser = openBrowser
-		provider = providers.NewStandardOpWithOptions(opts)
+		opts.HttpClient = httpClient
+		provider = withCallbackServer(providers.NewStandardOpWithOptions(opts))
 	}
 
 	return provider, nil
 }
 
+// redirectURIs returns the redirect URIs with the path replaced by
+// RedirectPath if it is set
+func (p *ProviderConfig) redirectURIs() ([]string, error) {
+	if p.RedirectPath == "" {
+		return p.RedirectURIs, nil
+	}
+	if !strings.HasPrefix(p.RedirectPath, "/") {
+		return nil, fmt.Errorf("invalid redirect path. Expected redirect path to start with '/' got (%s)", p.RedirectPath)
+	}
+	redirectURIs := []string{}
+	for _, redirectURI := range p.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect URI (%s): %w", redirectURI, err)
+		}
+		u.Path = p.RedirectPath
+		redirectURIs = append(redirectURIs, u.String())
+	}
+	return redirectURIs, nil
+}
+
 func (p *ProviderConfig) hasScopes() bool {
 	return len(p.Scopes) > 0 && (len(p.Scopes) > 1 || p.Scopes[0] != "")
 }
@@ -243,8 +439,14 @@ func (p *ProviderConfig) hasScopes() bool {
 // OPKSSH_DEFAULT can be set to an alias
 // OPKSSH_PROVIDERS is a ; separated list of providers of the format <alias>,<issuer>,<client_id>,<client_secret>,<scopes>;<alias>,<issuer>,<client_id>,<client_secret>,<scopes>
 func GetProvidersConfigFromEnv() ([]ProviderConfig, error) {
+	return ProvidersConfigFromEnv(os.LookupEnv)
+}
+
+// ProvidersConfigFromEnv is GetProvidersConfigFromEnv but reads the
+// environment using lookupEnv, which has the same signature as os.LookupEnv
+func ProvidersConfigFromEnv(lookupEnv func(key string) (string, bool)) ([]ProviderConfig, error) {
 	// Get the providers from the env variable
-	providerList, ok := os.LookupEnv(OPKSSH_PROVIDERS_ENVVAR)
+	providerList, ok := lookupEnv(OPKSSH_PROVIDERS_ENVVAR)
 	if !ok || providerList == "" {
 		return nil, nil
 	}
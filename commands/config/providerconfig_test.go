@@ -17,10 +17,22 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestProvidersConfigFromStrings(t *testing.T) {
@@ -202,3 +214,163 @@ func TestProviderConfigFromString(t *testing.T) {
 		})
 	}
 }
+
+func TestProviderConfigRedirectPath(t *testing.T) {
+	configYaml := `
+alias: example
+issuer: https://example.com
+client_id: client-id
+redirect_path: /oauth2/callback
+redirect_uris:
+  - http://localhost:3000/login-callback
+  - http://127.0.0.1:10001/login-callback?x=1
+`
+	var providerConfig ProviderConfig
+	require.NoError(t, yaml.Unmarshal([]byte(configYaml), &providerConfig))
+	require.Equal(t, "/oauth2/callback", providerConfig.RedirectPath)
+
+	redirectURIs, err := providerConfig.redirectURIs()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"http://localhost:3000/oauth2/callback",
+		"http://127.0.0.1:10001/oauth2/callback?x=1",
+	}, redirectURIs)
+
+	// The default redirect URIs are used if redirect_path is not set
+	providerConfig = DefaultProviderConfig()
+	redirectURIs, err = providerConfig.redirectURIs()
+	require.NoError(t, err)
+	require.Equal(t, DefaultProviderConfig().RedirectURIs, redirectURIs)
+
+	providerConfig.Issuer = "https://example.com"
+	providerConfig.ClientID = "client-id"
+	providerConfig.RedirectPath = "oauth2/callback"
+	_, err = providerConfig.ToProvider(false)
+	require.ErrorContains(t, err, "Expected redirect path to start with '/'")
+}
+
+func TestProviderRedirectPathCallbackRoute(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	server := newTestDiscoveryServer(t, leaf, "test-kid")
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+	// Find a free port for the callback server
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = server.URL
+	providerConfig.ClientID = "client-id"
+	providerConfig.CABundle = caBundlePath
+	providerConfig.RedirectURIs = []string{fmt.Sprintf("http://localhost:%d/login-callback", port)}
+	providerConfig.RedirectPath = "/oauth2/callback"
+
+	op, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+	browserOp, ok := op.(providers.BrowserOpenIdProvider)
+	require.True(t, ok)
+	loginURICh := make(chan string, 1)
+	browserOp.ReuseBrowserWindowHook(loginURICh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	go func() {
+		_, _ = opkClient.Auth(ctx)
+	}()
+	<-loginURICh
+
+	// The callback server listens on the configured path and not the default
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/oauth2/callback", port))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotEqual(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/login-callback", port))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestProviderConfigRedactsSecret(t *testing.T) {
+	providerConfig, err := NewProviderConfigFromString("https://accounts.google.com,client-id,super-secret-value,openid email", false)
+	require.NoError(t, err)
+
+	for _, formatted := range []string{
+		fmt.Sprintf("%v", providerConfig),
+		fmt.Sprintf("%+v", providerConfig),
+		fmt.Sprintf("%#v", providerConfig),
+		fmt.Sprintf("%+v", ClientConfig{Providers: []ProviderConfig{providerConfig}}),
+	} {
+		require.NotContains(t, formatted, "super-secret-value")
+		require.Contains(t, formatted, Redacted)
+		require.Contains(t, formatted, "client-id")
+	}
+	// Formatting the config does not change it
+	require.Equal(t, "super-secret-value", providerConfig.ClientSecret)
+
+	require.Equal(t, "https://accounts.google.com,client-id,***,openid email",
+		RedactProviderConfigString("https://accounts.google.com,client-id,super-secret-value,openid email", false))
+	require.Equal(t, "google,https://accounts.google.com,client-id,***",
+		RedactProviderConfigString("google,https://accounts.google.com,client-id,super-secret-value", true))
+	require.Equal(t, "https://example.com,client-id,,openid", RedactProviderConfigString("https://example.com,client-id,,openid", false))
+	require.Equal(t, "https://example.com,client-id", RedactProviderConfigString("https://example.com,client-id", false))
+}
+
+func TestProviderDiscoveryURL(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+	var customRequests, jwksRequests atomic.Int32
+	server := httptest.NewUnstartedServer(nil)
+	mux := http.NewServeMux()
+	// The discovery document is only served at a non-standard path
+	mux.HandleFunc("/oidc/custom-discovery", func(w http.ResponseWriter, r *http.Request) {
+		customRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/auth",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwksRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	})
+	server.Config.Handler = mux
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{leaf}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	providerConfig := DefaultProviderConfig()
+	providerConfig.Issuer = server.URL
+	providerConfig.ClientID = "client-id"
+	providerConfig.CABundle = caBundlePath
+	providerConfig.DiscoveryURL = server.URL + "/oidc/custom-discovery"
+	provider, err := providerConfig.ToProvider(false)
+	require.NoError(t, err)
+
+	// The key is not in the JWKS but the JWKS is found through the discovery
+	// document at discovery_url
+	_, _ = provider.PublicKeyByKeyId(context.Background(), "test-kid")
+	require.NotZero(t, customRequests.Load())
+	require.NotZero(t, jwksRequests.Load())
+
+	providerConfig.DiscoveryURL = "http://example.com/discovery"
+	_, err = providerConfig.ToProvider(false)
+	require.ErrorContains(t, err, "invalid discovery_url")
+}
+
+func TestProviderConfigDiscoveryURLYAML(t *testing.T) {
+	var providerConfig ProviderConfig
+	require.NoError(t, yaml.Unmarshal([]byte("alias: op\nissuer: https://example.com\nclient_id: client-id\ndiscovery_url: https://example.com/oidc/discovery\n"), &providerConfig))
+	require.Equal(t, "https://example.com/oidc/discovery", providerConfig.DiscoveryURL)
+}
@@ -0,0 +1,65 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultOfflineScope is the scope OpenID Providers commonly require before
+// they issue a refresh token
+const DefaultOfflineScope = "offline_access"
+
+// offlineScope returns the scope to request to get a refresh token, or "" if
+// the provider issues refresh tokens without one. Google and GitLab reject
+// offline_access, Google issues refresh tokens because of access_type=offline
+// and GitLab always issues them.
+func (p *ProviderConfig) offlineScope() string {
+	if p.OfflineScope != "" {
+		return p.OfflineScope
+	}
+	if strings.HasPrefix(p.Issuer, "https://accounts.google.com") || p.IsGitlab() || p.Issuer == "https://issuer.hello.coop" {
+		return ""
+	}
+	return DefaultOfflineScope
+}
+
+// EnableRefresh updates the provider config so that the provider issues a
+// refresh token, which login --auto-refresh needs. The offline scope, see
+// OfflineScope, is added to the scopes if it is missing. Returns an error if
+// the provider config can not get a refresh token.
+func (p *ProviderConfig) EnableRefresh() error {
+	if strings.HasPrefix(p.Issuer, "https://accounts.google.com") && p.AccessType != "offline" {
+		return fmt.Errorf("provider (%s) must set access_type to offline to get a refresh token for auto-refresh, got (%s)", p.Issuer, p.AccessType)
+	}
+	scope := p.offlineScope()
+	if scope == "" {
+		return nil
+	}
+	if !p.hasScopes() {
+		p.Scopes = []string{"openid", "profile", "email"}
+	}
+	// Scopes from OPKSSH_PROVIDERS may hold several space separated scopes
+	for _, s := range strings.Fields(strings.Join(p.Scopes, " ")) {
+		if s == scope {
+			return nil
+		}
+	}
+	p.Scopes = append(append([]string{}, p.Scopes...), scope)
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestEnableRefresh(t *testing.T) {
+	tests := []struct {
+		name           string
+		providerConfig ProviderConfig
+		expectedScopes []string
+		errorString    string
+	}{
+		{
+			name:           "Offline scope added",
+			providerConfig: ProviderConfig{Issuer: "https://auth.example.com", Scopes: []string{"openid", "email"}},
+			expectedScopes: []string{"openid", "email", "offline_access"},
+		},
+		{
+			name:           "Offline scope already requested",
+			providerConfig: ProviderConfig{Issuer: "https://auth.example.com", Scopes: []string{"openid offline_access"}},
+			expectedScopes: []string{"openid offline_access"},
+		},
+		{
+			name:           "Default scopes",
+			providerConfig: ProviderConfig{Issuer: "https://auth.example.com", Scopes: []string{""}},
+			expectedScopes: []string{"openid", "profile", "email", "offline_access"},
+		},
+		{
+			name:           "Configured offline scope",
+			providerConfig: ProviderConfig{Issuer: "https://auth.example.com", Scopes: []string{"openid"}, OfflineScope: "refresh"},
+			expectedScopes: []string{"openid", "refresh"},
+		},
+		{
+			name:           "Azure",
+			providerConfig: ProviderConfig{Issuer: "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0", Scopes: []string{"openid", "email"}},
+			expectedScopes: []string{"openid", "email", "offline_access"},
+		},
+		{
+			name:           "Google",
+			providerConfig: ProviderConfig{Issuer: "https://accounts.google.com", Scopes: []string{"openid", "email"}, AccessType: "offline"},
+			expectedScopes: []string{"openid", "email"},
+		},
+		{
+			name:           "Google online access",
+			providerConfig: ProviderConfig{Issuer: "https://accounts.google.com", Scopes: []string{"openid", "email"}, AccessType: "online"},
+			errorString:    "must set access_type to offline",
+		},
+		{
+			name:           "GitLab",
+			providerConfig: ProviderConfig{Issuer: GitlabIssuer, Scopes: []string{"openid", "email"}},
+			expectedScopes: []string{"openid", "email"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providerConfig := tt.providerConfig
+			err := providerConfig.EnableRefresh()
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedScopes, providerConfig.Scopes)
+		})
+	}
+
+	// The scopes of the original config are not changed
+	scopes := make([]string, 2, 3)
+	copy(scopes, []string{"openid", "email"})
+	original := ProviderConfig{Issuer: "https://auth.example.com", Scopes: scopes}
+	updated := original
+	require.NoError(t, updated.EnableRefresh())
+	require.Equal(t, []string{"openid", "email"}, original.Scopes)
+	require.Equal(t, []string{"openid", "email", "offline_access"}, updated.Scopes)
+
+	var providerConfig ProviderConfig
+	require.NoError(t, yaml.Unmarshal([]byte("alias: op\nissuer: https://auth.example.com\nclient_id: abc\noffline_scope: refresh_token\n"), &providerConfig))
+	require.Equal(t, "refresh_token", providerConfig.OfflineScope)
+}
@@ -17,13 +17,110 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"os"
+	"strings"
+	"time"
 
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v3"
 )
 
 type ServerConfig struct {
 	EnvVars map[string]string `yaml:"env_vars"`
+	// IdTokenSigningAlgs maps an issuer to the only algorithm ID Tokens from
+	// that issuer may be signed with, e.g. RS256. Issuers not listed accept
+	// any algorithm the issuer's JWKS advertises.
+	IdTokenSigningAlgs map[string]string `yaml:"id_token_signing_algs,omitempty"`
+	// DiscoveryURLs maps an issuer to the URL its OpenID Connect discovery
+	// document is fetched from, for OPs that do not serve it at
+	// .well-known/openid-configuration under the issuer. The issuer in the
+	// document must still match.
+	DiscoveryURLs map[string]string `yaml:"discovery_urls,omitempty"`
+	// DropPrivileges, if set, makes verify switch to an unprivileged user
+	// after reading its config and policy files. This is only supported on
+	// Linux.
+	DropPrivileges *DropPrivilegesConfig `yaml:"drop_privileges,omitempty"`
+	// VerificationBundle, if set, makes verify use the trusted providers,
+	// discovery documents and JWKS in a signed verification bundle rather
+	// than /etc/opk/providers and the network.
+	VerificationBundle *VerificationBundleConfig `yaml:"verification_bundle,omitempty"`
+	// CaseSensitiveEmailLocalPart makes the part of an email before the @
+	// case-sensitive when matching email entries in the policy. By default
+	// emails are matched case-insensitively.
+	CaseSensitiveEmailLocalPart bool `yaml:"case_sensitive_email_local_part,omitempty"`
+	// AllowMissingEmailVerified lets email entries in the policy match ID
+	// Tokens that have no email_verified claim. By default email entries only
+	// match if email_verified is true.
+	AllowMissingEmailVerified bool `yaml:"allow_missing_email_verified,omitempty"`
+	// CertPrincipals, if set, constrains the principals that the SSH certs
+	// presented to verify may carry
+	CertPrincipals *CertPrincipalsConfig `yaml:"cert_principals,omitempty"`
+	// MaxCertLifetime, if set, is the longest validity window, from
+	// ValidAfter to ValidBefore, that the SSH certs presented to verify may
+	// have, e.g. 24h. Certs that never expire are denied.
+	MaxCertLifetime time.Duration `yaml:"max_cert_lifetime,omitempty"`
+	// TrustedCAKeys, if set, are the only public keys, in authorized_keys
+	// format, that the SSH certs presented to verify may be signed with.
+	// verify only returns a cert-authority line for a cert signed by one of
+	// them. Certs signed by one of them rather than by the key in the cert,
+	// as issued by login --ca-key, are accepted as well.
+	TrustedCAKeys []string `yaml:"trusted_ca_keys,omitempty"`
+	// AuditChain, if set, makes verify append a hash-chained record of each
+	// cert it accepts to a file, see AuditChainConfig
+	AuditChain *AuditChainConfig `yaml:"audit_chain,omitempty"`
+	// VerifyDaemon, if set, makes verify forward its arguments to the
+	// opkssh serve-verify daemon, see VerifyDaemonConfig
+	VerifyDaemon *VerifyDaemonConfig `yaml:"verify_daemon,omitempty"`
+	// PostVerifyCommand, if set, is a command that verify starts, without
+	// waiting for it, after accepting a cert. The principal and the identity
+	// logging in are passed in OPKSSH_ environment variables. sshd calls
+	// verify before the client proves it holds the cert's key, so this is
+	// not a record of a completed login.
+	PostVerifyCommand string `yaml:"post_verify_command,omitempty"`
+}
+
+// VerifyDaemonConfig is the Unix socket the opkssh serve-verify daemon
+// listens on. Verify sends each request to the daemon, which keeps the
+// config loaded and JWKS cached between requests, and verifies in its own
+// process if the daemon can not be reached.
+type VerifyDaemonConfig struct {
+	Socket string `yaml:"socket"`
+}
+
+// AuditChainConfig is the file verify appends the audit chain to. Each record
+// includes the hash of the previous record, so that removing or editing
+// records can be detected with opkssh server verify-audit-chain.
+type AuditChainConfig struct {
+	Path string `yaml:"path"`
+}
+
+// CertPrincipalsConfig constrains the principal list of SSH certs. A cert
+// with no principals, which opkssh login creates by default, passes both
+// constraints.
+type CertPrincipalsConfig struct {
+	// MaxPrincipals is the most principals a cert may carry, 0 means no limit
+	MaxPrincipals int `yaml:"max_principals,omitempty"`
+	// ForbidWildcard rejects certs with a principal containing * or ?
+	ForbidWildcard bool `yaml:"forbid_wildcard,omitempty"`
+}
+
+// VerificationBundleConfig is the path of a verification bundle exported by
+// opkssh bundle export and the public key, in authorized_keys format, that
+// the bundle must be signed with
+type VerificationBundleConfig struct {
+	Path      string `yaml:"path"`
+	PublicKey string `yaml:"public_key"`
+}
+
+// DropPrivilegesConfig is the user and group that verify switches to when
+// dropping privileges. Each may be a name or a numeric ID. If Group is not
+// set the user's primary group is used.
+type DropPrivilegesConfig struct {
+	User  string `yaml:"user"`
+	Group string `yaml:"group,omitempty"`
 }
 
 func NewServerConfig(c []byte) (*ServerConfig, error) {
@@ -43,3 +140,95 @@ func (c *ServerConfig) SetEnvVars() error {
 	}
 	return nil
 }
+
+// CheckSigningAlg returns an error if an expected signing algorithm is
+// configured for the issuer and alg does not match it
+func (c *ServerConfig) CheckSigningAlg(issuer string, alg string) error {
+	expectedAlg, ok := c.IdTokenSigningAlgs[issuer]
+	if !ok {
+		return nil
+	}
+	// GQ signatures replace the provider's RS256 signature on the ID Token,
+	// GQ256 tokens were therefore originally signed with RS256
+	if alg == "GQ256" {
+		alg = "RS256"
+	}
+	if alg != expectedAlg {
+		return fmt.Errorf("ID Token from issuer %s is signed with %s but server config expects %s", issuer, alg, expectedAlg)
+	}
+	return nil
+}
+
+// CheckCertPrincipals returns an error describing why the principals of an
+// SSH cert are not allowed by cert_principals, or nil if they are
+func (c *ServerConfig) CheckCertPrincipals(principals []string) error {
+	if c.CertPrincipals == nil {
+		return nil
+	}
+	if c.CertPrincipals.MaxPrincipals > 0 && len(principals) > c.CertPrincipals.MaxPrincipals {
+		return fmt.Errorf("cert has %d principals but server config allows at most %d", len(principals), c.CertPrincipals.MaxPrincipals)
+	}
+	if c.CertPrincipals.ForbidWildcard {
+		for _, principal := range principals {
+			if strings.ContainsAny(principal, "*?") {
+				return fmt.Errorf("cert has wildcard principal %q but server config forbids wildcard principals", principal)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckCertLifetime returns an error if max_cert_lifetime is set and the
+// validity window of an SSH cert, given as the cert's ValidAfter and
+// ValidBefore in seconds since the epoch, is longer
+func (c *ServerConfig) CheckCertLifetime(validAfter uint64, validBefore uint64) error {
+	if c.MaxCertLifetime <= 0 {
+		return nil
+	}
+	if validBefore == ssh.CertTimeInfinity {
+		return fmt.Errorf("cert never expires but server config allows a lifetime of at most %s", c.MaxCertLifetime)
+	}
+	if validBefore <= validAfter {
+		return nil
+	}
+	if lifetime := validBefore - validAfter; lifetime > uint64(c.MaxCertLifetime/time.Second) {
+		lifetimeStr := fmt.Sprintf("%ds", lifetime)
+		// Lifetimes of hundreds of years overflow a time.Duration
+		if lifetime <= uint64(math.MaxInt64/int64(time.Second)) {
+			lifetimeStr = (time.Duration(lifetime) * time.Second).String()
+		}
+		return fmt.Errorf("cert is valid for %s but server config allows a lifetime of at most %s", lifetimeStr, c.MaxCertLifetime)
+	}
+	return nil
+}
+
+// ParseTrustedCAKeys parses the keys in trusted_ca_keys
+func (c *ServerConfig) ParseTrustedCAKeys() ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+	for _, trustedKey := range c.TrustedCAKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(trustedKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_ca_keys entry %q: %w", trustedKey, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// CheckTrustedCA returns an error if trusted_ca_keys is set and caKey, the
+// key an SSH cert is signed with, is not one of the trusted keys
+func (c *ServerConfig) CheckTrustedCA(caKey ssh.PublicKey) error {
+	if len(c.TrustedCAKeys) == 0 {
+		return nil
+	}
+	trustedKeys, err := c.ParseTrustedCAKeys()
+	if err != nil {
+		return err
+	}
+	for _, trustedKey := range trustedKeys {
+		if bytes.Equal(trustedKey.Marshal(), caKey.Marshal()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("cert is signed by %s %s which is not in trusted_ca_keys", caKey.Type(), ssh.FingerprintSHA256(caKey))
+}
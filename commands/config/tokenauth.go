@@ -0,0 +1,129 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Token endpoint auth methods, as registered for token_endpoint_auth_method
+// in OpenID Connect Dynamic Client Registration
+const (
+	TokenAuthClientSecretBasic = "client_secret_basic"
+	TokenAuthClientSecretPost  = "client_secret_post"
+	TokenAuthNone              = "none"
+)
+
+// validateTokenEndpointAuthMethod checks TokenEndpointAuthMethod is a method
+// opkssh supports and that the methods sending a client secret have one
+func (p *ProviderConfig) validateTokenEndpointAuthMethod() error {
+	switch p.TokenEndpointAuthMethod {
+	case "", TokenAuthNone:
+		return nil
+	case TokenAuthClientSecretBasic, TokenAuthClientSecretPost:
+		if p.ClientSecret == "" {
+			return fmt.Errorf("token_endpoint_auth_method %s requires client_secret to be set", p.TokenEndpointAuthMethod)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid token_endpoint_auth_method (%s). Expected %s, %s or %s",
+			p.TokenEndpointAuthMethod, TokenAuthClientSecretBasic, TokenAuthClientSecretPost, TokenAuthNone)
+	}
+}
+
+// tokenAuthTransport rewrites the client authentication of requests to the
+// OP's token endpoint to use a single auth method. The OIDC relying party
+// sends the client secret in the Authorization header and, if the OP
+// rejects that, again in the request body, which fails for OPs that only
+// accept one of them or that expect public clients to send no secret.
+type tokenAuthTransport struct {
+	base         http.RoundTripper
+	method       string
+	clientID     string
+	clientSecret string
+}
+
+// withTokenEndpointAuth returns an http.Client, based on httpClient if it is
+// not nil, that authenticates to the token endpoint using method. If method
+// is empty httpClient is returned unchanged.
+func withTokenEndpointAuth(httpClient *http.Client, method string, clientID string, clientSecret string) *http.Client {
+	if method == "" {
+		return httpClient
+	}
+	tokenClient := &http.Client{}
+	if httpClient != nil {
+		*tokenClient = *httpClient
+	}
+	base := tokenClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	tokenClient.Transport = &tokenAuthTransport{
+		base:         base,
+		method:       method,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+	}
+	return tokenClient
+}
+
+func (t *tokenAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || req.Body == nil ||
+		!strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	// Only token requests, which always have a grant_type, are rewritten
+	if err != nil || form.Get("grant_type") == "" {
+		req.Body = io.NopCloser(strings.NewReader(string(body)))
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request they are given
+	tokenReq := req.Clone(req.Context())
+	tokenReq.Header.Del("Authorization")
+	form.Del("client_secret")
+	switch t.method {
+	case TokenAuthClientSecretBasic:
+		form.Del("client_id")
+		// RFC 6749 section 2.3.1 requires the client ID and secret to be
+		// form encoded before they are base64 encoded
+		tokenReq.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+	case TokenAuthClientSecretPost:
+		form.Set("client_id", t.clientID)
+		form.Set("client_secret", t.clientSecret)
+	case TokenAuthNone:
+		form.Set("client_id", t.clientID)
+	}
+
+	encoded := form.Encode()
+	tokenReq.Body = io.NopCloser(strings.NewReader(encoded))
+	tokenReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(encoded)), nil
+	}
+	tokenReq.ContentLength = int64(len(encoded))
+	return t.base.RoundTrip(tokenReq)
+}
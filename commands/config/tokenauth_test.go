@@ -0,0 +1,205 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestProviderConfigTokenEndpointAuthMethod(t *testing.T) {
+	configYaml := `
+alias: example
+issuer: https://example.com
+client_id: client-id
+token_endpoint_auth_method: none
+`
+	var providerConfig ProviderConfig
+	require.NoError(t, yaml.Unmarshal([]byte(configYaml), &providerConfig))
+	require.Equal(t, TokenAuthNone, providerConfig.TokenEndpointAuthMethod)
+
+	tests := []struct {
+		name         string
+		method       string
+		clientSecret string
+		errorString  string
+	}{
+		{name: "Default", method: ""},
+		{name: "Basic", method: TokenAuthClientSecretBasic, clientSecret: "secret"},
+		{name: "Post", method: TokenAuthClientSecretPost, clientSecret: "secret"},
+		{name: "None", method: TokenAuthNone},
+		{name: "Basic without secret", method: TokenAuthClientSecretBasic, errorString: "token_endpoint_auth_method client_secret_basic requires client_secret to be set"},
+		{name: "Post without secret", method: TokenAuthClientSecretPost, errorString: "token_endpoint_auth_method client_secret_post requires client_secret to be set"},
+		{name: "Unknown", method: "private_key_jwt", clientSecret: "secret", errorString: "invalid token_endpoint_auth_method (private_key_jwt)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providerConfig := DefaultProviderConfig()
+			providerConfig.Issuer = "https://example.com"
+			providerConfig.ClientID = "client-id"
+			providerConfig.ClientSecret = tt.clientSecret
+			providerConfig.TokenEndpointAuthMethod = tt.method
+			_, err := providerConfig.ToProvider(false)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// tokenRequest is the client authentication sent to the token endpoint
+type tokenRequest struct {
+	basicUser     string
+	basicPassword string
+	hasBasicAuth  bool
+	form          url.Values
+}
+
+func TestProviderConfigTokenEndpointAuthRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		clientSecret string
+		expected     tokenRequest
+	}{
+		{
+			name:     "Default uses the Authorization header first",
+			method:   "",
+			expected: tokenRequest{hasBasicAuth: true, basicUser: "client-id"},
+		},
+		{
+			name:         "Basic",
+			method:       TokenAuthClientSecretBasic,
+			clientSecret: "s3cret/+",
+			expected:     tokenRequest{hasBasicAuth: true, basicUser: "client-id", basicPassword: url.QueryEscape("s3cret/+")},
+		},
+		{
+			name:         "Post",
+			method:       TokenAuthClientSecretPost,
+			clientSecret: "s3cret/+",
+			expected:     tokenRequest{form: url.Values{"client_id": {"client-id"}, "client_secret": {"s3cret/+"}}},
+		},
+		{
+			name:     "None",
+			method:   TokenAuthNone,
+			expected: tokenRequest{form: url.Values{"client_id": {"client-id"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caPem, leaf := newTestCA(t)
+			server := newTestDiscoveryServer(t, leaf, "test-kid")
+			caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+			require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+			// Record the token requests, the OP rejects them so login stops there
+			var mu sync.Mutex
+			var tokenRequests []tokenRequest
+			server.Config.Handler.(*http.ServeMux).HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				require.NoError(t, r.ParseForm())
+				user, password, ok := r.BasicAuth()
+				mu.Lock()
+				tokenRequests = append(tokenRequests, tokenRequest{basicUser: user, basicPassword: password, hasBasicAuth: ok, form: r.PostForm})
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			})
+
+			ln, err := net.Listen("tcp", "localhost:0")
+			require.NoError(t, err)
+			port := ln.Addr().(*net.TCPAddr).Port
+			require.NoError(t, ln.Close())
+
+			providerConfig := DefaultProviderConfig()
+			providerConfig.Issuer = server.URL
+			providerConfig.ClientID = "client-id"
+			providerConfig.ClientSecret = tt.clientSecret
+			providerConfig.TokenEndpointAuthMethod = tt.method
+			providerConfig.CABundle = caBundlePath
+			providerConfig.RedirectURIs = []string{fmt.Sprintf("http://localhost:%d/login-callback", port)}
+
+			op, err := providerConfig.ToProvider(false)
+			require.NoError(t, err)
+			browserOp, ok := op.(providers.BrowserOpenIdProvider)
+			require.True(t, ok)
+			loginURICh := make(chan string, 1)
+			browserOp.ReuseBrowserWindowHook(loginURICh)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			opkClient, err := client.New(op)
+			require.NoError(t, err)
+			go func() {
+				_, _ = opkClient.Auth(ctx)
+			}()
+			loginURI := <-loginURICh
+
+			// Act as the browser: follow the login URI to the OP and return
+			// to the callback with an authorization code
+			jar, err := cookiejar.New(nil)
+			require.NoError(t, err)
+			browser := &http.Client{
+				Jar: jar,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := browser.Get(loginURI)
+			require.NoError(t, err)
+			resp.Body.Close()
+			authURL, err := url.Parse(resp.Header.Get("Location"))
+			require.NoError(t, err)
+			callbackURL, err := url.Parse(authURL.Query().Get("redirect_uri"))
+			require.NoError(t, err)
+			callbackURL.RawQuery = url.Values{"code": {"auth-code"}, "state": {authURL.Query().Get("state")}}.Encode()
+			// The callback exchanges the code at the token endpoint before
+			// it responds
+			resp, err = browser.Get(callbackURL.String())
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.NotEmpty(t, tokenRequests)
+			got := tokenRequests[0]
+			require.Equal(t, "authorization_code", got.form.Get("grant_type"))
+			require.Equal(t, "auth-code", got.form.Get("code"))
+			require.Equal(t, tt.expected.hasBasicAuth, got.hasBasicAuth)
+			require.Equal(t, tt.expected.basicUser, got.basicUser)
+			require.Equal(t, tt.expected.basicPassword, got.basicPassword)
+			for _, key := range []string{"client_id", "client_secret"} {
+				require.Equal(t, tt.expected.form[key], got.form[key], key)
+			}
+		})
+	}
+}
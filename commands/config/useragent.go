@@ -0,0 +1,71 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultUserAgent is the User-Agent header sent on requests to the OP when
+// user_agent is not set in the provider config. It is set to include the
+// opkssh version at startup.
+var DefaultUserAgent = "opkssh"
+
+// userAgent returns the User-Agent to send to the OP
+func (p *ProviderConfig) userAgent() (string, error) {
+	if p.UserAgent == "" {
+		return DefaultUserAgent, nil
+	}
+	if strings.ContainsFunc(p.UserAgent, func(c rune) bool { return c < ' ' || c == 0x7f }) {
+		return "", fmt.Errorf("invalid user_agent (%q). The User-Agent can not contain control characters", p.UserAgent)
+	}
+	return p.UserAgent, nil
+}
+
+// userAgentTransport sets the User-Agent header on every request to the OP,
+// including discovery, JWKS, token and refresh requests
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// withUserAgent returns an http.Client, based on httpClient if it is not nil,
+// that sends userAgent as the User-Agent header
+func withUserAgent(httpClient *http.Client, userAgent string) *http.Client {
+	if userAgent == "" {
+		return httpClient
+	}
+	uaClient := &http.Client{}
+	if httpClient != nil {
+		*uaClient = *httpClient
+	}
+	base := uaClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	uaClient.Transport = &userAgentTransport{base: base, userAgent: userAgent}
+	return uaClient
+}
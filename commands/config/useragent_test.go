@@ -0,0 +1,122 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestProviderUserAgent(t *testing.T) {
+	caPem, leaf := newTestCA(t)
+	caBundlePath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caBundlePath, caPem, 0600))
+
+	var mu sync.Mutex
+	var discoveryUserAgents []string
+	server := httptest.NewUnstartedServer(nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		discoveryUserAgents = append(discoveryUserAgents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/auth",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	})
+	server.Config.Handler = mux
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{leaf}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name              string
+		userAgent         string
+		expectedUserAgent string
+		errorString       string
+	}{
+		{
+			name:              "Default",
+			expectedUserAgent: DefaultUserAgent,
+		},
+		{
+			name:              "Override",
+			userAgent:         "my-company-opkssh/1.0",
+			expectedUserAgent: "my-company-opkssh/1.0",
+		},
+		{
+			name:        "Control characters",
+			userAgent:   "opkssh\r\nX-Injected: true",
+			errorString: "invalid user_agent",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			discoveryUserAgents = nil
+			mu.Unlock()
+
+			providerConfig := DefaultProviderConfig()
+			providerConfig.Issuer = server.URL
+			providerConfig.ClientID = "client-id"
+			providerConfig.CABundle = caBundlePath
+			providerConfig.UserAgent = tt.userAgent
+			provider, err := providerConfig.ToProvider(false)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+
+			// The key is not in the JWKS but the discovery request is made
+			// before that is known
+			_, _ = provider.PublicKeyByKeyId(context.Background(), "test-kid")
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.NotEmpty(t, discoveryUserAgents)
+			for _, userAgent := range discoveryUserAgents {
+				require.Equal(t, tt.expectedUserAgent, userAgent)
+			}
+		})
+	}
+}
+
+func TestProviderConfigUserAgentYAML(t *testing.T) {
+	var providerConfig ProviderConfig
+	require.NoError(t, yaml.Unmarshal([]byte("alias: op\nissuer: https://example.com\nclient_id: client-id\nuser_agent: custom/1.0\n"), &providerConfig))
+	require.Equal(t, "custom/1.0", providerConfig.UserAgent)
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/spf13/afero"
+)
+
+// ConfigCmd provides functionality to read and update the opkssh client config file
+type ConfigCmd struct {
+	Fs            afero.Fs
+	ConfigPathArg string
+	KeyStore      config.KeyStore
+}
+
+func NewConfigCmd(configPathArg string) *ConfigCmd {
+	return &ConfigCmd{
+		Fs:            afero.NewOsFs(),
+		ConfigPathArg: configPathArg,
+		KeyStore:      config.NewOSKeyStore(),
+	}
+}
+
+// ConfigPath returns the path of the client config file, defaulting to
+// ~/.opk/config.yml if no path was supplied.
+func (c *ConfigCmd) ConfigPath() (string, error) {
+	if c.ConfigPathArg != "" {
+		return c.ConfigPathArg, nil
+	}
+	return defaultClientConfigPath()
+}
+
+// SetDefault sets default_provider in the client config file to alias. It
+// returns an error if alias is not configured in the client config file. An
+// encrypted config file is decrypted to update it and then encrypted again.
+func (c *ConfigCmd) SetDefault(alias string) (string, error) {
+	configPath, configBytes, err := c.readConfig()
+	if err != nil {
+		return "", err
+	}
+
+	encrypted := config.IsEncryptedConfig(configBytes)
+	if encrypted {
+		if configBytes, err = config.DecryptClientConfig(configBytes, c.KeyStore); err != nil {
+			return "", err
+		}
+	}
+
+	updatedBytes, err := config.SetDefaultProvider(configBytes, alias)
+	if err != nil {
+		return "", err
+	}
+
+	if encrypted {
+		if updatedBytes, err = config.EncryptClientConfig(updatedBytes, c.KeyStore); err != nil {
+			return "", err
+		}
+	}
+	if err := c.writeConfig(configPath, updatedBytes); err != nil {
+		return "", err
+	}
+	return configPath, nil
+}
+
+// Encrypt encrypts the client config file in place with a key stored in the
+// OS keyring, creating the key if it does not exist yet. opkssh login
+// decrypts the config file when it reads it.
+func (c *ConfigCmd) Encrypt() (string, error) {
+	configPath, configBytes, err := c.readConfig()
+	if err != nil {
+		return "", err
+	}
+
+	encryptedBytes, err := config.EncryptClientConfig(configBytes, c.KeyStore)
+	if err != nil {
+		return "", err
+	}
+	if err := c.writeConfig(configPath, encryptedBytes); err != nil {
+		return "", err
+	}
+	return configPath, nil
+}
+
+// Decrypt replaces an encrypted client config file with its plaintext
+func (c *ConfigCmd) Decrypt() (string, error) {
+	configPath, encryptedBytes, err := c.readConfig()
+	if err != nil {
+		return "", err
+	}
+
+	configBytes, err := config.DecryptClientConfig(encryptedBytes, c.KeyStore)
+	if err != nil {
+		return "", err
+	}
+	if err := c.writeConfig(configPath, configBytes); err != nil {
+		return "", err
+	}
+	return configPath, nil
+}
+
+func (c *ConfigCmd) readConfig() (string, []byte, error) {
+	configPath, err := c.ConfigPath()
+	if err != nil {
+		return "", nil, err
+	}
+
+	afs := &afero.Afero{Fs: c.Fs}
+	configBytes, err := afs.ReadFile(configPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return configPath, configBytes, nil
+}
+
+// writeConfig overwrites the config file at configPath keeping its
+// permissions
+func (c *ConfigCmd) writeConfig(configPath string, configBytes []byte) error {
+	fileInfo, err := c.Fs.Stat(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to describe config file: %w", err)
+	}
+	afs := &afero.Afero{Fs: c.Fs}
+	if err := afs.WriteFile(configPath, configBytes, fileInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+func defaultClientConfigPath() (string, error) {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user config dir: %w", err)
+	}
+	return filepath.Join(dir, ".opk", "config.yml"), nil
+}
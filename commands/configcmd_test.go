@@ -0,0 +1,138 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigSetDefault(t *testing.T) {
+	configPath := "/home/alice/.opk/config.yml"
+
+	tests := []struct {
+		name        string
+		alias       string
+		errorString string
+	}{
+		{
+			name:  "Known alias",
+			alias: "gitlab",
+		},
+		{
+			name:        "Unknown alias",
+			alias:       "authentik",
+			errorString: "no provider with alias authentik found in config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(mockFs, configPath, config.DefaultClientConfig, 0600))
+
+			configCmd := ConfigCmd{Fs: mockFs, ConfigPathArg: configPath}
+			path, err := configCmd.SetDefault(tt.alias)
+
+			configBytes, readErr := afero.ReadFile(mockFs, configPath)
+			require.NoError(t, readErr)
+			clientConfig, parseErr := config.NewClientConfig(configBytes)
+			require.NoError(t, parseErr)
+
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				// The config file should not be modified on error
+				require.Equal(t, config.DefaultClientConfig, configBytes)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, configPath, path)
+				require.Equal(t, tt.alias, clientConfig.DefaultProvider)
+
+				fileInfo, err := mockFs.Stat(configPath)
+				require.NoError(t, err)
+				require.Equal(t, "-rw-------", fileInfo.Mode().Perm().String())
+			}
+		})
+	}
+
+	// Missing config file
+	configCmd := ConfigCmd{Fs: afero.NewMemMapFs(), ConfigPathArg: configPath}
+	_, err := configCmd.SetDefault("google")
+	require.ErrorContains(t, err, "failed to read config file")
+}
+
+// memKeyStore is a config.KeyStore that keeps the config key in memory
+type memKeyStore struct {
+	key []byte
+}
+
+func (m *memKeyStore) GetKey() ([]byte, error) {
+	if m.key == nil {
+		return nil, config.ErrConfigKeyNotFound
+	}
+	return m.key, nil
+}
+
+func (m *memKeyStore) SetKey(key []byte) error {
+	m.key = key
+	return nil
+}
+
+func TestConfigEncryptDecrypt(t *testing.T) {
+	configPath := "/home/alice/.opk/config.yml"
+	mockFs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(mockFs, configPath, config.DefaultClientConfig, 0600))
+
+	configCmd := ConfigCmd{Fs: mockFs, ConfigPathArg: configPath, KeyStore: &memKeyStore{}}
+	path, err := configCmd.Encrypt()
+	require.NoError(t, err)
+	require.Equal(t, configPath, path)
+
+	encryptedBytes, err := afero.ReadFile(mockFs, configPath)
+	require.NoError(t, err)
+	require.True(t, config.IsEncryptedConfig(encryptedBytes))
+	fileInfo, err := mockFs.Stat(configPath)
+	require.NoError(t, err)
+	require.Equal(t, "-rw-------", fileInfo.Mode().Perm().String())
+
+	_, err = configCmd.Encrypt()
+	require.ErrorContains(t, err, "config file is already encrypted")
+
+	// Setting the default provider keeps the config file encrypted
+	_, err = configCmd.SetDefault("gitlab")
+	require.NoError(t, err)
+	encryptedBytes, err = afero.ReadFile(mockFs, configPath)
+	require.NoError(t, err)
+	clientConfig, err := config.LoadClientConfig(encryptedBytes, configCmd.KeyStore)
+	require.NoError(t, err)
+	require.Equal(t, "gitlab", clientConfig.DefaultProvider)
+
+	_, err = configCmd.Decrypt()
+	require.NoError(t, err)
+	configBytes, err := afero.ReadFile(mockFs, configPath)
+	require.NoError(t, err)
+	require.False(t, config.IsEncryptedConfig(configBytes))
+	expected, err := config.SetDefaultProvider(config.DefaultClientConfig, "gitlab")
+	require.NoError(t, err)
+	require.Equal(t, expected, configBytes)
+
+	_, err = configCmd.Decrypt()
+	require.ErrorContains(t, err, "config file is not encrypted")
+}
@@ -0,0 +1,62 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/openpubkey/opkssh/policy/files"
+	"github.com/spf13/afero"
+)
+
+// DiffPolicyCmd compares two policy files, such as the old and new version
+// of a policy file changed in a pull request. Unlike the policy loaders it
+// does not check the permissions of the files, so that copies outside of
+// /etc/opk can be compared.
+type DiffPolicyCmd struct {
+	Fs afero.Fs
+}
+
+func NewDiffPolicyCmd() *DiffPolicyCmd {
+	return &DiffPolicyCmd{Fs: afero.NewOsFs()}
+}
+
+// Run returns the semantic difference between the policy files at oldPath and
+// newPath, along with the problems with rows that were skipped because
+// opkssh verify would skip them too
+func (d *DiffPolicyCmd) Run(oldPath string, newPath string) (*policy.PolicyDiff, []string, error) {
+	oldPolicy, oldProblems, err := d.loadPolicy(oldPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	newPolicy, newProblems, err := d.loadPolicy(newPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return policy.Diff(oldPolicy, newPolicy), append(oldProblems, newProblems...), nil
+}
+
+func (d *DiffPolicyCmd) loadPolicy(path string) (*policy.Policy, []string, error) {
+	content, err := afero.ReadFile(d.Fs, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+	problemLog := &files.ConfigLog{}
+	p := policy.FromTableWithLog(content, path, problemLog)
+	return p, configLogProblems(problemLog), nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffPolicy(t *testing.T) {
+	mockFs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(mockFs, "/old/auth_id", []byte(`root alice@example.com https://accounts.google.com
+dev bob@example.com https://accounts.google.com
+`), 0644))
+	// Comments, whitespace and order do not change the policy
+	require.NoError(t, afero.WriteFile(mockFs, "/reordered/auth_id", []byte(`# Developers
+dev    bob@example.com    https://accounts.google.com
+root alice@example.com https://accounts.google.com # JIRA-1
+`), 0644))
+	require.NoError(t, afero.WriteFile(mockFs, "/new/auth_id", []byte(`root alice@example.com https://accounts.google.com deny
+ops carol@example.com https://accounts.google.com
+invalid-row
+`), 0644))
+
+	diffCmd := DiffPolicyCmd{Fs: mockFs}
+	diff, problems, err := diffCmd.Run("/old/auth_id", "/reordered/auth_id")
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	require.True(t, diff.Empty())
+	require.Empty(t, diff.String())
+
+	diff, problems, err = diffCmd.Run("/old/auth_id", "/new/auth_id")
+	require.NoError(t, err)
+	require.Len(t, problems, 1)
+	require.Contains(t, problems[0], "invalid-row in /new/auth_id")
+	require.False(t, diff.Empty())
+	require.Equal(t, `- dev bob@example.com https://accounts.google.com
++ ops carol@example.com https://accounts.google.com
+~ root alice@example.com https://accounts.google.com: (none) -> deny
+`, diff.String())
+
+	_, _, err = diffCmd.Run("/old/auth_id", "/missing/auth_id")
+	require.ErrorContains(t, err, "failed to read policy file /missing/auth_id")
+}
@@ -0,0 +1,67 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// ExpandPath expands a leading ~ or ~user in path to the home directory of
+// the current user or of user, and $VAR or ${VAR} to the value of the
+// environment variable. Shells only expand these in some positions, e.g. not
+// in --private-key-file=~/keys/id, which would otherwise create a directory
+// literally named ~. An environment variable that is not set is an error
+// rather than an empty string.
+func ExpandPath(path string) (string, error) {
+	home, rest := "", path
+	if strings.HasPrefix(path, "~") {
+		name, after, _ := strings.Cut(filepath.ToSlash(path[1:]), "/")
+		var err error
+		if name == "" {
+			home, err = os.UserHomeDir()
+		} else {
+			var u *user.User
+			if u, err = user.Lookup(name); err == nil {
+				home = u.HomeDir
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to expand ~%s in path %q: %w", name, path, err)
+		}
+		rest = ""
+		if after != "" || strings.HasSuffix(filepath.ToSlash(path), "/") {
+			rest = string(filepath.Separator) + filepath.FromSlash(after)
+		}
+	}
+
+	var unset []string
+	rest = os.Expand(rest, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("failed to expand path %q, environment variable %s is not set", path, strings.Join(unset, ", "))
+	}
+	return home + rest, nil
+}
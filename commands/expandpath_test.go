@@ -0,0 +1,73 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OPKSSH_TEST_KEYS", filepath.Join(home, "keys"))
+	t.Setenv("OPKSSH_TEST_NAME", "id")
+	// Setenv restores the variable after the test
+	t.Setenv("OPKSSH_TEST_UNSET", "")
+	require.NoError(t, os.Unsetenv("OPKSSH_TEST_UNSET"))
+
+	current, err := user.Current()
+	require.NoError(t, err)
+	// On windows the username is prefixed with the domain
+	username := filepath.Base(current.Username)
+
+	tests := []struct {
+		name        string
+		path        string
+		want        string
+		errorString string
+	}{
+		{name: "Tilde", path: "~", want: home},
+		{name: "Tilde path", path: "~/keys/id", want: filepath.Join(home, "keys", "id")},
+		{name: "Tilde user path", path: "~" + username + "/keys/id", want: filepath.Join(current.HomeDir, "keys", "id")},
+		{name: "Home variable", path: "$HOME/keys/id", want: home + "/keys/id"},
+		{name: "Braced variable", path: "${OPKSSH_TEST_KEYS}/id", want: filepath.Join(home, "keys") + "/id"},
+		{name: "Tilde and variable", path: "~/keys/$OPKSSH_TEST_NAME", want: filepath.Join(home, "keys", "id")},
+		{name: "Absolute path", path: "/etc/opk/config.yml", want: "/etc/opk/config.yml"},
+		{name: "Tilde not leading", path: "keys/~/id", want: "keys/~/id"},
+		{name: "Stdin", path: "-", want: "-"},
+		{name: "Empty", path: "", want: ""},
+		{name: "Unset variable", path: "$OPKSSH_TEST_UNSET/id", errorString: `failed to expand path "$OPKSSH_TEST_UNSET/id", environment variable OPKSSH_TEST_UNSET is not set`},
+		{name: "Unknown user", path: "~opkssh-no-such-user/id", errorString: "failed to expand ~opkssh-no-such-user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandPath(tt.path)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// DefaultExportValidFor is how long sshd accepts exported keys for by default
+const DefaultExportValidFor = 24 * time.Hour
+
+// ExportAuthorizedKeysCmd writes a static authorized_keys fragment with the
+// line opkssh verify would return for each opkssh public key that the policy
+// allows to log in as a principal. sshd can read the fragment, for instance
+// with AuthorizedKeysFile, to keep accepting those keys when opkssh verify
+// can not run.
+type ExportAuthorizedKeysCmd struct {
+	Fs afero.Fs
+	// Verify verifies the PK Token in each key and checks it against the
+	// policy, as opkssh verify does
+	Verify *VerifyCmd
+	// KeysPathArg is a file of opkssh public keys, one per line, or a
+	// directory of such files
+	KeysPathArg string
+	// ValidForArg makes sshd stop accepting the exported keys this long after
+	// they were exported, so that they don't outlive the ID Token or their
+	// removal from the policy
+	ValidForArg time.Duration
+	now         func() time.Time // Used in tests to control the current time
+}
+
+func NewExportAuthorizedKeysCmd(verify *VerifyCmd, keysPathArg string, validForArg time.Duration) *ExportAuthorizedKeysCmd {
+	return &ExportAuthorizedKeysCmd{
+		Fs:          afero.NewOsFs(),
+		Verify:      verify,
+		KeysPathArg: keysPathArg,
+		ValidForArg: validForArg,
+		now:         time.Now,
+	}
+}
+
+// exportKey is an opkssh public key read from the keys file along with where
+// it was read from
+type exportKey struct {
+	source  string
+	typ     string
+	certB64 string
+}
+
+// Run writes the authorized_keys lines for the keys at KeysPathArg that may
+// log in as principal to w and returns how many keys were written. Keys that
+// fail verification or are not allowed by the policy are skipped with a
+// warning. The policy is evaluated when the fragment is exported, so policy
+// entries with hours and policy plugins are not re-checked when sshd uses it.
+func (e *ExportAuthorizedKeysCmd) Run(ctx context.Context, principal string, w io.Writer) (int, error) {
+	if e.ValidForArg <= 0 {
+		return 0, fmt.Errorf("--valid-for must be positive, got %s", e.ValidForArg)
+	}
+	keys, err := e.readKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	now := e.now()
+	expiryOption := fmt.Sprintf(`expiry-time="%s",`, now.Add(e.ValidForArg).UTC().Format("200601021504Z"))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# opkssh authorized_keys for principal %s, exported at %s\n", principal, now.UTC().Format(time.RFC3339))
+	exported := 0
+	for _, key := range keys {
+		result, err := e.Verify.VerifyIdentity(ctx, principal, key.certB64, key.typ)
+		if err != nil {
+			log.Printf("Warning: skipping key %s: %v", key.source, err)
+			continue
+		}
+		fmt.Fprintf(&out, "# %q %s\n", key.source, auditRecord(result.PKToken, result.Cert, principal))
+		fmt.Fprintf(&out, "%s%s", expiryOption, result.AuthorizedKeysLine)
+		exported++
+	}
+
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write authorized_keys: %w", err)
+	}
+	return exported, nil
+}
+
+// readKeys reads the opkssh public keys in the file at KeysPathArg or, if it
+// is a directory, in each of the files in it. Blank lines and lines starting
+// with # are ignored.
+func (e *ExportAuthorizedKeysCmd) readKeys() ([]exportKey, error) {
+	info, err := e.Fs.Stat(e.KeysPathArg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+	paths := []string{e.KeysPathArg}
+	if info.IsDir() {
+		entries, err := afero.ReadDir(e.Fs, e.KeysPathArg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys: %w", err)
+		}
+		paths = nil
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() {
+				paths = append(paths, filepath.Join(e.KeysPathArg, entry.Name()))
+			}
+		}
+	}
+
+	var keys []exportKey
+	for _, path := range paths {
+		keysBytes, err := afero.ReadFile(e.Fs, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(keysBytes))
+		// PK Tokens make opkssh public keys longer than bufio's default limit
+		scanner.Buffer(make([]byte, 0, 64*1024), len(keysBytes)+1)
+		for lineNumber := 1; scanner.Scan(); lineNumber++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			source := fmt.Sprintf("%s:%d", path, lineNumber)
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				log.Printf("Warning: skipping key %s: expected a key type and a base64 encoded key", source)
+				continue
+			}
+			keys = append(keys, exportKey{source: source, typ: fields[0], certB64: fields[1]})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read keys from %s: %w", path, err)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/openpubkey/opkssh/sshcert"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExportAuthorizedKeys(t *testing.T) {
+	t.Parallel()
+	alg := jwa.ES256
+
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	// opksshPublicKey returns the contents of an opkssh public key file for
+	// an ID Token with the email claim email
+	opksshPublicKey := func(email string) string {
+		signer, err := util.GenKeyPair(alg)
+		require.NoError(t, err)
+		idtTemplate.ExtraClaims = map[string]any{"email": email, "email_verified": true}
+		opkClient, err := client.New(op, client.WithSigner(signer, alg))
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(context.Background())
+		require.NoError(t, err)
+		cert, err := sshcert.New(pkt, []string{})
+		require.NoError(t, err)
+		sshSigner, err := ssh.NewSignerFromSigner(signer)
+		require.NoError(t, err)
+		signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+		require.NoError(t, err)
+		sshCert, err := cert.SignCert(signerMas)
+		require.NoError(t, err)
+		return string(ssh.MarshalAuthorizedKey(sshCert))
+	}
+	allowedKey := opksshPublicKey("arthur.aardvark@example.com")
+	deniedKey := opksshPublicKey("bob.baboon@example.com")
+	// The policy here allows by sub, so the email claim is not checked
+	injectingKey := opksshPublicKey("mallory@example.com\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIB7s mallory")
+
+	verPkt, err := verifier.New(op, verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+	ver := &VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: func(principal string, pkt *pktoken.PKToken, certB64 string, typArg string) (*policy.Match, error) {
+			claims := struct {
+				Email string `json:"email"`
+			}{}
+			if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+				return nil, err
+			}
+			if principal != "root" || (claims.Email != "arthur.aardvark@example.com" && !strings.HasPrefix(claims.Email, "mallory@")) {
+				return nil, fmt.Errorf("no policy to allow %s to assume %s", claims.Email, principal)
+			}
+			return &policy.Match{}, nil
+		},
+	}
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	newExportCmd := func(keysPath string, validFor time.Duration) (*ExportAuthorizedKeysCmd, afero.Fs) {
+		mockFs := afero.NewMemMapFs()
+		e := NewExportAuthorizedKeysCmd(ver, keysPath, validFor)
+		e.Fs = mockFs
+		e.now = func() time.Time { return now }
+		return e, mockFs
+	}
+
+	t.Run("file", func(t *testing.T) {
+		e, mockFs := newExportCmd("/keys", DefaultExportValidFor)
+		require.NoError(t, afero.WriteFile(mockFs, "/keys", []byte("# keys\n\n"+allowedKey+deniedKey), 0600))
+
+		var out strings.Builder
+		exported, err := e.Run(context.Background(), "root", &out)
+		require.NoError(t, err)
+		require.Equal(t, 1, exported)
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		require.Len(t, lines, 3)
+		require.Equal(t, "# opkssh authorized_keys for principal root, exported at 2025-06-01T12:00:00Z", lines[0])
+		require.Contains(t, lines[1], `# "/keys:3" principal="root" email="arthur.aardvark@example.com"`)
+		allowedFields := strings.Fields(allowedKey)
+		require.True(t, strings.HasPrefix(lines[2], `expiry-time="202506021200Z",cert-authority ecdsa-sha2-nistp256 `), lines[2])
+		require.NotContains(t, out.String(), allowedFields[1], "the cert itself should not be exported, only its public key")
+	})
+
+	t.Run("directory with expiry", func(t *testing.T) {
+		e, mockFs := newExportCmd("/keys", 72*time.Hour)
+		require.NoError(t, afero.WriteFile(mockFs, "/keys/arthur-cert.pub", []byte(allowedKey), 0600))
+		require.NoError(t, afero.WriteFile(mockFs, "/keys/bob-cert.pub", []byte(deniedKey), 0600))
+		require.NoError(t, mockFs.MkdirAll("/keys/subdir", 0700))
+
+		var out strings.Builder
+		exported, err := e.Run(context.Background(), "root", &out)
+		require.NoError(t, err)
+		require.Equal(t, 1, exported)
+		require.Contains(t, out.String(), `# "/keys/arthur-cert.pub:1" `)
+		require.Contains(t, out.String(), "\nexpiry-time=\"202506041200Z\",cert-authority ecdsa-sha2-nistp256 ")
+		require.NotContains(t, out.String(), "bob")
+	})
+
+	t.Run("no allowed keys", func(t *testing.T) {
+		e, mockFs := newExportCmd("/keys", DefaultExportValidFor)
+		require.NoError(t, afero.WriteFile(mockFs, "/keys", []byte(deniedKey+"not-a-key\n"), 0600))
+
+		var out strings.Builder
+		exported, err := e.Run(context.Background(), "root", &out)
+		require.NoError(t, err)
+		require.Equal(t, 0, exported)
+		require.Equal(t, 1, strings.Count(out.String(), "\n"))
+	})
+
+	t.Run("missing keys", func(t *testing.T) {
+		e, _ := newExportCmd("/keys", DefaultExportValidFor)
+		_, err := e.Run(context.Background(), "root", &strings.Builder{})
+		require.ErrorContains(t, err, "failed to read keys")
+	})
+
+	t.Run("claims can not add lines", func(t *testing.T) {
+		e, mockFs := newExportCmd("/keys", DefaultExportValidFor)
+		require.NoError(t, afero.WriteFile(mockFs, "/keys", []byte(injectingKey), 0600))
+
+		var out strings.Builder
+		exported, err := e.Run(context.Background(), "root", &out)
+		require.NoError(t, err)
+		require.Equal(t, 1, exported)
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		require.Len(t, lines, 3)
+		require.Contains(t, lines[1], `email="mallory@example.com\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIB7s mallory"`)
+		for _, line := range lines {
+			require.False(t, strings.HasPrefix(line, "ssh-ed25519"), line)
+		}
+	})
+
+	for _, validFor := range []time.Duration{0, -time.Hour} {
+		t.Run(fmt.Sprintf("valid for %s", validFor), func(t *testing.T) {
+			e, mockFs := newExportCmd("/keys", validFor)
+			require.NoError(t, afero.WriteFile(mockFs, "/keys", []byte(allowedKey), 0600))
+			_, err := e.Run(context.Background(), "root", &strings.Builder{})
+			require.ErrorContains(t, err, "--valid-for must be positive")
+		})
+	}
+}
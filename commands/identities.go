@@ -0,0 +1,216 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/opkssh/sshcert"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// openpubkeyKeyComment is the comment opkssh sets on the SSH public keys it
+// writes. It is used to detect keys that opkssh generated and may overwrite.
+const openpubkeyKeyComment = "openpubkey"
+
+// isOpkKeyComment returns true if comment marks a key generated by opkssh.
+// Keys written with --cert-comment-prefix have comments such as
+// "openpubkey/opkssh-1.2", so any comment containing openpubkeyKeyComment
+// counts.
+func isOpkKeyComment(comment string) bool {
+	return strings.Contains(comment, openpubkeyKeyComment)
+}
+
+// validateKeyComment checks comment can be used as the comment of the SSH
+// keys opkssh writes and will still be detected as generated by opkssh
+func validateKeyComment(comment string) error {
+	if !isOpkKeyComment(comment) {
+		return fmt.Errorf("invalid --cert-comment-prefix %q, it must contain %q so that opkssh can recognise its keys", comment, openpubkeyKeyComment)
+	}
+	for _, r := range comment {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid --cert-comment-prefix %q, it can not contain whitespace or control characters", comment)
+		}
+	}
+	return nil
+}
+
+// LocalIdentity describes an opkssh generated SSH key found on disk
+type LocalIdentity struct {
+	// SeckeyPath is the path of the SSH private key
+	SeckeyPath string
+	// PubkeyPath is the path of the SSH public key (SSH certificate)
+	PubkeyPath string
+	Issuer     string
+	Subject    string
+	Email      string
+	// Name is the name claim, a display name for the user that is not
+	// used by policies
+	Name     string
+	Audience string
+	// IssuedAt is when the ID Token in the PK Token was issued
+	IssuedAt time.Time
+	// ExpiresAt is when the ID Token in the PK Token expires. Note that the
+	// server's expiration policy may consider the key expired before this.
+	ExpiresAt time.Time
+	// PKT is the PK Token embedded in the SSH certificate
+	PKT *pktoken.PKToken
+}
+
+// Expired returns true if the ID Token in the PK Token has expired
+func (i LocalIdentity) Expired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+// ListLocalIdentities finds the opkssh generated SSH keys in ~/.ssh and
+// returns the identity and expiry of each. Keys not generated by opkssh are
+// ignored. Identities are sorted by public key path.
+func ListLocalIdentities(fs afero.Fs) ([]LocalIdentity, error) {
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return listLocalIdentitiesInDir(fs, filepath.Join(homePath, ".ssh"))
+}
+
+func listLocalIdentitiesInDir(fs afero.Fs, sshPath string) ([]LocalIdentity, error) {
+	entries, err := afero.ReadDir(fs, sshPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []LocalIdentity{}, nil
+		}
+		return nil, fmt.Errorf("failed to read ssh directory %s: %w", sshPath, err)
+	}
+
+	identities := []LocalIdentity{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pub") {
+			continue
+		}
+		identity, err := readLocalIdentity(fs, filepath.Join(sshPath, entry.Name()))
+		if err != nil {
+			// Not an opkssh key or, if the key has the openpubkey comment,
+			// not a valid opkssh cert, for instance a key written by an old
+			// version
+			continue
+		}
+		identities = append(identities, *identity)
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].PubkeyPath < identities[j].PubkeyPath
+	})
+	return identities, nil
+}
+
+// findLocalIdentity reads the opkssh key whose private key is at keyPath or,
+// if keyPath is empty, the first opkssh key at the default SSH key paths that
+// login writes to
+func findLocalIdentity(fs afero.Fs, keyPath string) (*LocalIdentity, error) {
+	if keyPath != "" {
+		return readLocalIdentity(fs, keyPath+".pub")
+	}
+
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, keyFilename := range []string{"id_ecdsa", "id_ed25519"} {
+		identity, err := readLocalIdentity(fs, filepath.Join(homePath, ".ssh", keyFilename+".pub"))
+		if err == nil {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("no opkssh key found in %s, run opkssh login to create one", filepath.Join(homePath, ".ssh"))
+}
+
+// readLocalIdentity reads the opkssh SSH public key at pubkeyPath and parses
+// the identity in it. Returns an error if the key was not generated by opkssh.
+func readLocalIdentity(fs afero.Fs, pubkeyPath string) (*LocalIdentity, error) {
+	pubkey, isOpk, err := readOpkPubkeyFile(fs, pubkeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if !isOpk {
+		return nil, fmt.Errorf("%s was not generated by opkssh", pubkeyPath)
+	}
+	identity, err := newLocalIdentity(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse opkssh key %s: %w", pubkeyPath, err)
+	}
+	identity.PubkeyPath = pubkeyPath
+	identity.SeckeyPath = strings.TrimSuffix(pubkeyPath, ".pub")
+	return identity, nil
+}
+
+// newLocalIdentity parses the identity from the PK Token in an opkssh SSH certificate
+func newLocalIdentity(pubkey ssh.PublicKey) (*LocalIdentity, error) {
+	cert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an SSH certificate")
+	}
+	pkt, err := (&sshcert.SshCertSmuggler{SshCert: cert}).GetPKToken()
+	if err != nil {
+		return nil, err
+	}
+	return newLocalIdentityFromPKT(pkt)
+}
+
+// newLocalIdentityFromPKT parses the identity from a PK Token. The key paths
+// are left empty.
+func newLocalIdentityFromPKT(pkt *pktoken.PKToken) (*LocalIdentity, error) {
+	idt, err := oidc.NewJwt(pkt.OpToken)
+	if err != nil {
+		return nil, err
+	}
+	claims := idt.GetClaims()
+	return &LocalIdentity{
+		Issuer:    claims.Issuer,
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Name:      nameClaim(*pkt),
+		Audience:  claims.Audience,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.Expiration, 0),
+		PKT:       pkt,
+	}, nil
+}
+
+// readOpkPubkeyFile reads the SSH public key at pubkeyPath and reports
+// whether it was generated by opkssh, which we check by looking at the
+// associated comment.
+func readOpkPubkeyFile(fs afero.Fs, pubkeyPath string) (ssh.PublicKey, bool, error) {
+	sshPubkey, err := afero.ReadFile(fs, pubkeyPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read: %s", pubkeyPath)
+	}
+	pubkey, comment, _, _, err := ssh.ParseAuthorizedKey(sshPubkey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse: %s", pubkeyPath)
+	}
+	// If the key comment contains "openpubkey" then we generated it
+	return pubkey, isOpkKeyComment(comment), nil
+}
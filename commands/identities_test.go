@@ -0,0 +1,86 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestListLocalIdentities(t *testing.T) {
+	pkt, signer, _ := Mocks(t)
+	certBytes, seckeyPem, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+
+	homePath, err := os.UserHomeDir()
+	require.NoError(t, err)
+	sshPath := filepath.Join(homePath, ".ssh")
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{Fs: mockFs}
+
+	// opkssh generated keys
+	require.NoError(t, loginCmd.writeKeys(filepath.Join(sshPath, "id_ecdsa"), filepath.Join(sshPath, "id_ecdsa.pub"), seckeyPem, certBytes))
+	require.NoError(t, loginCmd.writeKeys(filepath.Join(sshPath, "opkssh_server_group1"), filepath.Join(sshPath, "opkssh_server_group1.pub"), seckeyPem, certBytes))
+
+	// A regular SSH key that was not generated by opkssh
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshEdPub, err := ssh.NewPublicKey(edPub)
+	require.NoError(t, err)
+	authKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshEdPub)))
+	require.NoError(t, afero.WriteFile(mockFs, filepath.Join(sshPath, "id_ed25519.pub"), []byte(authKey+" alice@laptop"), 0644))
+
+	// A plain key with the openpubkey comment but no PK Token
+	require.NoError(t, afero.WriteFile(mockFs, filepath.Join(sshPath, "id_plain.pub"), []byte(authKey+" openpubkey"), 0644))
+
+	// Files that are not public keys
+	require.NoError(t, afero.WriteFile(mockFs, filepath.Join(sshPath, "known_hosts"), []byte("example.com ssh-ed25519 AAAA"), 0644))
+	require.NoError(t, afero.WriteFile(mockFs, filepath.Join(sshPath, "garbage.pub"), []byte("not a key"), 0644))
+	require.NoError(t, mockFs.MkdirAll(filepath.Join(sshPath, "dir.pub"), 0755))
+
+	identities, err := ListLocalIdentities(mockFs)
+	require.NoError(t, err)
+	require.Len(t, identities, 2)
+
+	require.Equal(t, filepath.Join(sshPath, "id_ecdsa.pub"), identities[0].PubkeyPath)
+	require.Equal(t, filepath.Join(sshPath, "id_ecdsa"), identities[0].SeckeyPath)
+	require.Equal(t, filepath.Join(sshPath, "opkssh_server_group1.pub"), identities[1].PubkeyPath)
+
+	for _, identity := range identities {
+		require.Equal(t, "arthur.aardvark@example.com", identity.Email)
+		require.Equal(t, "me", identity.Subject)
+		require.Equal(t, "https://accounts.example.com", identity.Issuer)
+		require.Equal(t, "test_client_id", identity.Audience)
+		require.True(t, identity.ExpiresAt.After(identity.IssuedAt))
+		require.False(t, identity.Expired())
+		require.NotNil(t, identity.PKT)
+	}
+
+	// A missing ssh directory is not an error
+	identities, err = ListLocalIdentities(afero.NewMemMapFs())
+	require.NoError(t, err)
+	require.Empty(t, identities)
+}
@@ -0,0 +1,68 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+// This file is the only place opkssh skips verifying an ID Token. It is only
+// reachable from login --insecure-skip-id-token-verify, which deliberately
+// has no equivalent in the client config or environment variables so that
+// it can not be turned on by a config file someone else controls.
+//
+// Threat model: login normally checks the ID Token it receives against the
+// OpenID Provider's JWKS, which costs a JWKS fetch per login. Where the ID
+// Token is delivered over mutually authenticated TLS from a trusted broker
+// that has already checked it, this check is redundant. Skipping it means a
+// compromised or misconfigured broker can make login write a cert for an
+// identity the OP never issued, and login will not notice. SSH servers are
+// unaffected: opkssh verify always checks the ID Token in the cert and has
+// no way to skip it, so such a cert is rejected when used.
+
+// insecureSkipIDTokenVerify wraps op so that the PK Token verifier used by
+// login accepts the ID Token from op without checking its signature,
+// audience or nonce. The signature of the client instance claims and the
+// expiration of the ID Token are still checked.
+func insecureSkipIDTokenVerify(op providers.OpenIdProvider) providers.OpenIdProvider {
+	// Keep refresh support, which the client looks for on the provider
+	if refreshableOp, ok := op.(providers.RefreshableOpenIdProvider); ok {
+		return &insecureSkipVerifyRefreshableOp{RefreshableOpenIdProvider: refreshableOp}
+	}
+	return &insecureSkipVerifyOp{OpenIdProvider: op}
+}
+
+type insecureSkipVerifyOp struct {
+	providers.OpenIdProvider
+}
+
+// VerifyIDToken does not verify the ID Token, see insecureSkipIDTokenVerify
+func (*insecureSkipVerifyOp) VerifyIDToken(context.Context, []byte, *clientinstance.Claims) error {
+	return nil
+}
+
+type insecureSkipVerifyRefreshableOp struct {
+	providers.RefreshableOpenIdProvider
+}
+
+// VerifyIDToken does not verify the ID Token, see insecureSkipIDTokenVerify
+func (*insecureSkipVerifyRefreshableOp) VerifyIDToken(context.Context, []byte, *clientinstance.Claims) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/pktoken/clientinstance"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// badSignatureOp is a provider whose ID Tokens fail verification, as if
+// their signature was invalid
+type badSignatureOp struct {
+	*providers.MockProvider
+}
+
+func (*badSignatureOp) VerifyIDToken(context.Context, []byte, *clientinstance.Claims) error {
+	return fmt.Errorf("invalid ID Token signature")
+}
+
+func TestLoginInsecureSkipVerify(t *testing.T) {
+	mockOp, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	var op providers.OpenIdProvider = &badSignatureOp{MockProvider: mockOp}
+
+	// The refresh support of the provider is kept
+	_, ok := insecureSkipIDTokenVerify(op).(providers.RefreshableOpenIdProvider)
+	require.True(t, ok)
+
+	tests := []struct {
+		name           string
+		config         string
+		insecureSkip   bool
+		expectVerified bool
+	}{
+		{
+			name:           "Verified by default",
+			config:         "providers: []\n",
+			expectVerified: true,
+		},
+		{
+			name:         "Skipped with the flag",
+			config:       "providers: []\n",
+			insecureSkip: true,
+		},
+		{
+			name:           "Can not be enabled in the client config",
+			config:         "insecure_skip_id_token_verify: true\ninsecure_skip_verify: true\nproviders: []\n",
+			expectVerified: true,
+		},
+		{
+			name: "Can not be enabled in a provider config",
+			config: "default_provider: mock\nproviders:\n" +
+				"  - alias: mock\n    issuer: https://accounts.example.com\n    client_id: test_client_id\n    scopes: openid\n" +
+				"    insecure_skip_id_token_verify: true\n    insecure_skip_verify: true\n",
+			expectVerified: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFs := afero.NewMemMapFs()
+			loginCmd := LoginCmd{
+				Fs:                    mockFs,
+				configPathArg:         ConfigPathStdin,
+				stdin:                 strings.NewReader(tt.config),
+				keyPathArg:            "/keys/opkssh",
+				disableBrowserOpenArg: true,
+				overrideProvider:      &op,
+				insecureSkipVerifyArg: tt.insecureSkip,
+			}
+			err := loginCmd.Run(context.Background())
+			if tt.expectVerified {
+				require.ErrorContains(t, err, "invalid ID Token signature")
+				return
+			}
+			require.NoError(t, err)
+			exists, err := afero.Exists(mockFs, "/keys/opkssh.pub")
+			require.NoError(t, err)
+			require.True(t, exists)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// logFileWriter writes to a log file that several opkssh processes may be
+// appending to at once, e.g. when they share a --log-dir. Writes are
+// buffered until a line is complete and each batch of complete lines is
+// written in a single append while holding an exclusive lock on the file, so
+// lines from different processes never interleave. The lock is advisory and
+// only taken if the file supports it.
+type logFileWriter struct {
+	mu   sync.Mutex
+	file afero.File
+	buf  []byte
+}
+
+func newLogFileWriter(file afero.File) *logFileWriter {
+	return &logFileWriter{file: file}
+}
+
+func (w *logFileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	end := bytes.LastIndexByte(w.buf, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	if err := w.writeLocked(w.buf[:end+1]); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf[:0], w.buf[end+1:]...)
+	return len(p), nil
+}
+
+// Flush writes any incomplete line left in the buffer
+func (w *logFileWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if err := w.writeLocked(w.buf); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close flushes any incomplete line and closes the log file
+func (w *logFileWriter) Close() error {
+	flushErr := w.Flush()
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// writeLocked appends lines to the file while holding the file lock
+func (w *logFileWriter) writeLocked(lines []byte) error {
+	unlock, err := lockFile(w.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = w.file.Write(lines)
+	return err
+}
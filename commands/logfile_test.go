@@ -0,0 +1,127 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFileWriterBuffersLines(t *testing.T) {
+	mockFs := afero.NewMemMapFs()
+	logFile, err := mockFs.Create("/logs/opkssh.log")
+	require.NoError(t, err)
+	w := newLogFileWriter(logFile)
+
+	n, err := w.Write([]byte("first "))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	_, err = w.Write([]byte("line\nsecond"))
+	require.NoError(t, err)
+
+	logBytes, err := afero.ReadFile(mockFs, "/logs/opkssh.log")
+	require.NoError(t, err)
+	require.Equal(t, "first line\n", string(logBytes), "incomplete lines should not be written")
+
+	// Closing writes the incomplete line
+	require.NoError(t, w.Close())
+	logBytes, err = afero.ReadFile(mockFs, "/logs/opkssh.log")
+	require.NoError(t, err)
+	require.Equal(t, "first line\nsecond", string(logBytes))
+}
+
+const (
+	// concurrentLogDirEnv is set when the test binary is run by
+	// TestLoginConcurrentLogDir to log in several times to a shared log dir
+	concurrentLogDirEnv = "OPKSSH_TEST_CONCURRENT_LOG_DIR"
+	concurrentLogins    = 10
+	concurrentProcesses = 4
+)
+
+func TestLoginConcurrentLogDir(t *testing.T) {
+	logDir := t.TempDir()
+
+	cmds := []*exec.Cmd{}
+	for i := 0; i < concurrentProcesses; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLoginConcurrentLogDirHelper$")
+		cmd.Env = append(os.Environ(), concurrentLogDirEnv+"="+logDir)
+		require.NoError(t, cmd.Start())
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		require.NoError(t, cmd.Wait())
+	}
+
+	logFile, err := os.Open(filepath.Join(logDir, "opkssh.log"))
+	require.NoError(t, err)
+	defer logFile.Close()
+
+	loginsLogged := 0
+	scanner := bufio.NewScanner(logFile)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), "garbled log line: %s", scanner.Text())
+		require.NotEmpty(t, entry.Time)
+		require.NotEmpty(t, entry.Level)
+		if strings.HasPrefix(entry.Msg, "running login command with args") {
+			loginsLogged++
+		}
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, concurrentProcesses*concurrentLogins, loginsLogged)
+}
+
+// TestLoginConcurrentLogDirHelper is run in several processes at once by
+// TestLoginConcurrentLogDir
+func TestLoginConcurrentLogDirHelper(t *testing.T) {
+	logDir := os.Getenv(concurrentLogDirEnv)
+	if logDir == "" {
+		t.Skip("only run by TestLoginConcurrentLogDir")
+	}
+	_, _, mockOp := Mocks(t)
+
+	keyDir := t.TempDir()
+	for i := 0; i < concurrentLogins; i++ {
+		loginCmd := LoginCmd{
+			Fs:                    afero.NewOsFs(),
+			configPathArg:         filepath.Join(keyDir, "config.yml"),
+			keyPathArg:            filepath.Join(keyDir, "id_ecdsa_"+strconv.Itoa(i)),
+			logDirArg:             logDir,
+			logFormatArg:          LogFormatJSON,
+			verbosity:             2,
+			disableBrowserOpenArg: true,
+			overrideProvider:      &mockOp,
+		}
+		require.NoError(t, loginCmd.Run(context.Background()), fmt.Sprintf("login %d", i))
+	}
+}
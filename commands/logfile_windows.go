@@ -0,0 +1,42 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build windows
+
+package commands
+
+import (
+	"math"
+
+	"github.com/spf13/afero"
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on file, blocking until it is available,
+// and returns a function that releases it. Files that are not backed by a
+// handle, such as in-memory files, are not locked.
+func lockFile(file afero.File) (func(), error) {
+	fdFile, ok := file.(interface{ Fd() uintptr })
+	if !ok {
+		return func() {}, nil
+	}
+	handle := windows.Handle(fdFile.Fd())
+	overlapped := new(windows.Overlapped)
+	if err := windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, math.MaxUint32, math.MaxUint32, overlapped); err != nil {
+		return nil, err
+	}
+	return func() { _ = windows.UnlockFileEx(handle, 0, math.MaxUint32, math.MaxUint32, overlapped) }, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	levelDebug = "DEBUG"
+	levelInfo  = "INFO"
+	levelWarn  = "WARN"
+	levelError = "ERROR"
+)
+
+// levelColors are the ANSI escape codes used to color each level in text logs
+var levelColors = map[string]string{
+	levelDebug: "\033[90m",
+	levelInfo:  "\033[36m",
+	levelWarn:  "\033[33m",
+	levelError: "\033[31m",
+}
+
+const colorReset = "\033[0m"
+
+// levelTags maps the tags messages start with to their level. Tags are
+// removed from the message when it is written.
+var levelTags = []struct {
+	tag   string
+	level string
+}{
+	{"DEBUG:", levelDebug},
+	{"INFO:", levelInfo},
+	{"WARNING:", levelWarn},
+	{"WARN:", levelWarn},
+	{"ERROR:", levelError},
+}
+
+// logLevel returns the level of a log message and the message without its
+// level tag. Messages without a tag that start with "error" or "failed" are
+// errors, all others are info.
+func logLevel(msg string) (string, string) {
+	upper := strings.ToUpper(msg)
+	for _, t := range levelTags {
+		if strings.HasPrefix(upper, t.tag) {
+			return t.level, strings.TrimSpace(msg[len(t.tag):])
+		}
+	}
+	if strings.HasPrefix(upper, "ERROR") || strings.HasPrefix(upper, "FAILED") {
+		return levelError, msg
+	}
+	return levelInfo, msg
+}
+
+// logWriter is set as the output of the standard logger, with the logger's
+// flags set to 0, to write each log message with a timestamp and level as
+// either text or JSON
+type logWriter struct {
+	out    io.Writer
+	format string
+	color  bool
+	now    func() time.Time
+}
+
+func newLogWriter(out io.Writer, format string, color bool) *logWriter {
+	return &logWriter{
+		out:    out,
+		format: format,
+		color:  color,
+		now:    time.Now,
+	}
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	level, msg := logLevel(strings.TrimRight(string(p), "\n"))
+	now := w.now()
+
+	var line string
+	if w.format == LogFormatJSON {
+		entry, err := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{
+			Time:  now.Format(time.RFC3339),
+			Level: level,
+			Msg:   msg,
+		})
+		if err != nil {
+			return 0, err
+		}
+		line = string(entry) + "\n"
+	} else {
+		levelStr := fmt.Sprintf("%-5s", level)
+		if w.color {
+			levelStr = levelColors[level] + levelStr + colorReset
+		}
+		line = fmt.Sprintf("%s %s %s\n", now.Format("2006/01/02 15:04:05"), levelStr, msg)
+	}
+
+	if _, err := io.WriteString(w.out, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// validateLogFormat checks the log format is one we know how to write
+func validateLogFormat(format string) error {
+	switch format {
+	case LogFormatText, LogFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+// useColor returns true if logs written to out should be colored. Color is
+// only used in text logs written to a terminal, and never if --no-color or
+// the NO_COLOR environment variable is set.
+func useColor(out io.Writer, format string, noColor bool, lookupEnv func(string) (string, bool)) bool {
+	if noColor || format != LogFormatText {
+		return false
+	}
+	if v, ok := lookupEnv("NO_COLOR"); ok && v != "" {
+		return false
+	}
+	f, ok := out.(*os.File)
+	return ok && isTerminal(f)
+}
+
+// isTerminal returns true if f is a terminal rather than, for instance, a
+// pipe or a regular file
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
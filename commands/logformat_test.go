@@ -0,0 +1,153 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func noEnv(string) (string, bool) { return "", false }
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		msg           string
+		expectedLevel string
+		expectedMsg   string
+	}{
+		{msg: "Refreshing id_token...", expectedLevel: levelInfo, expectedMsg: "Refreshing id_token..."},
+		{msg: "DEBUG: running login command", expectedLevel: levelDebug, expectedMsg: "running login command"},
+		{msg: "Warning: OpenPubkey SSH requires OpenSSH v. 8.1 or greater", expectedLevel: levelWarn, expectedMsg: "OpenPubkey SSH requires OpenSSH v. 8.1 or greater"},
+		{msg: "WARN: something odd", expectedLevel: levelWarn, expectedMsg: "something odd"},
+		{msg: "ERROR: it broke", expectedLevel: levelError, expectedMsg: "it broke"},
+		{msg: "Error executing login command: bad", expectedLevel: levelError, expectedMsg: "Error executing login command: bad"},
+		{msg: "Failed to open url: bad", expectedLevel: levelError, expectedMsg: "Failed to open url: bad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			level, msg := logLevel(tt.msg)
+			require.Equal(t, tt.expectedLevel, level)
+			require.Equal(t, tt.expectedMsg, msg)
+		})
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	now := time.Date(2025, 4, 1, 12, 30, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	w := newLogWriter(&buf, LogFormatText, false)
+	w.now = func() time.Time { return now }
+	logger := log.New(w, "", 0)
+	logger.Printf("Waiting for %v before attempting to refresh id_token...", time.Minute)
+	logger.Print("DEBUG: details")
+	require.Equal(t, "2025/04/01 12:30:00 INFO  Waiting for 1m0s before attempting to refresh id_token...\n"+
+		"2025/04/01 12:30:00 DEBUG details\n", buf.String())
+	require.NotContains(t, buf.String(), "\033[")
+
+	buf.Reset()
+	w = newLogWriter(&buf, LogFormatText, true)
+	w.now = func() time.Time { return now }
+	log.New(w, "", 0).Print("Failed to open url: bad")
+	require.Equal(t, "2025/04/01 12:30:00 \033[31mERROR\033[0m Failed to open url: bad\n", buf.String())
+
+	buf.Reset()
+	w = newLogWriter(&buf, LogFormatJSON, false)
+	w.now = func() time.Time { return now }
+	log.New(w, "", 0).Print("Warning: \"quoted\"\n")
+	var entry map[string]string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, map[string]string{
+		"time":  "2025-04-01T12:30:00Z",
+		"level": levelWarn,
+		"msg":   `"quoted"`,
+	}, entry)
+}
+
+func TestUseColor(t *testing.T) {
+	// Color is never used when the output is not a terminal
+	require.False(t, useColor(&bytes.Buffer{}, LogFormatText, false, noEnv))
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	require.False(t, useColor(w, LogFormatText, false, noEnv))
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "opkssh.log"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.False(t, useColor(f, LogFormatText, false, noEnv))
+
+	// Nor when it is disabled, or the logs are JSON, whatever the output
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no terminal available")
+	}
+	defer tty.Close()
+	require.True(t, useColor(tty, LogFormatText, false, noEnv))
+	require.False(t, useColor(tty, LogFormatText, true, noEnv))
+	require.False(t, useColor(tty, LogFormatJSON, false, noEnv))
+	noColorEnv := func(key string) (string, bool) {
+		if key == "NO_COLOR" {
+			return "1", true
+		}
+		return "", false
+	}
+	require.False(t, useColor(tty, LogFormatText, false, noColorEnv))
+}
+
+func TestLoginCmdLogFormat(t *testing.T) {
+	defer log.SetFlags(log.LstdFlags)
+	defer log.SetOutput(os.Stdout)
+
+	_, _, mockOp := Mocks(t)
+	logDir := "./logs"
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{
+		Fs:                    mockFs,
+		verbosity:             2,
+		logDirArg:             logDir,
+		logFormatArg:          LogFormatJSON,
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+
+	logBytes, err := afero.ReadFile(mockFs, filepath.Join(logDir, "opkssh.log"))
+	require.NoError(t, err)
+	var entry map[string]string
+	require.NoError(t, json.Unmarshal(bytes.SplitN(logBytes, []byte("\n"), 2)[0], &entry))
+	require.Equal(t, levelDebug, entry["level"])
+	require.Contains(t, entry["msg"], "running login command with args:")
+
+	loginCmd = LoginCmd{
+		Fs:           afero.NewMemMapFs(),
+		logFormatArg: "yaml",
+	}
+	require.ErrorContains(t, loginCmd.Run(context.Background()), `unknown log format "yaml"`)
+}
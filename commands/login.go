@@ -17,32 +17,44 @@
 package commands
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/rand"
+	"net/url"
 	"os"
 
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/openpubkey/openpubkey/client"
-	"github.com/openpubkey/openpubkey/client/choosers"
 	"github.com/openpubkey/openpubkey/oidc"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/openpubkey/opkssh/commands/config"
 	"github.com/openpubkey/opkssh/sshcert"
+	"github.com/skip2/go-qrcode"
 	"github.com/spf13/afero"
+	zoidc "github.com/zitadel/oidc/v3/pkg/oidc"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -55,14 +67,63 @@ type LoginCmd struct {
 	logDirArg             string
 	disableBrowserOpenArg bool
 	printIdTokenArg       bool
+	claimsOutArg          string
 	keyPathArg            string
 	providerArg           string
 	providerAliasArg      string
-	verbosity             int                       // Default verbosity is 0, 1 is verbose, 2 is debug
-	overrideProvider      *providers.OpenIdProvider // Used in tests to override the provider to inject a mock provider
+	providerAliasesArg    []string
+	issuerSelectArg       string
+	issuerAliasArg        string
+	clientIDArg           string
+	clientSecretArg       string
+	caBundleArg           string
+	userAgentArg          string
+	qrArg                 bool
+	sourceAddressArg      string
+	certCommentPrefixArg  string
+	extensionsArg         []string
+	allProvidersArg       bool
+	noOverwriteArg        bool
+	printCertArg          bool
+	hostedDomainArg       string
+	reauthOnExpiryArg     bool
+	logFormatArg          string
+	keyFormatArg          string
+	noColorArg            bool
+	selectAccountArg      bool
+	concurrencyArg        int
+	principalsArg         []string
+	signerArg             crypto.Signer
+	outputDirArg          string
+	refreshJitterArg      time.Duration
+	renewThresholdArg     time.Duration
+	expirationPolicyArg   string
+	identityTemplateArg   string
+	identityClaimArg      string
+	addToAgentArg         bool
+	agentConfirmArg       bool
+	requireEmailArg       bool
+	shellExportArg        bool
+	insecureSkipVerifyArg bool
+	forceNewKeyArg        bool
+	noCertArg             bool
+	caKeyPathArg          string
+	loginTimeoutArg       time.Duration
+	loginTimeoutBehavior  string
+	stdin                 io.Reader                          // Used to read the config when configPathArg is "-", defaults to os.Stdin
+	exportOut             io.Writer                          // Used to write the --shell-export lines, defaults to os.Stdout
+	lookupEnv             func(string) (string, bool)        // Used to read environment variables, defaults to os.LookupEnv
+	verbosity             int                                // Default verbosity is 0, 1 is verbose, 2 is debug
+	overrideProvider      *providers.OpenIdProvider          // Used in tests to override the provider to inject a mock provider
+	rng                   *rand.Rand                         // Used to pick the refresh jitter, defaults to a randomly seeded source
+	agentDialer           func() (io.ReadWriteCloser, error) // Used to connect to ssh-agent, defaults to dialAgent
+	keyStore              config.KeyStore                    // Used to decrypt an encrypted config, defaults to the OS keyring
+	now                   func() time.Time                   // Used in tests to control the current time, defaults to time.Now
+	loginRetryBackoff     time.Duration                      // Used in tests to shorten the first backoff of login retries, defaults to loginRetryMinBackoff
 
 	// State
-	config *config.ClientConfig
+	config   *config.ClientConfig
+	caSigner ssh.Signer // The CA key read from caKeyPathArg
 
 	// Outputs
 	pkt        *pktoken.PKToken
@@ -70,12 +131,371 @@ type LoginCmd struct {
 	alg        jwa.SignatureAlgorithm
 	client     *client.OpkClient
 	principals []string
+	agentCert  *ssh.Certificate // The SSH cert last added to ssh-agent
+}
+
+// ConfigPathStdin is the config path value that makes login read the client
+// config from stdin rather than from a file
+const ConfigPathStdin = "-"
+
+// String implements fmt.Stringer for debug logging. The client secret in the
+// provider argument is redacted.
+func (l *LoginCmd) String() string {
+	// loginCmd has no String method, so formatting it does not recurse
+	type loginCmd LoginCmd
+	redacted := loginCmd(*l)
+	redacted.providerArg = config.RedactProviderConfigString(l.providerArg, false)
+	if redacted.clientSecretArg != "" {
+		redacted.clientSecretArg = config.Redacted
+	}
+	return fmt.Sprintf("%+v", redacted)
+}
+
+// LoginOption configures optional behavior of the login command
+type LoginOption func(*LoginCmd)
+
+// WithCABundle sets a PEM CA bundle used to verify TLS connections to the
+// OpenID Provider. It applies to every provider and takes precedence over any
+// ca_bundle set in the client config.
+func WithCABundle(caBundlePath string) LoginOption {
+	return func(l *LoginCmd) {
+		l.caBundleArg = caBundlePath
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent on requests to the OpenID
+// Provider. It applies to every provider and takes precedence over any
+// user_agent set in the client config.
+func WithUserAgent(userAgent string) LoginOption {
+	return func(l *LoginCmd) {
+		l.userAgentArg = userAgent
+	}
+}
+
+// WithQRCode prints the login URL as a QR code to stdout in addition to
+// opening the browser (unless the browser is disabled)
+func WithQRCode() LoginOption {
+	return func(l *LoginCmd) {
+		l.qrArg = true
+	}
+}
+
+// WithSourceAddress restricts the SSH certificate to the supplied comma
+// separated list of addresses or CIDR ranges using the source-address
+// critical option
+func WithSourceAddress(sourceAddress string) LoginOption {
+	return func(l *LoginCmd) {
+		l.sourceAddressArg = sourceAddress
+	}
+}
+
+// WithCertCommentPrefix sets the comment of the SSH keys written by login,
+// e.g. openpubkey/opkssh-1.2, so that the tool or version that wrote a key
+// can be told apart. It must contain openpubkey.
+func WithCertCommentPrefix(prefix string) LoginOption {
+	return func(l *LoginCmd) {
+		l.certCommentPrefixArg = prefix
+	}
+}
+
+// WithExtensions sets extensions on the SSH certificate. Each extension is
+// supplied as name=value.
+func WithExtensions(extensions []string) LoginOption {
+	return func(l *LoginCmd) {
+		l.extensionsArg = extensions
+	}
+}
+
+// WithAllProviders logs in to every configured provider rather than a single
+// provider, writing a key per provider to ~/.ssh/opkssh_<alias>
+func WithAllProviders() LoginOption {
+	return func(l *LoginCmd) {
+		l.allProvidersArg = true
+	}
+}
+
+// WithNoOverwrite makes login fail rather than replace any existing SSH key
+// file, including keys previously generated by opkssh
+func WithNoOverwrite() LoginOption {
+	return func(l *LoginCmd) {
+		l.noOverwriteArg = true
+	}
+}
+
+// WithPrintCert prints the generated SSH cert in authorized_keys format to
+// stdout after it is written
+func WithPrintCert() LoginOption {
+	return func(l *LoginCmd) {
+		l.printCertArg = true
+	}
+}
+
+// WithIssuerAlias logs in to the well known OpenID Provider with the short
+// name issuerAlias, e.g. google, using the client ID clientID and the
+// optional client secret clientSecret, instead of a provider from the
+// client config. See config.ResolveIssuerAlias.
+func WithIssuerAlias(issuerAlias string, clientID string, clientSecret string) LoginOption {
+	return func(l *LoginCmd) {
+		l.issuerAliasArg = issuerAlias
+		l.clientIDArg = clientID
+		l.clientSecretArg = clientSecret
+	}
+}
+
+// WithHostedDomain restricts Google logins to accounts in the supplied
+// Google Workspace hosted domain. It applies to every Google provider and
+// takes precedence over any hd set in the client config.
+func WithHostedDomain(hostedDomain string) LoginOption {
+	return func(l *LoginCmd) {
+		l.hostedDomainArg = hostedDomain
+	}
+}
+
+// WithReauthOnExpiry keeps login running and repeats the full interactive
+// login shortly before the ID Token expires. Unlike auto-refresh this does
+// not need refresh tokens, so it works with OPs that do not issue them.
+func WithReauthOnExpiry() LoginOption {
+	return func(l *LoginCmd) {
+		l.reauthOnExpiryArg = true
+	}
+}
+
+// WithLogFormat sets the format logs are written in, either LogFormatText
+// (the default) or LogFormatJSON
+func WithLogFormat(logFormat string) LoginOption {
+	return func(l *LoginCmd) {
+		l.logFormatArg = logFormat
+	}
+}
+
+// WithNoColor disables colored log levels. Color is otherwise used when logs
+// are written as text to a terminal.
+func WithNoColor() LoginOption {
+	return func(l *LoginCmd) {
+		l.noColorArg = true
+	}
+}
+
+// WithSelectAccountEveryTime makes the OP ask which account to use on every
+// login by setting prompt=select_account, and ignores the default provider in
+// the client config so the provider is chosen every time as well. This suits
+// machines shared by several users.
+func WithSelectAccountEveryTime() LoginOption {
+	return func(l *LoginCmd) {
+		l.selectAccountArg = true
+	}
+}
+
+// WithConcurrency limits how many providers are logged in to at once when
+// logging in to multiple providers. Zero uses DefaultLoginConcurrency.
+func WithConcurrency(concurrency int) LoginOption {
+	return func(l *LoginCmd) {
+		l.concurrencyArg = concurrency
+	}
+}
+
+// WithProviderAliases sets the aliases of the providers to log in with. A
+// single alias selects that provider as the alias arg of NewLogin does. With
+// more than one alias the web chooser is opened with only those providers
+// rather than every configured provider.
+func WithProviderAliases(aliases ...string) LoginOption {
+	return func(l *LoginCmd) {
+		if len(aliases) == 1 {
+			l.providerAliasArg = aliases[0]
+			l.providerAliasesArg = nil
+		} else {
+			l.providerAliasesArg = aliases
+		}
+	}
+}
+
+// WithIssuerSelect logs in with the configured provider whose issuer is
+// issuer, for scripts that know the issuer but not the alias it is configured
+// with locally
+func WithIssuerSelect(issuer string) LoginOption {
+	return func(l *LoginCmd) {
+		l.issuerSelectArg = issuer
+	}
+}
+
+// WithClaimsOut writes every claim in the ID Token as JSON to the file at
+// claimsOut, readable only by the user, after each login
+func WithClaimsOut(claimsOut string) LoginOption {
+	return func(l *LoginCmd) {
+		l.claimsOutArg = claimsOut
+	}
+}
+
+// WithOutputDir writes the private key, the cert and a metadata.json
+// describing them to outputDir rather than to ~/.ssh. The directory is
+// created if needed and made readable only by the user.
+func WithOutputDir(outputDir string) LoginOption {
+	return func(l *LoginCmd) {
+		l.outputDirArg = outputDir
+	}
+}
+
+// WithRefreshJitter moves each --auto-refresh refresh by a random amount of
+// up to jitter earlier or later, so that machines started at the same time do
+// not all refresh at once. Refreshes are never moved past expiry.
+func WithRefreshJitter(jitter time.Duration) LoginOption {
+	return func(l *LoginCmd) {
+		l.refreshJitterArg = jitter
+	}
+}
+
+// WithKeyFormat sets the format the private key is written in, either
+// KeyFormatOpenSSH, the default, or KeyFormatPKCS8 for tools that expect a
+// PEM encoded PKCS#8 key. The cert is the same in either format.
+func WithKeyFormat(keyFormat string) LoginOption {
+	return func(l *LoginCmd) {
+		l.keyFormatArg = keyFormat
+	}
+}
+
+// WithRenewThreshold makes login do nothing if the current opkssh key remains
+// valid for longer than threshold, so that it can be run often, e.g. from
+// cron, without logging in to the OP each time. When the key expires is
+// decided by expirationPolicy, which uses the same values as
+// /etc/opk/providers and should match the server.
+func WithRenewThreshold(threshold time.Duration, expirationPolicy string) LoginOption {
+	return func(l *LoginCmd) {
+		l.renewThresholdArg = threshold
+		l.expirationPolicyArg = expirationPolicy
+	}
+}
+
+// WithLoginTimeout bounds each interactive login with the OP to timeout. When
+// the first login of --auto-refresh times out, behavior decides whether login
+// fails, LoginTimeoutFail, or tries again after a backoff, LoginTimeoutRetry,
+// so that a login started at boot with no one present keeps waiting for the
+// user rather than exiting.
+func WithLoginTimeout(timeout time.Duration, behavior string) LoginOption {
+	return func(l *LoginCmd) {
+		l.loginTimeoutArg = timeout
+		l.loginTimeoutBehavior = behavior
+	}
+}
+
+// WithIdentityTemplate sets the Go text/template used to print the identity
+// after login. The template is executed on a LocalIdentity, e.g.
+// '{{.Email}} via {{.Issuer}}'. Without it IdentityString is printed.
+func WithIdentityTemplate(tmpl string) LoginOption {
+	return func(l *LoginCmd) {
+		l.identityTemplateArg = tmpl
+	}
+}
+
+// WithIdentityClaim makes login print the value of claim, such as
+// preferred_username, as the identity in place of the email. Use it with OPs
+// whose servers run opkssh verify with the same --identity-claim.
+func WithIdentityClaim(claim string) LoginOption {
+	return func(l *LoginCmd) {
+		l.identityClaimArg = claim
+	}
+}
+
+// WithAddToAgent adds the SSH key and cert to the running ssh-agent as well
+// as writing them to disk. On Windows this is the OpenSSH for Windows agent
+// service unless SSH_AUTH_SOCK names another agent's pipe. If the agent can
+// not be reached a warning is logged and ssh reads the key from disk.
+func WithAddToAgent() LoginOption {
+	return func(l *LoginCmd) {
+		l.addToAgentArg = true
+	}
+}
+
+// WithAgentConfirm makes the ssh-agent ask the user to confirm each use of
+// the key added with WithAddToAgent, as ssh-add -c does
+func WithAgentConfirm() LoginOption {
+	return func(l *LoginCmd) {
+		l.agentConfirmArg = true
+	}
+}
+
+// WithRequireEmail makes login fail if the ID Token does not have an email
+// claim with email_verified set to true, rather than falling back to
+// identifying the user by their sub
+func WithRequireEmail() LoginOption {
+	return func(l *LoginCmd) {
+		l.requireEmailArg = true
+	}
+}
+
+// WithInsecureSkipIDTokenVerify makes login accept the ID Token from the
+// OpenID Provider without verifying its signature. It is for ID Tokens
+// delivered over mutually authenticated TLS by a trusted broker and must
+// never be set from a config file. SSH servers still verify the ID Token.
+func WithInsecureSkipIDTokenVerify() LoginOption {
+	return func(l *LoginCmd) {
+		l.insecureSkipVerifyArg = true
+	}
+}
+
+// WithShellExport makes login print shell commands that export the paths of
+// the key and cert it wrote, for eval $(opkssh login --shell-export). All
+// other output is written to stderr.
+func WithShellExport() LoginOption {
+	return func(l *LoginCmd) {
+		l.shellExportArg = true
+	}
+}
+
+// WithForceNewKey makes login remove the keys opkssh previously added to
+// ssh-agent and check that the newly generated key differs from the key of
+// the opkssh cert it replaces on disk. Copies of the previous key forwarded
+// through the agent can no longer be used once it is removed from the agent.
+func WithForceNewKey() LoginOption {
+	return func(l *LoginCmd) {
+		l.forceNewKeyArg = true
+	}
+}
+
+// WithNoCert makes login write the public key as a plain key rather than an
+// SSH cert, for sshd setups that do not accept SSH certs, along with a
+// registration of the key's fingerprint to the identity in the ID Token.
+// The plain key carries no expiry, so it stays valid until it is removed from
+// the server.
+func WithNoCert() LoginOption {
+	return func(l *LoginCmd) {
+		l.noCertArg = true
+	}
+}
+
+// WithCAKey makes login sign the SSH cert with the CA private key at
+// caKeyPath rather than with the key the PK Token commits to. The PK Token is
+// still embedded in the cert, so the server can trust the CA key with sshd's
+// TrustedUserCAKeys and in KRLs while opkssh verify checks the PK Token and
+// policy when the CA key is in trusted_ca_keys.
+func WithCAKey(caKeyPath string) LoginOption {
+	return func(l *LoginCmd) {
+		l.caKeyPathArg = caKeyPath
+	}
+}
+
+// WithSigner makes login sign the PK Token and the SSH cert with signer, such
+// as a key held in a PKCS#11 HSM, rather than with a newly generated ECDSA
+// key. ECDSA P-256 and RSA keys are supported. As the private key is not
+// available it is not written, only the SSH cert is written to the private
+// key file path with .pub appended, so that path must be set.
+func WithSigner(signer crypto.Signer) LoginOption {
+	return func(l *LoginCmd) {
+		l.signerArg = signer
+	}
+}
+
+// WithPrincipals sets the principals of the SSH cert. Without it the
+// default_principal template in the client config is used, if set.
+func WithPrincipals(principals ...string) LoginOption {
+	return func(l *LoginCmd) {
+		l.principalsArg = principals
+	}
 }
 
 func NewLogin(autoRefreshArg bool, configPathArg string, createConfigArg bool, logDirArg string, disableBrowserOpenArg bool, printIdTokenArg bool,
-	providerArg string, keyPathArg string, providerAliasArg string) *LoginCmd {
+	providerArg string, keyPathArg string, providerAliasArg string, opts ...LoginOption) *LoginCmd {
 
-	return &LoginCmd{
+	l := &LoginCmd{
 		Fs:                    afero.NewOsFs(),
 		autoRefreshArg:        autoRefreshArg,
 		configPathArg:         configPathArg,
@@ -87,37 +507,189 @@ func NewLogin(autoRefreshArg bool, configPathArg string, createConfigArg bool, l
 		providerArg:           providerArg,
 		providerAliasArg:      providerAliasArg,
 	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
 }
 
 func (l *LoginCmd) Run(ctx context.Context) error {
+	logFormat := l.logFormatArg
+	if logFormat == "" {
+		logFormat = LogFormatText
+	}
+	if err := validateLogFormat(logFormat); err != nil {
+		return err
+	}
+	stdoutLog := newLogWriter(l.stdout(), logFormat, useColor(l.stdout(), logFormat, l.noColorArg, l.getenv))
+	log.SetFlags(0)
+
 	// If a log directory was provided, write any logs to a file in that directory AND stdout
 	if l.logDirArg != "" {
 		logFilePath := filepath.Join(l.logDirArg, "opkssh.log")
 		logFile, err := l.Fs.OpenFile(logFilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0660)
 		if err != nil {
-			log.Printf("Failed to open log for writing: %v \n", err)
+			// The log directory may not be writable on locked down systems,
+			// logging to stdout alone is better than not logging in
+			log.SetOutput(stdoutLog)
+			log.Printf("Warning: failed to open log file for writing, logging to stdout only: %v", err)
+		} else {
+			// Other opkssh processes may share the log dir, so whole lines are
+			// appended under a file lock
+			lockedLogFile := newLogFileWriter(logFile)
+			defer lockedLogFile.Close()
+			// The log file is never colored
+			multiWriter := io.MultiWriter(stdoutLog, newLogWriter(lockedLogFile, logFormat, false))
+			log.SetOutput(multiWriter)
 		}
-		defer logFile.Close()
-		multiWriter := io.MultiWriter(os.Stdout, logFile)
-		log.SetOutput(multiWriter)
 	} else {
-		log.SetOutput(os.Stdout)
+		log.SetOutput(stdoutLog)
 	}
 
 	if l.verbosity >= 2 {
-		log.Printf("DEBUG: running login command with args: %+v", *l)
+		log.Printf("DEBUG: running login command with args: %+v", l)
+	}
+
+	if l.autoRefreshArg && l.reauthOnExpiryArg {
+		return fmt.Errorf("--auto-refresh and --reauth-on-expiry can not be used together")
+	}
+	if l.refreshJitterArg < 0 {
+		return fmt.Errorf("--refresh-jitter must not be negative, got %s", l.refreshJitterArg)
+	}
+	if l.keyFormatArg != "" {
+		if err := validateKeyFormat(l.keyFormatArg); err != nil {
+			return err
+		}
+	}
+	if l.loginTimeoutArg < 0 {
+		return fmt.Errorf("--login-timeout must not be negative, got %s", l.loginTimeoutArg)
+	}
+	switch l.loginTimeoutBehavior {
+	case "", LoginTimeoutFail:
+	case LoginTimeoutRetry:
+		if l.loginTimeoutArg == 0 || !l.autoRefreshArg {
+			return fmt.Errorf("--login-timeout-behavior=%s requires --login-timeout and --auto-refresh", LoginTimeoutRetry)
+		}
+	default:
+		return fmt.Errorf("unknown login timeout behavior %q, expected %s or %s", l.loginTimeoutBehavior, LoginTimeoutFail, LoginTimeoutRetry)
+	}
+	if l.agentConfirmArg && !l.addToAgentArg {
+		return fmt.Errorf("--agent-confirm requires --add-to-agent")
+	}
+	if l.shellExportArg && (l.autoRefreshArg || l.reauthOnExpiryArg || l.allProvidersArg) {
+		return fmt.Errorf("--shell-export can not be used with --auto-refresh, --reauth-on-expiry or --all-providers")
+	}
+	if l.noCertArg && (l.autoRefreshArg || l.reauthOnExpiryArg || l.addToAgentArg || len(l.principalsArg) > 0) {
+		return fmt.Errorf("--no-cert can not be used with --auto-refresh, --reauth-on-expiry, --add-to-agent or --principal")
+	}
+	if l.insecureSkipVerifyArg {
+		log.Printf("WARNING: --insecure-skip-id-token-verify is set, the signature of the ID Token from the OpenID Provider is NOT verified. Only use it when the ID Token is delivered over mutually authenticated TLS by a trusted broker")
+	}
+	if l.issuerAliasArg != "" {
+		if l.clientIDArg == "" {
+			return fmt.Errorf("--issuer-alias requires --client-id")
+		}
+		if l.providerArg != "" || l.providerAliasArg != "" || len(l.providerAliasesArg) > 0 || l.allProvidersArg {
+			return fmt.Errorf("--issuer-alias can not be used with --provider, --all-providers or provider aliases")
+		}
+	} else if l.clientIDArg != "" || l.clientSecretArg != "" {
+		return fmt.Errorf("--client-id and --client-secret can only be used with --issuer-alias")
+	}
+	if l.issuerSelectArg != "" && (l.providerArg != "" || l.issuerAliasArg != "" || l.providerAliasArg != "" || len(l.providerAliasesArg) > 0 || l.allProvidersArg) {
+		return fmt.Errorf("--issuer-select can not be used with --provider, --issuer-alias, --all-providers or provider aliases")
+	}
+	if l.renewThresholdArg < 0 {
+		return fmt.Errorf("--renew-threshold must not be negative, got %s", l.renewThresholdArg)
+	}
+	if l.renewThresholdArg > 0 {
+		if l.autoRefreshArg || l.reauthOnExpiryArg || l.allProvidersArg {
+			return fmt.Errorf("--renew-threshold can not be used with --auto-refresh, --reauth-on-expiry or --all-providers")
+		}
+		if _, err := identityValidUntil(&LocalIdentity{}, l.expirationPolicyArg); err != nil {
+			return err
+		}
+	}
+
+	// Check the arguments used to build the SSH cert before sending the user to the OP
+	if l.certCommentPrefixArg != "" {
+		if err := validateKeyComment(l.certCommentPrefixArg); err != nil {
+			return err
+		}
+	}
+	if l.sourceAddressArg != "" {
+		if err := sshcert.ValidateSourceAddress(l.sourceAddressArg); err != nil {
+			return err
+		}
+	}
+	for _, extension := range l.extensionsArg {
+		if _, _, err := parseExtensionArg(extension); err != nil {
+			return err
+		}
+	}
+	for _, principal := range l.principalsArg {
+		if err := validatePrincipal(principal); err != nil {
+			return err
+		}
+	}
+	if l.identityTemplateArg != "" {
+		if _, err := parseIdentityTemplate(l.identityTemplateArg); err != nil {
+			return err
+		}
+	}
+	if l.caKeyPathArg != "" {
+		if l.noCertArg {
+			return fmt.Errorf("--ca-key can not be used with --no-cert")
+		}
+		if err := l.loadCAKey(); err != nil {
+			return err
+		}
+	}
+	keyPath := l.keyPathArg
+	if l.outputDirArg != "" {
+		if l.keyPathArg != "" {
+			return fmt.Errorf("--output-dir can not be used with --private-key-file")
+		}
+		if l.allProvidersArg {
+			return fmt.Errorf("--output-dir can not be used with --all-providers")
+		}
+		var err error
+		if keyPath, err = l.prepareOutputDir(); err != nil {
+			return err
+		}
+	}
+
+	if l.renewThresholdArg > 0 && !l.renewNeeded(keyPath) {
+		return nil
 	}
 
 	if l.configPathArg == "" {
-		dir, dirErr := os.UserHomeDir()
-		if dirErr != nil {
-			return fmt.Errorf("failed to get user config dir: %w", dirErr)
+		configPath, err := defaultClientConfigPath()
+		if err != nil {
+			return err
 		}
-		l.configPathArg = filepath.Join(dir, ".opk", "config.yml")
+		l.configPathArg = configPath
 	}
 
 	var configBytes []byte
-	if _, err := l.Fs.Stat(l.configPathArg); err == nil {
+	if l.configPathArg == ConfigPathStdin {
+		// Reading the config from stdin never touches the config file on disk
+		if l.createConfigArg {
+			return fmt.Errorf("--create-config can not be used when reading the config from stdin")
+		}
+		stdin := l.stdin
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+		var err error
+		configBytes, err = io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read config from stdin: %w", err)
+		}
+		l.config, err = config.LoadClientConfig(configBytes, l.configKeyStore())
+		if err != nil {
+			return fmt.Errorf("failed to parse config from stdin: %w", err)
+		}
+	} else if _, err := l.Fs.Stat(l.configPathArg); err == nil {
 		if l.createConfigArg {
 			log.Printf("--create-config=true but config file already exists at %s", l.configPathArg)
 		}
@@ -125,32 +697,58 @@ func (l *LoginCmd) Run(ctx context.Context) error {
 		// Load the file from the filesystem
 		afs := &afero.Afero{Fs: l.Fs}
 		configBytes, err = afs.ReadFile(l.configPathArg)
-		if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			// On locked down systems the config may not be readable, the
+			// default config still lets the user log in
+			log.Printf("Warning: failed to read client config file, using the default config: %v", err)
+			if err := l.useDefaultConfig(); err != nil {
+				return err
+			}
+		} else if err != nil {
 			return fmt.Errorf("failed to read config file: %w", err)
+		} else {
+			l.config, err = config.LoadClientConfig(configBytes, l.configKeyStore())
+			if err != nil {
+				return fmt.Errorf("failed to parse config file: %w", err)
+			}
 		}
-		l.config, err = config.NewClientConfig(configBytes)
-		if err != nil {
-			return fmt.Errorf("failed to parse config file: %w", err)
+	} else if l.createConfigArg {
+		// Creating the config file is the whole point of --create-config so
+		// unlike reading the config, failing to write it is an error
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to check for an existing config file at %s: %w", l.configPathArg, err)
+		}
+		afs := &afero.Afero{Fs: l.Fs}
+		if err := l.Fs.MkdirAll(filepath.Dir(l.configPathArg), 0755); err != nil {
+			return fmt.Errorf("failed to create config directory: %w", err)
+		}
+		if err := afs.WriteFile(l.configPathArg, config.DefaultClientConfig, 0644); err != nil {
+			return fmt.Errorf("failed to write default config file: %w", err)
 		}
+		log.Printf("created client config file at %s", l.configPathArg)
+		return nil
 	} else {
-		if l.createConfigArg {
-			afs := &afero.Afero{Fs: l.Fs}
-			if err := l.Fs.MkdirAll(filepath.Dir(l.configPathArg), 0755); err != nil {
-				return fmt.Errorf("failed to create config directory: %w", err)
-			}
-			if err := afs.WriteFile(l.configPathArg, config.DefaultClientConfig, 0644); err != nil {
-				return fmt.Errorf("failed to write default config file: %w", err)
-			}
-			log.Printf("created client config file at %s", l.configPathArg)
-			return nil
-		} else {
+		if errors.Is(err, fs.ErrNotExist) {
 			log.Printf("failed to find client config file to generate a default config, run `opkssh login --create-config` to create a default config file")
+		} else {
+			log.Printf("Warning: failed to access client config file, using the default config: %v", err)
 		}
-		l.config, err = config.NewClientConfig(config.DefaultClientConfig)
-		if err != nil {
-			return fmt.Errorf("failed to parse default config file: %w", err)
+		if err := l.useDefaultConfig(); err != nil {
+			return err
 		}
 	}
+	if l.config.DefaultPrincipal != "" {
+		if _, err := parsePrincipalTemplate(l.config.DefaultPrincipal); err != nil {
+			return err
+		}
+	}
+	if err := l.checkAllowedPrincipals(); err != nil {
+		return err
+	}
+
+	if l.allProvidersArg {
+		return l.runAllProviders(ctx)
+	}
 
 	var provider providers.OpenIdProvider
 	if l.overrideProvider != nil {
@@ -161,12 +759,18 @@ func (l *LoginCmd) Run(ctx context.Context) error {
 			return err
 		}
 		if chooser != nil {
+			if l.qrArg {
+				log.Printf("--qr is not supported with the web chooser, specify a provider alias to print the login URL as a QR code")
+			}
 			provider, err = chooser.ChooseOp(ctx)
 			if err != nil {
 				return fmt.Errorf("error choosing provider: %w", err)
 			}
 		} else if op != nil {
 			provider = op
+			if browserOp, ok := op.(providers.BrowserOpenIdProvider); ok {
+				l.hookLoginURI(ctx, browserOp)
+			}
 		} else {
 			return fmt.Errorf("no provider found") // Either the provider or the chooser must be set. If this occurs we have a bug in the code.
 		}
@@ -175,15 +779,19 @@ func (l *LoginCmd) Run(ctx context.Context) error {
 	// Execute login command
 	if l.autoRefreshArg {
 		if providerRefreshable, ok := provider.(providers.RefreshableOpenIdProvider); ok {
-			err := l.LoginWithRefresh(ctx, providerRefreshable, l.printIdTokenArg, l.keyPathArg)
+			err := l.LoginWithRefresh(ctx, providerRefreshable, l.printIdTokenArg, keyPath)
 			if err != nil {
 				return fmt.Errorf("error logging in: %w", err)
 			}
 		} else {
 			return fmt.Errorf("supplied OpenID Provider (%v) does not support auto-refresh and auto-refresh argument set to true", provider.Issuer())
 		}
+	} else if l.reauthOnExpiryArg {
+		if err := l.LoginWithReauth(ctx, provider, l.printIdTokenArg, keyPath); err != nil {
+			return fmt.Errorf("error logging in: %w", err)
+		}
 	} else {
-		err := l.Login(ctx, provider, l.printIdTokenArg, l.keyPathArg)
+		err := l.Login(ctx, provider, l.printIdTokenArg, keyPath)
 		if err != nil {
 			return fmt.Errorf("error logging in: %w", err)
 		}
@@ -191,7 +799,65 @@ func (l *LoginCmd) Run(ctx context.Context) error {
 	return nil
 }
 
-func (l *LoginCmd) determineProvider() (providers.OpenIdProvider, *choosers.WebChooser, error) {
+// hookLoginURI intercepts the login URI the provider would open in the
+// browser. The provider's callback listener is bridged to both loopback
+// addresses, so the localhost redirect URI works whether the browser resolves
+// localhost to 127.0.0.1 or ::1, and with --qr the login URI is printed as a
+// QR code so it can be opened on another device.
+func (l *LoginCmd) hookLoginURI(ctx context.Context, op providers.BrowserOpenIdProvider) {
+	loginURICh := make(chan string, 1)
+	op.ReuseBrowserWindowHook(loginURICh)
+	go func() {
+		for {
+			select {
+			case loginURI := <-loginURICh:
+				l.openLoginURI(ctx, loginURI)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// openLoginURI does what the provider would have done with the login URI
+// had it not been intercepted by hookLoginURI
+func (l *LoginCmd) openLoginURI(ctx context.Context, loginURI string) {
+	if u, err := url.Parse(loginURI); err == nil {
+		if _, err := bridgeLoopback(ctx, u.Port(), callbackIdleTimeout); err != nil && l.verbosity >= 2 {
+			log.Printf("DEBUG: %v", err)
+		}
+	}
+
+	if l.qrArg {
+		qr, err := renderQRCode(loginURI)
+		if err != nil {
+			log.Printf("Failed to render QR code: %v", err)
+		} else {
+			fmt.Fprintf(l.stdout(), "Scan the QR code below or open %s to login\n%s", loginURI, qr)
+		}
+	} else if l.disableBrowserOpenArg {
+		log.Printf("Open your browser to: %s", loginURI)
+	} else {
+		log.Printf("Opening browser to %s", loginURI)
+	}
+	if !l.disableBrowserOpenArg {
+		if err := util.OpenUrl(loginURI); err != nil {
+			log.Printf("Failed to open url: %v", err)
+		}
+	}
+}
+
+// renderQRCode renders uri as a QR code made of unicode block characters
+// suitable for printing to a terminal
+func renderQRCode(uri string) (string, error) {
+	qr, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	return qr.ToSmallString(false), nil
+}
+
+func (l *LoginCmd) determineProvider() (providers.OpenIdProvider, *WebChooser, error) {
 	openBrowser := !l.disableBrowserOpenArg
 
 	var defaultProviderAlias string
@@ -205,6 +871,9 @@ func (l *LoginCmd) determineProvider() (providers.OpenIdProvider, *choosers.WebC
 		if err != nil {
 			return nil, nil, fmt.Errorf("error parsing provider argument: %w", err)
 		}
+		if err := l.applyProviderOverrides(&providerConfig); err != nil {
+			return nil, nil, err
+		}
 
 		if provider, err = providerConfig.ToProvider(openBrowser); err != nil {
 			return nil, nil, fmt.Errorf("error creating provider from config: %w", err)
@@ -213,31 +882,67 @@ func (l *LoginCmd) determineProvider() (providers.OpenIdProvider, *choosers.WebC
 		}
 	}
 
-	// Set the default provider from the env variable if specified
-	defaultProviderEnv, _ := os.LookupEnv(config.OPKSSH_DEFAULT_ENVVAR)
-	providerConfigsEnv, err := config.GetProvidersConfigFromEnv()
+	// A well known issuer given by its short name with the client ID from
+	// the command line also bypasses the configured providers
+	if l.issuerAliasArg != "" {
+		issuer, err := config.ResolveIssuerAlias(l.issuerAliasArg, l.config.IssuerAliases)
+		if err != nil {
+			return nil, nil, err
+		}
+		providerConfig, err := config.NewProviderConfigFromString(strings.Join([]string{issuer, l.clientIDArg, l.clientSecretArg}, ","), false)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating provider for issuer alias %s: %w", l.issuerAliasArg, err)
+		}
+		if err := l.applyProviderOverrides(&providerConfig); err != nil {
+			return nil, nil, err
+		}
+		if provider, err = providerConfig.ToProvider(openBrowser); err != nil {
+			return nil, nil, fmt.Errorf("error creating provider from config: %w", err)
+		}
+		return provider, nil, nil
+	}
+
+	providerConfigs, err = l.configuredProviders()
 	if err != nil {
-		return nil, nil, fmt.Errorf("error getting provider config from env: %w", err)
+		return nil, nil, err
 	}
 
-	if l.providerAliasArg != "" {
-		defaultProviderAlias = l.providerAliasArg
-	} else if defaultProviderEnv != "" {
-		defaultProviderAlias = defaultProviderEnv
-	} else if l.config.DefaultProvider != "" {
-		defaultProviderAlias = l.config.DefaultProvider
-	} else {
-		defaultProviderAlias = config.WEBCHOOSER_ALIAS
+	if l.issuerSelectArg != "" {
+		providerConfig, err := providerConfigForIssuer(providerConfigs, l.issuerSelectArg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if provider, err = providerConfig.ToProvider(openBrowser); err != nil {
+			return nil, nil, fmt.Errorf("error creating provider from config: %w", err)
+		}
+		return provider, nil, nil
 	}
 
-	if providerConfigsEnv != nil {
-		providerConfigs = providerConfigsEnv
-	} else if len(l.config.Providers) > 0 {
-		providerConfigs = l.config.Providers
-	} else {
-		return nil, nil, fmt.Errorf("no providers specified")
+	// If several aliases were given, let the user choose between just those
+	if len(l.providerAliasesArg) > 0 {
+		providerMap, err := config.CreateProvidersMap(providerConfigs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating provider map: %w", err)
+		}
+		var providerList []providers.BrowserOpenIdProvider
+		var names []string
+		for _, alias := range l.providerAliasesArg {
+			providerConfig, ok := providerMap[alias]
+			if !ok {
+				return nil, nil, fmt.Errorf("error getting provider config for alias %s", alias)
+			}
+			op, err := providerConfig.ToProvider(openBrowser)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error creating provider from config: %w", err)
+			}
+			providerList = append(providerList, op.(providers.BrowserOpenIdProvider))
+			names = append(names, providerConfig.ChooserName())
+		}
+		return nil, NewWebChooser(providerList, names, openBrowser), nil
 	}
 
+	defaultProviderAlias = l.defaultProviderAlias()
+
 	if strings.ToUpper(defaultProviderAlias) != config.WEBCHOOSER_ALIAS {
 		providerMap, err := config.CreateProvidersMap(providerConfigs)
 		if err != nil {
@@ -255,29 +960,164 @@ func (l *LoginCmd) determineProvider() (providers.OpenIdProvider, *choosers.WebC
 	} else {
 		// If the default provider is WEBCHOOSER, we need to create a chooser and return it
 		var providerList []providers.BrowserOpenIdProvider
+		var names []string
 		for _, providerConfig := range providerConfigs {
 			op, err := providerConfig.ToProvider(openBrowser)
 			if err != nil {
 				return nil, nil, fmt.Errorf("error creating provider from config: %w", err)
 			}
 			providerList = append(providerList, op.(providers.BrowserOpenIdProvider))
+			names = append(names, providerConfig.ChooserName())
+		}
+		return nil, NewWebChooser(providerList, names, openBrowser), nil
+	}
+}
+
+// providerConfigForIssuer returns the provider config in providerConfigs
+// with the issuer issuer. A trailing slash is ignored when comparing issuers.
+// It is an error if no provider or more than one provider has the issuer.
+func providerConfigForIssuer(providerConfigs []config.ProviderConfig, issuer string) (config.ProviderConfig, error) {
+	var matches []config.ProviderConfig
+	for _, providerConfig := range providerConfigs {
+		if strings.TrimSuffix(providerConfig.Issuer, "/") == strings.TrimSuffix(issuer, "/") {
+			matches = append(matches, providerConfig)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return config.ProviderConfig{}, fmt.Errorf("no configured provider has the issuer %s", issuer)
+	case 1:
+		return matches[0], nil
+	default:
+		aliases := []string{}
+		for _, match := range matches {
+			aliases = append(aliases, strings.Join(match.AliasList, " "))
+		}
+		return config.ProviderConfig{}, fmt.Errorf("more than one configured provider has the issuer %s (%s), select one by alias instead", issuer, strings.Join(aliases, ", "))
+	}
+}
+
+// defaultProviderAlias returns the alias of the provider to log in with. The
+// provider alias argument takes precedence over the OPKSSH_DEFAULT environment
+// variable, which takes precedence over the default provider in the client
+// config. If none of them are set, or only the client config default is set
+// and select account every time is on, the web chooser is used. Setting
+// OPKSSH_FORCE_CHOOSER uses the web chooser unless an alias argument is given.
+func (l *LoginCmd) defaultProviderAlias() string {
+	// Set the default provider from the env variable if specified
+	defaultProviderEnv, _ := l.getenv(config.OPKSSH_DEFAULT_ENVVAR)
+
+	if l.providerAliasArg != "" {
+		return l.providerAliasArg
+	} else if l.forceChooser() {
+		return config.WEBCHOOSER_ALIAS
+	} else if defaultProviderEnv != "" {
+		return defaultProviderEnv
+	} else if l.config.DefaultProvider != "" && !l.selectAccountArg {
+		return l.config.DefaultProvider
+	} else {
+		return config.WEBCHOOSER_ALIAS
+	}
+}
+
+// getenv looks up an environment variable using lookupEnv if it is set,
+// otherwise os.LookupEnv
+func (l *LoginCmd) getenv(key string) (string, bool) {
+	if l.lookupEnv == nil {
+		return os.LookupEnv(key)
+	}
+	return l.lookupEnv(key)
+}
+
+// forceChooser returns true if OPKSSH_FORCE_CHOOSER is set to true, which
+// makes login ignore OPKSSH_DEFAULT and default_provider in the client config
+// and open the web chooser. This helps when troubleshooting a misconfigured
+// default provider.
+func (l *LoginCmd) forceChooser() bool {
+	forceChooserEnv, _ := l.getenv(config.OPKSSH_FORCE_CHOOSER_ENVVAR)
+	forceChooser, err := strconv.ParseBool(forceChooserEnv)
+	return err == nil && forceChooser
+}
+
+// configuredProviders returns the providers configured in the OPKSSH_PROVIDERS
+// environment variable or, if that is not set, in the client config. Login
+// arguments that override the provider config are applied.
+func (l *LoginCmd) configuredProviders() ([]config.ProviderConfig, error) {
+	var providerConfigs []config.ProviderConfig
+	providerConfigsEnv, err := config.ProvidersConfigFromEnv(l.getenv)
+	if err != nil {
+		return nil, fmt.Errorf("error getting provider config from env: %w", err)
+	}
+
+	if providerConfigsEnv != nil {
+		providerConfigs = providerConfigsEnv
+	} else if len(l.config.Providers) > 0 {
+		providerConfigs = l.config.Providers
+	} else {
+		return nil, fmt.Errorf("no providers specified")
+	}
+	providerConfigs = append([]config.ProviderConfig{}, providerConfigs...)
+	for i := range providerConfigs {
+		if err := l.applyProviderOverrides(&providerConfigs[i]); err != nil {
+			return nil, err
 		}
+	}
+	return providerConfigs, nil
+}
 
-		chooser := choosers.NewWebChooser(
-			providerList, openBrowser,
-		)
-		return nil, chooser, nil
+// applyProviderOverrides applies login arguments that override settings in
+// the provider config. With --auto-refresh the provider config is changed to
+// request a refresh token, failing before the user is sent to the provider
+// if it can not get one.
+func (l *LoginCmd) applyProviderOverrides(providerConfig *config.ProviderConfig) error {
+	if l.caBundleArg != "" {
+		providerConfig.CABundle = l.caBundleArg
+	}
+	if l.userAgentArg != "" {
+		providerConfig.UserAgent = l.userAgentArg
+	}
+	if l.hostedDomainArg != "" && strings.HasPrefix(providerConfig.Issuer, "https://accounts.google.com") {
+		providerConfig.HostedDomain = l.hostedDomainArg
 	}
+	if l.selectAccountArg {
+		providerConfig.Prompt = "select_account"
+	}
+	if l.autoRefreshArg {
+		if err := providerConfig.EnableRefresh(); err != nil {
+			return fmt.Errorf("error enabling auto-refresh: %w", err)
+		}
+	}
+	return nil
 }
 
 func (l *LoginCmd) login(ctx context.Context, provider providers.OpenIdProvider, printIdToken bool, seckeyPath string) (*LoginCmd, error) {
-	var err error
-	alg := jwa.ES256
-	signer, err := util.GenKeyPair(alg)
+	if l.signerArg != nil && l.addToAgentArg {
+		return nil, fmt.Errorf("the key of a custom signer can not be added to ssh-agent")
+	}
+	if l.signerArg != nil && seckeyPath == "" {
+		return nil, fmt.Errorf("a private key file path is required with a custom signer, the SSH cert is written to it with .pub appended")
+	}
+	if l.signerArg != nil && l.forceNewKeyArg {
+		return nil, fmt.Errorf("a new key can not be forced with a custom signer, its key is always the same")
+	}
+	signer, alg, err := l.loginSigner()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate keypair: %w", err)
+		return nil, err
+	}
+	if l.forceNewKeyArg {
+		if err := l.checkNewKey(signer, seckeyPath); err != nil {
+			return nil, err
+		}
+		if removed, err := l.removeOpkKeysFromAgent(); err != nil {
+			log.Printf("Warning: failed to remove previous opkssh keys from ssh-agent: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d previous opkssh key(s) from ssh-agent", removed)
+		}
 	}
 
+	if l.insecureSkipVerifyArg {
+		provider = insecureSkipIDTokenVerify(provider)
+	}
 	opkClient, err := client.New(provider, client.WithSigner(signer, alg))
 	if err != nil {
 		return nil, err
@@ -288,10 +1128,23 @@ func (l *LoginCmd) login(ctx context.Context, provider providers.OpenIdProvider,
 		return nil, err
 	}
 
-	// If principals is empty the server does not enforce any principal. The OPK
-	// verifier should use policy to make this decision.
-	principals := []string{}
-	certBytes, seckeySshPem, err := createSSHCert(pkt, signer, principals)
+	if l.requireEmailArg {
+		if err := checkVerifiedEmail(pkt); err != nil {
+			return nil, err
+		}
+	}
+
+	principals, err := l.certPrincipals(pkt)
+	if err != nil {
+		return nil, err
+	}
+	var certBytes, seckeySshPem []byte
+	if l.noCertArg {
+		// The plain public key is written where the SSH cert would be
+		certBytes, seckeySshPem, err = l.plainKey(signer)
+	} else {
+		certBytes, seckeySshPem, err = l.signSSHCert(pkt, signer, principals)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate SSH cert: %w", err)
 	}
@@ -299,57 +1152,181 @@ func (l *LoginCmd) login(ctx context.Context, provider providers.OpenIdProvider,
 	// Write ssh secret key and public key to filesystem
 	if seckeyPath != "" {
 		// If we have set seckeyPath then write it there
+		if l.noOverwriteArg {
+			for _, path := range []string{seckeyPath, seckeyPath + ".pub"} {
+				// Writing into a named pipe does not overwrite anything
+				if l.fileExists(path) && !isNamedPipe(l.Fs, path) {
+					return nil, fmt.Errorf("refusing to overwrite %s as --no-overwrite is set, use --private-key-file to write the key to a different path", path)
+				}
+			}
+		}
 		if err := l.writeKeys(seckeyPath, seckeyPath+".pub", seckeySshPem, certBytes); err != nil {
 			return nil, fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
 		}
 	} else {
 		// If keyPath isn't set then write it to the default location
-		if err := l.writeKeysToSSHDir(seckeySshPem, certBytes); err != nil {
+		seckeyPath, err = l.writeKeysToSSHDir(seckeySshPem, certBytes, !l.noOverwriteArg)
+		if err != nil {
 			return nil, fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
 		}
 	}
 
+	if l.noCertArg {
+		if err := l.writeRegistration(pkt, signer, seckeyPath); err != nil {
+			return nil, err
+		}
+	}
+	if l.outputDirArg != "" {
+		if err := l.writeOutputMetadata(pkt, principals); err != nil {
+			return nil, err
+		}
+	}
+	if l.addToAgentArg {
+		if err := l.addToAgent(signer, certBytes); err != nil {
+			log.Printf("Warning: failed to add SSH key to ssh-agent, ssh will read the key from disk instead: %v", err)
+		}
+	}
+
 	if printIdToken {
 		idTokenStr, err := PrettyIdToken(*pkt)
 
-		if err != nil {
-			return nil, fmt.Errorf("failed to format ID Token: %w", err)
-		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to format ID Token: %w", err)
+		}
+
+		fmt.Fprintf(l.stdout(), "id_token:\n%s\n", idTokenStr)
+	}
+	if l.claimsOutArg != "" {
+		if err := l.writeClaims(pkt); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.identityTemplateArg != "" {
+		idStr, err := renderIdentityTemplate(l.identityTemplateArg, pkt)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(l.stdout(), idStr)
+	} else {
+		idStr, err := IdentityStringForClaim(*pkt, l.identityClaimArg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ID Token: %w", err)
+		}
+		fmt.Fprintf(l.stdout(), "Keys generated for identity\n%s\n", idStr)
+	}
+
+	if l.printCertArg {
+		fmt.Fprintf(l.stdout(), "%s\n", l.sshPubkeyLine(certBytes))
+	}
+
+	if l.shellExportArg {
+		if err := l.writeShellExports(seckeyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return &LoginCmd{
+		pkt:        pkt,
+		signer:     signer,
+		client:     opkClient,
+		alg:        alg,
+		principals: principals,
+	}, nil
+}
+
+// Login performs the OIDC login procedure and creates the SSH certs/keys in the
+// default SSH key location.
+func (l *LoginCmd) Login(ctx context.Context, provider providers.OpenIdProvider, printIdToken bool, seckeyPath string) error {
+	loginResult, err := l.loginWithTimeout(ctx, provider, printIdToken, seckeyPath)
+	if err != nil {
+		return err
+	}
+	l.client = loginResult.client
+	return nil
+}
+
+// Client returns the OpenPubkey client used by the last successful login so
+// that embedders can perform further OpenPubkey operations, such as refreshing
+// the PK Token, with the authenticated session. It returns nil if no login has
+// succeeded.
+func (l *LoginCmd) Client() *client.OpkClient {
+	return l.client
+}
+
+// ErrRefreshSessionExpired is returned by LoginWithRefresh when the OP rejects
+// the refresh token because it expired or was revoked. Refreshing can not
+// recover from this, the user has to log in again interactively.
+var ErrRefreshSessionExpired = errors.New("refresh session expired or was revoked, log in again")
+
+// isRefreshSessionExpired returns true if err is the OP rejecting a refresh
+// token. OPs respond with invalid_grant to expired and revoked refresh tokens.
+func isRefreshSessionExpired(err error) bool {
+	var oidcErr *zoidc.Error
+	return errors.As(err, &oidcErr) && oidcErr.ErrorType == zoidc.InvalidGrant
+}
+
+const (
+	LoginTimeoutFail  = "fail"
+	LoginTimeoutRetry = "retry"
+)
+
+// Backoff between the login attempts of LoginTimeoutRetry, doubling from
+// loginRetryMinBackoff up to loginRetryMaxBackoff
+const (
+	loginRetryMinBackoff = 5 * time.Second
+	loginRetryMaxBackoff = 5 * time.Minute
+)
 
-		fmt.Printf("id_token:\n%s\n", idTokenStr)
+// loginWithTimeout performs an interactive login bounded by --login-timeout.
+// A login that times out returns an error wrapping context.DeadlineExceeded.
+func (l *LoginCmd) loginWithTimeout(ctx context.Context, provider providers.OpenIdProvider, printIdToken bool, seckeyPath string) (*LoginCmd, error) {
+	if l.loginTimeoutArg == 0 {
+		return l.login(ctx, provider, printIdToken, seckeyPath)
 	}
-
-	idStr, err := IdentityString(*pkt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse ID Token: %w", err)
+	loginCtx, cancel := context.WithTimeout(ctx, l.loginTimeoutArg)
+	defer cancel()
+	loginResult, err := l.login(loginCtx, provider, printIdToken, seckeyPath)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("login timed out after %s: %w", l.loginTimeoutArg, err)
 	}
-	fmt.Printf("Keys generated for identity\n%s\n", idStr)
-
-	return &LoginCmd{
-		pkt:        pkt,
-		signer:     signer,
-		client:     opkClient,
-		alg:        alg,
-		principals: principals,
-	}, nil
+	return loginResult, err
 }
 
-// Login performs the OIDC login procedure and creates the SSH certs/keys in the
-// default SSH key location.
-func (l *LoginCmd) Login(ctx context.Context, provider providers.OpenIdProvider, printIdToken bool, seckeyPath string) error {
-	_, err := l.login(ctx, provider, printIdToken, seckeyPath)
-	return err
+// initialLogin performs the first interactive login of LoginWithRefresh. With
+// LoginTimeoutRetry a login that times out is tried again, backing off between
+// attempts, until it succeeds, fails for another reason or ctx is done.
+func (l *LoginCmd) initialLogin(ctx context.Context, provider providers.OpenIdProvider, printIdToken bool, seckeyPath string) (*LoginCmd, error) {
+	backoff := l.loginRetryBackoff
+	if backoff == 0 {
+		backoff = loginRetryMinBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		loginResult, err := l.loginWithTimeout(ctx, provider, printIdToken, seckeyPath)
+		if err == nil || l.loginTimeoutBehavior != LoginTimeoutRetry || ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+			return loginResult, err
+		}
+		log.Printf("Warning: login attempt %d timed out, retrying in %s", attempt, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(2*backoff, loginRetryMaxBackoff)
+	}
 }
 
 // LoginWithRefresh performs the OIDC login procedure, creates the SSH
 // certs/keys in the default SSH key location, and continues to run and refresh
 // the PKT (and create new SSH certs) indefinitely as its token expires. This
 // function only returns if it encounters an error or if the supplied context is
-// cancelled.
+// cancelled. If the refresh token expires or is revoked the returned error
+// wraps ErrRefreshSessionExpired.
 func (l *LoginCmd) LoginWithRefresh(ctx context.Context, provider providers.RefreshableOpenIdProvider, printIdToken bool, seckeyPath string) error {
-	if loginResult, err := l.login(ctx, provider, printIdToken, seckeyPath); err != nil {
+	if loginResult, err := l.initialLogin(ctx, provider, printIdToken, seckeyPath); err != nil {
 		return err
 	} else {
+		l.client = loginResult.client
 		var claims struct {
 			Expiration int64 `json:"exp"`
 		}
@@ -357,25 +1334,31 @@ func (l *LoginCmd) LoginWithRefresh(ctx context.Context, provider providers.Refr
 			return err
 		}
 
+		refreshCount := 0
 		for {
-			// Sleep until a minute before expiration to give us time to refresh
-			// the token and minimize any interruptions
-			untilExpired := time.Until(time.Unix(claims.Expiration, 0)) - time.Minute
+			// Sleep until shortly before expiration, see refreshWait
+			untilExpired := l.refreshWait(time.Until(time.Unix(claims.Expiration, 0)))
 			log.Printf("Waiting for %v before attempting to refresh id_token...", untilExpired)
 			select {
 			case <-time.After(untilExpired):
 				log.Print("Refreshing id_token...")
 			case <-ctx.Done():
+				log.Print(refreshSummary(loginResult.pkt, refreshCount, claims.Expiration))
 				return ctx.Err()
 			}
 
 			refreshedPkt, err := loginResult.client.Refresh(ctx)
 			if err != nil {
+				if isRefreshSessionExpired(err) {
+					log.Print(refreshSummary(loginResult.pkt, refreshCount, claims.Expiration))
+					return fmt.Errorf("%w: %w", ErrRefreshSessionExpired, err)
+				}
 				return err
 			}
 			loginResult.pkt = refreshedPkt
+			refreshCount++
 
-			certBytes, seckeySshPem, err := createSSHCert(loginResult.pkt, loginResult.signer, loginResult.principals)
+			certBytes, seckeySshPem, err := l.signSSHCert(loginResult.pkt, loginResult.signer, loginResult.principals)
 			if err != nil {
 				return fmt.Errorf("failed to generate SSH cert: %w", err)
 			}
@@ -387,11 +1370,28 @@ func (l *LoginCmd) LoginWithRefresh(ctx context.Context, provider providers.Refr
 					return fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
 				}
 			} else {
-				// If keyPath isn't set then write it to the default location
-				if err := l.writeKeysToSSHDir(seckeySshPem, certBytes); err != nil {
+				// If keyPath isn't set then write it to the default location.
+				// The key being replaced is the one written by this login so
+				// it is always overwritten, even with --no-overwrite
+				if _, err := l.writeKeysToSSHDir(seckeySshPem, certBytes, true); err != nil {
 					return fmt.Errorf("failed to write SSH keys to filesystem: %w", err)
 				}
 			}
+			if l.outputDirArg != "" {
+				if err := l.writeOutputMetadata(loginResult.pkt, loginResult.principals); err != nil {
+					return err
+				}
+			}
+			if l.claimsOutArg != "" {
+				if err := l.writeClaims(loginResult.pkt); err != nil {
+					return err
+				}
+			}
+			if l.addToAgentArg {
+				if err := l.addToAgent(loginResult.signer, certBytes); err != nil {
+					log.Printf("Warning: failed to add SSH key to ssh-agent, ssh will read the key from disk instead: %v", err)
+				}
+			}
 
 			comPkt, err := refreshedPkt.Compact()
 			if err != nil {
@@ -414,108 +1414,541 @@ func (l *LoginCmd) LoginWithRefresh(ctx context.Context, provider providers.Refr
 	}
 }
 
-func createSSHCert(pkt *pktoken.PKToken, signer crypto.Signer, principals []string) ([]byte, []byte, error) {
-	cert, err := sshcert.New(pkt, principals)
+// certOptions returns the options used to customize the SSH cert
+func (l *LoginCmd) certOptions() []sshcert.CertOption {
+	certOpts := []sshcert.CertOption{}
+	if l.sourceAddressArg != "" {
+		certOpts = append(certOpts, sshcert.WithSourceAddress(l.sourceAddressArg))
+	}
+	for _, extension := range l.extensionsArg {
+		name, value, _ := strings.Cut(extension, "=")
+		certOpts = append(certOpts, sshcert.WithExtension(name, value))
+	}
+	return certOpts
+}
+
+// configKeyStore returns the KeyStore holding the key used to decrypt an
+// encrypted client config
+func (l *LoginCmd) configKeyStore() config.KeyStore {
+	if l.keyStore != nil {
+		return l.keyStore
+	}
+	return config.NewOSKeyStore()
+}
+
+// renewNeeded returns false if the opkssh key at keyPath, or at the default
+// SSH key paths if keyPath is empty, remains valid for longer than the renew
+// threshold. If there is no opkssh key a new one is needed.
+func (l *LoginCmd) renewNeeded(keyPath string) bool {
+	identity, err := findLocalIdentity(l.Fs, keyPath)
 	if err != nil {
-		return nil, nil, err
+		log.Printf("No current opkssh key to renew, logging in: %v", err)
+		return true
 	}
-	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	validUntil, err := identityValidUntil(identity, l.expirationPolicyArg)
 	if err != nil {
-		return nil, nil, err
+		log.Printf("Warning: failed to determine when opkssh key %s expires, logging in: %v", identity.PubkeyPath, err)
+		return true
+	}
+
+	now := time.Now
+	if l.now != nil {
+		now = l.now
 	}
+	remaining := validUntil.Sub(now())
+	if remaining > l.renewThresholdArg {
+		log.Printf("opkssh key %s is valid until %s (%s remaining), more than the renew threshold of %s, not logging in",
+			identity.PubkeyPath, validUntil.Format(time.RFC3339), remaining.Round(time.Second), l.renewThresholdArg)
+		return false
+	}
+	log.Printf("opkssh key %s expires at %s (in %s), within the renew threshold of %s, logging in",
+		identity.PubkeyPath, validUntil.Format(time.RFC3339), remaining.Round(time.Second), l.renewThresholdArg)
+	return true
+}
 
-	signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+// useDefaultConfig sets the client config to the default config embedded in
+// opkssh, for when there is no config file or it can not be read
+func (l *LoginCmd) useDefaultConfig() error {
+	var err error
+	l.config, err = config.NewClientConfig(config.DefaultClientConfig)
 	if err != nil {
-		return nil, nil, err
+		return fmt.Errorf("failed to parse default config file: %w", err)
+	}
+	return nil
+}
+
+// parseExtensionArg splits an SSH certificate extension supplied as
+// name=value into its name and value
+func parseExtensionArg(extension string) (string, string, error) {
+	name, value, ok := strings.Cut(extension, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid extension (%s), expected name=value", extension)
+	}
+	if err := sshcert.ValidateExtensionName(name); err != nil {
+		return "", "", err
+	}
+	return name, value, nil
+}
+
+// LoginWithReauth performs the OIDC login procedure and creates the SSH
+// certs/keys like Login, then repeats the full login a minute before each ID
+// Token expires. Unlike LoginWithRefresh it does not use refresh tokens, so it
+// works with OPs that do not issue them, but the user must log in again each
+// time. This function only returns if it encounters an error or if the
+// supplied context is cancelled.
+func (l *LoginCmd) LoginWithReauth(ctx context.Context, provider providers.OpenIdProvider, printIdToken bool, seckeyPath string) error {
+	loginResult, err := l.loginWithTimeout(ctx, provider, printIdToken, seckeyPath)
+	if err != nil {
+		return err
+	}
+	l.client = loginResult.client
+
+	// The keys replaced by later logins are the ones written by this login so
+	// they are always overwritten, even with --no-overwrite
+	reauthCmd := *l
+	reauthCmd.noOverwriteArg = false
+
+	reauthCount := 0
+	for {
+		var claims struct {
+			Expiration int64 `json:"exp"`
+		}
+		if err := json.Unmarshal(loginResult.pkt.Payload, &claims); err != nil {
+			return err
+		}
+
+		// Log in again a minute before expiration to minimize any
+		// interruptions
+		untilExpired := time.Until(time.Unix(claims.Expiration, 0)) - time.Minute
+		log.Printf("Waiting for %v before logging in again...", untilExpired)
+		select {
+		case <-time.After(untilExpired):
+		case <-ctx.Done():
+		}
+		// Checked after the select as both cases may be ready at once, e.g.
+		// when the context is cancelled during a login that returned an
+		// ID Token which is already about to expire
+		if ctx.Err() != nil {
+			expiresAt := time.Unix(claims.Expiration, 0)
+			log.Printf("Stopping reauth-on-expiry after %d re-login(s). The current id_token expires at %s (in %v), the SSH key written to disk remains usable until then unless the server's expiration policy is stricter.",
+				reauthCount, expiresAt.Format(time.RFC3339), time.Until(expiresAt).Round(time.Second))
+			return ctx.Err()
+		}
+		log.Print("id_token is about to expire, logging in again...")
+
+		if loginResult, err = reauthCmd.login(ctx, provider, printIdToken, seckeyPath); err != nil {
+			return err
+		}
+		l.client = loginResult.client
+		reauthCount++
+	}
+}
+
+// refreshWait returns how long to wait before refreshing an ID Token that
+// expires in untilExpiry. To give us time to refresh the token and minimize
+// any interruptions we refresh a minute before expiration, moved by a random
+// amount of up to --refresh-jitter either way. The wait is clamped so that it
+// is never negative and the refresh is never after expiry.
+func (l *LoginCmd) refreshWait(untilExpiry time.Duration) time.Duration {
+	wait := untilExpiry - time.Minute
+	if l.refreshJitterArg > 0 {
+		if l.rng == nil {
+			l.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		wait += time.Duration(l.rng.Int63n(2*int64(l.refreshJitterArg)+1)) - l.refreshJitterArg
+	}
+	if wait > untilExpiry {
+		wait = untilExpiry
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// refreshSummary describes the state of the auto-refresh loop when it stops so
+// the user knows how long the SSH key already written remains valid.
+func refreshSummary(pkt *pktoken.PKToken, refreshCount int, expiration int64) string {
+	identity := "unknown"
+	if idt, err := oidc.NewJwt(pkt.OpToken); err == nil {
+		claims := idt.GetClaims()
+		if claims.Email != "" {
+			identity = claims.Email + " (" + claims.Issuer + ")"
+		} else {
+			identity = claims.Subject + " (" + claims.Issuer + ")"
+		}
+	}
+	expiresAt := time.Unix(expiration, 0)
+	return fmt.Sprintf("Stopping auto-refresh after %d refresh(es). Last identity: %s. The current id_token expires at %s (in %v), the SSH key written to disk remains usable until then unless the server's expiration policy is stricter.",
+		refreshCount, identity, expiresAt.Format(time.RFC3339), time.Until(expiresAt).Round(time.Second))
+}
+
+// checkAllowedPrincipals returns an error if the client config sets
+// allowed_principals and a --principal is not one of them
+func (l *LoginCmd) checkAllowedPrincipals() error {
+	if len(l.config.AllowedPrincipals) == 0 {
+		return nil
+	}
+	for _, principal := range l.principalsArg {
+		if !slices.Contains(l.config.AllowedPrincipals, principal) {
+			return fmt.Errorf("refusing to request principal %q as it is not in allowed_principals in the client config (%s)", principal, strings.Join(l.config.AllowedPrincipals, ", "))
+		}
+	}
+	return nil
+}
+
+// certPrincipals returns the principals of the SSH cert for pkt. These are
+// the --principal args if given, otherwise the principal produced by the
+// default_principal template in the client config. If principals is empty
+// the server does not enforce any principal. The OPK verifier should use
+// policy to make this decision.
+func (l *LoginCmd) certPrincipals(pkt *pktoken.PKToken) ([]string, error) {
+	if len(l.principalsArg) > 0 {
+		return l.principalsArg, nil
+	}
+	if l.config == nil || l.config.DefaultPrincipal == "" {
+		return []string{}, nil
+	}
+	principal, err := principalFromTemplate(l.config.DefaultPrincipal, pkt)
+	if err != nil {
+		return nil, err
+	}
+	return []string{principal}, nil
+}
+
+func createSSHCert(pkt *pktoken.PKToken, signer ssh.Signer, principals []string, certOpts ...sshcert.CertOption) ([]byte, error) {
+	// Record the issuer in the key ID so that sshd's logs show which OP
+	// minted the cert on servers that accept several OPs
+	keyId, err := sshcert.IssuerKeyId(pkt)
+	if err != nil {
+		return nil, err
+	}
+	certOpts = append([]sshcert.CertOption{sshcert.WithKeyId(keyId)}, certOpts...)
+	cert, err := sshcert.New(pkt, principals, certOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("signer does not support choosing the signature algorithm")
+	}
+	var algorithms []string
+	switch signer.PublicKey().Type() {
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoED25519:
+		// A CA key set with --ca-key may be any of these types
+		algorithms = []string{signer.PublicKey().Type()}
+	case ssh.KeyAlgoRSA:
+		algorithms = []string{ssh.KeyAlgoRSASHA256}
+	default:
+		return nil, fmt.Errorf("unsupported SSH cert key type %s", signer.PublicKey().Type())
+	}
+	signerMas, err := ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+	if err != nil {
+		return nil, err
 	}
 
 	sshCert, err := cert.SignCert(signerMas)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	certBytes := ssh.MarshalAuthorizedKey(sshCert)
 	// Remove newline character that MarshalAuthorizedKey() adds
 	certBytes = certBytes[:len(certBytes)-1]
+	return certBytes, nil
+}
+
+// createSSHCertAndKey creates the SSH cert for pkt signed by signer, which
+// must be the key the PK Token commits to, and returns it along with the
+// private key to write next to it
+func createSSHCertAndKey(pkt *pktoken.PKToken, signer crypto.Signer, principals []string, certOpts ...sshcert.CertOption) ([]byte, []byte, error) {
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBytes, err := createSSHCert(pkt, sshSigner, principals, certOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	seckeySsh, err := ssh.MarshalPrivateKey(signer, "openpubkey cert")
+	seckeyPem, err := marshalPrivateKey(signer, KeyFormatOpenSSH)
 	if err != nil {
 		return nil, nil, err
 	}
-	seckeySshBytes := pem.EncodeToMemory(seckeySsh)
+	return certBytes, seckeyPem, nil
+}
+
+const (
+	KeyFormatOpenSSH = "openssh"
+	KeyFormatPKCS8   = "pkcs8"
+)
 
-	return certBytes, seckeySshBytes, nil
+func validateKeyFormat(format string) error {
+	switch format {
+	case KeyFormatOpenSSH, KeyFormatPKCS8:
+		return nil
+	default:
+		return fmt.Errorf("unknown key format %q, expected %s or %s", format, KeyFormatOpenSSH, KeyFormatPKCS8)
+	}
 }
 
-func (l *LoginCmd) writeKeysToSSHDir(seckeySshPem []byte, certBytes []byte) error {
-	homePath, err := os.UserHomeDir()
+// marshalPrivateKey PEM encodes the private key of signer in keyFormat
+func marshalPrivateKey(signer crypto.Signer, keyFormat string) ([]byte, error) {
+	switch keyFormat {
+	case KeyFormatOpenSSH, "":
+		seckeySsh, err := ssh.MarshalPrivateKey(signer, "openpubkey cert")
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(seckeySsh), nil
+	case KeyFormatPKCS8:
+		seckeyDer, err := x509.MarshalPKCS8PrivateKey(signer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal private key as PKCS#8: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: seckeyDer}), nil
+	default:
+		return nil, validateKeyFormat(keyFormat)
+	}
+}
+
+// signSSHCert creates the SSH cert for pkt and returns it along with the
+// private key in the format set with WithKeyFormat. A signer set with
+// WithSigner has no private key to return, so only the SSH cert is returned.
+func (l *LoginCmd) signSSHCert(pkt *pktoken.PKToken, signer crypto.Signer, principals []string) ([]byte, []byte, error) {
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	certSigner := sshSigner
+	if l.caSigner != nil {
+		certSigner = l.caSigner
+	}
+	certBytes, err := createSSHCert(pkt, certSigner, principals, l.certOptions()...)
+	if err != nil || l.signerArg != nil {
+		return certBytes, nil, err
+	}
+	seckeyPem, err := marshalPrivateKey(signer, l.keyFormatArg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certBytes, seckeyPem, nil
+}
+
+// loginSigner returns the key set with WithSigner or, by default, a newly
+// generated ECDSA key, along with the algorithm the PK Token is signed with
+func (l *LoginCmd) loginSigner() (crypto.Signer, jwa.SignatureAlgorithm, error) {
+	if l.signerArg == nil {
+		signer, err := util.GenKeyPair(jwa.ES256)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate keypair: %w", err)
+		}
+		return signer, jwa.ES256, nil
+	}
+	switch pubkey := l.signerArg.Public().(type) {
+	case *ecdsa.PublicKey:
+		if pubkey.Curve != elliptic.P256() {
+			return nil, "", fmt.Errorf("unsupported signer, ECDSA keys must use the P-256 curve")
+		}
+		return l.signerArg, jwa.ES256, nil
+	case *rsa.PublicKey:
+		return l.signerArg, jwa.RS256, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported signer key type %T, expected an ECDSA P-256 or RSA key", pubkey)
+	}
+}
+
+// checkNewKey returns an error if signer has the key of the opkssh cert that
+// the login would replace, i.e. the cert at seckeyPath or, if seckeyPath is
+// empty, the opkssh certs in the default SSH key paths
+func (l *LoginCmd) checkNewKey(signer crypto.Signer, seckeyPath string) error {
+	newKey, err := ssh.NewPublicKey(signer.Public())
 	if err != nil {
 		return err
 	}
+	pubkeyPaths := []string{seckeyPath + ".pub"}
+	if seckeyPath == "" {
+		homePath, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		pubkeyPaths = []string{filepath.Join(homePath, ".ssh", "id_ecdsa.pub"), filepath.Join(homePath, ".ssh", "id_ed25519.pub")}
+	}
+	for _, pubkeyPath := range pubkeyPaths {
+		if !l.fileExists(pubkeyPath) {
+			continue
+		}
+		pubkey, isOpk, err := readOpkPubkeyFile(l.Fs, pubkeyPath)
+		if err != nil || (seckeyPath == "" && !isOpk) {
+			continue
+		}
+		if cert, ok := pubkey.(*ssh.Certificate); ok {
+			pubkey = cert.Key
+		}
+		if bytes.Equal(pubkey.Marshal(), newKey.Marshal()) {
+			return fmt.Errorf("the generated key is the same as the key of the previous opkssh cert %s", pubkeyPath)
+		}
+	}
+	return nil
+}
+
+// writeKeysToSSHDir writes the keys to the first default SSH key path that is
+// free or holds a key generated by openpubkey and returns the path of the
+// private key. If overwrite is false, a key generated by openpubkey is never
+// replaced and an error is returned instead.
+func (l *LoginCmd) writeKeysToSSHDir(seckeySshPem []byte, certBytes []byte, overwrite bool) (string, error) {
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
 	sshPath := filepath.Join(homePath, ".ssh")
 
 	// Make ~/.ssh if folder does not exist
 	err = l.Fs.MkdirAll(sshPath, os.ModePerm)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// For ssh to automatically find the key created by openpubkey when
 	// connecting, we use one of the default ssh key paths. However, the file
 	// might contain an existing key. We will overwrite the key if it was
 	// generated by openpubkey  which we check by looking at the associated
-	// comment. If the comment is equal to "openpubkey", we overwrite the file
+	// comment. If the comment contains "openpubkey", we overwrite the file
 	// with a new key.
 	for _, keyFilename := range []string{"id_ecdsa", "id_ed25519"} {
 		seckeyPath := filepath.Join(sshPath, keyFilename)
 		pubkeyPath := seckeyPath + ".pub"
 
 		if !l.fileExists(seckeyPath) {
+			if !overwrite && l.fileExists(pubkeyPath) {
+				return "", fmt.Errorf("refusing to overwrite %s as --no-overwrite is set, use --private-key-file to write the key to a different path", pubkeyPath)
+			}
 			// If ssh key file does not currently exist, we don't have to worry about overwriting it
-			return l.writeKeys(seckeyPath, pubkeyPath, seckeySshPem, certBytes)
+			return seckeyPath, l.writeKeys(seckeyPath, pubkeyPath, seckeySshPem, certBytes)
 		} else if !l.fileExists(pubkeyPath) {
 			continue
 		} else {
 			// If the ssh key file does exist, check if it was generated by openpubkey, if it was then it is safe to overwrite
-			afs := &afero.Afero{Fs: l.Fs}
-			sshPubkey, err := afs.ReadFile(pubkeyPath)
-			if err != nil {
-				log.Println("Failed to read:", pubkeyPath)
-				continue
-			}
-			_, comment, _, _, err := ssh.ParseAuthorizedKey(sshPubkey)
+			_, isOpk, err := readOpkPubkeyFile(l.Fs, pubkeyPath)
 			if err != nil {
-				log.Println("Failed to parse:", pubkeyPath)
+				log.Println(err)
 				continue
 			}
-
-			// If the key comment is "openpubkey" then we generated it
-			if comment == "openpubkey" {
-				return l.writeKeys(seckeyPath, pubkeyPath, seckeySshPem, certBytes)
+			if isOpk {
+				if !overwrite {
+					return "", fmt.Errorf("refusing to overwrite existing opkssh key %s as --no-overwrite is set, use --private-key-file to write the key to a different path", seckeyPath)
+				}
+				return seckeyPath, l.writeKeys(seckeyPath, pubkeyPath, seckeySshPem, certBytes)
 			}
 		}
 	}
-	return fmt.Errorf("no default ssh key file free for openpubkey")
+	return "", fmt.Errorf("no default ssh key file free for openpubkey")
 }
 
+// writeKeys writes the SSH secret key and public key (certificate). Each file
+// is replaced atomically so that ssh, or anything else reading the keys while
+// they are refreshed, never sees a partially written file. If seckeyPath is a
+// named pipe (FIFO) the secret key is written into it instead, so that it is
+// handed to the reader without ever being stored in a file.
 func (l *LoginCmd) writeKeys(seckeyPath string, pubkeyPath string, seckeySshPem []byte, certBytes []byte) error {
+	// A key set with WithSigner, e.g. held in an HSM, has no secret key to write
+	if seckeySshPem == nil {
+		fmt.Fprintf(l.stdout(), "Writing opk ssh certificate to %s\n", pubkeyPath)
+		return writeFileAtomic(l.Fs, pubkeyPath, l.sshPubkeyLine(certBytes), 0644)
+	}
+
 	// Write ssh secret key to filesystem
-	afs := &afero.Afero{Fs: l.Fs}
-	if err := afs.WriteFile(seckeyPath, seckeySshPem, 0600); err != nil {
+	if isNamedPipe(l.Fs, seckeyPath) {
+		if err := writeNamedPipe(l.Fs, seckeyPath, seckeySshPem); err != nil {
+			return err
+		}
+	} else if err := writeFileAtomic(l.Fs, seckeyPath, seckeySshPem, 0600); err != nil {
 		return err
 	}
 
-	fmt.Printf("Writing opk ssh public key to %s and corresponding secret key to %s\n", pubkeyPath, seckeyPath)
+	fmt.Fprintf(l.stdout(), "Writing opk ssh public key to %s and corresponding secret key to %s\n", pubkeyPath, seckeyPath)
 
-	certBytes = append(certBytes, []byte(" openpubkey")...)
 	// Write ssh public key (certificate) to filesystem
-	return afs.WriteFile(pubkeyPath, certBytes, 0644)
+	return writeFileAtomic(l.Fs, pubkeyPath, l.sshPubkeyLine(certBytes), 0644)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path and then renames it over path
+func writeFileAtomic(fs afero.Fs, path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := afero.TempFile(fs, filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	if err := fs.Chmod(tmpPath, perm); err != nil {
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	if err := fs.Rename(tmpPath, path); err != nil {
+		_ = fs.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// isNamedPipe returns true if path is a named pipe (FIFO)
+func isNamedPipe(fs afero.Fs, path string) bool {
+	info, err := fs.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// writeNamedPipe writes data into the named pipe at path. Opening the pipe
+// blocks until a reader opens the other end, so the reader must be ready
+// before login writes the key. A pipe can't be replaced atomically or
+// truncated, the reader receives data as a single write.
+func writeNamedPipe(fs afero.Fs, path string, data []byte) error {
+	pipe, err := fs.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := pipe.Write(data); err != nil {
+		pipe.Close()
+		return err
+	}
+	return pipe.Close()
+}
+
+// sshPubkeyLine returns the line written to the SSH public key file for the
+// cert, which is the cert in authorized_keys format followed by the comment
+// that marks it as generated by openpubkey
+func (l *LoginCmd) sshPubkeyLine(certBytes []byte) []byte {
+	return append(append([]byte{}, certBytes...), []byte(" "+l.keyComment())...)
+}
+
+// keyComment returns the comment set on the SSH keys written to disk and
+// added to ssh-agent, which is --cert-comment-prefix if set
+func (l *LoginCmd) keyComment() string {
+	if l.certCommentPrefixArg != "" {
+		return l.certCommentPrefixArg
+	}
+	return openpubkeyKeyComment
 }
 
 func (l *LoginCmd) fileExists(fPath string) bool {
-	_, err := l.Fs.Open(fPath)
+	// Stat rather than Open, as opening a named pipe blocks until it has a
+	// writer
+	_, err := l.Fs.Stat(fPath)
 	return !errors.Is(err, os.ErrNotExist)
 }
 
+// IdentityString returns the identity in pkt as printed after login. ID
+// Tokens without an email claim can only be matched by a policy on their
+// sub, so the identity is labelled as such and the name claim, if any, is
+// shown to help recognise the account.
 func IdentityString(pkt pktoken.PKToken) (string, error) {
 	idt, err := oidc.NewJwt(pkt.OpToken)
 	if err != nil {
@@ -523,12 +1956,136 @@ func IdentityString(pkt pktoken.PKToken) (string, error) {
 	}
 	claims := idt.GetClaims()
 	if claims.Email == "" {
-		return "Sub, issuer, audience: \n" + claims.Subject + " " + claims.Issuer + " " + claims.Audience, nil
+		idStr := "Sub, issuer, audience (no email claim, policies must use the sub): \n" + claims.Subject + " " + claims.Issuer + " " + claims.Audience
+		if name := nameClaim(pkt); name != "" {
+			idStr += "\nName: " + name
+		}
+		return idStr, nil
 	} else {
 		return "Email, sub, issuer, audience: \n" + claims.Email + " " + claims.Subject + " " + claims.Issuer + " " + claims.Audience, nil
 	}
 }
 
+// nameClaim returns the name claim of the ID Token in pkt, or an empty
+// string if it has none
+func nameClaim(pkt pktoken.PKToken) string {
+	var claims struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Name
+}
+
+// checkVerifiedEmail returns an error if the ID Token of pkt does not have
+// an email claim with email_verified set to true. Some OPs send
+// email_verified as a string.
+func checkVerifiedEmail(pkt *pktoken.PKToken) error {
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified any    `json:"email_verified"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return fmt.Errorf("failed to parse ID Token claims: %w", err)
+	}
+	if claims.Email == "" {
+		return fmt.Errorf("the ID Token has no email claim and --require-email is set, check that the provider's scopes include email")
+	}
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = strings.EqualFold(v, "true")
+	}
+	if !verified {
+		return fmt.Errorf("the email %s in the ID Token is not verified (email_verified is not true) and --require-email is set", claims.Email)
+	}
+	return nil
+}
+
+// IdentityStringForClaim is IdentityString but shows the value of claim, such
+// as preferred_username, in place of the email. This is the identity that
+// servers running opkssh verify with --identity-claim match policies against.
+func IdentityStringForClaim(pkt pktoken.PKToken, claim string) (string, error) {
+	if claim == "" {
+		return IdentityString(pkt)
+	}
+	idt, err := oidc.NewJwt(pkt.OpToken)
+	if err != nil {
+		return "", err
+	}
+	claims := idt.GetClaims()
+	var rawClaims map[string]any
+	if err := json.Unmarshal(pkt.Payload, &rawClaims); err != nil {
+		return "", fmt.Errorf("failed to parse ID Token claims: %w", err)
+	}
+	value, _ := rawClaims[claim].(string)
+	if value == "" {
+		return "Sub, issuer, audience (no " + claim + " claim): \n" + claims.Subject + " " + claims.Issuer + " " + claims.Audience, nil
+	}
+	return claim + ", sub, issuer, audience: \n" + value + " " + claims.Subject + " " + claims.Issuer + " " + claims.Audience, nil
+}
+
+// parseIdentityTemplate parses an --identity-template. So that a template
+// using a field LocalIdentity does not have is caught before the user is sent
+// to the OP, the template is also executed on an empty LocalIdentity.
+func parseIdentityTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("identity").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --identity-template: %w", err)
+	}
+	if err := t.Execute(io.Discard, LocalIdentity{}); err != nil {
+		return nil, fmt.Errorf("invalid --identity-template: %w", err)
+	}
+	return t, nil
+}
+
+// renderIdentityTemplate executes the --identity-template tmpl on the
+// identity in pkt
+func renderIdentityTemplate(tmpl string, pkt *pktoken.PKToken) (string, error) {
+	t, err := parseIdentityTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	identity, err := newLocalIdentityFromPKT(pkt)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse ID Token: %w", err)
+	}
+	var sb strings.Builder
+	if err := t.Execute(&sb, identity); err != nil {
+		return "", fmt.Errorf("failed to apply --identity-template: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// IdTokenClaims returns every claim in the ID Token of pkt, including the
+// claims oidc.OidcClaims has no field for
+func IdTokenClaims(pkt pktoken.PKToken) (map[string]any, error) {
+	var claims map[string]any
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse ID Token claims: %w", err)
+	}
+	return claims, nil
+}
+
+// writeClaims writes every claim in the ID Token to --claims-out
+func (l *LoginCmd) writeClaims(pkt *pktoken.PKToken) error {
+	claims, err := IdTokenClaims(*pkt)
+	if err != nil {
+		return err
+	}
+	claimsJson, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.Fs, l.claimsOutArg, append(claimsJson, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write ID Token claims to %s: %w", l.claimsOutArg, err)
+	}
+	return nil
+}
+
 func PrettyIdToken(pkt pktoken.PKToken) (string, error) {
 	idt, err := oidc.NewJwt(pkt.OpToken)
 	if err != nil {
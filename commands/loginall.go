@@ -0,0 +1,177 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/openpubkey/openpubkey/providers"
+)
+
+// DefaultLoginConcurrency is the number of providers logged in to at once
+// when logging in to multiple providers, kept low to avoid OP rate limits
+const DefaultLoginConcurrency = 4
+
+// AliasedProvider is an OpenID Provider along with the alias it is configured
+// under. The alias is used to name the SSH key generated for the provider.
+type AliasedProvider struct {
+	Alias    string
+	Provider providers.OpenIdProvider
+}
+
+// LoginResult is the outcome of logging in to a single provider
+type LoginResult struct {
+	Alias string
+	// SeckeyPath is the path the SSH private key was written to
+	SeckeyPath string
+	Err        error
+}
+
+// allProvidersKeyPath returns the path of the SSH private key written for
+// the provider with the given alias when logging in to all providers
+func allProvidersKeyPath(sshPath string, alias string) string {
+	return filepath.Join(sshPath, "opkssh_"+alias)
+}
+
+// runAllProviders logs in to every configured provider and writes a key per
+// provider to ~/.ssh/opkssh_<alias>
+func (l *LoginCmd) runAllProviders(ctx context.Context) error {
+	if l.providerArg != "" || l.providerAliasArg != "" || len(l.providerAliasesArg) > 0 {
+		return fmt.Errorf("--all-providers can not be used with --provider or a provider alias")
+	}
+	if l.keyPathArg != "" {
+		return fmt.Errorf("--all-providers can not be used with --key-path, keys are written to ~/.ssh/opkssh_<alias>")
+	}
+	if l.autoRefreshArg {
+		return fmt.Errorf("--all-providers can not be used with --auto-refresh")
+	}
+	if l.reauthOnExpiryArg {
+		return fmt.Errorf("--all-providers can not be used with --reauth-on-expiry")
+	}
+	if l.concurrencyArg < 0 {
+		return fmt.Errorf("--concurrency can not be negative, got %d", l.concurrencyArg)
+	}
+
+	providerConfigs, err := l.configuredProviders()
+	if err != nil {
+		return err
+	}
+	openBrowser := !l.disableBrowserOpenArg
+	ops := []AliasedProvider{}
+	for _, providerConfig := range providerConfigs {
+		if len(providerConfig.AliasList) == 0 {
+			return fmt.Errorf("provider %s has no alias", providerConfig.Issuer)
+		}
+		op, err := providerConfig.ToProvider(openBrowser)
+		if err != nil {
+			return fmt.Errorf("error creating provider from config: %w", err)
+		}
+		ops = append(ops, AliasedProvider{Alias: providerConfig.AliasList[0], Provider: op})
+	}
+
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	results := l.LoginAllProviders(ctx, ops, filepath.Join(homePath, ".ssh"))
+
+	fmt.Print(formatLoginResults(results))
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to login to %d of %d providers", failed, len(results))
+	}
+	return nil
+}
+
+// LoginAllProviders logs in to each of the supplied providers and writes the
+// SSH keys for each provider to sshPath/opkssh_<alias>. Providers that
+// require the user to login in a browser are run one at a time, since they
+// compete for the browser and the redirect URI ports. All other providers are
+// run concurrently. No more than the configured concurrency of logins, browser
+// or otherwise, run at once. A result is returned for each provider in the
+// order the providers were supplied.
+func (l *LoginCmd) LoginAllProviders(ctx context.Context, ops []AliasedProvider, sshPath string) []LoginResult {
+	results := make([]LoginResult, len(ops))
+	if err := l.Fs.MkdirAll(sshPath, os.ModePerm); err != nil {
+		for i, op := range ops {
+			results[i] = LoginResult{Alias: op.Alias, Err: err}
+		}
+		return results
+	}
+
+	concurrency := l.concurrencyArg
+	if concurrency == 0 {
+		concurrency = DefaultLoginConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	loginOne := func(i int) {
+		sem <- struct{}{}
+		defer func() { <-sem }()
+		seckeyPath := allProvidersKeyPath(sshPath, ops[i].Alias)
+		results[i] = LoginResult{Alias: ops[i].Alias, SeckeyPath: seckeyPath}
+		_, results[i].Err = l.login(ctx, ops[i].Provider, l.printIdTokenArg, seckeyPath)
+	}
+
+	var wg sync.WaitGroup
+	for i, op := range ops {
+		if _, ok := op.Provider.(providers.BrowserOpenIdProvider); !ok {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				loginOne(i)
+			}(i)
+		}
+	}
+	for i, op := range ops {
+		if _, ok := op.Provider.(providers.BrowserOpenIdProvider); ok {
+			if ctx.Err() != nil {
+				results[i] = LoginResult{Alias: op.Alias, Err: ctx.Err()}
+				continue
+			}
+			log.Printf("Logging in to %s (%s), complete the login in your browser\n", op.Alias, op.Provider.Issuer())
+			loginOne(i)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// formatLoginResults summarizes the outcome of logging in to each provider
+func formatLoginResults(results []LoginResult) string {
+	var sb strings.Builder
+	sb.WriteString("Login results:\n")
+	for _, result := range results {
+		if result.Err != nil {
+			sb.WriteString(fmt.Sprintf("  %s: failed: %v\n", result.Alias, result.Err))
+		} else {
+			sb.WriteString(fmt.Sprintf("  %s: success, key written to %s\n", result.Alias, result.SeckeyPath))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,135 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/opkssh/commands/config"
+)
+
+// callbackIdleTimeout is how long a connection to the localhost servers
+// opkssh runs during login, the callback server, the web chooser and the
+// loopback bridge, may sit idle before it is closed, so that an abandoned
+// browser or a stalled connection can't hold on to them
+const callbackIdleTimeout = config.CallbackIdleTimeout
+
+// loopbackPairs are the loopback addresses the login callback listener may
+// be bound to, each paired with the other loopback address
+var loopbackPairs = [][2]string{
+	{"127.0.0.1", "::1"},
+	{"::1", "127.0.0.1"},
+}
+
+// bridgeLoopback makes the login callback listener on port reachable on both
+// loopback addresses. The provider binds its callback listener to localhost,
+// which is only one of 127.0.0.1 and ::1, while the browser may resolve the
+// localhost redirect URI to the other. bridgeLoopback listens on port on the
+// loopback address the callback listener is not bound to and forwards
+// connections to it. The bridge is closed when ctx is done or when the
+// callback listener has gone away, and bridged connections are closed once
+// nothing has been sent in either direction for idleTimeout.
+func bridgeLoopback(ctx context.Context, port string, idleTimeout time.Duration) (net.Listener, error) {
+	for _, pair := range loopbackPairs {
+		listenAddr := net.JoinHostPort(pair[0], port)
+		targetAddr := net.JoinHostPort(pair[1], port)
+		ln, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			// Either the callback listener is bound here or this loopback
+			// address is not available on this host
+			continue
+		}
+		probe, err := net.Dial("tcp", targetAddr)
+		if err != nil {
+			ln.Close()
+			continue
+		}
+		probe.Close()
+
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		go forwardLoopback(ln, targetAddr, idleTimeout)
+		return ln, nil
+	}
+	return nil, fmt.Errorf("no loopback address to bridge to port %s", port)
+}
+
+// forwardLoopback forwards each connection accepted by ln to targetAddr until
+// ln is closed or targetAddr stops accepting connections
+func forwardLoopback(ln net.Listener, targetAddr string, idleTimeout time.Duration) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		target, err := net.Dial("tcp", targetAddr)
+		if err != nil {
+			// The login is over and the callback listener has been shut down
+			conn.Close()
+			return
+		}
+		go func() {
+			// Both directions share one idle timer. Once the browser has sent
+			// its request it sends nothing more while the callback works on
+			// the response, so only a connection idle both ways is closed.
+			idle := time.AfterFunc(idleTimeout, func() {
+				conn.Close()
+				target.Close()
+			})
+			defer idle.Stop()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			pipe := func(dst net.Conn, src net.Conn) {
+				defer wg.Done()
+				// Copy errors just mean one side hung up or went idle
+				_, _ = io.Copy(dst, activityReader{Reader: src, idle: idle, timeout: idleTimeout})
+				// Let the other side see the end of the stream
+				if tcpConn, ok := dst.(*net.TCPConn); ok {
+					_ = tcpConn.CloseWrite()
+				}
+			}
+			go pipe(target, conn)
+			go pipe(conn, target)
+			wg.Wait()
+			conn.Close()
+			target.Close()
+		}()
+	}
+}
+
+// activityReader restarts the idle timer each time data is read
+type activityReader struct {
+	io.Reader
+	idle    *time.Timer
+	timeout time.Duration
+}
+
+func (r activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.idle.Reset(r.timeout)
+	}
+	return n, err
+}
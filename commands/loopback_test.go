@@ -0,0 +1,179 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// listenLoopback starts an HTTP server, standing in for the provider's
+// callback listener, on host and returns its port
+func listenLoopback(t *testing.T, host string) string {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("loopback address %s is not available: %v", host, err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "callback %s", r.URL.Path)
+	})}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { server.Close() })
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+	return port
+}
+
+func getBody(t *testing.T, url string) string {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestBridgeLoopback(t *testing.T) {
+	tests := []struct {
+		name       string
+		listenHost string
+		bridgeHost string
+	}{
+		// localhost resolves to ::1 only, but the browser uses 127.0.0.1
+		{name: "Callback on IPv6 loopback", listenHost: "::1", bridgeHost: "127.0.0.1"},
+		// The browser prefers ::1 for localhost
+		{name: "Callback on IPv4 loopback", listenHost: "127.0.0.1", bridgeHost: "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := listenLoopback(t, tt.listenHost)
+			if ln, err := net.Listen("tcp", net.JoinHostPort(tt.bridgeHost, "0")); err != nil {
+				t.Skipf("loopback address %s is not available: %v", tt.bridgeHost, err)
+			} else {
+				ln.Close()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			bridge, err := bridgeLoopback(ctx, port, callbackIdleTimeout)
+			require.NoError(t, err)
+			require.Equal(t, net.JoinHostPort(tt.bridgeHost, port), bridge.Addr().String())
+
+			bridgedURL := "http://" + net.JoinHostPort(tt.bridgeHost, port) + "/login-callback"
+			require.Equal(t, "callback /login-callback", getBody(t, bridgedURL))
+			require.Equal(t, "callback /login-callback", getBody(t, "http://"+net.JoinHostPort(tt.listenHost, port)+"/login-callback"))
+
+			// The bridge stops when the login is over
+			cancel()
+			require.Eventually(t, func() bool {
+				ln, err := net.Listen("tcp", net.JoinHostPort(tt.bridgeHost, port))
+				if err != nil {
+					return false
+				}
+				ln.Close()
+				return true
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestBridgeLoopbackNoCallbackListener(t *testing.T) {
+	// Find a port nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+	ln.Close()
+
+	_, err = bridgeLoopback(context.Background(), port, callbackIdleTimeout)
+	require.ErrorContains(t, err, "no loopback address to bridge to port "+port)
+}
+
+func TestBridgeLoopbackIdleTimeout(t *testing.T) {
+	port := listenLoopback(t, "::1")
+	bridgeAddr := net.JoinHostPort("127.0.0.1", port)
+	if ln, err := net.Listen("tcp", bridgeAddr); err != nil {
+		t.Skipf("loopback address 127.0.0.1 is not available: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := bridgeLoopback(ctx, port, 100*time.Millisecond)
+	require.NoError(t, err)
+
+	// Connect to the callback port and hold the connection open without
+	// sending anything
+	conn, err := net.Dial("tcp", bridgeAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF, "expected the bridge to close the idle connection")
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// The bridge still accepts new connections
+	require.Equal(t, "callback /login-callback", getBody(t, "http://"+bridgeAddr+"/login-callback"))
+}
+
+func TestBridgeLoopbackSlowResponse(t *testing.T) {
+	// A response that takes longer than the idle timeout, while the browser
+	// sends nothing more, is not cut off as long as it keeps arriving
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("loopback address ::1 is not available: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(60 * time.Millisecond):
+			}
+			fmt.Fprintf(w, "%d", i)
+			w.(http.Flusher).Flush()
+		}
+	})}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { server.Close() })
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+
+	bridgeAddr := net.JoinHostPort("127.0.0.1", port)
+	if ln, err := net.Listen("tcp", bridgeAddr); err != nil {
+		t.Skipf("loopback address 127.0.0.1 is not available: %v", err)
+	} else {
+		ln.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = bridgeLoopback(ctx, port, 100*time.Millisecond)
+	require.NoError(t, err)
+
+	require.Equal(t, "01234", getBody(t, "http://"+bridgeAddr+"/login-callback"))
+}
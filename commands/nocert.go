@@ -0,0 +1,87 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// noCertRegistrationSuffix is appended to the private key path to get the
+// path the registration of a --no-cert key is written to
+const noCertRegistrationSuffix = ".registration"
+
+// plainKey returns the public key of signer in authorized_keys format, which
+// --no-cert writes in place of the SSH cert, and the secret key to write
+func (l *LoginCmd) plainKey(signer crypto.Signer) ([]byte, []byte, error) {
+	sshPubkey, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	pubkeyBytes := bytes.TrimSpace(ssh.MarshalAuthorizedKey(sshPubkey))
+	if l.signerArg != nil {
+		return pubkeyBytes, nil, nil
+	}
+	seckeyPem, err := marshalPrivateKey(signer, l.keyFormatArg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pubkeyBytes, seckeyPem, nil
+}
+
+// registrationLine returns the registration of a --no-cert key: the SHA256
+// fingerprint of the key followed by the identity and issuer of the ID Token,
+// in the order opkssh add takes them. The identity is the email, or the sub
+// if the ID Token has no email claim.
+func registrationLine(pkt *pktoken.PKToken, sshPubkey ssh.PublicKey) (string, error) {
+	idt, err := oidc.NewJwt(pkt.OpToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse ID Token: %w", err)
+	}
+	claims := idt.GetClaims()
+	identity := claims.Email
+	if identity == "" {
+		identity = claims.Subject
+	}
+	return ssh.FingerprintSHA256(sshPubkey) + " " + identity + " " + claims.Issuer, nil
+}
+
+// writeRegistration writes the registration of the --no-cert key of signer
+// next to the private key at seckeyPath and prints it
+func (l *LoginCmd) writeRegistration(pkt *pktoken.PKToken, signer crypto.Signer, seckeyPath string) error {
+	sshPubkey, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	line, err := registrationLine(pkt, sshPubkey)
+	if err != nil {
+		return err
+	}
+	registrationPath := seckeyPath + noCertRegistrationSuffix
+	fmt.Fprintf(l.stdout(), "Writing key registration to %s\n", registrationPath)
+	if err := afero.WriteFile(l.Fs, registrationPath, []byte(line+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write key registration: %w", err)
+	}
+	fmt.Fprintf(l.stdout(), "Register the key for %s with:\n%s\n", seckeyPath+".pub", line)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/openpubkey/openpubkey/oidc"
+	"github.com/openpubkey/openpubkey/pktoken"
+)
+
+const (
+	// outputDirKeyName is the name of the private key written to --output-dir.
+	// The cert is written next to it with a .pub suffix.
+	outputDirKeyName = "id_ecdsa"
+	// outputDirMetadataName is the name of the metadata file written to --output-dir
+	outputDirMetadataName = "metadata.json"
+)
+
+// loginMetadata describes the key and cert written to --output-dir so that
+// they can be archived or handed off without parsing the cert
+type loginMetadata struct {
+	PrivateKeyFile string   `json:"private_key_file"`
+	CertFile       string   `json:"cert_file"`
+	Email          string   `json:"email,omitempty"`
+	Subject        string   `json:"sub"`
+	Issuer         string   `json:"issuer"`
+	Audience       string   `json:"aud"`
+	Principals     []string `json:"principals"`
+	// IssuedAt and ExpiresAt are from the ID Token. Servers may consider the
+	// key expired earlier depending on their expiration policy.
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// prepareOutputDir creates the --output-dir directory, readable only by the
+// user, and returns the path of the private key to write in it
+func (l *LoginCmd) prepareOutputDir() (string, error) {
+	if err := l.Fs.MkdirAll(l.outputDirArg, 0700); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	// MkdirAll leaves the permissions of an existing directory unchanged
+	if err := l.Fs.Chmod(l.outputDirArg, 0700); err != nil {
+		return "", fmt.Errorf("failed to set permissions on output directory: %w", err)
+	}
+	return filepath.Join(l.outputDirArg, outputDirKeyName), nil
+}
+
+// writeOutputMetadata writes metadata.json describing the identity, issuer,
+// principals and expiry of the key written to --output-dir
+func (l *LoginCmd) writeOutputMetadata(pkt *pktoken.PKToken, principals []string) error {
+	idt, err := oidc.NewJwt(pkt.OpToken)
+	if err != nil {
+		return fmt.Errorf("failed to parse ID Token: %w", err)
+	}
+	claims := idt.GetClaims()
+	if principals == nil {
+		principals = []string{}
+	}
+	metadata := loginMetadata{
+		PrivateKeyFile: outputDirKeyName,
+		CertFile:       outputDirKeyName + ".pub",
+		Email:          claims.Email,
+		Subject:        claims.Subject,
+		Issuer:         claims.Issuer,
+		Audience:       claims.Audience,
+		Principals:     principals,
+		IssuedAt:       time.Unix(claims.IssuedAt, 0).UTC(),
+		ExpiresAt:      time.Unix(claims.Expiration, 0).UTC(),
+	}
+	metadataJson, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	metadataPath := filepath.Join(l.outputDirArg, outputDirMetadataName)
+	if err := writeFileAtomic(l.Fs, metadataPath, append(metadataJson, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", metadataPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoginCmdOutputDir(t *testing.T) {
+	_, _, mockOp := Mocks(t)
+	outputDir := filepath.Join("/handoff", "alice")
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{
+		Fs:                    mockFs,
+		outputDirArg:          outputDir,
+		principalsArg:         []string{"alice"},
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+
+	requirePerm := func(path string, perm os.FileMode) {
+		fi, err := mockFs.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, perm, fi.Mode().Perm(), "unexpected permissions on %s", path)
+	}
+	requirePerm(outputDir, 0700)
+	requirePerm(filepath.Join(outputDir, "id_ecdsa"), 0600)
+	requirePerm(filepath.Join(outputDir, "id_ecdsa.pub"), 0644)
+	requirePerm(filepath.Join(outputDir, "metadata.json"), 0644)
+
+	seckeyBytes, err := afero.ReadFile(mockFs, filepath.Join(outputDir, "id_ecdsa"))
+	require.NoError(t, err)
+	seckey, err := ssh.ParseRawPrivateKey(seckeyBytes)
+	require.NoError(t, err)
+
+	pubkeyBytes, err := afero.ReadFile(mockFs, filepath.Join(outputDir, "id_ecdsa.pub"))
+	require.NoError(t, err)
+	pubkey, comment, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
+	require.NoError(t, err)
+	require.Equal(t, openpubkeyKeyComment, comment)
+	cert, ok := pubkey.(*ssh.Certificate)
+	require.True(t, ok, "expected an SSH cert")
+	require.Equal(t, []string{"alice"}, cert.ValidPrincipals)
+
+	// The cert is for the private key written next to it
+	signer, err := ssh.NewSignerFromKey(seckey)
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey().Marshal(), cert.Key.Marshal())
+
+	metadataBytes, err := afero.ReadFile(mockFs, filepath.Join(outputDir, "metadata.json"))
+	require.NoError(t, err)
+	var metadata loginMetadata
+	require.NoError(t, json.Unmarshal(metadataBytes, &metadata))
+	identity, err := newLocalIdentity(pubkey)
+	require.NoError(t, err)
+	require.Equal(t, loginMetadata{
+		PrivateKeyFile: "id_ecdsa",
+		CertFile:       "id_ecdsa.pub",
+		Email:          "arthur.aardvark@example.com",
+		Subject:        "me",
+		Issuer:         "https://accounts.example.com",
+		Audience:       identity.Audience,
+		Principals:     []string{"alice"},
+		IssuedAt:       identity.IssuedAt.UTC(),
+		ExpiresAt:      identity.ExpiresAt.UTC(),
+	}, metadata)
+
+	// Nothing is written to ~/.ssh
+	homePath, err := os.UserHomeDir()
+	require.NoError(t, err)
+	_, err = mockFs.Stat(filepath.Join(homePath, ".ssh"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// An existing directory is made readable only by the user
+	mockFs = afero.NewMemMapFs()
+	require.NoError(t, mockFs.MkdirAll(outputDir, 0755))
+	loginCmd = LoginCmd{
+		Fs:                    mockFs,
+		outputDirArg:          outputDir,
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+	requirePerm(outputDir, 0700)
+	metadataBytes, err = afero.ReadFile(mockFs, filepath.Join(outputDir, "metadata.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(metadataBytes), `"principals": []`)
+
+	loginCmd = LoginCmd{
+		Fs:           afero.NewMemMapFs(),
+		outputDirArg: outputDir,
+		keyPathArg:   "/keys/opkssh",
+	}
+	require.ErrorContains(t, loginCmd.Run(context.Background()), "--output-dir can not be used with --private-key-file")
+}
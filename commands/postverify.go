@@ -0,0 +1,95 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// commandStarter starts command, the program followed by its arguments, with
+// the environment env without waiting for it to exit
+type commandStarter func(command []string, env []string) error
+
+// startDetached starts command with env and does not wait for it. Its output
+// is discarded rather than inherited, as sshd waits for the output of verify
+// to be closed before it continues. The exit status is only logged if the
+// process is still running when the command exits, as the verify daemon is.
+func startDetached(command []string, env []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("post_verify_command %s failed: %v\n", command[0], err)
+		}
+	}()
+	return nil
+}
+
+// postVerifyEnv returns the environment variables describing the accepted
+// login that post_verify_command is run with
+func postVerifyEnv(result *VerifyResult, principal string) []string {
+	return []string{
+		"OPKSSH_PRINCIPAL=" + principal,
+		"OPKSSH_ISSUER=" + result.Issuer,
+		"OPKSSH_SUB=" + result.Subject,
+		"OPKSSH_EMAIL=" + result.Email,
+		"OPKSSH_KEY_ID=" + result.Cert.KeyId,
+	}
+}
+
+// parsePostVerifyCommand splits post_verify_command into the program and its
+// arguments
+func parsePostVerifyCommand(postVerifyCommand string) ([]string, error) {
+	command, err := shellquote.Split(postVerifyCommand)
+	if err != nil {
+		return nil, fmt.Errorf("invalid post_verify_command %q: %w", postVerifyCommand, err)
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("invalid post_verify_command %q: no command", postVerifyCommand)
+	}
+	return command, nil
+}
+
+// runPostVerifyCommand starts post_verify_command from the server config, if
+// it is set, for a cert accepted to log in as principal. It does not wait
+// for the command, so sshd is not kept waiting for the authorized_keys line.
+// Failures are logged and never deny the login.
+func (v *VerifyCmd) runPostVerifyCommand(result *VerifyResult, principal string) {
+	if v.serverConfig == nil || v.serverConfig.PostVerifyCommand == "" {
+		return
+	}
+	command, err := parsePostVerifyCommand(v.serverConfig.PostVerifyCommand)
+	if err != nil {
+		log.Printf("Failed to run post_verify_command: %v\n", err)
+		return
+	}
+	start := v.startCommand
+	if start == nil {
+		start = startDetached
+	}
+	if err := start(command, append(os.Environ(), postVerifyEnv(result, principal)...)); err != nil {
+		log.Printf("Failed to run post_verify_command %s: %v\n", command[0], err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/opkssh/policy"
+)
+
+// parsePrincipalTemplate parses a default_principal template from the client
+// config. Templates use Go template syntax with the ID Token claims as the
+// data, e.g. {{.preferred_username}} or {{localpart .email}}. Referencing a
+// claim the ID Token does not have is an error rather than an empty principal.
+func parsePrincipalTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("default_principal").Funcs(policy.PrincipalTemplateFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default_principal template %q: %w", tmpl, err)
+	}
+	return t, nil
+}
+
+// principalFromTemplate returns the SSH cert principal produced by the
+// default_principal template tmpl for the claims in the ID Token of pkt
+func principalFromTemplate(tmpl string, pkt *pktoken.PKToken) (string, error) {
+	t, err := parsePrincipalTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse ID Token claims: %w", err)
+	}
+	var principal strings.Builder
+	if err := t.Execute(&principal, claims); err != nil {
+		return "", fmt.Errorf("failed to apply default_principal template %q: %w", tmpl, err)
+	}
+	if err := validatePrincipal(principal.String()); err != nil {
+		return "", fmt.Errorf("default_principal template %q: %w", tmpl, err)
+	}
+	return principal.String(), nil
+}
+
+// validatePrincipal checks principal can be used as an SSH cert principal and
+// as a username when connecting
+func validatePrincipal(principal string) error {
+	if principal == "" {
+		return fmt.Errorf("principal is empty")
+	}
+	if strings.ContainsAny(principal, " \t\r\n,") {
+		return fmt.Errorf("invalid principal %q, principals can not contain whitespace or commas", principal)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPrincipalFromTemplate(t *testing.T) {
+	pkt, _, _ := Mocks(t)
+
+	tests := []struct {
+		name              string
+		tmpl              string
+		expectedPrincipal string
+		errorString       string
+	}{
+		{name: "Email local part", tmpl: "{{localpart .email}}", expectedPrincipal: "arthur.aardvark"},
+		{name: "Claim", tmpl: "{{.sub}}", expectedPrincipal: "me"},
+		{name: "Text and functions", tmpl: "opk-{{lower (localpart .email)}}", expectedPrincipal: "opk-arthur.aardvark"},
+		{name: "Missing claim", tmpl: "{{.preferred_username}}", errorString: "failed to apply default_principal template"},
+		{name: "Empty principal", tmpl: "{{if false}}x{{end}}", errorString: "principal is empty"},
+		{name: "Whitespace", tmpl: "{{.sub}} {{.sub}}", errorString: "principals can not contain whitespace or commas"},
+		{name: "Invalid template", tmpl: "{{.email", errorString: "invalid default_principal template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := principalFromTemplate(tt.tmpl, pkt)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedPrincipal, principal)
+		})
+	}
+}
+
+func TestLoginCmdDefaultPrincipal(t *testing.T) {
+	_, _, mockOp := Mocks(t)
+
+	certPrincipals := func(t *testing.T, fs afero.Fs) []string {
+		pubkeyBytes, err := afero.ReadFile(fs, "/keys/opkssh.pub")
+		require.NoError(t, err)
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey(pubkeyBytes)
+		require.NoError(t, err)
+		cert, ok := pubkey.(*ssh.Certificate)
+		require.True(t, ok, "expected an SSH cert")
+		return cert.ValidPrincipals
+	}
+	stdinConfig := "default_principal: '{{localpart .email}}'\nproviders: []\n"
+
+	// The principal is taken from the ID Token claims
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{
+		Fs:                    mockFs,
+		configPathArg:         ConfigPathStdin,
+		stdin:                 strings.NewReader(stdinConfig),
+		keyPathArg:            "/keys/opkssh",
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+	require.Equal(t, []string{"arthur.aardvark"}, certPrincipals(t, mockFs))
+
+	// --principal takes precedence over default_principal
+	mockFs = afero.NewMemMapFs()
+	loginCmd = LoginCmd{
+		Fs:                    mockFs,
+		configPathArg:         ConfigPathStdin,
+		stdin:                 strings.NewReader(stdinConfig),
+		keyPathArg:            "/keys/opkssh",
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+		principalsArg:         []string{"root", "admin"},
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+	require.Equal(t, []string{"root", "admin"}, certPrincipals(t, mockFs))
+
+	// Without either the cert has no principals
+	mockFs = afero.NewMemMapFs()
+	loginCmd = LoginCmd{
+		Fs:                    mockFs,
+		configPathArg:         ConfigPathStdin,
+		stdin:                 strings.NewReader("providers: []\n"),
+		keyPathArg:            "/keys/opkssh",
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+	require.Empty(t, certPrincipals(t, mockFs))
+
+	// A bad template is caught before the user is sent to the OP
+	loginCmd = LoginCmd{
+		Fs:            afero.NewMemMapFs(),
+		configPathArg: ConfigPathStdin,
+		stdin:         strings.NewReader("default_principal: '{{.email'\nproviders: []\n"),
+	}
+	require.ErrorContains(t, loginCmd.Run(context.Background()), "invalid default_principal template")
+
+	loginCmd = LoginCmd{
+		Fs:            afero.NewMemMapFs(),
+		principalsArg: []string{"a,b"},
+	}
+	require.ErrorContains(t, loginCmd.Run(context.Background()), "principals can not contain whitespace or commas")
+}
+
+func TestLoginCmdAllowedPrincipals(t *testing.T) {
+	_, _, mockOp := Mocks(t)
+	stdinConfig := "allowed_principals: [dev, deploy]\nproviders: []\n"
+
+	tests := []struct {
+		name        string
+		config      string
+		principals  []string
+		errorString string
+	}{
+		{name: "Allowed principal", config: stdinConfig, principals: []string{"dev"}},
+		{name: "Allowed principals", config: stdinConfig, principals: []string{"dev", "deploy"}},
+		{name: "No principal", config: stdinConfig},
+		{name: "Disallowed principal", config: stdinConfig, principals: []string{"dev", "admin"}, errorString: `refusing to request principal "admin" as it is not in allowed_principals in the client config (dev, deploy)`},
+		{name: "No allowlist", config: "providers: []\n", principals: []string{"admin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFs := afero.NewMemMapFs()
+			loginCmd := LoginCmd{
+				Fs:                    mockFs,
+				configPathArg:         ConfigPathStdin,
+				stdin:                 strings.NewReader(tt.config),
+				keyPathArg:            "/keys/opkssh",
+				disableBrowserOpenArg: true,
+				overrideProvider:      &mockOp,
+				principalsArg:         tt.principals,
+			}
+			err := loginCmd.Run(context.Background())
+			if tt.errorString != "" {
+				require.EqualError(t, err, tt.errorString)
+				// The user is not sent to the OP
+				exists, err := afero.Exists(mockFs, "/keys/opkssh.pub")
+				require.NoError(t, err)
+				require.False(t, exists)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os/user"
+	"strconv"
+
+	"github.com/openpubkey/opkssh/commands/config"
+)
+
+// privilegeDropper abstracts the syscalls used to drop privileges so that
+// the decision of whether and how to drop them can be tested
+type privilegeDropper interface {
+	Getuid() int
+	Getgid() int
+	Setgroups(gids []int) error
+	Setgid(gid int) error
+	Setuid(uid int) error
+}
+
+// idLookup abstracts os/user so that users and groups can be faked in tests
+type idLookup struct {
+	LookupUser    func(name string) (*user.User, error)
+	LookupUserId  func(uid string) (*user.User, error)
+	LookupGroup   func(name string) (*user.Group, error)
+	LookupGroupId func(gid string) (*user.Group, error)
+}
+
+var osIdLookup = idLookup{
+	LookupUser:    user.Lookup,
+	LookupUserId:  user.LookupId,
+	LookupGroup:   user.LookupGroup,
+	LookupGroupId: user.LookupGroupId,
+}
+
+// resolveDropTarget returns the uid and gid to drop privileges to
+func resolveDropTarget(dropConfig *config.DropPrivilegesConfig, lookup idLookup) (int, int, error) {
+	if dropConfig.User == "" {
+		return 0, 0, fmt.Errorf("drop_privileges requires a user")
+	}
+	u, err := lookup.LookupUser(dropConfig.User)
+	if err != nil {
+		if _, numErr := strconv.Atoi(dropConfig.User); numErr != nil {
+			return 0, 0, fmt.Errorf("failed to find user %s to drop privileges to: %w", dropConfig.User, err)
+		}
+		if u, err = lookup.LookupUserId(dropConfig.User); err != nil {
+			return 0, 0, fmt.Errorf("failed to find user %s to drop privileges to: %w", dropConfig.User, err)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("user %s has a non-numeric uid (%s)", u.Username, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if dropConfig.Group != "" {
+		g, err := lookup.LookupGroup(dropConfig.Group)
+		if err != nil {
+			if _, numErr := strconv.Atoi(dropConfig.Group); numErr != nil {
+				return 0, 0, fmt.Errorf("failed to find group %s to drop privileges to: %w", dropConfig.Group, err)
+			}
+			if g, err = lookup.LookupGroupId(dropConfig.Group); err != nil {
+				return 0, 0, fmt.Errorf("failed to find group %s to drop privileges to: %w", dropConfig.Group, err)
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("group of user %s has a non-numeric gid (%s)", u.Username, gidStr)
+	}
+
+	if uid == 0 || gid == 0 {
+		return 0, 0, fmt.Errorf("refusing to drop privileges to uid %d gid %d, drop_privileges must not be root", uid, gid)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches the process to the user and group in dropConfig.
+// If the process is already running as them this does nothing. The process
+// must be running as root to switch to a different user.
+func dropPrivileges(dropConfig *config.DropPrivilegesConfig, dropper privilegeDropper, lookup idLookup) error {
+	uid, gid, err := resolveDropTarget(dropConfig, lookup)
+	if err != nil {
+		return err
+	}
+
+	currentUid := dropper.Getuid()
+	if currentUid == uid && dropper.Getgid() == gid {
+		log.Printf("Already running as uid %d gid %d, no privileges to drop\n", uid, gid)
+		return nil
+	}
+	if currentUid != 0 {
+		return fmt.Errorf("can not drop privileges to uid %d gid %d, verify is running as uid %d which is not root", uid, gid, currentUid)
+	}
+
+	// Order matters, once the uid is changed we no longer have permission to
+	// change the groups
+	if err := dropper.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := dropper.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid to %d: %w", gid, err)
+	}
+	if err := dropper.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid to %d: %w", uid, err)
+	}
+
+	if dropper.Getuid() != uid || dropper.Getgid() != gid {
+		return fmt.Errorf("failed to drop privileges, running as uid %d gid %d expected uid %d gid %d", dropper.Getuid(), dropper.Getgid(), uid, gid)
+	}
+	// If we can become root again then the privileges were not really dropped
+	if err := dropper.Setuid(0); err == nil {
+		return fmt.Errorf("failed to drop privileges, able to regain root after switching to uid %d", uid)
+	}
+	log.Printf("Dropped privileges to uid %d gid %d\n", uid, gid)
+	return nil
+}
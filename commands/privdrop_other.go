@@ -0,0 +1,35 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package commands
+
+import (
+	"errors"
+	"os"
+)
+
+var errPrivDropUnsupported = errors.New("drop_privileges is only supported on linux")
+
+// osPrivilegeDropper is not currently supported outside of Linux
+type osPrivilegeDropper struct{}
+
+func (osPrivilegeDropper) Getuid() int                { return os.Getuid() }
+func (osPrivilegeDropper) Getgid() int                { return os.Getgid() }
+func (osPrivilegeDropper) Setgroups(gids []int) error { return errPrivDropUnsupported }
+func (osPrivilegeDropper) Setgid(gid int) error       { return errPrivDropUnsupported }
+func (osPrivilegeDropper) Setuid(uid int) error       { return errPrivDropUnsupported }
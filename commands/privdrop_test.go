@@ -0,0 +1,207 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"os/user"
+	"testing"
+
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/stretchr/testify/require"
+)
+
+// mockPrivilegeDropper records the syscalls made to drop privileges
+type mockPrivilegeDropper struct {
+	uid, gid    int
+	groups      []int
+	calls       []string
+	ignoreSetid bool
+}
+
+func (m *mockPrivilegeDropper) Getuid() int { return m.uid }
+func (m *mockPrivilegeDropper) Getgid() int { return m.gid }
+
+func (m *mockPrivilegeDropper) Setgroups(gids []int) error {
+	m.calls = append(m.calls, fmt.Sprintf("setgroups %v", gids))
+	if m.uid != 0 {
+		return fmt.Errorf("operation not permitted")
+	}
+	m.groups = gids
+	return nil
+}
+
+func (m *mockPrivilegeDropper) Setgid(gid int) error {
+	m.calls = append(m.calls, fmt.Sprintf("setgid %d", gid))
+	if m.uid != 0 {
+		return fmt.Errorf("operation not permitted")
+	}
+	if !m.ignoreSetid {
+		m.gid = gid
+	}
+	return nil
+}
+
+func (m *mockPrivilegeDropper) Setuid(uid int) error {
+	m.calls = append(m.calls, fmt.Sprintf("setuid %d", uid))
+	if m.uid != 0 && m.uid != uid {
+		return fmt.Errorf("operation not permitted")
+	}
+	if !m.ignoreSetid {
+		m.uid = uid
+	}
+	return nil
+}
+
+var mockIdLookup = idLookup{
+	LookupUser: func(name string) (*user.User, error) {
+		switch name {
+		case "opksshuser":
+			return &user.User{Username: "opksshuser", Uid: "1001", Gid: "1001"}, nil
+		case "root":
+			return &user.User{Username: "root", Uid: "0", Gid: "0"}, nil
+		}
+		return nil, user.UnknownUserError(name)
+	},
+	LookupUserId: func(uid string) (*user.User, error) {
+		if uid == "1001" {
+			return &user.User{Username: "opksshuser", Uid: "1001", Gid: "1001"}, nil
+		}
+		return nil, user.UnknownUserIdError(0)
+	},
+	LookupGroup: func(name string) (*user.Group, error) {
+		if name == "nogroup" {
+			return &user.Group{Name: "nogroup", Gid: "65534"}, nil
+		}
+		return nil, user.UnknownGroupError(name)
+	},
+	LookupGroupId: func(gid string) (*user.Group, error) {
+		if gid == "65534" {
+			return &user.Group{Name: "nogroup", Gid: "65534"}, nil
+		}
+		return nil, user.UnknownGroupIdError(gid)
+	},
+}
+
+func TestDropPrivileges(t *testing.T) {
+	tests := []struct {
+		name          string
+		dropConfig    config.DropPrivilegesConfig
+		uid           int
+		gid           int
+		ignoreSetid   bool
+		expectedUid   int
+		expectedGid   int
+		expectedCalls []string
+		errorString   string
+	}{
+		{
+			name:          "Drop from root to user",
+			dropConfig:    config.DropPrivilegesConfig{User: "opksshuser"},
+			expectedUid:   1001,
+			expectedGid:   1001,
+			expectedCalls: []string{"setgroups [1001]", "setgid 1001", "setuid 1001", "setuid 0"},
+		},
+		{
+			name:          "Drop from root to numeric user and group",
+			dropConfig:    config.DropPrivilegesConfig{User: "1001", Group: "65534"},
+			expectedUid:   1001,
+			expectedGid:   65534,
+			expectedCalls: []string{"setgroups [65534]", "setgid 65534", "setuid 1001", "setuid 0"},
+		},
+		{
+			name:          "Drop from root to user and named group",
+			dropConfig:    config.DropPrivilegesConfig{User: "opksshuser", Group: "nogroup"},
+			expectedUid:   1001,
+			expectedGid:   65534,
+			expectedCalls: []string{"setgroups [65534]", "setgid 65534", "setuid 1001", "setuid 0"},
+		},
+		{
+			name:        "Already running as user",
+			dropConfig:  config.DropPrivilegesConfig{User: "opksshuser"},
+			uid:         1001,
+			gid:         1001,
+			expectedUid: 1001,
+			expectedGid: 1001,
+		},
+		{
+			name:        "Not root",
+			dropConfig:  config.DropPrivilegesConfig{User: "opksshuser"},
+			uid:         1002,
+			gid:         1002,
+			errorString: "verify is running as uid 1002 which is not root",
+		},
+		{
+			name:        "Drop to root",
+			dropConfig:  config.DropPrivilegesConfig{User: "root"},
+			errorString: "drop_privileges must not be root",
+		},
+		{
+			name:        "Missing user",
+			dropConfig:  config.DropPrivilegesConfig{},
+			errorString: "drop_privileges requires a user",
+		},
+		{
+			name:        "Unknown user",
+			dropConfig:  config.DropPrivilegesConfig{User: "nobody-here"},
+			errorString: "failed to find user nobody-here",
+		},
+		{
+			name:        "Unknown group",
+			dropConfig:  config.DropPrivilegesConfig{User: "opksshuser", Group: "wheel"},
+			errorString: "failed to find group wheel",
+		},
+		{
+			name:          "Syscalls silently fail",
+			dropConfig:    config.DropPrivilegesConfig{User: "opksshuser"},
+			ignoreSetid:   true,
+			errorString:   "failed to drop privileges, running as uid 0 gid 0 expected uid 1001 gid 1001",
+			expectedCalls: []string{"setgroups [1001]", "setgid 1001", "setuid 1001"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dropper := &mockPrivilegeDropper{uid: tt.uid, gid: tt.gid, ignoreSetid: tt.ignoreSetid}
+			err := dropPrivileges(&tt.dropConfig, dropper, mockIdLookup)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedUid, dropper.uid)
+				require.Equal(t, tt.expectedGid, dropper.gid)
+			}
+			require.Equal(t, tt.expectedCalls, dropper.calls)
+		})
+	}
+}
+
+func TestVerifyDropPrivileges(t *testing.T) {
+	dropper := &mockPrivilegeDropper{}
+	ver := VerifyCmd{privDropper: dropper}
+
+	// No server config, nothing to drop
+	require.False(t, ver.DropsPrivileges())
+	require.NoError(t, ver.DropPrivileges())
+
+	serverConfig, err := config.NewServerConfig([]byte("drop_privileges:\n  user: \"\"\n  group: nogroup\n"))
+	require.NoError(t, err)
+	ver.serverConfig = serverConfig
+	require.True(t, ver.DropsPrivileges())
+	require.ErrorContains(t, ver.DropPrivileges(), "drop_privileges requires a user")
+	require.Empty(t, dropper.calls)
+}
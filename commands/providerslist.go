@@ -0,0 +1,104 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/openpubkey/opkssh/commands/config"
+)
+
+// Output formats of opkssh providers list
+const (
+	ProvidersOutputText = "text"
+	ProvidersOutputJSON = "json"
+)
+
+// ProviderListing is a provider alias in the client config, as printed by
+// opkssh providers list. The JSON field names are relied on by completion
+// scripts and other tools and must not change.
+type ProviderListing struct {
+	Alias   string `json:"alias"`
+	Issuer  string `json:"issuer"`
+	Default bool   `json:"default"`
+}
+
+// ListProviders returns an entry for each provider alias in the client
+// config, sorted by alias. As with opkssh login, the default config is used
+// if there is no config file, and an encrypted config file is decrypted.
+func (c *ConfigCmd) ListProviders() ([]ProviderListing, error) {
+	_, configBytes, err := c.readConfig()
+	if errors.Is(err, fs.ErrNotExist) {
+		configBytes = config.DefaultClientConfig
+	} else if err != nil {
+		return nil, err
+	}
+	if config.IsEncryptedConfig(configBytes) {
+		if configBytes, err = config.DecryptClientConfig(configBytes, c.KeyStore); err != nil {
+			return nil, err
+		}
+	}
+
+	clientConfig, err := config.NewClientConfig(configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	providerMap, err := clientConfig.GetProvidersMap()
+	if err != nil {
+		return nil, err
+	}
+
+	listings := []ProviderListing{}
+	for alias, providerConfig := range providerMap {
+		listings = append(listings, ProviderListing{
+			Alias:   alias,
+			Issuer:  providerConfig.Issuer,
+			Default: alias == clientConfig.DefaultProvider,
+		})
+	}
+	sort.Slice(listings, func(i, j int) bool { return listings[i].Alias < listings[j].Alias })
+	return listings, nil
+}
+
+// WriteProviderList writes listings to w in format, ProvidersOutputText for
+// an aligned table or ProvidersOutputJSON for a JSON array
+func WriteProviderList(w io.Writer, listings []ProviderListing, format string) error {
+	switch format {
+	case ProvidersOutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listings)
+	case ProvidersOutputText, "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, listing := range listings {
+			if listing.Default {
+				fmt.Fprintf(tw, "%s\t%s\t(default)\n", listing.Alias, listing.Issuer)
+			} else {
+				fmt.Fprintf(tw, "%s\t%s\n", listing.Alias, listing.Issuer)
+			}
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q, expected %s or %s", format, ProvidersOutputText, ProvidersOutputJSON)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListProviders(t *testing.T) {
+	configPath := "/home/alice/.opk/config.yml"
+	configBytes := []byte(`---
+default_provider: keycloak
+
+providers:
+  - alias: keycloak kc
+    issuer: https://keycloak.example.com/realms/example
+    client_id: opkssh
+    scopes: openid email
+    redirect_uris:
+      - http://localhost:3000/login-callback
+
+  - alias: authentik
+    issuer: https://authentik.example.com/application/o/opkssh/
+    client_id: opkssh
+    scopes: openid email
+    redirect_uris:
+      - http://localhost:3000/login-callback
+
+  - alias: google
+    issuer: https://accounts.google.com
+    client_id: test_client_id
+    client_secret: test_client_secret
+    scopes: openid email
+    redirect_uris:
+      - http://localhost:3000/login-callback
+`)
+	mockFs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(mockFs, configPath, configBytes, 0600))
+
+	configCmd := ConfigCmd{Fs: mockFs, ConfigPathArg: configPath}
+	listings, err := configCmd.ListProviders()
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, WriteProviderList(&out, listings, ProvidersOutputText))
+	require.Equal(t, `authentik  https://authentik.example.com/application/o/opkssh/
+google     https://accounts.google.com
+kc         https://keycloak.example.com/realms/example
+keycloak   https://keycloak.example.com/realms/example  (default)
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, WriteProviderList(&out, listings, ProvidersOutputJSON))
+	require.Equal(t, `[
+  {
+    "alias": "authentik",
+    "issuer": "https://authentik.example.com/application/o/opkssh/",
+    "default": false
+  },
+  {
+    "alias": "google",
+    "issuer": "https://accounts.google.com",
+    "default": false
+  },
+  {
+    "alias": "kc",
+    "issuer": "https://keycloak.example.com/realms/example",
+    "default": false
+  },
+  {
+    "alias": "keycloak",
+    "issuer": "https://keycloak.example.com/realms/example",
+    "default": true
+  }
+]
+`, out.String())
+
+	require.ErrorContains(t, WriteProviderList(&out, listings, "yaml"), `unknown output format "yaml"`)
+
+	// Without a config file the default providers used by login are listed
+	configCmd = ConfigCmd{Fs: afero.NewMemMapFs(), ConfigPathArg: configPath}
+	listings, err = configCmd.ListProviders()
+	require.NoError(t, err)
+	aliases := []string{}
+	for _, listing := range listings {
+		aliases = append(aliases, listing.Alias)
+		require.False(t, listing.Default, "the default config uses the webchooser")
+	}
+	require.Equal(t, []string{"azure", "gitlab", "google", "hello", "microsoft"}, aliases)
+
+	// Duplicate aliases are an error, as they are for login
+	require.NoError(t, afero.WriteFile(mockFs, configPath, append(configBytes, []byte(`
+  - alias: google
+    issuer: https://accounts.example.com
+    client_id: opkssh
+    redirect_uris:
+      - http://localhost:3000/login-callback
+`)...), 0600))
+	configCmd = ConfigCmd{Fs: mockFs, ConfigPathArg: configPath}
+	_, err = configCmd.ListProviders()
+	require.ErrorContains(t, err, "duplicate provider alias found: google")
+}
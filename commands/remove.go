@@ -0,0 +1,70 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/openpubkey/opkssh/policy"
+)
+
+// RemoveCmd provides functionality to remove entries from the opkssh policy
+// file. It reads and writes the same policy file as AddCmd.
+type RemoveCmd struct {
+	HomePolicyLoader   *policy.HomePolicyLoader
+	SystemPolicyLoader *policy.SystemPolicyLoader
+
+	// Username is the username to lookup when the system policy file cannot be
+	// read and we fallback to the user's policy file.
+	Username string
+}
+
+// Run removes the allowed principals matching principal, identity, issuer and
+// comment from the policy file. Empty arguments match any value, so for
+// example only supplying a comment removes every entry with that comment.
+//
+// If successful, returns the policy filepath updated and the number of
+// principals removed. Otherwise, returns a non-nil error
+func (r *RemoveCmd) Run(principal string, identity string, issuer string, comment string) (string, int, error) {
+	if principal == "" && identity == "" && issuer == "" && comment == "" {
+		return "", 0, fmt.Errorf("at least one of principal, identity, issuer or comment must be specified")
+	}
+
+	add := AddCmd{
+		HomePolicyLoader:   r.HomePolicyLoader,
+		SystemPolicyLoader: r.SystemPolicyLoader,
+		Username:           r.Username,
+	}
+	currentPolicy, policyFilePath, err := add.LoadPolicy()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to load current policy: %w", err)
+	}
+
+	removed := currentPolicy.RemoveAllowedPrincipals(principal, identity, issuer, comment)
+	if removed == 0 {
+		return policyFilePath, 0, nil
+	}
+
+	policyLoader := r.HomePolicyLoader.PolicyLoader
+	if policyFilePath == policy.SystemDefaultPolicyPath {
+		policyLoader = r.SystemPolicyLoader.PolicyLoader
+	}
+	if err := policyLoader.Dump(currentPolicy, policyFilePath); err != nil {
+		return "", 0, fmt.Errorf("failed to write updated policy: %w", err)
+	}
+	return policyFilePath, removed, nil
+}
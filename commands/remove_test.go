@@ -0,0 +1,100 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemove(t *testing.T) {
+	initialPolicy := "root alice@example.com https://accounts.google.com # JIRA-123 access granted by bob\n" +
+		"dev alice@example.com https://accounts.google.com # JIRA-123 access granted by bob\n" +
+		"dev bob@example.com https://accounts.google.com\n" +
+		"root bob@example.com https://accounts.google.com deny # JIRA-123 access granted by bob\n"
+
+	tests := []struct {
+		name           string
+		principal      string
+		identity       string
+		issuer         string
+		comment        string
+		expectedCount  int
+		expectedPolicy string
+		errorString    string
+	}{
+		{
+			name:          "Remove by comment",
+			comment:       "JIRA-123 access granted by bob",
+			expectedCount: 2,
+			expectedPolicy: "dev bob@example.com https://accounts.google.com\n" +
+				"root bob@example.com https://accounts.google.com deny # JIRA-123 access granted by bob\n",
+		},
+		{
+			name:          "Remove by entry",
+			principal:     "dev",
+			identity:      "bob@example.com",
+			issuer:        "https://accounts.google.com",
+			expectedCount: 1,
+			expectedPolicy: "root alice@example.com https://accounts.google.com # JIRA-123 access granted by bob\n" +
+				"dev alice@example.com https://accounts.google.com # JIRA-123 access granted by bob\n" +
+				"root bob@example.com https://accounts.google.com deny # JIRA-123 access granted by bob\n",
+		},
+		{
+			name:           "Comment does not match",
+			principal:      "dev",
+			identity:       "bob@example.com",
+			comment:        "JIRA-123 access granted by bob",
+			expectedCount:  0,
+			expectedPolicy: initialPolicy,
+		},
+		{
+			name:           "Nothing to match",
+			expectedPolicy: initialPolicy,
+			errorString:    "at least one of principal, identity, issuer or comment must be specified",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockFs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(mockFs, policy.SystemDefaultPolicyPath, []byte(initialPolicy), 0640))
+			addCmd := MockAddCmd(mockFs)
+			removeCmd := RemoveCmd{
+				HomePolicyLoader:   addCmd.HomePolicyLoader,
+				SystemPolicyLoader: addCmd.SystemPolicyLoader,
+				Username:           addCmd.Username,
+			}
+
+			policyPath, removed, err := removeCmd.Run(tt.principal, tt.identity, tt.issuer, tt.comment)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, policy.SystemDefaultPolicyPath, policyPath)
+			}
+			require.Equal(t, tt.expectedCount, removed)
+
+			policyContent, err := afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedPolicy, string(policyContent))
+		})
+	}
+}
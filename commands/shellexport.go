@@ -0,0 +1,92 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// ShellExportKeyVar is set by login --shell-export to the path of the
+	// SSH private key
+	ShellExportKeyVar = "SSH_OPK_KEY"
+	// ShellExportCertVar is set by login --shell-export to the path of the
+	// SSH cert
+	ShellExportCertVar = "SSH_OPK_CERT"
+)
+
+// stdout returns where login writes its output. With --shell-export stdout
+// is kept for the export lines, so everything else goes to stderr.
+func (l *LoginCmd) stdout() io.Writer {
+	if l.shellExportArg {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeShellExports prints the commands that export the paths of the key at
+// seckeyPath and its cert, in the syntax of the user's shell
+func (l *LoginCmd) writeShellExports(seckeyPath string) error {
+	seckeyPath, err := filepath.Abs(seckeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path of %s: %w", seckeyPath, err)
+	}
+	shell, _ := l.getenv("SHELL")
+	out := l.exportOut
+	if out == nil {
+		out = os.Stdout
+	}
+	_, err = io.WriteString(out, shellExports(shell, [][2]string{
+		{ShellExportKeyVar, seckeyPath},
+		{ShellExportCertVar, seckeyPath + ".pub"},
+	}))
+	return err
+}
+
+// shellExports returns the commands that export each name and value in vars
+// in the syntax of shell, the path of the user's shell from $SHELL. fish has
+// its own syntax, every other shell is assumed to be POSIX compatible like
+// bash and zsh.
+func shellExports(shell string, vars [][2]string) string {
+	var sb strings.Builder
+	for _, v := range vars {
+		if filepath.Base(shell) == "fish" {
+			fmt.Fprintf(&sb, "set -gx %s %s;\n", v[0], fishQuote(v[1]))
+		} else {
+			fmt.Fprintf(&sb, "%s=%s; export %s;\n", v[0], posixQuote(v[1]), v[0])
+		}
+	}
+	return sb.String()
+}
+
+// posixQuote quotes s for a POSIX shell. Nothing is special inside single
+// quotes, so a single quote is written by closing the quotes, escaping it
+// and opening them again.
+func posixQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes s for fish, where backslashes and single quotes must be
+// escaped inside single quotes
+func fishQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
@@ -0,0 +1,110 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellExports(t *testing.T) {
+	vars := [][2]string{
+		{ShellExportKeyVar, "/home/alice/.ssh/id_ecdsa"},
+		{ShellExportCertVar, `/home/o'brien/my keys\$HOME/id_ecdsa.pub`},
+	}
+	tests := []struct {
+		shell    string
+		expected string
+	}{
+		{
+			shell: "/bin/bash",
+			expected: "SSH_OPK_KEY='/home/alice/.ssh/id_ecdsa'; export SSH_OPK_KEY;\n" +
+				`SSH_OPK_CERT='/home/o'\''brien/my keys\$HOME/id_ecdsa.pub'; export SSH_OPK_CERT;` + "\n",
+		},
+		{
+			shell: "/usr/bin/zsh",
+			expected: "SSH_OPK_KEY='/home/alice/.ssh/id_ecdsa'; export SSH_OPK_KEY;\n" +
+				`SSH_OPK_CERT='/home/o'\''brien/my keys\$HOME/id_ecdsa.pub'; export SSH_OPK_CERT;` + "\n",
+		},
+		{
+			shell: "",
+			expected: "SSH_OPK_KEY='/home/alice/.ssh/id_ecdsa'; export SSH_OPK_KEY;\n" +
+				`SSH_OPK_CERT='/home/o'\''brien/my keys\$HOME/id_ecdsa.pub'; export SSH_OPK_CERT;` + "\n",
+		},
+		{
+			shell: "/usr/local/bin/fish",
+			expected: "set -gx SSH_OPK_KEY '/home/alice/.ssh/id_ecdsa';\n" +
+				`set -gx SSH_OPK_CERT '/home/o\'brien/my keys\\$HOME/id_ecdsa.pub';` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			exports := shellExports(tt.shell, vars)
+			require.Equal(t, tt.expected, exports)
+
+			// Evaluate the exports with the shell if it is installed
+			shellName := filepath.Base(tt.shell)
+			if tt.shell == "" {
+				shellName = "sh"
+			}
+			shellPath, err := exec.LookPath(shellName)
+			if err != nil {
+				t.Skipf("%s is not installed", shellName)
+			}
+			out, err := exec.Command(shellPath, "-c", exports+`printf '%s\n%s' "$SSH_OPK_KEY" "$SSH_OPK_CERT"`).Output()
+			require.NoError(t, err)
+			require.Equal(t, vars[0][1]+"\n"+vars[1][1], string(out))
+		})
+	}
+}
+
+func TestLoginShellExport(t *testing.T) {
+	_, _, mockOp := Mocks(t)
+
+	var exportOut bytes.Buffer
+	loginCmd := LoginCmd{
+		Fs:                    afero.NewMemMapFs(),
+		disableBrowserOpenArg: true,
+		overrideProvider:      &mockOp,
+		keyPathArg:            "/keys/opkssh",
+		shellExportArg:        true,
+		exportOut:             &exportOut,
+		lookupEnv: func(key string) (string, bool) {
+			if key == "SHELL" {
+				return "/bin/bash", true
+			}
+			return "", false
+		},
+	}
+	require.NoError(t, loginCmd.Run(context.Background()))
+	seckeyPath, err := filepath.Abs("/keys/opkssh")
+	require.NoError(t, err)
+	require.Equal(t, shellExports("/bin/bash", [][2]string{{"SSH_OPK_KEY", seckeyPath}, {"SSH_OPK_CERT", seckeyPath + ".pub"}}), exportOut.String())
+
+	loginCmd = LoginCmd{
+		Fs:             afero.NewMemMapFs(),
+		shellExportArg: true,
+		autoRefreshArg: true,
+	}
+	require.ErrorContains(t, loginCmd.Run(context.Background()), "--shell-export can not be used with --auto-refresh")
+}
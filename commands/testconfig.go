@@ -0,0 +1,194 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/openpubkey/opkssh/policy/files"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestConfigResult is the outcome of checking one of the server's
+// configuration files. The file passed if there are no problems.
+type TestConfigResult struct {
+	Name     string
+	Path     string
+	Problems []string
+}
+
+// Passed returns true if no problems were found with the file
+func (r TestConfigResult) Passed() bool {
+	return len(r.Problems) == 0
+}
+
+// TestConfigCmd checks that the server config, the providers file and the
+// system policy file read by opkssh verify are well-formed and have the
+// permissions and ownership the install script gives them, so that problems
+// can be found before sshd is reloaded
+type TestConfigCmd struct {
+	Fs               afero.Fs
+	ConfigPathArg    string
+	ProvidersPathArg string
+	PolicyPathArg    string
+	// filePermChecker is used to check the permissions and ownership of the
+	// files
+	filePermChecker files.PermsChecker
+}
+
+func NewTestConfigCmd(configPathArg string, providersPathArg string, policyPathArg string) *TestConfigCmd {
+	fs := afero.NewOsFs()
+	return &TestConfigCmd{
+		Fs:               fs,
+		ConfigPathArg:    configPathArg,
+		ProvidersPathArg: providersPathArg,
+		PolicyPathArg:    policyPathArg,
+		filePermChecker: files.PermsChecker{
+			Fs:        fs,
+			CmdRunner: files.ExecCmd,
+		},
+	}
+}
+
+// Run checks each of the server's configuration files and returns a result
+// for each of them
+func (t *TestConfigCmd) Run() []TestConfigResult {
+	return []TestConfigResult{
+		{Name: "server config", Path: t.ConfigPathArg, Problems: t.checkServerConfig()},
+		{Name: "providers", Path: t.ProvidersPathArg, Problems: t.checkProviders()},
+		{Name: "policy", Path: t.PolicyPathArg, Problems: t.checkPolicy()},
+	}
+}
+
+// readFile reads the file at path after checking it has the permissions and
+// ownership of the system config files
+func (t *TestConfigCmd) readFile(path string) ([]byte, error) {
+	content, err := afero.ReadFile(t.Fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if err := t.filePermChecker.CheckPerm(path, []fs.FileMode{files.ModeSystemPerms}, "root", "opksshuser"); err != nil {
+		return nil, fmt.Errorf("bad permissions: %w", err)
+	}
+	return content, nil
+}
+
+func (t *TestConfigCmd) checkServerConfig() []string {
+	content, err := t.readFile(t.ConfigPathArg)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	serverConfig, err := config.NewServerConfig(content)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to parse config file: %v", err)}
+	}
+
+	problems := []string{}
+	if serverConfig.DropPrivileges != nil && serverConfig.DropPrivileges.User == "" {
+		problems = append(problems, "drop_privileges must set user")
+	}
+	if bundle := serverConfig.VerificationBundle; bundle != nil {
+		if bundle.Path == "" || bundle.PublicKey == "" {
+			problems = append(problems, "verification_bundle must set both path and public_key")
+		} else if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(bundle.PublicKey)); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid verification_bundle public_key: %v", err))
+		}
+	}
+	if serverConfig.CertPrincipals != nil && serverConfig.CertPrincipals.MaxPrincipals < 0 {
+		problems = append(problems, "cert_principals max_principals must not be negative")
+	}
+	if serverConfig.MaxCertLifetime < 0 {
+		problems = append(problems, "max_cert_lifetime must not be negative")
+	}
+	if err := (&policy.ProviderPolicy{}).SetDiscoveryURLs(serverConfig.DiscoveryURLs); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid discovery_urls: %v", err))
+	}
+	if _, err := serverConfig.ParseTrustedCAKeys(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if serverConfig.AuditChain != nil && serverConfig.AuditChain.Path == "" {
+		problems = append(problems, "audit_chain must set path")
+	}
+	if serverConfig.VerifyDaemon != nil && serverConfig.VerifyDaemon.Socket == "" {
+		problems = append(problems, "verify_daemon must set socket")
+	}
+	if serverConfig.PostVerifyCommand != "" {
+		if _, err := parsePostVerifyCommand(serverConfig.PostVerifyCommand); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+func (t *TestConfigCmd) checkProviders() []string {
+	content, err := t.readFile(t.ProvidersPathArg)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problemLog := &files.ConfigLog{}
+	providerPolicy := (&policy.ProvidersFileLoader{}).FromTableWithLog(content, t.ProvidersPathArg, problemLog)
+	problems := configLogProblems(problemLog)
+	if _, err := providerPolicy.CreateVerifier(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+func (t *TestConfigCmd) checkPolicy() []string {
+	content, err := t.readFile(t.PolicyPathArg)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problemLog := &files.ConfigLog{}
+	policy.FromTableWithLog(content, t.PolicyPathArg, problemLog)
+	return configLogProblems(problemLog)
+}
+
+func configLogProblems(problemLog *files.ConfigLog) []string {
+	problems := []string{}
+	for _, problem := range problemLog.GetProblems() {
+		problems = append(problems, problem.String())
+	}
+	return problems
+}
+
+// WriteTestConfigReport writes a pass or fail line for each result to w,
+// followed by the problems found with the file, and returns an error if any
+// of the files failed
+func WriteTestConfigReport(w io.Writer, results []TestConfigResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Passed() {
+			fmt.Fprintf(w, "PASS %s (%s)\n", result.Name, result.Path)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL %s (%s)\n", result.Name, result.Path)
+		for _, problem := range result.Problems {
+			fmt.Fprintf(w, "  - %s\n", problem)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d configuration files failed", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/openpubkey/opkssh/policy/files"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testConfigServerConfig = "---\nenv_vars:\n  HTTPS_PROXY: http://proxy.example.com:3128\n"
+	testConfigProviders    = "https://accounts.example.com test_client_id 24h\n"
+	testConfigPolicy       = "root alice@example.com https://accounts.example.com\n"
+)
+
+func newTestConfigCmd(t *testing.T, contents map[string]string, perms map[string]fs.FileMode, owner string) *TestConfigCmd {
+	mockFs := afero.NewMemMapFs()
+	for path, content := range contents {
+		perm, ok := perms[path]
+		if !ok {
+			perm = files.ModeSystemPerms
+		}
+		require.NoError(t, afero.WriteFile(mockFs, path, []byte(content), perm))
+	}
+	return &TestConfigCmd{
+		Fs:               mockFs,
+		ConfigPathArg:    "/etc/opk/config.yml",
+		ProvidersPathArg: "/etc/opk/providers",
+		PolicyPathArg:    "/etc/opk/auth_id",
+		filePermChecker: files.PermsChecker{
+			Fs: mockFs,
+			CmdRunner: func(name string, arg ...string) ([]byte, error) {
+				return []byte(owner + " opksshuser"), nil
+			},
+		},
+	}
+}
+
+func TestTestConfig(t *testing.T) {
+	t.Parallel()
+
+	goodFiles := map[string]string{
+		"/etc/opk/config.yml": testConfigServerConfig,
+		"/etc/opk/providers":  testConfigProviders,
+		"/etc/opk/auth_id":    testConfigPolicy,
+	}
+	withFile := func(path string, content string) map[string]string {
+		contents := map[string]string{}
+		for k, v := range goodFiles {
+			contents[k] = v
+		}
+		contents[path] = content
+		return contents
+	}
+
+	tests := []struct {
+		name          string
+		contents      map[string]string
+		perms         map[string]fs.FileMode
+		owner         string
+		failed        []string
+		errorContains string
+	}{
+		{
+			name:     "Good config",
+			contents: goodFiles,
+			owner:    "root",
+		},
+		{
+			name:          "Wrong permissions on policy",
+			contents:      goodFiles,
+			perms:         map[string]fs.FileMode{"/etc/opk/auth_id": 0644},
+			owner:         "root",
+			failed:        []string{"policy"},
+			errorContains: "expected one of the following permissions [640], got (644)",
+		},
+		{
+			name:          "Wrong owner",
+			contents:      goodFiles,
+			owner:         "alice",
+			failed:        []string{"server config", "providers", "policy"},
+			errorContains: "expected owner (root), got (alice)",
+		},
+		{
+			name:          "Corrupt policy",
+			contents:      withFile("/etc/opk/auth_id", testConfigPolicy+"root alice@example.com\nroot bob@example.com https://accounts.example.com unknown\n"),
+			owner:         "root",
+			failed:        []string{"policy"},
+			errorContains: "wrong number of arguments (expected=3, got=2)",
+		},
+		{
+			name:          "Corrupt server config",
+			contents:      withFile("/etc/opk/config.yml", "env_vars: [\n"),
+			owner:         "root",
+			failed:        []string{"server config"},
+			errorContains: "failed to parse config file",
+		},
+		{
+			name:          "Invalid expiration policy in providers",
+			contents:      withFile("/etc/opk/providers", "https://accounts.example.com test_client_id 1year\n"),
+			owner:         "root",
+			failed:        []string{"providers"},
+			errorContains: "invalid expiration policy: 1year",
+		},
+		{
+			name:          "No providers",
+			contents:      withFile("/etc/opk/providers", ""),
+			owner:         "root",
+			failed:        []string{"providers"},
+			errorContains: "no providers configured",
+		},
+		{
+			name: "Missing server config",
+			contents: map[string]string{
+				"/etc/opk/providers": testConfigProviders,
+				"/etc/opk/auth_id":   testConfigPolicy,
+			},
+			owner:         "root",
+			failed:        []string{"server config"},
+			errorContains: "failed to read file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			results := newTestConfigCmd(t, tt.contents, tt.perms, tt.owner).Run()
+
+			failed := []string{}
+			problems := []string{}
+			for _, result := range results {
+				if !result.Passed() {
+					failed = append(failed, result.Name)
+					problems = append(problems, result.Problems...)
+				}
+			}
+			if len(tt.failed) == 0 {
+				require.Empty(t, failed)
+				return
+			}
+			require.Equal(t, tt.failed, failed)
+			require.Contains(t, problems[0], tt.errorContains)
+		})
+	}
+}
+
+func TestTestConfigCorruptPolicyReportsEachLine(t *testing.T) {
+	t.Parallel()
+
+	contents := map[string]string{
+		"/etc/opk/config.yml": testConfigServerConfig,
+		"/etc/opk/providers":  testConfigProviders,
+		"/etc/opk/auth_id":    testConfigPolicy + "root alice@example.com\nroot bob@example.com https://accounts.example.com unknown\n",
+	}
+	results := newTestConfigCmd(t, contents, nil, "root").Run()
+
+	var out bytes.Buffer
+	err := WriteTestConfigReport(&out, results)
+	require.ErrorContains(t, err, "1 of 3 configuration files failed")
+	require.Contains(t, out.String(), "PASS server config (/etc/opk/config.yml)\n")
+	require.Contains(t, out.String(), "PASS providers (/etc/opk/providers)\n")
+	require.Contains(t, out.String(), "FAIL policy (/etc/opk/auth_id)\n")
+	require.Contains(t, out.String(), "wrong number of arguments (expected=3, got=2)")
+	require.Contains(t, out.String(), "unknown policy option (unknown)")
+}
+
+func TestTestConfigReportAllPassed(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	err := WriteTestConfigReport(&out, []TestConfigResult{
+		{Name: "server config", Path: "/etc/opk/config.yml"},
+		{Name: "policy", Path: "/etc/opk/auth_id", Problems: []string{}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "PASS server config (/etc/opk/config.yml)\nPASS policy (/etc/opk/auth_id)\n", out.String())
+}
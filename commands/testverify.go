@@ -0,0 +1,71 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/spf13/afero"
+)
+
+// TestVerifyCmd checks whether the claims of an ID Token are allowed to
+// assume a principal by a policy file, without an SSH cert or a login. Like
+// DiffPolicyCmd it does not check the permissions of the policy file, so
+// candidate policies can be tested before they are installed.
+type TestVerifyCmd struct {
+	Fs         afero.Fs
+	PolicyPath string
+	// Explain prints the rule that decided and why it took precedence
+	Explain bool
+}
+
+func NewTestVerifyCmd(policyPath string, explain bool) *TestVerifyCmd {
+	return &TestVerifyCmd{Fs: afero.NewOsFs(), PolicyPath: policyPath, Explain: explain}
+}
+
+// Run evaluates the policy for the ID Token claims in the JSON file at
+// claimsPath and principal, writes the decision to out and returns an error
+// if access is denied
+func (t *TestVerifyCmd) Run(out io.Writer, principal string, claimsPath string) error {
+	policyBytes, err := afero.ReadFile(t.Fs, t.PolicyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file %s: %w", t.PolicyPath, err)
+	}
+	claims, err := afero.ReadFile(t.Fs, claimsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read claims file %s: %w", claimsPath, err)
+	}
+	decision, err := policy.ExplainFromBytes(policyBytes, claims, principal)
+	if err != nil {
+		return err
+	}
+
+	result := "denied"
+	if decision.Allowed {
+		result = "allowed"
+	}
+	fmt.Fprintf(out, "Access to %s is %s by %s\n", principal, result, t.PolicyPath)
+	if t.Explain {
+		fmt.Fprintf(out, "Access %s\n", decision.Reason)
+	}
+	if !decision.Allowed {
+		return policy.EvaluateFromBytes(policyBytes, claims, principal)
+	}
+	return nil
+}
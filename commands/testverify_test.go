@@ -0,0 +1,81 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestVerify(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/auth_id", []byte(`* *@example.com https://accounts.example.com deny
+root alice@example.com https://accounts.example.com
+`), 0640))
+	require.NoError(t, afero.WriteFile(fs, "/alice.json", []byte(`{"iss":"https://accounts.example.com","sub":"alice","email":"alice@example.com","email_verified":true}`), 0600))
+	require.NoError(t, afero.WriteFile(fs, "/bob.json", []byte(`{"iss":"https://accounts.example.com","sub":"bob","email":"bob@example.com","email_verified":true}`), 0600))
+
+	tests := []struct {
+		name        string
+		claimsPath  string
+		explain     bool
+		wantOutput  string
+		errorString string
+	}{
+		{
+			name:       "Allowed",
+			claimsPath: "/alice.json",
+			wantOutput: "Access to root is allowed by /auth_id\n",
+		},
+		{
+			name:       "Allowed with explain",
+			claimsPath: "/alice.json",
+			explain:    true,
+			wantOutput: "Access to root is allowed by /auth_id\n" +
+				`Access allowed by the explicit allow rule "root alice@example.com https://accounts.example.com" which takes precedence over the wildcard deny rule "* *@example.com https://accounts.example.com deny"` + "\n",
+		},
+		{
+			name:        "Denied with explain",
+			claimsPath:  "/bob.json",
+			explain:     true,
+			wantOutput:  "Access to root is denied by /auth_id\n" + `Access denied by the wildcard deny rule "* *@example.com https://accounts.example.com deny", no explicit allow rule matched` + "\n",
+			errorString: "policy denies bob@example.com",
+		},
+		{
+			name:        "Missing claims file",
+			claimsPath:  "/missing.json",
+			errorString: "failed to read claims file /missing.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &TestVerifyCmd{Fs: fs, PolicyPath: "/auth_id", Explain: tt.explain}
+			var out bytes.Buffer
+			err := cmd.Run(&out, "root", tt.claimsPath)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantOutput, out.String())
+		})
+	}
+}
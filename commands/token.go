@@ -0,0 +1,68 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openpubkey/openpubkey/gq"
+	"github.com/spf13/afero"
+)
+
+// TokenCmd prints the ID Token from the PK Token in the local opkssh key so
+// that it can be passed to services that accept the ID Token directly
+type TokenCmd struct {
+	Fs         afero.Fs
+	keyPathArg string
+	now        func() time.Time // Used in tests to control the current time
+}
+
+func NewTokenCmd(keyPathArg string) *TokenCmd {
+	return &TokenCmd{
+		Fs:         afero.NewOsFs(),
+		keyPathArg: keyPathArg,
+		now:        time.Now,
+	}
+}
+
+// Run prints the ID Token to stdout
+func (t *TokenCmd) Run() error {
+	idToken, err := t.IDToken()
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(idToken))
+	return nil
+}
+
+// IDToken returns the ID Token from the PK Token in the local opkssh key.
+// Returns an error if the ID Token has expired or if its signature was
+// replaced by a GQ signature, as other services can not verify it.
+func (t *TokenCmd) IDToken() ([]byte, error) {
+	identity, err := findLocalIdentity(t.Fs, t.keyPathArg)
+	if err != nil {
+		return nil, err
+	}
+	if !t.now().Before(identity.ExpiresAt) {
+		return nil, fmt.Errorf("ID Token in %s expired at %s, run opkssh login to get a new one", identity.PubkeyPath, identity.ExpiresAt.Format(time.RFC3339))
+	}
+	if alg, ok := identity.PKT.ProviderAlgorithm(); ok && alg == gq.GQ256 {
+		return nil, fmt.Errorf("ID Token in %s is GQ signed and can not be verified by other services", identity.PubkeyPath)
+	}
+	return identity.PKT.OpToken, nil
+}
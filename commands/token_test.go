@@ -0,0 +1,111 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken(t *testing.T) {
+	pkt, signer, _ := Mocks(t)
+	certBytes, seckeyPem, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+
+	// A PK Token with a GQ signed ID Token
+	gqOpts := providers.DefaultMockProviderOpts()
+	gqOpts.GQSign = true
+	gqOp, _, _, err := providers.NewMockProvider(gqOpts)
+	require.NoError(t, err)
+	gqSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	gqClient, err := client.New(gqOp, client.WithSigner(gqSigner, jwa.ES256))
+	require.NoError(t, err)
+	gqPkt, err := gqClient.Auth(context.Background())
+	require.NoError(t, err)
+	gqCertBytes, gqSeckeyPem, err := createSSHCertAndKey(gqPkt, gqSigner, []string{})
+	require.NoError(t, err)
+
+	homePath, err := os.UserHomeDir()
+	require.NoError(t, err)
+	sshPath := filepath.Join(homePath, ".ssh")
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{Fs: mockFs}
+	require.NoError(t, loginCmd.writeKeys(filepath.Join(sshPath, "id_ecdsa"), filepath.Join(sshPath, "id_ecdsa.pub"), seckeyPem, certBytes))
+	require.NoError(t, loginCmd.writeKeys("/keys/gq", "/keys/gq.pub", gqSeckeyPem, gqCertBytes))
+
+	identity, err := readLocalIdentity(mockFs, filepath.Join(sshPath, "id_ecdsa.pub"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		keyPath     string
+		now         time.Time
+		expected    []byte
+		errorString string
+	}{
+		{
+			name:     "Valid token",
+			now:      identity.IssuedAt,
+			expected: pkt.OpToken,
+		},
+		{
+			name:        "Expired token",
+			now:         identity.ExpiresAt.Add(time.Second),
+			errorString: "expired at",
+		},
+		{
+			name:        "GQ signed token",
+			keyPath:     "/keys/gq",
+			now:         identity.IssuedAt,
+			errorString: "is GQ signed",
+		},
+		{
+			name:        "Missing key",
+			keyPath:     "/keys/missing",
+			now:         identity.IssuedAt,
+			errorString: "failed to read: /keys/missing.pub",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenCmd := NewTokenCmd(tt.keyPath)
+			tokenCmd.Fs = mockFs
+			tokenCmd.now = func() time.Time { return tt.now }
+			idToken, err := tokenCmd.IDToken()
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Nil(t, idToken)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, idToken)
+			}
+		})
+	}
+}
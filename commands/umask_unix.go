@@ -0,0 +1,31 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !windows
+
+package commands
+
+import "syscall"
+
+// withUmask runs fn with the process umask set to mask, so that files and
+// sockets fn creates never have more permissions than mask allows, even for
+// an instant. The umask is process wide, so fn should not run while other
+// goroutines are creating files.
+func withUmask(mask int, fn func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -18,22 +18,31 @@ package commands
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/verifier"
 	"github.com/openpubkey/opkssh/commands/config"
 	"github.com/openpubkey/opkssh/policy"
 	"github.com/openpubkey/opkssh/policy/files"
+	"github.com/openpubkey/opkssh/policy/plugins"
 	"github.com/openpubkey/opkssh/sshcert"
 	"github.com/spf13/afero"
 	"golang.org/x/crypto/ssh"
 )
 
-// PolicyEnforcerFunc returns nil if the supplied PK token is permitted to login as
-// username. Otherwise, an error is returned indicating the reason for rejection
-type PolicyEnforcerFunc func(username string, pkt *pktoken.PKToken, sshCert string, keyType string) error
+// PolicyEnforcerFunc returns what in the policy permits the supplied PK token
+// to login as username. Otherwise, an error is returned indicating the reason
+// for rejection. If the policy restricts username to a command, the command
+// is set in the returned match.
+type PolicyEnforcerFunc func(username string, pkt *pktoken.PKToken, sshCert string, keyType string) (*policy.Match, error)
 
 // VerifyCmd provides functionality to verify OPK tokens contained in SSH
 // certificates and authorize requests to SSH as a specific username using a
@@ -51,6 +60,16 @@ type VerifyCmd struct {
 	ConfigPathArg string
 	// filePermChecker is used to check the file permissions of the config file
 	filePermChecker files.PermsChecker
+	// serverConfig is the server config loaded from ConfigPathArg, nil if it
+	// has not been loaded
+	serverConfig *config.ServerConfig
+	// privDropper is used to drop privileges if the server config asks for it
+	privDropper privilegeDropper
+	// jwksCacheTTL, if not zero, is how long the PK Token verifier keeps the
+	// JWKS it fetches. It is set by the verify daemon.
+	jwksCacheTTL time.Duration
+	// startCommand starts post_verify_command, startDetached if nil
+	startCommand commandStarter
 }
 
 func NewVerifyCmd(pktVerifier verifier.Verifier, checkPolicy PolicyEnforcerFunc, configPathArg string) *VerifyCmd {
@@ -64,6 +83,7 @@ func NewVerifyCmd(pktVerifier verifier.Verifier, checkPolicy PolicyEnforcerFunc,
 			Fs:        fs,
 			CmdRunner: files.ExecCmd,
 		},
+		privDropper: osPrivilegeDropper{},
 	}
 }
 
@@ -87,60 +107,457 @@ func NewVerifyCmd(pktVerifier verifier.Verifier, checkPolicy PolicyEnforcerFunc,
 //
 // This function:
 // 1. Verifying the PK token with the OP (OpenID Provider)
-// 2. Enforcing policy by checking if the identity is allowed to assume
+// 2. Checking the certificate's public key is the key bound in the PK token
+// and that the certificate is signed by that key
+// 3. Checking the certificate's principals are allowed by the server config
+// 4. Enforcing policy by checking if the identity is allowed to assume
 // the username (principal) requested.
 //
+// If the cert is accepted, post_verify_command from the server config is
+// started without waiting for it.
+//
 // If all steps of verification succeed, then the expected authorized_keys file
 // format string is returned (i.e. the expected line to produce on standard
-// output when using sshd's AuthorizedKeysCommand feature). Otherwise, a non-nil
-// error is returned.
+// output when using sshd's AuthorizedKeysCommand feature). If the policy
+// restricts the principal to a command, the line starts with a command option
+// so that sshd only runs that command. Otherwise, a non-nil error is returned.
+// The checks are done by VerifyIdentity, AuthorizedKeysCommand adds logging
+// of whether access was authorized or denied.
 func (v *VerifyCmd) AuthorizedKeysCommand(ctx context.Context, userArg string, typArg string, certB64Arg string) (string, error) {
-	// Parse the b64 pubkey and expect it to be an ssh certificate
-	cert, err := sshcert.NewFromAuthorizedKey(typArg, certB64Arg)
-	if err != nil {
+	result, err := v.VerifyIdentity(ctx, userArg, certB64Arg, typArg)
+	var denied *DeniedError
+	if errors.As(err, &denied) {
+		log.Printf("Denied %s: %v\n", auditRecord(denied.PKToken, denied.Cert, userArg), denied.Err)
 		return "", err
-	}
-	if pkt, err := cert.VerifySshPktCert(ctx, v.PktVerifier); err != nil { // Verify the PKT contained in the cert
+	} else if err != nil {
 		return "", err
-	} else if err := v.CheckPolicy(userArg, pkt, certB64Arg, typArg); err != nil { // Check if username is authorized
+	}
+	if err := v.appendAuditChain(result, userArg); err != nil {
+		// Every accepted cert must be recorded, so a cert that can't be is denied
+		log.Printf("Denied %s: %v\n", auditRecord(result.PKToken, result.Cert, userArg), err)
 		return "", err
-	} else { // Success!
-		// sshd expects the public key in the cert, not the cert itself. This
-		// public key is key of the CA that signs the cert, in our setting there
-		// is no CA.
-		pubkeyBytes := ssh.MarshalAuthorizedKey(cert.SshCert.SignatureKey)
-		return "cert-authority " + string(pubkeyBytes), nil
 	}
+	log.Printf("Authorized %s\n", auditRecord(result.PKToken, result.Cert, userArg))
+	v.runPostVerifyCommand(result, userArg)
+	return result.AuthorizedKeysLine, nil
 }
 
-// SetEnvVarInConfig sets the environment variables specified in the server config file
-func (v *VerifyCmd) SetEnvVarInConfig() error {
+// appendAuditChain records the accepted cert in the audit chain if the server
+// config enables it
+func (v *VerifyCmd) appendAuditChain(result *VerifyResult, principal string) error {
+	if v.serverConfig == nil || v.serverConfig.AuditChain == nil {
+		return nil
+	}
+	entry := newAuditChainEntry(result, principal, time.Now())
+	if err := appendAuditChain(v.Fs, v.serverConfig.AuditChain.Path, entry); err != nil {
+		return fmt.Errorf("failed to record login in audit chain %s: %w", v.serverConfig.AuditChain.Path, err)
+	}
+	return nil
+}
+
+// VerifyResult describes an SSH cert that VerifyIdentity found may be used to
+// log in as a principal
+type VerifyResult struct {
+	// PKToken is the verified PK token contained in the cert
+	PKToken *pktoken.PKToken
+	// Cert is the SSH cert
+	Cert *ssh.Certificate
+	// Issuer, Subject and Email identify who is logging in. They are taken
+	// from the ID Token in the verified PK token.
+	Issuer  string
+	Subject string
+	Email   string
+	// Match is what in the policy allowed the identity to log in as the
+	// principal
+	Match *policy.Match
+	// AuthorizedKeysLine is the line, ending in a newline, that sshd
+	// expects an AuthorizedKeysCommand to print to accept the cert
+	AuthorizedKeysLine string
+}
+
+// DeniedError is returned by VerifyIdentity when the cert and the PK token in
+// it are valid but the identity may not log in as the principal
+type DeniedError struct {
+	PKToken *pktoken.PKToken
+	Cert    *ssh.Certificate
+	Err     error
+}
+
+func (e *DeniedError) Error() string { return e.Err.Error() }
+func (e *DeniedError) Unwrap() error { return e.Err }
+
+// VerifyIdentity performs the checks of AuthorizedKeysCommand on the
+// base64-encoded SSH cert certB64 of type typ presented to log in as
+// principal and returns the verified identity, the policy entry that allowed
+// it and the authorized_keys line for sshd. Unlike AuthorizedKeysCommand it
+// does not log the outcome, so it can be used by programs other than sshd
+// that authenticate opkssh certs. If the cert is valid but the policy does
+// not allow access the error is a *DeniedError. certB64 may also be the cert
+// in authorized_keys format, see normalizeCertArgs.
+func (v *VerifyCmd) VerifyIdentity(ctx context.Context, principal string, certB64 string, typ string) (*VerifyResult, error) {
+	typ, certB64, err := normalizeCertArgs(typ, certB64)
+	if err != nil {
+		return nil, err
+	}
+	// Parse the b64 pubkey and expect it to be an ssh certificate
+	cert, err := sshcert.NewFromAuthorizedKey(typ, certB64)
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := cert.VerifySshPktCert(ctx, v.PktVerifier) // Verify the PKT contained in the cert
+	if err != nil {
+		return nil, err
+	}
+	if err := v.verifyCertSignature(cert); err != nil { // Check the cert is signed by the key bound in the PKT or a trusted CA key
+		return nil, err
+	}
+	if err := v.checkSigningAlg(pkt); err != nil { // Check the ID Token is signed with the expected algorithm
+		return nil, err
+	}
+	if err := v.checkTrustedCA(cert.SshCert); err != nil { // Check the cert is signed by a CA key trusted by the server config
+		return nil, &DeniedError{PKToken: pkt, Cert: cert.SshCert, Err: err}
+	}
+	if err := v.checkCertPrincipals(cert.SshCert); err != nil { // Check the cert's principals are allowed by the server config
+		return nil, &DeniedError{PKToken: pkt, Cert: cert.SshCert, Err: err}
+	}
+	if err := v.checkCertLifetime(cert.SshCert); err != nil { // Check the cert's validity window is allowed by the server config
+		return nil, &DeniedError{PKToken: pkt, Cert: cert.SshCert, Err: err}
+	}
+	match, err := v.CheckPolicy(principal, pkt, certB64, typ) // Check if username is authorized
+	if err != nil {
+		return nil, &DeniedError{PKToken: pkt, Cert: cert.SshCert, Err: err}
+	}
+
+	var claims struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse ID Token: %w", err)
+	}
+
+	// sshd expects the public key in the cert, not the cert itself. This
+	// public key is key of the CA that signs the cert, in our setting there
+	// is no CA.
+	line := "cert-authority " + string(ssh.MarshalAuthorizedKey(cert.SshCert.SignatureKey))
+	if match != nil && match.Command != "" {
+		option, err := commandOption(match.Command)
+		if err != nil {
+			return nil, &DeniedError{PKToken: pkt, Cert: cert.SshCert, Err: err}
+		}
+		line = option + "," + line
+	}
+	return &VerifyResult{
+		PKToken:            pkt,
+		Cert:               cert.SshCert,
+		Issuer:             claims.Issuer,
+		Subject:            claims.Subject,
+		Email:              claims.Email,
+		Match:              match,
+		AuthorizedKeysLine: line,
+	}, nil
+}
+
+// normalizeCertArgs returns the key type and base64-encoded cert from the
+// %t and %k arguments sshd passes to the AuthorizedKeysCommand. Depending on
+// how the command is configured and quoted the cert may arrive as
+// "<type> <base64>" rather than the bare base64, and the type may be
+// missing, in which case it is read from the cert.
+func normalizeCertArgs(typ string, certB64 string) (string, string, error) {
+	typ = strings.TrimSpace(typ)
+	fields := strings.Fields(certB64)
+	switch len(fields) {
+	case 0:
+		return "", "", fmt.Errorf("no SSH cert supplied")
+	case 1:
+		certB64 = fields[0]
+	default:
+		// authorized_keys format, anything after the base64 is a comment
+		if typ != "" && typ != fields[0] {
+			return "", "", fmt.Errorf("key type %s does not match the type %s of the supplied key", typ, fields[0])
+		}
+		typ, certB64 = fields[0], fields[1]
+	}
+	if typ == "" {
+		keyBytes, err := base64.StdEncoding.DecodeString(certB64)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to decode SSH cert: %w", err)
+		}
+		pubkey, err := ssh.ParsePublicKey(keyBytes)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to parse SSH cert: %w", err)
+		}
+		typ = pubkey.Type()
+	}
+	return typ, certB64, nil
+}
+
+// auditRecord describes who is logging in as principal for the log. The
+// identity and issuer are taken from the verified PK token. The cert's key ID
+// is only recorded so the record can be matched with sshd's logs, it is not
+// verified. Every value is quoted, as claims the OP has not verified could
+// otherwise start a new log line or, in an exported authorized_keys file, a
+// new key.
+func auditRecord(pkt *pktoken.PKToken, cert *ssh.Certificate, principal string) string {
+	var claims struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return fmt.Sprintf("principal=%q (failed to parse ID Token: %v)", principal, err)
+	}
+	return fmt.Sprintf("principal=%q email=%q sub=%q issuer=%q cert_key_id=%q",
+		principal, claims.Email, claims.Subject, claims.Issuer, cert.KeyId)
+}
+
+// commandOption returns the authorized_keys command option that restricts
+// the key to command. Double quotes in the command are escaped with a
+// backslash, the only escape sshd recognizes, so other backslashes are
+// written as they are. A command ending in a backslash or spanning lines is
+// an error, as sshd would read the rest of the authorized_keys line as part
+// of the command.
+func commandOption(command string) (string, error) {
+	if strings.ContainsAny(command, "\r\n") {
+		return "", fmt.Errorf("command %q must be a single line", command)
+	}
+	if strings.HasSuffix(command, `\`) {
+		return "", fmt.Errorf("command %q must not end with a backslash", command)
+	}
+	escaped := strings.ReplaceAll(command, `"`, `\"`)
+	return `command="` + escaped + `"`, nil
+}
+
+// checkSigningAlg rejects ID Tokens not signed with the algorithm the server
+// config expects for the issuer
+func (v *VerifyCmd) checkSigningAlg(pkt *pktoken.PKToken) error {
+	if v.serverConfig == nil {
+		return nil
+	}
+	issuer, err := pkt.Issuer()
+	if err != nil {
+		return err
+	}
+	alg, ok := pkt.ProviderAlgorithm()
+	if !ok {
+		return fmt.Errorf("ID Token is missing the alg header")
+	}
+	return v.serverConfig.CheckSigningAlg(issuer, string(alg))
+}
+
+// checkCertPrincipals rejects certs whose principals are not allowed by
+// cert_principals in the server config
+func (v *VerifyCmd) checkCertPrincipals(cert *ssh.Certificate) error {
+	if v.serverConfig == nil {
+		return nil
+	}
+	return v.serverConfig.CheckCertPrincipals(cert.ValidPrincipals)
+}
+
+// checkCertLifetime rejects certs valid for longer than max_cert_lifetime in
+// the server config
+func (v *VerifyCmd) checkCertLifetime(cert *ssh.Certificate) error {
+	if v.serverConfig == nil {
+		return nil
+	}
+	return v.serverConfig.CheckCertLifetime(cert.ValidAfter, cert.ValidBefore)
+}
+
+// checkTrustedCA rejects certs not signed by one of the trusted_ca_keys in the
+// server config
+func (v *VerifyCmd) checkTrustedCA(cert *ssh.Certificate) error {
+	if v.serverConfig == nil {
+		return nil
+	}
+	return v.serverConfig.CheckTrustedCA(cert.SignatureKey)
+}
+
+// verifyCertSignature checks the cert is signed by the key bound in the PK
+// Token or, as for certs issued with login --ca-key, by one of the
+// trusted_ca_keys in the server config
+func (v *VerifyCmd) verifyCertSignature(cert *sshcert.SshCertSmuggler) error {
+	selfSignedErr := cert.VerifySelfSigned()
+	if selfSignedErr == nil || cert.SshCert.SignatureKey == nil || v.serverConfig == nil || len(v.serverConfig.TrustedCAKeys) == 0 {
+		return selfSignedErr
+	}
+	caKey := cert.SshCert.SignatureKey
+	if err := v.serverConfig.CheckTrustedCA(caKey); err != nil {
+		return selfSignedErr
+	}
+	if err := cert.VerifyCaSig(caKey); err != nil {
+		return fmt.Errorf("certificate signature does not verify with the trusted CA key %s: %w", ssh.FingerprintSHA256(caKey), err)
+	}
+	return nil
+}
+
+// LoadServerConfig reads and parses the server config file at ConfigPathArg
+// and keeps it for use during verification
+func (v *VerifyCmd) LoadServerConfig() (*config.ServerConfig, error) {
 	var configBytes []byte
 
 	// Load the file from the filesystem
 	afs := &afero.Afero{Fs: v.Fs}
 	configBytes, err := afs.ReadFile(v.ConfigPathArg)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	err = v.filePermChecker.CheckPerm(v.ConfigPathArg, []fs.FileMode{0640}, "root", "opksshuser")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	serverConfig, err := config.NewServerConfig(configBytes)
 	if err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	v.serverConfig = serverConfig
+	return serverConfig, nil
+}
+
+// SetEnvVarInConfig sets the environment variables specified in the server config file
+func (v *VerifyCmd) SetEnvVarInConfig() error {
+	serverConfig, err := v.LoadServerConfig()
+	if err != nil {
+		return err
 	}
 	return serverConfig.SetEnvVars()
 }
 
+// ApplyServerConfig is SetEnvVarInConfig for commands where the server
+// config is optional. A missing config file is not an error, but one that
+// can't be read, has the wrong permissions or doesn't parse is, so that the
+// checks the config turns on are never silently skipped.
+func (v *VerifyCmd) ApplyServerConfig() error {
+	err := v.SetEnvVarInConfig()
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Println("No server config at", v.ConfigPathArg)
+		return nil
+	}
+	return err
+}
+
+// LoadProviderPolicy returns the trusted providers and a PK Token verifier
+// for them. If the server config sets verification_bundle these come from
+// the bundle, which must be signed with the configured public key, and the
+// verifier does not use the network. Otherwise the providers are read from
+// providersPath. LoadServerConfig must be called first for the bundle to be
+// used.
+func (v *VerifyCmd) LoadProviderPolicy(providersPath string) (*policy.ProviderPolicy, *verifier.Verifier, error) {
+	if v.serverConfig == nil || v.serverConfig.VerificationBundle == nil {
+		providerPolicy, err := policy.NewProviderFileLoader().LoadProviderPolicy(providersPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open %s: %w", providersPath, err)
+		}
+		if v.serverConfig != nil {
+			if err := providerPolicy.SetDiscoveryURLs(v.serverConfig.DiscoveryURLs); err != nil {
+				return nil, nil, fmt.Errorf("invalid discovery_urls in server config: %w", err)
+			}
+		}
+		var pktVerifier *verifier.Verifier
+		if v.jwksCacheTTL > 0 {
+			pktVerifier, err = providerPolicy.CreateCachingVerifier(v.jwksCacheTTL)
+		} else {
+			pktVerifier, err = providerPolicy.CreateVerifier()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create pk token verifier (likely bad configuration): %w", err)
+		}
+		return providerPolicy, pktVerifier, nil
+	}
+
+	bundleConfig := v.serverConfig.VerificationBundle
+	if bundleConfig.Path == "" || bundleConfig.PublicKey == "" {
+		return nil, nil, fmt.Errorf("verification_bundle in server config must set both path and public_key")
+	}
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(bundleConfig.PublicKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid verification_bundle public_key in server config: %w", err)
+	}
+	signedBundle, err := afero.ReadFile(v.Fs, bundleConfig.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read verification bundle: %w", err)
+	}
+	bundle, err := policy.OpenVerificationBundle(signedBundle, pubkey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", bundleConfig.Path, err)
+	}
+	pktVerifier, err := bundle.CreateVerifier(bundleConfig.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create pk token verifier from verification bundle: %w", err)
+	}
+	return bundle.ProviderPolicy(bundleConfig.Path), pktVerifier, nil
+}
+
+// DropsPrivileges returns true if the server config asks verify to drop
+// privileges. Anything needing privileges, such as reading the policy, must
+// happen before DropPrivileges is called.
+func (v *VerifyCmd) DropsPrivileges() bool {
+	return v.serverConfig != nil && v.serverConfig.DropPrivileges != nil
+}
+
+// DropPrivileges switches to the user and group configured in the server
+// config under drop_privileges. It does nothing if drop_privileges is not set.
+func (v *VerifyCmd) DropPrivileges() error {
+	if !v.DropsPrivileges() {
+		return nil
+	}
+	return dropPrivileges(v.serverConfig.DropPrivileges, v.privDropper, osIdLookup)
+}
+
+// VerifyDaemonSocket returns the socket of the verify daemon that the server
+// config sets, or an empty string if verify checks certs itself
+func (v *VerifyCmd) VerifyDaemonSocket() string {
+	if v.serverConfig == nil || v.serverConfig.VerifyDaemon == nil {
+		return ""
+	}
+	return v.serverConfig.VerifyDaemon.Socket
+}
+
+// CaseSensitiveEmailLocalPart returns true if the server config makes the
+// part of an email before the @ case-sensitive when matching policy entries
+func (v *VerifyCmd) CaseSensitiveEmailLocalPart() bool {
+	return v.serverConfig != nil && v.serverConfig.CaseSensitiveEmailLocalPart
+}
+
+// AllowMissingEmailVerified returns true if the server config lets email
+// entries match ID Tokens that have no email_verified claim
+func (v *VerifyCmd) AllowMissingEmailVerified() bool {
+	return v.serverConfig != nil && v.serverConfig.AllowMissingEmailVerified
+}
+
 // OpkPolicyEnforcerAuthFunc returns an opkssh policy.Enforcer that can be
-// used in the opkssh verify command.
-func OpkPolicyEnforcerFunc(username string) PolicyEnforcerFunc {
+// used in the opkssh verify command. providerPolicy is used to match policy
+// entries against the fallback issuers of a provider. identityClaim, if set,
+// is the claim matched against email entries instead of the email claim.
+// caseSensitiveEmailLocalPart makes the part of an email before the @
+// case-sensitive when matching email entries. allowMissingEmailVerified lets
+// email entries match ID Tokens without an email_verified claim.
+func OpkPolicyEnforcerFunc(username string, providerPolicy *policy.ProviderPolicy, identityClaim string, caseSensitiveEmailLocalPart bool, allowMissingEmailVerified bool) PolicyEnforcerFunc {
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader:                policy.NewMultiPolicyLoader(username, policy.ReadWithSudoScript),
+		ProviderPolicy:              providerPolicy,
+		IdentityClaim:               identityClaim,
+		CaseSensitiveEmailLocalPart: caseSensitiveEmailLocalPart,
+		AllowMissingEmailVerified:   allowMissingEmailVerified,
+	}
+	return policyEnforcer.CheckPolicyMatch
+}
+
+// PreloadedOpkPolicyEnforcerFunc is like OpkPolicyEnforcerFunc but reads the
+// policy and the policy plugin configs immediately rather than when the PK
+// token is checked, so that they are read before privileges are dropped.
+func PreloadedOpkPolicyEnforcerFunc(username string, providerPolicy *policy.ProviderPolicy, identityClaim string, caseSensitiveEmailLocalPart bool, allowMissingEmailVerified bool) PolicyEnforcerFunc {
+	policyPlugins := plugins.NewPolicyPluginEnforcer()
+	policyPlugins.Preload(policy.PolicyPluginDir)
 	policyEnforcer := &policy.Enforcer{
-		PolicyLoader: policy.NewMultiPolicyLoader(username, policy.ReadWithSudoScript),
+		PolicyLoader:                policy.NewPreloadedLoader(policy.NewMultiPolicyLoader(username, policy.ReadWithSudoScript)),
+		ProviderPolicy:              providerPolicy,
+		IdentityClaim:               identityClaim,
+		CaseSensitiveEmailLocalPart: caseSensitiveEmailLocalPart,
+		AllowMissingEmailVerified:   allowMissingEmailVerified,
+		PolicyPlugins:               policyPlugins,
 	}
-	return policyEnforcer.CheckPolicy
+	return policyEnforcer.CheckPolicyMatch
 }
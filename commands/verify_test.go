@@ -17,12 +17,20 @@
 package commands
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/openpubkey/openpubkey/client"
@@ -30,6 +38,8 @@ import (
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/util"
 	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/openpubkey/opkssh/policy"
 	"github.com/openpubkey/opkssh/policy/files"
 	"github.com/openpubkey/opkssh/sshcert"
 	"github.com/spf13/afero"
@@ -37,8 +47,48 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func AllowAllPolicyEnforcer(userDesired string, pkt *pktoken.PKToken, certB64 string, typArg string) error {
-	return nil
+func AllowAllPolicyEnforcer(userDesired string, pkt *pktoken.PKToken, certB64 string, typArg string) (*policy.Match, error) {
+	return &policy.Match{}, nil
+}
+
+// mockVerifyPKToken returns a mock OP, a PK token it issued to
+// arthur.aardvark@example.com with a verified email, the key the PK token
+// commits to and a PK token verifier for the OP that ignores expiry
+func mockVerifyPKToken(t *testing.T) (providers.OpenIdProvider, *pktoken.PKToken, crypto.Signer, *verifier.Verifier) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	verPkt, err := verifier.New(op, verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+	return op, pkt, signer, verPkt
+}
+
+// mockVerifyCert is mockVerifyPKToken but returns an opkssh cert without
+// principals for the PK token, as the key type and base64 cert arguments
+// sshd passes to verify
+func mockVerifyCert(t *testing.T) (providers.OpenIdProvider, *verifier.Verifier, string, string) {
+	op, pkt, signer, verPkt := mockVerifyPKToken(t)
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+	typeArg, certB64Arg := certArgs(certBytes)
+	return op, verPkt, typeArg, certB64Arg
+}
+
+// certArgs splits a cert in authorized_keys format into the key type and
+// base64 cert arguments sshd passes to verify
+func certArgs(certBytes []byte) (string, string) {
+	fields := strings.Fields(string(certBytes))
+	return fields[0], fields[1]
 }
 
 func TestAuthorizedKeysCommand(t *testing.T) {
@@ -53,7 +103,8 @@ func TestAuthorizedKeysCommand(t *testing.T) {
 
 	mockEmail := "arthur.aardvark@example.com"
 	idtTemplate.ExtraClaims = map[string]any{
-		"email": mockEmail,
+		"email":          mockEmail,
+		"email_verified": true,
 	}
 
 	client, err := client.New(op, client.WithSigner(signer, alg))
@@ -99,6 +150,209 @@ func TestAuthorizedKeysCommand(t *testing.T) {
 	require.Contains(t, pubkeyList, expectedPubkeyList)
 }
 
+func TestAuthorizedKeysCommandCertArgForms(t *testing.T) {
+	t.Parallel()
+	pkt, signer, op := Mocks(t)
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+	authKey := strings.TrimSpace(string(certBytes))
+	typeArg, certB64Arg := strings.Split(authKey, " ")[0], strings.Split(authKey, " ")[1]
+
+	verPkt, err := verifier.New(op, verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+	ver := VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: func(username string, pkt *pktoken.PKToken, sshCert string, keyType string) (*policy.Match, error) {
+			// The policy is always given the bare cert and its type
+			require.Equal(t, certB64Arg, sshCert)
+			require.Equal(t, typeArg, keyType)
+			return nil, nil
+		},
+	}
+
+	tests := []struct {
+		name        string
+		typ         string
+		cert        string
+		errorString string
+	}{
+		{name: "Type and bare base64", typ: typeArg, cert: certB64Arg},
+		{name: "Type and type prefixed base64", typ: typeArg, cert: authKey},
+		{name: "Type prefixed base64 with comment", typ: typeArg, cert: authKey + " openpubkey\n"},
+		{name: "Type prefixed base64 without type", cert: authKey},
+		{name: "Bare base64 without type", cert: certB64Arg},
+		{name: "Surrounding whitespace", typ: " " + typeArg + " ", cert: " " + certB64Arg + "\n"},
+		{name: "Mismatched type", typ: ssh.KeyAlgoED25519, cert: authKey, errorString: "key type ssh-ed25519 does not match the type " + typeArg},
+		{name: "Empty cert", typ: typeArg, cert: " ", errorString: "no SSH cert supplied"},
+		{name: "Invalid base64 without type", cert: "not-base64!", errorString: "failed to decode SSH cert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pubkeyList, err := ver.AuthorizedKeysCommand(context.Background(), "user", tt.typ, tt.cert)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Contains(t, pubkeyList, "cert-authority ecdsa-sha2-nistp256")
+		})
+	}
+}
+
+// TestAuthorizedKeysCommandLargePKToken checks that a cert carrying a large
+// PK token, such as one from an OP that puts many groups in the ID Token,
+// verifies without being truncated anywhere between the cert arg and the PK
+// token verifier
+func TestAuthorizedKeysCommandLargePKToken(t *testing.T) {
+	t.Parallel()
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+
+	groups := []string{}
+	for i := 0; i < 2000; i++ {
+		groups = append(groups, fmt.Sprintf("engineering-platform-infrastructure-team-%04d", i))
+	}
+	idtTemplate.ExtraClaims = map[string]any{
+		"email":          "arthur.aardvark@example.com",
+		"email_verified": true,
+		"groups":         groups,
+	}
+
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	cert, err := sshcert.New(pkt, []string{})
+	require.NoError(t, err)
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	require.NoError(t, err)
+	signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+	require.NoError(t, err)
+	sshCert, err := cert.SignCert(signerMas)
+	require.NoError(t, err)
+
+	typeArg, certB64Arg, ok := strings.Cut(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshCert))), " ")
+	require.True(t, ok)
+	// Well over the 4096 byte limit old versions of OpenSSH placed on
+	// AuthorizedKeysCommand arguments
+	require.Greater(t, len(certB64Arg), 100*1024)
+
+	verPkt, err := verifier.New(op, verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+
+	var verifiedGroups []string
+	ver := VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: func(userDesired string, verifiedPkt *pktoken.PKToken, certB64 string, typArg string) (*policy.Match, error) {
+			require.Equal(t, certB64Arg, certB64)
+			var claims struct {
+				Groups []string `json:"groups"`
+			}
+			require.NoError(t, json.Unmarshal(verifiedPkt.Payload, &claims))
+			verifiedGroups = claims.Groups
+			return &policy.Match{}, nil
+		},
+	}
+
+	pubkeyList, err := ver.AuthorizedKeysCommand(context.Background(), "user", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.Contains(t, pubkeyList, "cert-authority ecdsa-sha2-nistp256")
+	require.Equal(t, groups, verifiedGroups)
+}
+
+func TestAuthorizedKeysCommandAudience(t *testing.T) {
+	t.Parallel()
+	expectedClientID := "test_client_id"
+
+	tests := []struct {
+		name        string
+		aud         any
+		errorString string
+	}{
+		{
+			name: "String aud matching client ID",
+			aud:  expectedClientID,
+		},
+		{
+			name: "Array aud containing client ID",
+			aud:  []string{"other_client_id", expectedClientID, "another_client_id"},
+		},
+		{
+			name: "Array aud with only client ID",
+			aud:  []string{expectedClientID},
+		},
+		{
+			name:        "String aud not matching client ID",
+			aud:         "other_client_id",
+			errorString: "audience does not contain clientID test_client_id",
+		},
+		{
+			name:        "Array aud not containing client ID",
+			aud:         []string{"other_client_id", "another_client_id"},
+			errorString: "audience does not contain clientID test_client_id",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg := jwa.ES256
+			signer, err := util.GenKeyPair(alg)
+			require.NoError(t, err)
+
+			// The mock provider issuing the ID Token skips the client ID
+			// check so that we can issue ID Tokens with any audience. The
+			// audience is then checked by the verifier used by opkssh verify.
+			providerOpts := providers.DefaultMockProviderOpts()
+			providerOpts.VerifierOpts.SkipClientIDCheck = true
+			op, backend, idtTemplate, err := providers.NewMockProvider(providerOpts)
+			require.NoError(t, err)
+			idtTemplate.ExtraClaims = map[string]any{
+				"email":          "arthur.aardvark@example.com",
+				"email_verified": true,
+				"aud":            tt.aud,
+			}
+
+			opkClient, err := client.New(op, client.WithSigner(signer, alg))
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			require.NoError(t, err)
+
+			certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+			require.NoError(t, err)
+			typeArg, certB64Arg := certArgs(certBytes)
+
+			providerVerifier := providers.NewProviderVerifier(op.Issuer(), providers.ProviderVerifierOpts{
+				CommitType:        providers.CommitTypesEnum.NONCE_CLAIM,
+				ClientID:          expectedClientID,
+				DiscoverPublicKey: backend.GetPublicKeyFinder(),
+			})
+			verPkt, err := verifier.New(
+				providerVerifier,
+				verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE),
+			)
+			require.NoError(t, err)
+
+			ver := VerifyCmd{
+				PktVerifier: *verPkt,
+				CheckPolicy: AllowAllPolicyEnforcer,
+			}
+			pubkeyList, err := ver.AuthorizedKeysCommand(context.Background(), "user", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, pubkeyList)
+			} else {
+				require.NoError(t, err)
+				require.Contains(t, pubkeyList, "cert-authority ecdsa-sha2-nistp256")
+			}
+		})
+	}
+}
+
 func TestEnvFromConfig(t *testing.T) {
 	// Do not run this test in parallel with other tests as it modifies environment variables
 
@@ -200,3 +454,670 @@ env_vars:
 	}
 
 }
+
+func TestApplyServerConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		configFile  map[string]string
+		permission  fs.FileMode
+		errorString string
+	}{
+		{
+			name:       "Missing config",
+			configFile: map[string]string{"wrong-filename.yml": "---\n"},
+			permission: 0640,
+		},
+		{
+			name:        "Wrong Permissions",
+			configFile:  map[string]string{"server_config.yml": "---\n"},
+			permission:  0677,
+			errorString: "expected one of the following permissions [640], got (677)",
+		},
+		{
+			name:        "Corrupted file",
+			configFile:  map[string]string{"server_config.yml": `;;;corrupted`},
+			permission:  0640,
+			errorString: "failed to parse config file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mockFs := afero.NewMemMapFs()
+			for name, content := range tt.configFile {
+				err := afero.WriteFile(mockFs, filepath.Join("/etc/opk", name), []byte(content), tt.permission)
+				require.NoError(t, err)
+			}
+
+			ver := VerifyCmd{
+				Fs:            mockFs,
+				ConfigPathArg: "/etc/opk/server_config.yml",
+				filePermChecker: files.PermsChecker{
+					Fs: mockFs,
+					CmdRunner: func(name string, arg ...string) ([]byte, error) {
+						return []byte("root opksshuser"), nil
+					},
+				},
+			}
+			err := ver.ApplyServerConfig()
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandSigningAlg(t *testing.T) {
+	t.Parallel()
+	issuer := "https://accounts.example.com"
+
+	tests := []struct {
+		name        string
+		opAlg       string
+		gqSign      bool
+		pinnedAlgs  map[string]string
+		errorString string
+	}{
+		{
+			name:  "No server config accepts any alg",
+			opAlg: "ES256",
+		},
+		{
+			name:       "Issuer not pinned accepts any alg",
+			opAlg:      "ES256",
+			pinnedAlgs: map[string]string{"https://other.example.com": "RS256"},
+		},
+		{
+			name:       "Matching alg",
+			opAlg:      "RS256",
+			pinnedAlgs: map[string]string{issuer: "RS256"},
+		},
+		{
+			name:       "GQ signed token from RS256 issuer",
+			opAlg:      "RS256",
+			gqSign:     true,
+			pinnedAlgs: map[string]string{issuer: "RS256"},
+		},
+		{
+			name:        "Mismatched alg",
+			opAlg:       "ES256",
+			pinnedAlgs:  map[string]string{issuer: "RS256"},
+			errorString: "ID Token from issuer https://accounts.example.com is signed with ES256 but server config expects RS256",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg := jwa.ES256
+			signer, err := util.GenKeyPair(alg)
+			require.NoError(t, err)
+
+			providerOpts := providers.DefaultMockProviderOpts()
+			providerOpts.Alg = tt.opAlg
+			providerOpts.GQSign = tt.gqSign
+			op, backend, idtTemplate, err := providers.NewMockProvider(providerOpts)
+			require.NoError(t, err)
+			idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+
+			opkClient, err := client.New(op, client.WithSigner(signer, alg))
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			require.NoError(t, err)
+
+			certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+			require.NoError(t, err)
+			typeArg, certB64Arg := certArgs(certBytes)
+
+			providerVerifier := providers.NewProviderVerifier(op.Issuer(), providers.ProviderVerifierOpts{
+				CommitType:        providers.CommitTypesEnum.NONCE_CLAIM,
+				ClientID:          "test_client_id",
+				DiscoverPublicKey: backend.GetPublicKeyFinder(),
+			})
+			verPkt, err := verifier.New(
+				providerVerifier,
+				verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE),
+			)
+			require.NoError(t, err)
+
+			ver := VerifyCmd{
+				PktVerifier: *verPkt,
+				CheckPolicy: AllowAllPolicyEnforcer,
+			}
+			if tt.pinnedAlgs != nil {
+				ver.serverConfig = &config.ServerConfig{IdTokenSigningAlgs: tt.pinnedAlgs}
+			}
+			pubkeyList, err := ver.AuthorizedKeysCommand(context.Background(), "user", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, pubkeyList)
+			} else {
+				require.NoError(t, err)
+				require.Contains(t, pubkeyList, "cert-authority ecdsa-sha2-nistp256")
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandRestrictedCommand(t *testing.T) {
+	op, verPkt, typeArg, certB64Arg := mockVerifyCert(t)
+
+	issuer := op.Issuer()
+	policyTable := "backup arthur.aardvark@example.com " + issuer + " 'command=/usr/bin/rsync --server --sender \"/srv/backup\"'\n" +
+		"dev arthur.aardvark@example.com " + issuer + "\n"
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader: &staticPolicyLoader{policy: policy.FromTable([]byte(policyTable), "test")},
+	}
+	ver := VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: policyEnforcer.CheckPolicyMatch,
+	}
+
+	// The restricted principal gets a command option
+	authKey, err := ver.AuthorizedKeysCommand(context.Background(), "backup", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authKey, `command="/usr/bin/rsync --server --sender \"/srv/backup\"",cert-authority ecdsa-sha2-nistp256 `), authKey)
+
+	// The unrestricted principal does not
+	authKey, err = ver.AuthorizedKeysCommand(context.Background(), "dev", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authKey, "cert-authority ecdsa-sha2-nistp256 "), authKey)
+	require.NotContains(t, authKey, "command=")
+
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+	require.ErrorContains(t, err, "no policy to allow arthur.aardvark@example.com")
+
+	// A command sshd would misparse denies access rather than writing a
+	// broken authorized_keys line, even if the policy check did not reject it
+	ver.CheckPolicy = func(string, *pktoken.PKToken, string, string) (*policy.Match, error) {
+		return &policy.Match{Command: `/bin/echo \`}, nil
+	}
+	authKey, err = ver.AuthorizedKeysCommand(context.Background(), "backup", typeArg, certB64Arg)
+	require.ErrorContains(t, err, "must not end with a backslash")
+	require.Empty(t, authKey)
+}
+
+func TestCommandOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    string
+		wantErr string
+	}{
+		{name: "plain", command: "/usr/bin/backup", want: `command="/usr/bin/backup"`},
+		{name: "quotes", command: `/bin/sh -c "ls"`, want: `command="/bin/sh -c \"ls\""`},
+		{name: "backslash", command: `/bin/echo a\b`, want: `command="/bin/echo a\b"`},
+		{name: "escaped quote", command: `/bin/echo \"`, want: `command="/bin/echo \\""`},
+		{name: "trailing backslash", command: `/bin/echo \`, wantErr: "must not end with a backslash"},
+		{name: "newline", command: "/bin/true\n/bin/false", wantErr: "must be a single line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := commandOption(tt.command)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandCertPrincipals(t *testing.T) {
+	_, pkt, signer, verPkt := mockVerifyPKToken(t)
+
+	tests := []struct {
+		name           string
+		certPrincipals []string
+		constraints    *config.CertPrincipalsConfig
+		errorString    string
+	}{
+		{name: "No constraints", certPrincipals: []string{"root", "dev", "*"}},
+		{name: "No principals", certPrincipals: []string{}, constraints: &config.CertPrincipalsConfig{MaxPrincipals: 1, ForbidWildcard: true}},
+		{name: "At most max principals", certPrincipals: []string{"root"}, constraints: &config.CertPrincipalsConfig{MaxPrincipals: 1}},
+		{
+			name:           "Too many principals",
+			certPrincipals: []string{"root", "dev"},
+			constraints:    &config.CertPrincipalsConfig{MaxPrincipals: 1},
+			errorString:    "cert has 2 principals but server config allows at most 1",
+		},
+		{name: "Wildcard allowed", certPrincipals: []string{"dev-*"}, constraints: &config.CertPrincipalsConfig{MaxPrincipals: 1}},
+		{
+			name:           "Wildcard forbidden",
+			certPrincipals: []string{"root", "*"},
+			constraints:    &config.CertPrincipalsConfig{ForbidWildcard: true},
+			errorString:    `cert has wildcard principal "*" but server config forbids wildcard principals`,
+		},
+		{
+			name:           "Glob forbidden",
+			certPrincipals: []string{"dev-?"},
+			constraints:    &config.CertPrincipalsConfig{ForbidWildcard: true},
+			errorString:    `cert has wildcard principal "dev-?"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certBytes, _, err := createSSHCertAndKey(pkt, signer, tt.certPrincipals)
+			require.NoError(t, err)
+			typeArg, certB64Arg := certArgs(certBytes)
+
+			ver := VerifyCmd{
+				PktVerifier:  *verPkt,
+				CheckPolicy:  AllowAllPolicyEnforcer,
+				serverConfig: &config.ServerConfig{CertPrincipals: tt.constraints},
+			}
+			authKey, err := ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, authKey)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(authKey, "cert-authority ecdsa-sha2-nistp256 "), authKey)
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandMaxCertLifetime(t *testing.T) {
+	_, pkt, signer, verPkt := mockVerifyPKToken(t)
+
+	now := uint64(time.Now().Unix())
+	validity := func(validAfter uint64, validBefore uint64) sshcert.CertOption {
+		return func(cert *ssh.Certificate) error {
+			cert.ValidAfter = validAfter
+			cert.ValidBefore = validBefore
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name            string
+		validity        sshcert.CertOption
+		maxCertLifetime time.Duration
+		errorString     string
+	}{
+		{name: "No limit", validity: validity(0, ssh.CertTimeInfinity)},
+		{name: "Within limit", validity: validity(now, now+3600), maxCertLifetime: 24 * time.Hour},
+		{name: "Exactly the limit", validity: validity(now, now+24*3600), maxCertLifetime: 24 * time.Hour},
+		{
+			name:            "Over limit",
+			validity:        validity(now, now+48*3600),
+			maxCertLifetime: 24 * time.Hour,
+			errorString:     "cert is valid for 48h0m0s but server config allows a lifetime of at most 24h0m0s",
+		},
+		{
+			name:            "Never expires",
+			validity:        validity(0, ssh.CertTimeInfinity),
+			maxCertLifetime: 24 * time.Hour,
+			errorString:     "cert never expires but server config allows a lifetime of at most 24h0m0s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{}, tt.validity)
+			require.NoError(t, err)
+			typeArg, certB64Arg := certArgs(certBytes)
+
+			ver := VerifyCmd{
+				PktVerifier:  *verPkt,
+				CheckPolicy:  AllowAllPolicyEnforcer,
+				serverConfig: &config.ServerConfig{MaxCertLifetime: tt.maxCertLifetime},
+			}
+			authKey, err := ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, authKey)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(authKey, "cert-authority ecdsa-sha2-nistp256 "), authKey)
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandPostVerifyCommand(t *testing.T) {
+	op, verPkt, typeArg, certB64Arg := mockVerifyCert(t)
+
+	denyAll := func(string, *pktoken.PKToken, string, string) (*policy.Match, error) {
+		return nil, fmt.Errorf("no policy to allow")
+	}
+
+	tests := []struct {
+		name              string
+		checkPolicy       PolicyEnforcerFunc
+		postVerifyCommand string
+		startErr          error
+		wantCommand       []string
+		errorString       string
+	}{
+		{
+			name:              "Run on success",
+			checkPolicy:       AllowAllPolicyEnforcer,
+			postVerifyCommand: `/usr/local/bin/provision-home --notify "#ssh logins"`,
+			wantCommand:       []string{"/usr/local/bin/provision-home", "--notify", "#ssh logins"},
+		},
+		{
+			name:        "Not set",
+			checkPolicy: AllowAllPolicyEnforcer,
+		},
+		{
+			name:              "Not run on denial",
+			checkPolicy:       denyAll,
+			postVerifyCommand: "/usr/local/bin/provision-home",
+			errorString:       "no policy to allow",
+		},
+		{
+			name:              "Failure does not deny",
+			checkPolicy:       AllowAllPolicyEnforcer,
+			postVerifyCommand: "/usr/local/bin/missing",
+			startErr:          fmt.Errorf("no such file or directory"),
+			wantCommand:       []string{"/usr/local/bin/missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotCommand []string
+			var gotEnv []string
+			ver := VerifyCmd{
+				PktVerifier:  *verPkt,
+				CheckPolicy:  tt.checkPolicy,
+				serverConfig: &config.ServerConfig{PostVerifyCommand: tt.postVerifyCommand},
+				startCommand: func(command []string, env []string) error {
+					gotCommand, gotEnv = command, env
+					return tt.startErr
+				},
+			}
+			authKey, err := ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, authKey)
+			} else {
+				require.NoError(t, err)
+				require.NotEmpty(t, authKey)
+			}
+			require.Equal(t, tt.wantCommand, gotCommand)
+			if tt.wantCommand == nil {
+				require.Nil(t, gotEnv)
+				return
+			}
+			// The login is described after the inherited environment, so
+			// that it takes precedence
+			require.Equal(t, []string{
+				"OPKSSH_PRINCIPAL=root",
+				"OPKSSH_ISSUER=" + op.Issuer(),
+				"OPKSSH_SUB=me",
+				"OPKSSH_EMAIL=arthur.aardvark@example.com",
+				"OPKSSH_KEY_ID=arthur.aardvark@example.com " + op.Issuer(),
+			}, gotEnv[len(gotEnv)-5:])
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandTrustedCA(t *testing.T) {
+	_, pkt, signer, verPkt := mockVerifyPKToken(t)
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, nil)
+	require.NoError(t, err)
+	typeArg, certB64Arg := certArgs(certBytes)
+
+	authorizedKey := func(s crypto.Signer) string {
+		pubkey, err := ssh.NewPublicKey(s.Public())
+		require.NoError(t, err)
+		return string(ssh.MarshalAuthorizedKey(pubkey))
+	}
+
+	tests := []struct {
+		name          string
+		trustedCAKeys []string
+		errorString   string
+	}{
+		{name: "No trusted CA keys"},
+		{name: "Trusted CA key", trustedCAKeys: []string{authorizedKey(otherSigner), authorizedKey(signer)}},
+		{name: "Untrusted CA key", trustedCAKeys: []string{authorizedKey(otherSigner)}, errorString: "which is not in trusted_ca_keys"},
+		{name: "Invalid trusted CA key", trustedCAKeys: []string{"ssh-ed25519 not-a-key"}, errorString: "invalid trusted_ca_keys entry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ver := VerifyCmd{
+				PktVerifier:  *verPkt,
+				CheckPolicy:  AllowAllPolicyEnforcer,
+				serverConfig: &config.ServerConfig{TrustedCAKeys: tt.trustedCAKeys},
+			}
+			authKey, err := ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, authKey)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "cert-authority "+authorizedKey(signer), authKey)
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandCASigned(t *testing.T) {
+	alg := jwa.ES256
+	_, pkt, _, verPkt := mockVerifyPKToken(t)
+	_, caKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	caSigner, err := ssh.NewSignerFromSigner(caKey)
+	require.NoError(t, err)
+	otherCAKey, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	otherCASigner, err := ssh.NewSignerFromSigner(otherCAKey)
+	require.NoError(t, err)
+
+	// The cert binds the key in the PK Token but is signed by the CA key
+	certBytes, err := createSSHCert(pkt, caSigner, nil)
+	require.NoError(t, err)
+	typeArg, certB64Arg := certArgs(certBytes)
+
+	caAuthorizedKey := string(ssh.MarshalAuthorizedKey(caSigner.PublicKey()))
+	otherCAAuthorizedKey := string(ssh.MarshalAuthorizedKey(otherCASigner.PublicKey()))
+
+	tests := []struct {
+		name          string
+		trustedCAKeys []string
+		errorString   string
+	}{
+		{name: "Trusted CA key", trustedCAKeys: []string{otherCAAuthorizedKey, caAuthorizedKey}},
+		{name: "No trusted CA keys", errorString: "certificate is signed by a key"},
+		{name: "Untrusted CA key", trustedCAKeys: []string{otherCAAuthorizedKey}, errorString: "certificate is signed by a key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ver := VerifyCmd{
+				PktVerifier:  *verPkt,
+				CheckPolicy:  AllowAllPolicyEnforcer,
+				serverConfig: &config.ServerConfig{TrustedCAKeys: tt.trustedCAKeys},
+			}
+			authKey, err := ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Empty(t, authKey)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "cert-authority "+caAuthorizedKey, authKey)
+		})
+	}
+
+	// A cert signed by a trusted CA key still has to hold a PK Token that
+	// commits to the key in the cert
+	otherSigner, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+	cert, err := sshcert.NewFromAuthorizedKey(typeArg, certB64Arg)
+	require.NoError(t, err)
+	cert.SshCert.Key, err = ssh.NewPublicKey(otherSigner.Public())
+	require.NoError(t, err)
+	mas, err := ssh.NewSignerWithAlgorithms(caSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoED25519})
+	require.NoError(t, err)
+	_, err = cert.SignCert(mas)
+	require.NoError(t, err)
+	swappedB64 := strings.Split(string(ssh.MarshalAuthorizedKey(cert.SshCert)), " ")[1]
+	ver := VerifyCmd{
+		PktVerifier:  *verPkt,
+		CheckPolicy:  AllowAllPolicyEnforcer,
+		serverConfig: &config.ServerConfig{TrustedCAKeys: []string{caAuthorizedKey}},
+	}
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, strings.TrimSpace(swappedB64))
+	require.ErrorContains(t, err, "does not match public key in certificate")
+}
+
+func TestAuthorizedKeysCommandKeyBinding(t *testing.T) {
+	_, pkt, _, verPkt := mockVerifyPKToken(t)
+	otherSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	ver := VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: AllowAllPolicyEnforcer,
+	}
+
+	otherSshSigner, err := ssh.NewSignerFromSigner(otherSigner)
+	require.NoError(t, err)
+	otherSignerMas, err := ssh.NewSignerWithAlgorithms(otherSshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		certKey     ssh.PublicKey
+		errorString string
+	}{
+		{
+			name:        "Cert key does not match the PK token",
+			certKey:     otherSshSigner.PublicKey(),
+			errorString: "public key 'upk' in PK Token does not match public key in certificate",
+		},
+		{
+			name:        "Cert key matches the PK token but cert signed by another key",
+			errorString: "certificate is signed by a key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := sshcert.New(pkt, []string{})
+			require.NoError(t, err)
+			if tt.certKey != nil {
+				cert.SshCert.Key = tt.certKey
+			}
+			sshCert, err := cert.SignCert(otherSignerMas)
+			require.NoError(t, err)
+
+			certTypeAndCertB64 := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshCert)))
+			typeArg := strings.Split(certTypeAndCertB64, " ")[0]
+			certB64Arg := strings.Split(certTypeAndCertB64, " ")[1]
+
+			authKey, err := ver.AuthorizedKeysCommand(context.Background(), "user", typeArg, certB64Arg)
+			require.ErrorContains(t, err, tt.errorString)
+			require.Empty(t, authKey)
+		})
+	}
+}
+
+func TestAuthorizedKeysCommandAuditLog(t *testing.T) {
+	op, pkt, signer, verPkt := mockVerifyPKToken(t)
+	policyTable := "dev arthur.aardvark@example.com " + op.Issuer() + "\n"
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader: &staticPolicyLoader{policy: policy.FromTable([]byte(policyTable), "test")},
+	}
+	ver := VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: policyEnforcer.CheckPolicyMatch,
+	}
+
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stdout)
+
+	// The cert's key ID records the issuer
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+	typeArg, certB64Arg := certArgs(certBytes)
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "dev", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.Contains(t, logBuf.String(), `Authorized principal="dev" email="arthur.aardvark@example.com" sub="me" issuer="https://accounts.example.com" cert_key_id="arthur.aardvark@example.com https://accounts.example.com"`)
+
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "root", typeArg, certB64Arg)
+	require.Error(t, err)
+	require.Contains(t, logBuf.String(), `Denied principal="root" email="arthur.aardvark@example.com" sub="me" issuer="https://accounts.example.com"`)
+
+	// A forged key ID is recorded but the identity and issuer come from the
+	// verified PK token
+	logBuf.Reset()
+	certBytes, _, err = createSSHCertAndKey(pkt, signer, []string{}, sshcert.WithKeyId("mallory@example.com https://evil.example.com"))
+	require.NoError(t, err)
+	typeArg, certB64Arg = certArgs(certBytes)
+	_, err = ver.AuthorizedKeysCommand(context.Background(), "dev", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.Contains(t, logBuf.String(), `Authorized principal="dev" email="arthur.aardvark@example.com" sub="me" issuer="https://accounts.example.com" cert_key_id="mallory@example.com https://evil.example.com"`)
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	op, pkt, signer, verPkt := mockVerifyPKToken(t)
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+	typeArg, certB64Arg := certArgs(certBytes)
+
+	issuer := op.Issuer()
+	policyTable := "backup arthur.aardvark@example.com " + issuer + " command=/usr/bin/backup\n" +
+		"dev me " + issuer + "\n" +
+		"root arthur.aardvark@example.com " + issuer + " deny\n"
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader: &staticPolicyLoader{policy: policy.FromTable([]byte(policyTable), "test")},
+	}
+	ver := VerifyCmd{
+		PktVerifier: *verPkt,
+		CheckPolicy: policyEnforcer.CheckPolicyMatch,
+	}
+
+	result, err := ver.VerifyIdentity(context.Background(), "dev", certB64Arg, typeArg)
+	require.NoError(t, err)
+	require.Equal(t, issuer, result.Issuer)
+	require.Equal(t, "me", result.Subject)
+	require.Equal(t, "arthur.aardvark@example.com", result.Email)
+	require.Equal(t, pkt.Payload, result.PKToken.Payload)
+	require.Equal(t, "me", result.Match.Entry.IdentityAttribute)
+	require.Equal(t, []string{"dev"}, result.Match.Entry.Principals)
+	require.Equal(t, "test", result.Match.Source)
+	require.Empty(t, result.Match.Command)
+	require.True(t, strings.HasPrefix(result.AuthorizedKeysLine, "cert-authority ecdsa-sha2-nistp256 "), result.AuthorizedKeysLine)
+	require.True(t, strings.HasSuffix(result.AuthorizedKeysLine, "\n"))
+
+	// The authorized_keys line is the one AuthorizedKeysCommand returns
+	authKey, err := ver.AuthorizedKeysCommand(context.Background(), "dev", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.Equal(t, authKey, result.AuthorizedKeysLine)
+
+	result, err = ver.VerifyIdentity(context.Background(), "backup", certB64Arg, typeArg)
+	require.NoError(t, err)
+	require.Equal(t, "arthur.aardvark@example.com", result.Match.Entry.IdentityAttribute)
+	require.Equal(t, "/usr/bin/backup", result.Match.Command)
+	require.True(t, strings.HasPrefix(result.AuthorizedKeysLine, `command="/usr/bin/backup",cert-authority `), result.AuthorizedKeysLine)
+
+	// A valid cert that the policy denies gives a DeniedError
+	result, err = ver.VerifyIdentity(context.Background(), "root", certB64Arg, typeArg)
+	require.ErrorContains(t, err, "policy denies arthur.aardvark@example.com")
+	require.Nil(t, result)
+	var denied *DeniedError
+	require.ErrorAs(t, err, &denied)
+	require.Equal(t, pkt.Payload, denied.PKToken.Payload)
+
+	// A cert that fails verification does not
+	_, err = ver.VerifyIdentity(context.Background(), "dev", certB64Arg[:len(certB64Arg)-8], typeArg)
+	require.Error(t, err)
+	require.False(t, errors.As(err, &denied))
+}
+
+type staticPolicyLoader struct {
+	policy *policy.Policy
+}
+
+func (l *staticPolicyLoader) Load() (*policy.Policy, policy.Source, error) {
+	return l.policy, policy.FileSource("test"), nil
+}
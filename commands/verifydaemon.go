@@ -0,0 +1,233 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+// The verify daemon protocol is one request per connection. The client
+// writes a verifyRequest as a line of JSON and the daemon answers with a
+// verifyResponse as a line of JSON, then closes the connection.
+
+const (
+	// DefaultVerifySocket is the socket opkssh serve-verify listens on if
+	// the server config does not set verify_daemon
+	DefaultVerifySocket = "/run/opk/verify.sock"
+	// verifyDaemonJwksCacheTTL is how long the daemon keeps the JWKS of an
+	// issuer before fetching it again
+	verifyDaemonJwksCacheTTL = 5 * time.Minute
+	// verifyDaemonReadTimeout is how long the daemon waits for a client to
+	// send its request
+	verifyDaemonReadTimeout = 5 * time.Second
+	// verifyDaemonClientTimeout bounds a request to the daemon, after which
+	// verify checks the cert itself
+	verifyDaemonClientTimeout = 15 * time.Second
+)
+
+// ErrVerifyDaemonUnavailable is returned by VerifyWithDaemon if no answer
+// was received from the daemon, in which case the cert has not been checked
+var ErrVerifyDaemonUnavailable = errors.New("verify daemon unavailable")
+
+type verifyRequest struct {
+	Principal string `json:"principal"`
+	Cert      string `json:"cert"`
+	KeyType   string `json:"key_type"`
+}
+
+type verifyResponse struct {
+	// AuthorizedKeys is the line for sshd if the cert is accepted
+	AuthorizedKeys string `json:"authorized_keys,omitempty"`
+	// Error is why the cert was rejected
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyDaemon answers the requests that opkssh verify forwards to it when
+// the server config sets verify_daemon. The server config and providers are
+// loaded once and the JWKS of issuers are cached, the policy is still read
+// for every request.
+type VerifyDaemon struct {
+	verify *VerifyCmd
+	// checkPolicy returns the policy enforcer for requests to log in as
+	// principal
+	checkPolicy func(principal string) PolicyEnforcerFunc
+}
+
+// NewVerifyDaemon loads the server config at configPath and the providers
+// at providersPath and returns a daemon that verifies certs against them.
+// identityClaim is as for opkssh verify --identity-claim.
+func NewVerifyDaemon(configPath string, providersPath string, identityClaim string) (*VerifyDaemon, error) {
+	v := NewVerifyCmd(verifier.Verifier{}, nil, configPath)
+	v.jwksCacheTTL = verifyDaemonJwksCacheTTL
+	if err := v.ApplyServerConfig(); err != nil {
+		return nil, fmt.Errorf("failed to load server config: %w", err)
+	}
+	if v.DropsPrivileges() {
+		log.Println("Warning: drop_privileges in the server config is ignored by serve-verify, run it as an unprivileged user instead")
+	}
+	providerPolicy, pktVerifier, err := v.LoadProviderPolicy(providersPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load providers: %w", err)
+	}
+	log.Println("Providers loaded: ", providerPolicy.ToString())
+	v.PktVerifier = *pktVerifier
+	return &VerifyDaemon{
+		verify: v,
+		checkPolicy: func(principal string) PolicyEnforcerFunc {
+			return OpkPolicyEnforcerFunc(principal, providerPolicy, identityClaim, v.CaseSensitiveEmailLocalPart(), v.AllowMissingEmailVerified())
+		},
+	}, nil
+}
+
+// Socket returns the socket set by verify_daemon in the server config, or
+// DefaultVerifySocket if it is not set
+func (d *VerifyDaemon) Socket() string {
+	if socket := d.verify.VerifyDaemonSocket(); socket != "" {
+		return socket
+	}
+	return DefaultVerifySocket
+}
+
+// ListenVerifySocket listens on the Unix socket at path, replacing any socket
+// left by a previous daemon. Only the owner and group of the socket, which
+// should include the AuthorizedKeysCommandUser, can connect.
+func ListenVerifySocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create directory for socket: %w", err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove old socket: %w", err)
+		}
+	}
+	// The socket is created with mode 0660 rather than chmod-ed afterwards,
+	// so that other users can't connect before its permissions are set
+	var listener net.Listener
+	err := withUmask(0117, func() error {
+		var err error
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve answers requests on listener until ctx is cancelled. Requests are
+// answered concurrently and those in progress are finished before it
+// returns.
+func (d *VerifyDaemon) Serve(ctx context.Context, listener net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			d.handle(ctx, conn)
+		}()
+	}
+}
+
+// handle answers the request on conn
+func (d *VerifyDaemon) handle(ctx context.Context, conn net.Conn) {
+	if err := conn.SetReadDeadline(time.Now().Add(verifyDaemonReadTimeout)); err != nil {
+		log.Println("Failed to set verify request deadline:", err)
+		return
+	}
+	var req verifyRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		log.Println("Failed to read verify request:", err)
+		return
+	}
+
+	var resp verifyResponse
+	v := *d.verify
+	v.CheckPolicy = d.checkPolicy(req.Principal)
+	if authKey, err := v.AuthorizedKeysCommand(ctx, req.Principal, req.KeyType, req.Cert); err != nil {
+		log.Println("failed to verify:", err)
+		resp.Error = err.Error()
+	} else {
+		log.Println("successfully verified")
+		resp.AuthorizedKeys = authKey
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Println("Failed to send verify response:", err)
+	}
+}
+
+// VerifyWithDaemon asks the verify daemon listening on socketPath whether the
+// base64-encoded SSH cert certB64 of type typ may be used to log in as
+// principal, and returns the line for sshd if it may. If the daemon does not
+// answer the error wraps ErrVerifyDaemonUnavailable.
+func VerifyWithDaemon(ctx context.Context, socketPath string, principal string, typ string, certB64 string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyDaemonClientTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrVerifyDaemonUnavailable, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrVerifyDaemonUnavailable, err)
+		}
+	}
+
+	req := verifyRequest{Principal: principal, Cert: certB64, KeyType: typ}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return "", fmt.Errorf("%w: failed to send request: %w", ErrVerifyDaemonUnavailable, err)
+	}
+	var resp verifyResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return "", fmt.Errorf("%w: failed to read response: %w", ErrVerifyDaemonUnavailable, err)
+	}
+	if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+	if resp.AuthorizedKeys == "" {
+		return "", fmt.Errorf("verify daemon returned an empty response")
+	}
+	return resp.AuthorizedKeys, nil
+}
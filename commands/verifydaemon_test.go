@@ -0,0 +1,110 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyDaemon(t *testing.T) {
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+
+	opkClient, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	verPkt, err := verifier.New(op, verifier.WithExpirationPolicy(verifier.ExpirationPolicies.NEVER_EXPIRE))
+	require.NoError(t, err)
+	policyTable := "dev arthur.aardvark@example.com " + op.Issuer() + "\n"
+	policyEnforcer := &policy.Enforcer{
+		PolicyLoader: &staticPolicyLoader{policy: policy.FromTable([]byte(policyTable), "test")},
+	}
+	daemon := &VerifyDaemon{
+		verify: &VerifyCmd{Fs: afero.NewMemMapFs(), PktVerifier: *verPkt},
+		checkPolicy: func(principal string) PolicyEnforcerFunc {
+			return policyEnforcer.CheckPolicyMatch
+		},
+	}
+
+	socket := filepath.Join(t.TempDir(), "verify.sock")
+	listener, err := ListenVerifySocket(socket)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(socket)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- daemon.Serve(ctx, listener) }()
+
+	certBytes, _, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+	typeArg, certB64Arg := strings.Split(string(certBytes), " ")[0], strings.Split(string(certBytes), " ")[1]
+
+	authKey, err := VerifyWithDaemon(context.Background(), socket, "dev", typeArg, certB64Arg)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(authKey, "cert-authority "), authKey)
+
+	// A denied request is answered by the daemon
+	_, err = VerifyWithDaemon(context.Background(), socket, "root", typeArg, certB64Arg)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrVerifyDaemonUnavailable))
+
+	_, err = VerifyWithDaemon(context.Background(), socket, "dev", typeArg, "invalid")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrVerifyDaemonUnavailable))
+
+	// Once stopped verify falls back to checking the cert itself
+	cancel()
+	require.NoError(t, <-served)
+	_, err = VerifyWithDaemon(context.Background(), socket, "dev", typeArg, certB64Arg)
+	require.ErrorIs(t, err, ErrVerifyDaemonUnavailable)
+}
+
+func TestNewVerifyDaemonBadConfig(t *testing.T) {
+	// A server config that fails to load must stop the daemon from starting
+	// rather than being ignored
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`;;;corrupted`), 0600))
+
+	daemon, err := NewVerifyDaemon(configPath, filepath.Join(t.TempDir(), "providers"), "")
+	require.ErrorContains(t, err, "failed to load server config")
+	require.Nil(t, daemon)
+}
@@ -0,0 +1,153 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+)
+
+// chooserPage lists the providers to choose from, by their names, linking
+// to /select with the index of the provider
+var chooserPage = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html>
+    <head>
+        <title>opkssh: OpenID Providers</title>
+        <style>
+            body { text-align: center; font-family: Arial, sans-serif; background-color: #f0f0f0; }
+            a { display: block; width: 240px; margin: 16px auto; padding: 16px; background-color: #4CAF50; color: white; text-decoration: none; }
+        </style>
+    </head>
+    <body>
+        <h3>opkssh: log in with</h3>
+        {{range $index, $name := .}}<a href="/select?op={{$index}}">{{$name}}</a>
+        {{end}}
+    </body>
+</html>
+`))
+
+// WebChooser lets the user choose the provider to log in with in their
+// browser. Unlike the openpubkey web chooser, which names each provider
+// after its issuer, providers are shown by the name in Names, see
+// config.ProviderConfig.ChooserName.
+type WebChooser struct {
+	OpList []providers.BrowserOpenIdProvider
+	// Names are the names the providers in OpList are shown by
+	Names       []string
+	OpenBrowser bool
+}
+
+func NewWebChooser(opList []providers.BrowserOpenIdProvider, names []string, openBrowser bool) *WebChooser {
+	return &WebChooser{OpList: opList, Names: names, OpenBrowser: openBrowser}
+}
+
+// ChooseOp serves the chooser page on localhost, opens it in the browser and
+// returns the provider the user chooses. The browser window is then
+// redirected to the provider's login page once the provider opens it.
+func (wc *WebChooser) ChooseOp(ctx context.Context) (providers.OpenIdProvider, error) {
+	if len(wc.Names) != len(wc.OpList) {
+		return nil, fmt.Errorf("web chooser has %d names for %d providers", len(wc.Names), len(wc.OpList))
+	}
+	// As in the openpubkey web chooser, each issuer can only be offered once
+	issuers := map[string]bool{}
+	for _, op := range wc.OpList {
+		if issuers[op.Issuer()] {
+			return nil, fmt.Errorf("provider in web chooser found with duplicate issuer: %s", op.Issuer())
+		}
+		issuers[op.Issuer()] = true
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind to an available port: %w", err)
+	}
+	opCh := make(chan providers.BrowserOpenIdProvider, 1)
+	errCh := make(chan error, 1)
+	server := &http.Server{ReadHeaderTimeout: callbackIdleTimeout, IdleTimeout: callbackIdleTimeout}
+	// The server is shut down once it has redirected to the provider, which
+	// only happens after ChooseOp returns
+	server.Handler = wc.handler(opCh, errCh, func() { go func() { _ = server.Shutdown(context.Background()) }() })
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Web chooser failed: %v", err)
+		}
+	}()
+
+	chooserURI := fmt.Sprintf("http://localhost:%d/chooser", listener.Addr().(*net.TCPAddr).Port)
+	if wc.OpenBrowser {
+		log.Printf("Opening browser to %s", chooserURI)
+		if err := util.OpenUrl(chooserURI); err != nil {
+			log.Printf("Failed to open url: %v", err)
+		}
+	} else {
+		log.Printf("Open your browser to: %s", chooserURI)
+	}
+
+	select {
+	case <-ctx.Done():
+		_ = server.Close()
+		return nil, ctx.Err()
+	case err := <-errCh:
+		return nil, err
+	case op := <-opCh:
+		return op, nil
+	}
+}
+
+// handler serves the chooser page and sends the chosen provider to opCh,
+// or an error to errCh if the choice is invalid. shutdown is called once the
+// choice has been handled.
+func (wc *WebChooser) handler(opCh chan<- providers.BrowserOpenIdProvider, errCh chan<- error, shutdown func()) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chooser", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if err := chooserPage.Execute(w, wc.Names); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/select", func(w http.ResponseWriter, r *http.Request) {
+		defer shutdown()
+		index, err := strconv.Atoi(r.URL.Query().Get("op"))
+		if err != nil || index < 0 || index >= len(wc.OpList) {
+			errorString := fmt.Sprintf("unknown OpenID Provider: %s", r.URL.Query().Get("op"))
+			http.Error(w, errorString, http.StatusBadRequest)
+			select {
+			case errCh <- fmt.Errorf("%s", errorString):
+			default:
+			}
+			return
+		}
+		op := wc.OpList[index]
+		select {
+		case opCh <- op:
+		default:
+			http.Error(w, "provider has already been chosen", http.StatusConflict)
+			return
+		}
+		redirectURICh := make(chan string, 1)
+		op.ReuseBrowserWindowHook(redirectURICh)
+		http.Redirect(w, r, <-redirectURICh, http.StatusFound)
+	})
+	return mux
+}
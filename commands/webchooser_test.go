@@ -0,0 +1,66 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/opkssh/commands/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebChooserDisplayNames(t *testing.T) {
+	configProviders, err := config.ProvidersConfigListFromStrings("cfg1," + providerArg1 + ";cfg2," + providerArg2 + ";cfg3," + providerArg3)
+	require.NoError(t, err)
+	configProviders[0].DisplayName = "Example & Co"
+	configProviders[2].AliasList = nil
+
+	loginCmd := LoginCmd{
+		disableBrowserOpenArg: true,
+		config: &config.ClientConfig{
+			DefaultProvider: config.WEBCHOOSER_ALIAS,
+			Providers:       configProviders,
+		},
+		lookupEnv: func(string) (string, bool) { return "", false },
+	}
+	provider, chooser, err := loginCmd.determineProvider()
+	require.NoError(t, err)
+	require.Nil(t, provider)
+	require.NotNil(t, chooser)
+	// Providers without a display_name are shown by their alias or issuer
+	require.Equal(t, []string{"Example & Co", "cfg2", providerIssuer3}, chooser.Names)
+	require.Len(t, chooser.OpList, 3)
+
+	// The names are shown, escaped, on the chooser page
+	opCh := make(chan providers.BrowserOpenIdProvider, 1)
+	errCh := make(chan error, 1)
+	handler := chooser.handler(opCh, errCh, func() {})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/chooser", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `<a href="/select?op=0">Example &amp; Co</a>`)
+	require.Contains(t, rr.Body.String(), `<a href="/select?op=1">cfg2</a>`)
+	require.Contains(t, rr.Body.String(), `<a href="/select?op=2">`+providerIssuer3+`</a>`)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/select?op=3", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.ErrorContains(t, <-errCh, "unknown OpenID Provider: 3")
+}
@@ -0,0 +1,85 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// WhoamiCmd prints the identity of the local opkssh key. It only reads the
+// key from disk and makes no network requests, so it is cheap enough to run
+// from a shell prompt.
+type WhoamiCmd struct {
+	Fs                  afero.Fs
+	keyPathArg          string
+	expirationPolicyArg string
+	shortArg            bool
+	now                 func() time.Time // Used in tests to control the current time
+}
+
+func NewWhoamiCmd(keyPathArg string, expirationPolicyArg string, shortArg bool) *WhoamiCmd {
+	return &WhoamiCmd{
+		Fs:                  afero.NewOsFs(),
+		keyPathArg:          keyPathArg,
+		expirationPolicyArg: expirationPolicyArg,
+		shortArg:            shortArg,
+		now:                 time.Now,
+	}
+}
+
+// Run prints the identity of the local opkssh key to stdout. Returns an
+// error if there is no opkssh key or it has expired.
+func (w *WhoamiCmd) Run() error {
+	whoami, err := w.Whoami()
+	if err != nil {
+		return err
+	}
+	fmt.Println(whoami)
+	return nil
+}
+
+// Whoami returns the identity of the local opkssh key. With --short this is
+// only the email, or the sub if the ID Token has no email, otherwise it is
+// the identity as printed by login followed by when the key expires.
+func (w *WhoamiCmd) Whoami() (string, error) {
+	identity, err := findLocalIdentity(w.Fs, w.keyPathArg)
+	if err != nil {
+		return "", err
+	}
+	validUntil, err := identityValidUntil(identity, w.expirationPolicyArg)
+	if err != nil {
+		return "", err
+	}
+	if !w.now().Before(validUntil) {
+		return "", fmt.Errorf("opkssh key %s expired at %s, run opkssh login to get a new one", identity.PubkeyPath, validUntil.Format(time.RFC3339))
+	}
+
+	if w.shortArg {
+		if identity.Email != "" {
+			return identity.Email, nil
+		}
+		return identity.Subject, nil
+	}
+	idStr, err := IdentityString(*identity.PKT)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse ID Token: %w", err)
+	}
+	return fmt.Sprintf("%s\nKey: %s\nValid until: %s", idStr, identity.PubkeyPath, validUntil.Format(time.RFC3339)), nil
+}
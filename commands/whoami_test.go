@@ -0,0 +1,124 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package commands
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhoami(t *testing.T) {
+	pkt, signer, _ := Mocks(t)
+	certBytes, seckeyPem, err := createSSHCertAndKey(pkt, signer, []string{})
+	require.NoError(t, err)
+
+	// A PK Token without an email claim
+	subOp, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	subSigner, err := util.GenKeyPair(jwa.ES256)
+	require.NoError(t, err)
+	subClient, err := client.New(subOp, client.WithSigner(subSigner, jwa.ES256))
+	require.NoError(t, err)
+	subPkt, err := subClient.Auth(context.Background())
+	require.NoError(t, err)
+	subCertBytes, subSeckeyPem, err := createSSHCertAndKey(subPkt, subSigner, []string{})
+	require.NoError(t, err)
+
+	homePath, err := os.UserHomeDir()
+	require.NoError(t, err)
+	sshPath := filepath.Join(homePath, ".ssh")
+
+	mockFs := afero.NewMemMapFs()
+	loginCmd := LoginCmd{Fs: mockFs}
+	require.NoError(t, loginCmd.writeKeys(filepath.Join(sshPath, "id_ecdsa"), filepath.Join(sshPath, "id_ecdsa.pub"), seckeyPem, certBytes))
+	require.NoError(t, loginCmd.writeKeys("/keys/sub", "/keys/sub.pub", subSeckeyPem, subCertBytes))
+
+	identity, err := readLocalIdentity(mockFs, filepath.Join(sshPath, "id_ecdsa.pub"))
+	require.NoError(t, err)
+	issuedAt := identity.IssuedAt
+
+	tests := []struct {
+		name        string
+		fs          afero.Fs
+		keyPath     string
+		short       bool
+		now         time.Time
+		expected    string
+		errorString string
+	}{
+		{
+			name:     "Short email",
+			short:    true,
+			now:      issuedAt.Add(time.Hour),
+			expected: "arthur.aardvark@example.com",
+		},
+		{
+			name:     "Short sub",
+			keyPath:  "/keys/sub",
+			short:    true,
+			now:      issuedAt.Add(time.Hour),
+			expected: "me",
+		},
+		{
+			name:     "Full",
+			now:      issuedAt.Add(time.Hour),
+			expected: "Email, sub, issuer, audience: \narthur.aardvark@example.com me https://accounts.example.com test_client_id\nKey: " + filepath.Join(sshPath, "id_ecdsa.pub") + "\nValid until: " + issuedAt.Add(24*time.Hour).Format(time.RFC3339),
+		},
+		{
+			name:        "Expired",
+			short:       true,
+			now:         issuedAt.Add(25 * time.Hour),
+			errorString: "expired at",
+		},
+		{
+			name:        "No key",
+			fs:          afero.NewMemMapFs(),
+			short:       true,
+			now:         issuedAt,
+			errorString: "no opkssh key found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whoami := NewWhoamiCmd(tt.keyPath, "24h", tt.short)
+			whoami.Fs = mockFs
+			if tt.fs != nil {
+				whoami.Fs = tt.fs
+			}
+			whoami.now = func() time.Time { return tt.now }
+			out, err := whoami.Whoami()
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				require.Error(t, whoami.Run())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, out)
+		})
+	}
+}
@@ -24,14 +24,21 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/openpubkey/openpubkey/verifier"
 	"github.com/openpubkey/opkssh/commands"
+	"github.com/openpubkey/opkssh/commands/config"
 	"github.com/openpubkey/opkssh/policy"
 	"github.com/openpubkey/opkssh/policy/files"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -45,7 +52,34 @@ func main() {
 	os.Exit(run())
 }
 
+// expandIssuerAlias expands the convenience aliases for well known issuers.
+// gitlab:<url> expands to the issuer of the self-hosted GitLab instance at
+// url.
+func expandIssuerAlias(issuer string) (string, error) {
+	if gitlabURL, ok := strings.CutPrefix(issuer, "gitlab:"); ok {
+		return config.GitlabIssuerFromURL(gitlabURL)
+	}
+	// Convenience aliases to save user time (who is going to remember the hideous Azure issuer string)
+	if wellKnown, ok := config.WellKnownIssuers[issuer]; ok {
+		return wellKnown, nil
+	}
+	return issuer, nil
+}
+
+// wellKnownIssuerNames returns the sorted short names of the well known
+// issuers for help text
+func wellKnownIssuerNames() []string {
+	names := make([]string, 0, len(config.WellKnownIssuers))
+	for name := range config.WellKnownIssuers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
 func run() int {
+	config.DefaultUserAgent = "opkssh/" + Version
+
 	rootCmd := &cobra.Command{
 		SilenceUsage: true,
 		Use:          "opkssh",
@@ -59,12 +93,19 @@ This program allows users to:
   - Verify OpenPubkey SSH certificates for use with sshd's AuthorizedKeysCommand`,
 		Example: `  opkssh login
   opkssh add root alice@example.com https://accounts.google.com`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return expandPathFlags(cmd)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return cmd.Help()
 		},
 	}
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
 
+	var commentArg string
+	var checkArg bool
+	var fromFileArg string
+	var strictArg bool
 	addCmd := &cobra.Command{
 		SilenceUsage: true,
 		Use:          "add <PRINCIPAL> <EMAIL|SUB|GROUP> <ISSUER>",
@@ -73,36 +114,46 @@ This program allows users to:
 
 It first attempts to write to the system-wide file (/etc/opk/auth_id). If it lacks permissions to update this file it falls back to writing to the user-specific file (~/.opk/auth_id).
 
+With --check the policy file is not written. Instead add reports whether the entry is already present (exit code 0), would be added (exit code 2) or conflicts with a deny rule or a command restriction (exit code 3).
+
+With --from-file add reads email,principal pairs, one per line, from a file and adds them all for ISSUER to the system-wide file in a single update. Malformed lines are skipped with a warning, or with --strict the policy file is left unchanged.
+
 Arguments:
   PRINCIPAL            The target user account (requested principal).
   EMAIL|SUB|GROUP      Email address, subscriber ID or group authorized to assume this principal. If using an OIDC group, the argument needs to be in the format of oidc:groups:<groupId>.
-  ISSUER               OpenID Connect provider (issuer) URL associated with the email/sub/group.
+  ISSUER               OpenID Connect provider (issuer) URL associated with the email/sub/group. The aliases google, azure, gitlab and hello may be used, and gitlab:<url> for a self-hosted GitLab instance.
 `,
-		Args: cobra.ExactArgs(3),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if fromFileArg != "" {
+				return cobra.ExactArgs(1)(cmd, args)
+			}
+			return cobra.ExactArgs(3)(cmd, args)
+		},
 		Example: `  opkssh add root alice@example.com https://accounts.google.com
   opkssh add alice 103030642802723203118 https://accounts.google.com
-  opkssh add developer oidc:groups:developer https://accounts.google.com`,
+  opkssh add developer oidc:groups:developer https://accounts.google.com
+  opkssh add root alice@example.com google --comment "JIRA-123 access granted by bob"
+  opkssh add root alice@example.com gitlab:gitlab.example.com
+  opkssh add --from-file users.csv google`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if fromFileArg != "" {
+				return runAddFromFile(fromFileArg, args[0], commentArg, strictArg)
+			}
 			inputPrincipal := args[0]
 			inputEmail := args[1]
-			inputIssuer := args[2]
-
-			// Convenience aliases to save user time (who is going to remember the hideous Azure issuer string)
-			switch inputIssuer {
-			case "google":
-				inputIssuer = "https://accounts.google.com"
-			case "azure", "microsoft":
-				inputIssuer = "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112-36a304b66dad/v2.0"
-			case "gitlab":
-				inputIssuer = "https://gitlab.com"
-			case "hello":
-				inputIssuer = "https://issuer.hello.coop"
+			inputIssuer, err := expandIssuerAlias(args[2])
+			if err != nil {
+				return err
 			}
 
 			add := commands.AddCmd{
 				HomePolicyLoader:   policy.NewHomePolicyLoader(),
 				SystemPolicyLoader: policy.NewSystemPolicyLoader(),
 				Username:           inputPrincipal,
+				Comment:            commentArg,
+			}
+			if checkArg {
+				return runAddCheck(cmd, add, inputPrincipal, inputEmail, inputIssuer)
 			}
 			policyFilePath, err := add.Run(inputPrincipal, inputEmail, inputIssuer)
 			if err != nil {
@@ -113,8 +164,137 @@ Arguments:
 			return nil
 		},
 	}
+	addCmd.Flags().BoolVar(&checkArg, "check", false, "Report whether the entry is already present, would be added or conflicts with the policy, without changing the policy file")
+	addCmd.Flags().StringVar(&commentArg, "comment", "", "Annotate the policy entry with a comment, such as a ticket number, that is shown by opkssh list")
+	addCmd.Flags().StringVar(&fromFileArg, "from-file", "", "Add the email,principal pairs in this file, one per line, for the issuer given as the only argument")
+	_ = addCmd.MarkFlagFilename("from-file")
+	addCmd.Flags().BoolVar(&strictArg, "strict", false, "With --from-file, fail without changing the policy file if any line is malformed")
+	addCmd.MarkFlagsMutuallyExclusive("from-file", "check")
 	rootCmd.AddCommand(addCmd)
 
+	listCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "list",
+		Short:        "Lists the rules in the policy file",
+		Long: `List prints the entries in the auth_id policy file, including any comments they were added with.
+
+It reads the system-wide file (/etc/opk/auth_id) or, if it lacks permissions to read this file, the user-specific file (~/.opk/auth_id).
+`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			currentUser, err := user.Current()
+			if err != nil {
+				return err
+			}
+			add := commands.AddCmd{
+				HomePolicyLoader:   policy.NewHomePolicyLoader(),
+				SystemPolicyLoader: policy.NewSystemPolicyLoader(),
+				Username:           currentUser.Username,
+			}
+			currentPolicy, policyFilePath, err := add.LoadPolicy()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to load policy: %v\n", err)
+				return err
+			}
+			policyBytes, err := currentPolicy.ToTable()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Policy %s:\n", policyFilePath)
+			fmt.Fprint(os.Stdout, string(policyBytes))
+			return nil
+		},
+	}
+	rootCmd.AddCommand(listCmd)
+
+	var removeCommentArg string
+	removeCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "remove [PRINCIPAL] [EMAIL|SUB|GROUP] [ISSUER]",
+		Short:        "Removes rules from the policy file",
+		Long: `Remove deletes the matching allow entries from the auth_id policy file. Deny rules must be removed by editing the file.
+
+Entries match if they match every supplied argument, so fewer arguments remove more entries. Use "" to match any value for an argument that is followed by another argument.
+
+Arguments:
+  PRINCIPAL            The target user account (requested principal).
+  EMAIL|SUB|GROUP      Email address, subscriber ID or group that was authorized to assume this principal.
+  ISSUER               OpenID Connect provider (issuer) URL associated with the email/sub/group.
+`,
+		Args: cobra.RangeArgs(0, 3),
+		Example: `  opkssh remove root alice@example.com https://accounts.google.com
+  opkssh remove "" alice@example.com
+  opkssh remove --comment "JIRA-123 access granted by bob"`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			inputs := make([]string, 3)
+			copy(inputs, args)
+			inputPrincipal, inputIdentity := inputs[0], inputs[1]
+			inputIssuer, err := expandIssuerAlias(inputs[2])
+			if err != nil {
+				return err
+			}
+
+			username := inputPrincipal
+			if username == "" {
+				currentUser, err := user.Current()
+				if err != nil {
+					return err
+				}
+				username = currentUser.Username
+			}
+			remove := commands.RemoveCmd{
+				HomePolicyLoader:   policy.NewHomePolicyLoader(),
+				SystemPolicyLoader: policy.NewSystemPolicyLoader(),
+				Username:           username,
+			}
+			policyFilePath, removed, err := remove.Run(inputPrincipal, inputIdentity, inputIssuer, removeCommentArg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to remove from policy: %v\n", err)
+				return err
+			}
+			if removed == 0 {
+				err := fmt.Errorf("no matching entries found in %s", policyFilePath)
+				fmt.Fprintf(os.Stderr, "Failed to remove from policy: %v\n", err)
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Successfully removed %d policy entries from %s\n", removed, policyFilePath)
+			return nil
+		},
+	}
+	removeCmd.Flags().StringVar(&removeCommentArg, "comment", "", "Only remove entries that were added with this comment")
+	rootCmd.AddCommand(removeCmd)
+
+	diffPolicyCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "diff-policy <OLD> <NEW>",
+		Short:        "Shows the entries that differ between two policy files",
+		Long: `Diff-policy compares two auth_id policy files and prints the entries added, removed or changed going from OLD to NEW, one per line:
+  + <PRINCIPAL> <IDENTITY> <ISSUER> [OPTIONS]   entry only in NEW
+  - <PRINCIPAL> <IDENTITY> <ISSUER> [OPTIONS]   entry only in OLD
+  ~ <PRINCIPAL> <IDENTITY> <ISSUER>: <OLD OPTIONS> -> <NEW OPTIONS>   entry whose options, such as deny, command or hours, changed
+
+Comments, whitespace and the order of entries are ignored, so files that grant the same access have no differences. Lines opkssh verify would skip are reported as warnings.
+
+Diff-policy exits with 0 if the policies are equivalent and 2 if they differ.`,
+		Args:    cobra.ExactArgs(2),
+		Example: `  git show HEAD~1:auth_id > /tmp/auth_id.old && opkssh diff-policy /tmp/auth_id.old auth_id`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			diff, problems, err := commands.NewDiffPolicyCmd().Run(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			for _, problem := range problems {
+				fmt.Fprintf(os.Stderr, "Warning: %s\n", problem)
+			}
+			if diff.Empty() {
+				return nil
+			}
+			fmt.Fprint(os.Stdout, diff.String())
+			return &commands.ExitCodeError{Code: diffPolicyExitDiffers, Msg: fmt.Sprintf("policies differ: %d added, %d removed, %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed))}
+		},
+	}
+	rootCmd.AddCommand(diffPolicyCmd)
+
 	var autoRefreshArg bool
 	var configPathArg string
 	var createConfigArg bool
@@ -123,9 +303,48 @@ Arguments:
 	var disableBrowserOpenArg bool
 	var printIdTokenArg bool
 	var keyPathArg string
+	var caBundleArg string
+	var userAgentArg string
+	var issuerSelectArg string
+	var qrArg bool
+	var sourceAddressArg string
+	var certCommentPrefixArg string
+	var extensionArgs []string
+	var configStdinArg bool
+	var allProvidersArg bool
+	var noOverwriteArg bool
+	var printCertArg bool
+	var hostedDomainArg string
+	var reauthOnExpiryArg bool
+	var logFormatArg string
+	var keyFormatArg string
+	var noColorArg bool
+	var selectAccountArg bool
+	var concurrencyArg int
+	var principalsArg []string
+	var outputDirArg string
+	var claimsOutArg string
+	var refreshJitterArg time.Duration
+	var renewThresholdArg time.Duration
+	var loginTimeoutArg time.Duration
+	var loginTimeoutBehaviorArg string
+	var loginExpirationPolicyArg string
+	var identityTemplateArg string
+	var identityClaimArg string
+	var addToAgentArg bool
+	var agentConfirmArg bool
+	var requireEmailArg bool
+	var insecureSkipVerifyArg bool
+	var shellExportArg bool
+	var forceNewKeyArg bool
+	var noCertArg bool
+	var caKeyPathArg string
+	var issuerAliasArg string
+	var clientIDArg string
+	var clientSecretArg string
 	loginCmd := &cobra.Command{
 		SilenceUsage: true,
-		Use:          "login [alias]",
+		Use:          "login [alias...]",
 		Short:        "Authenticate with an OpenID Provider to generate an SSH key for opkssh",
 		Long: `Login creates opkssh SSH keys
 
@@ -134,10 +353,14 @@ Login generates a key pair, then opens a browser to authenticate the user with t
 Users can then SSH into servers configured to use opkssh as the AuthorizedKeysCommand. The server verifies the PK token and grants access if the token is valid and the user is authorized per the auth_id policy.
 Arguments:
   alias      The provider alias to use. If not specified, the OPKSSH_DEFAULT provider will be used. The aliases are defined by the OPKSSH_PROVIDERS environment variable. The format is <alias>,<issuer>,<client_id>,<client_secret>,<scopes>
+             If more than one alias is given, the browser opens to let you choose between only those providers.
 `,
 		Example: `  opkssh login
   opkssh login google
-  opkssh login --provider=<issuer>,<client_id>,<client_secret>,<scopes>`,
+  opkssh login google azure
+  opkssh login --provider=<issuer>,<client_id>,<client_secret>,<scopes>
+  opkssh login --issuer-alias=gitlab --client-id=<client_id>
+  generate-config | opkssh login --config-path=-`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
@@ -149,31 +372,413 @@ Arguments:
 			}()
 
 			var providerAliasArg string
-			if len(args) > 0 {
+			if len(args) == 1 {
 				providerAliasArg = args[0]
 			}
 
-			login := commands.NewLogin(autoRefreshArg, configPathArg, createConfigArg, logDirArg, disableBrowserOpenArg, printIdTokenArg, providerArg, keyPathArg, providerAliasArg)
+			if configStdinArg {
+				if configPathArg != "" && configPathArg != commands.ConfigPathStdin {
+					return fmt.Errorf("--config-stdin can not be used with --config-path=%s", configPathArg)
+				}
+				configPathArg = commands.ConfigPathStdin
+			}
+
+			var loginOpts []commands.LoginOption
+			if len(args) > 1 {
+				loginOpts = append(loginOpts, commands.WithProviderAliases(args...))
+			}
+			if issuerAliasArg != "" || clientIDArg != "" || clientSecretArg != "" {
+				loginOpts = append(loginOpts, commands.WithIssuerAlias(issuerAliasArg, clientIDArg, clientSecretArg))
+			}
+			if caBundleArg != "" {
+				loginOpts = append(loginOpts, commands.WithCABundle(caBundleArg))
+			}
+			if userAgentArg != "" {
+				loginOpts = append(loginOpts, commands.WithUserAgent(userAgentArg))
+			}
+			if issuerSelectArg != "" {
+				loginOpts = append(loginOpts, commands.WithIssuerSelect(issuerSelectArg))
+			}
+			if qrArg {
+				loginOpts = append(loginOpts, commands.WithQRCode())
+			}
+			if sourceAddressArg != "" {
+				loginOpts = append(loginOpts, commands.WithSourceAddress(sourceAddressArg))
+			}
+			if certCommentPrefixArg != "" {
+				loginOpts = append(loginOpts, commands.WithCertCommentPrefix(certCommentPrefixArg))
+			}
+			if len(extensionArgs) > 0 {
+				loginOpts = append(loginOpts, commands.WithExtensions(extensionArgs))
+			}
+			if allProvidersArg {
+				loginOpts = append(loginOpts, commands.WithAllProviders())
+			}
+			if noOverwriteArg {
+				loginOpts = append(loginOpts, commands.WithNoOverwrite())
+			}
+			if printCertArg {
+				loginOpts = append(loginOpts, commands.WithPrintCert())
+			}
+			if hostedDomainArg != "" {
+				loginOpts = append(loginOpts, commands.WithHostedDomain(hostedDomainArg))
+			}
+			if reauthOnExpiryArg {
+				loginOpts = append(loginOpts, commands.WithReauthOnExpiry())
+			}
+			if logFormatArg != "" {
+				loginOpts = append(loginOpts, commands.WithLogFormat(logFormatArg))
+			}
+			if keyFormatArg != "" {
+				loginOpts = append(loginOpts, commands.WithKeyFormat(keyFormatArg))
+			}
+			if noColorArg {
+				loginOpts = append(loginOpts, commands.WithNoColor())
+			}
+			if selectAccountArg {
+				loginOpts = append(loginOpts, commands.WithSelectAccountEveryTime())
+			}
+			if concurrencyArg != commands.DefaultLoginConcurrency {
+				loginOpts = append(loginOpts, commands.WithConcurrency(concurrencyArg))
+			}
+			if identityTemplateArg != "" {
+				loginOpts = append(loginOpts, commands.WithIdentityTemplate(identityTemplateArg))
+			}
+			if identityClaimArg != "" {
+				loginOpts = append(loginOpts, commands.WithIdentityClaim(identityClaimArg))
+			}
+			if addToAgentArg {
+				loginOpts = append(loginOpts, commands.WithAddToAgent())
+			}
+			if agentConfirmArg {
+				loginOpts = append(loginOpts, commands.WithAgentConfirm())
+			}
+			if forceNewKeyArg {
+				loginOpts = append(loginOpts, commands.WithForceNewKey())
+			}
+			if noCertArg {
+				loginOpts = append(loginOpts, commands.WithNoCert())
+			}
+			if caKeyPathArg != "" {
+				loginOpts = append(loginOpts, commands.WithCAKey(caKeyPathArg))
+			}
+			if requireEmailArg {
+				loginOpts = append(loginOpts, commands.WithRequireEmail())
+			}
+			if shellExportArg {
+				loginOpts = append(loginOpts, commands.WithShellExport())
+			}
+			if insecureSkipVerifyArg {
+				loginOpts = append(loginOpts, commands.WithInsecureSkipIDTokenVerify())
+			}
+			if refreshJitterArg != 0 {
+				loginOpts = append(loginOpts, commands.WithRefreshJitter(refreshJitterArg))
+			}
+			if renewThresholdArg != 0 {
+				loginOpts = append(loginOpts, commands.WithRenewThreshold(renewThresholdArg, loginExpirationPolicyArg))
+			}
+			if loginTimeoutArg != 0 || loginTimeoutBehaviorArg != commands.LoginTimeoutFail {
+				loginOpts = append(loginOpts, commands.WithLoginTimeout(loginTimeoutArg, loginTimeoutBehaviorArg))
+			}
+			if outputDirArg != "" {
+				loginOpts = append(loginOpts, commands.WithOutputDir(outputDirArg))
+			}
+			if claimsOutArg != "" {
+				loginOpts = append(loginOpts, commands.WithClaimsOut(claimsOutArg))
+			}
+			if len(principalsArg) > 0 {
+				loginOpts = append(loginOpts, commands.WithPrincipals(principalsArg...))
+			}
+
+			login := commands.NewLogin(autoRefreshArg, configPathArg, createConfigArg, logDirArg, disableBrowserOpenArg, printIdTokenArg, providerArg, keyPathArg, providerAliasArg, loginOpts...)
 			if err := login.Run(ctx); err != nil {
 				log.Println("Error executing login command:", err)
+				if errors.Is(err, commands.ErrRefreshSessionExpired) {
+					return &commands.ExitCodeError{Code: loginExitRefreshSessionExpired, Msg: err.Error()}
+				}
 				return err
 			}
 			return nil
 		},
-		Args: cobra.MaximumNArgs(1),
+		Args: cobra.ArbitraryArgs,
 	}
 
 	// Define flags for login.
-	loginCmd.Flags().BoolVar(&autoRefreshArg, "auto-refresh", false, "Automatically refresh PK token after login")
-	loginCmd.Flags().StringVar(&configPathArg, "config-path", "", "Path to the client config file. Default: ~/.opk/config.yml on linux and %APPDATA%\\.opk\\config.yml on windows.")
+	loginCmd.Flags().BoolVar(&autoRefreshArg, "auto-refresh", false, "Automatically refresh PK token after login. Exits with code 2 if the refresh token expires or is revoked")
+	loginCmd.Flags().StringVar(&configPathArg, "config-path", "", "Path to the client config file. Default: ~/.opk/config.yml on linux and %APPDATA%\\.opk\\config.yml on windows. Use - to read the config from stdin.")
+	_ = loginCmd.MarkFlagFilename("config-path")
+	loginCmd.Flags().BoolVar(&configStdinArg, "config-stdin", false, "Read the client config from stdin, same as --config-path=-")
 	loginCmd.Flags().BoolVar(&createConfigArg, "create-config", false, "Creates a client config file if it does not exist")
 	loginCmd.Flags().StringVar(&logDirArg, "log-dir", "", "Directory to write output logs")
+	_ = loginCmd.MarkFlagDirname("log-dir")
 	loginCmd.Flags().BoolVar(&disableBrowserOpenArg, "disable-browser-open", false, "Set this flag to disable opening the browser. Useful for choosing the browser you want to use.")
 	loginCmd.Flags().BoolVar(&printIdTokenArg, "print-id-token", false, "Set this flag to print out the contents of the id_token. Useful for inspecting claims.")
 	loginCmd.Flags().StringVar(&providerArg, "provider", "", "OpenID Provider specification in the format: <issuer>,<client_id> or <issuer>,<client_id>,<client_secret> or <issuer>,<client_id>,<client_secret>,<scopes>")
+	loginCmd.Flags().StringVar(&issuerAliasArg, "issuer-alias", "", "Login to a well known OpenID Provider by short name instead of its issuer URL: "+strings.Join(wellKnownIssuerNames(), ", ")+". Requires --client-id. Aliases can be added or overridden with issuer_aliases in the client config")
+	loginCmd.Flags().StringVar(&issuerSelectArg, "issuer-select", "", "Login with the configured provider that has this issuer URL, e.g. https://accounts.google.com, instead of selecting it by alias. Fails if no provider or more than one provider has the issuer.")
+	loginCmd.Flags().StringVar(&clientIDArg, "client-id", "", "Client ID to use with --issuer-alias")
+	loginCmd.Flags().StringVar(&clientSecretArg, "client-secret", "", "Client secret to use with --issuer-alias, required by google")
 	loginCmd.Flags().StringVarP(&keyPathArg, "private-key-file", "i", "", "Path where private keys is written.")
+	_ = loginCmd.MarkFlagFilename("private-key-file")
+	loginCmd.Flags().StringVar(&caBundleArg, "ca-bundle", "", "Path to a PEM CA bundle to trust for TLS connections to the OpenID Provider. Overrides ca_bundle in the client config.")
+	_ = loginCmd.MarkFlagFilename("ca-bundle")
+	loginCmd.Flags().StringVar(&userAgentArg, "user-agent", "", "User-Agent header to send on requests to the OpenID Provider. Overrides user_agent in the client config. Defaults to opkssh/<version>.")
+	loginCmd.Flags().BoolVar(&qrArg, "qr", false, "Print the login URL as a QR code. Combine with --disable-browser-open to only print the QR code.")
+	loginCmd.Flags().StringVar(&certCommentPrefixArg, "cert-comment-prefix", "", "Comment to set on the SSH keys written, e.g. openpubkey/opkssh-1.2, to tell which tool or version wrote a key. Must contain openpubkey, which opkssh uses to recognise keys it may overwrite")
+	loginCmd.Flags().StringVar(&sourceAddressArg, "source-address", "", "Comma separated list of addresses or CIDR ranges the SSH cert may be used from, e.g. 10.0.0.0/8. Enforced by the SSH server using the source-address critical option.")
+	loginCmd.Flags().StringArrayVar(&extensionArgs, "extension", nil, "Extension to set on the SSH cert as name=value, e.g. role@example.com=admin. The SSH server ignores extensions it does not recognize. Can be repeated.")
+	loginCmd.Flags().BoolVar(&allProvidersArg, "all-providers", false, "Login to every configured provider, writing a key per provider to ~/.ssh/opkssh_<alias>. Providers that require a browser are logged in to one at a time.")
+	loginCmd.Flags().BoolVar(&noOverwriteArg, "no-overwrite", false, "Fail rather than overwrite any existing SSH key file, including keys previously generated by opkssh")
+	loginCmd.Flags().BoolVar(&printCertArg, "print-cert", false, "Set this flag to print out the generated SSH cert in authorized_keys format after it is written.")
+	loginCmd.Flags().StringVar(&hostedDomainArg, "hd", "", "Restrict Google logins to accounts in this Google Workspace hosted domain, e.g. --hd=example.com. Ignored by other providers.")
+	loginCmd.Flags().BoolVar(&reauthOnExpiryArg, "reauth-on-expiry", false, "Keep running and log in again through the browser shortly before the PK token expires. Use instead of --auto-refresh with OpenID Providers that do not issue refresh tokens.")
+	loginCmd.Flags().StringVar(&keyFormatArg, "key-format", commands.KeyFormatOpenSSH, "Format to write the private key in, openssh or pkcs8. pkcs8 writes a PEM encoded PKCS#8 key for tools that don't read OpenSSH private keys.")
+	loginCmd.Flags().StringVar(&logFormatArg, "log-format", commands.LogFormatText, "Format of log output, text or json. Each log is tagged with its level, DEBUG, INFO, WARN or ERROR.")
+	loginCmd.Flags().BoolVar(&noColorArg, "no-color", false, "Do not color log levels. Color is only used for text logs written to a terminal, and is also disabled by the NO_COLOR environment variable.")
+	loginCmd.Flags().BoolVar(&selectAccountArg, "select-account-every-time", false, "Ask the OpenID Provider which account to use on every login (prompt=select_account) and ignore the default provider in the client config. Useful on shared machines.")
+	loginCmd.Flags().IntVar(&concurrencyArg, "concurrency", commands.DefaultLoginConcurrency, "Maximum number of providers to log in to at once with --all-providers. Lower it if your OpenID Providers rate limit logins. 0 uses the default.")
+	loginCmd.Flags().StringArrayVar(&principalsArg, "principal", nil, "Principal to include in the SSH cert, may be given more than once. Overrides default_principal in the client config.")
+	loginCmd.Flags().StringVar(&identityTemplateArg, "identity-template", "", "Go template used to print the identity after login, e.g. '{{.Email}} via {{.Issuer}}'. Fields: Email, Name, Subject, Issuer, Audience, IssuedAt and ExpiresAt.")
+	loginCmd.Flags().BoolVar(&addToAgentArg, "add-to-agent", false, "Also add the SSH key and cert to the running ssh-agent. On Windows the OpenSSH for Windows ssh-agent service is used unless SSH_AUTH_SOCK is set to another agent's named pipe")
+	loginCmd.Flags().BoolVar(&agentConfirmArg, "agent-confirm", false, "With --add-to-agent, make ssh-agent ask for confirmation each time the key is used, as ssh-add -c does. The agent usually asks through ssh-askpass.")
+	loginCmd.Flags().BoolVar(&forceNewKeyArg, "force-new-key", false, "Make sure the new key differs from the key of the opkssh cert it replaces and remove keys previously added by opkssh from ssh-agent. Copies of the previous key forwarded through the agent stop working")
+	loginCmd.Flags().BoolVar(&noCertArg, "no-cert", false, "Write a plain SSH public key instead of an SSH cert, for servers that do not accept SSH certs, and a registration of its fingerprint to the identity next to the private key. The plain key does not expire")
+	loginCmd.Flags().StringVar(&caKeyPathArg, "ca-key", "", "Sign the SSH cert with the SSH CA private key at this path rather than the generated key, for servers that trust the CA with TrustedUserCAKeys or list it in trusted_ca_keys. An encrypted key is decrypted with the passphrase in OPKSSH_CA_KEY_PASSPHRASE")
+	_ = loginCmd.MarkFlagFilename("ca-key")
+	loginCmd.Flags().BoolVar(&shellExportArg, "shell-export", false, "Print shell commands that set SSH_OPK_KEY and SSH_OPK_CERT to the paths of the key and cert, for eval $(opkssh login --shell-export). Uses fish syntax if $SHELL is fish. All other output goes to stderr")
+	loginCmd.Flags().BoolVar(&insecureSkipVerifyArg, "insecure-skip-id-token-verify", false, "DANGEROUS: do not verify the signature of the ID Token from the OpenID Provider. Only for ID Tokens delivered over mutually authenticated TLS by a trusted broker. Can not be set in the client config. SSH servers still verify the ID Token")
+	loginCmd.Flags().BoolVar(&requireEmailArg, "require-email", false, "Fail login if the ID Token does not have an email claim with email_verified set to true, rather than identifying you by your sub. Usually means the provider's scopes are missing email")
+	loginCmd.Flags().StringVar(&identityClaimArg, "identity-claim", "", "Print this ID Token claim, e.g. preferred_username, as the identity in place of the email, for servers that run verify with --identity-claim")
+	loginCmd.Flags().DurationVar(&renewThresholdArg, "renew-threshold", 0, "Only log in if the current opkssh key expires within this long, otherwise do nothing, e.g. 30m. Useful for running login often from cron.")
+	loginCmd.Flags().StringVar(&loginExpirationPolicyArg, "expiration-policy", "24h", "With --renew-threshold, the expiration policy used by the server to decide when the key expires, options are: 24h, 48h, 1week, oidc")
+	loginCmd.Flags().DurationVar(&loginTimeoutArg, "login-timeout", 0, "Give up on logging in with the OP if it does not complete within this long, e.g. 10m. By default login waits until it is interrupted.")
+	loginCmd.Flags().StringVar(&loginTimeoutBehaviorArg, "login-timeout-behavior", commands.LoginTimeoutFail, "With --auto-refresh and --login-timeout, what to do when the first login times out, options are: fail, retry. With retry login is tried again, backing off between attempts, until it succeeds.")
+	loginCmd.Flags().DurationVar(&refreshJitterArg, "refresh-jitter", 0, "With --auto-refresh, refresh up to this long earlier or later than usual, chosen at random, so machines started together don't all refresh at once, e.g. 30s.")
+	loginCmd.Flags().StringVar(&claimsOutArg, "claims-out", "", "Write every claim in the ID Token as JSON to this file, with permissions 0600, after logging in.")
+	_ = loginCmd.MarkFlagFilename("claims-out")
+	loginCmd.Flags().StringVar(&outputDirArg, "output-dir", "", "Directory to write the private key, cert and a metadata.json describing them to, instead of ~/.ssh. Created with permissions 0700 if it does not exist.")
+	_ = loginCmd.MarkFlagDirname("output-dir")
 	rootCmd.AddCommand(loginCmd)
 
+	var clientConfigPathArg string
+	configCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "config",
+		Short:        "View and edit the opkssh client config file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+	configCmd.PersistentFlags().StringVar(&clientConfigPathArg, "config-path", "", "Path to the client config file. Default: ~/.opk/config.yml on linux and %APPDATA%\\.opk\\config.yml on windows.")
+	_ = configCmd.MarkPersistentFlagFilename("config-path")
+
+	setDefaultCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "set-default <ALIAS>",
+		Short:        "Set the default provider used by opkssh login",
+		Long: `Set-default sets default_provider in the client config file to the supplied provider alias.
+
+The alias must be one of the aliases of the providers in the client config file or webchooser.
+
+Arguments:
+  ALIAS      The provider alias to use by default when running opkssh login.
+`,
+		Args: cobra.ExactArgs(1),
+		Example: `  opkssh config set-default google
+  opkssh config set-default webchooser`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, err := commands.NewConfigCmd(clientConfigPathArg).SetDefault(args[0])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set default provider: %v\n", err)
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Set default provider to %s in %s\n", args[0], configPath)
+			return nil
+		},
+	}
+	configCmd.AddCommand(setDefaultCmd)
+
+	encryptConfigCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "encrypt",
+		Short:        "Encrypt the client config file with a key stored in the OS keyring",
+		Long: `Encrypt encrypts the client config file in place, so that secrets such as client secrets are not stored in plaintext.
+
+The key is stored in the OS keyring: the login keychain on macOS, the Secret Service keyring (using secret-tool) on linux and a file protected with the Data Protection API on windows.
+A new key is created the first time a config file is encrypted. opkssh login decrypts the config file when it reads it.`,
+		Args:    cobra.NoArgs,
+		Example: `  opkssh config encrypt`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, err := commands.NewConfigCmd(clientConfigPathArg).Encrypt()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to encrypt config file: %v\n", err)
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Encrypted %s\n", configPath)
+			return nil
+		},
+	}
+	configCmd.AddCommand(encryptConfigCmd)
+
+	decryptConfigCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "decrypt",
+		Short:        "Decrypt a client config file encrypted with opkssh config encrypt",
+		Args:         cobra.NoArgs,
+		Example:      `  opkssh config decrypt`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, err := commands.NewConfigCmd(clientConfigPathArg).Decrypt()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to decrypt config file: %v\n", err)
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Decrypted %s\n", configPath)
+			return nil
+		},
+	}
+	configCmd.AddCommand(decryptConfigCmd)
+	rootCmd.AddCommand(configCmd)
+
+	bundleCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "bundle",
+		Short:        "Manage verification bundles used to verify offline",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	var bundleProvidersPathArg string
+	var bundleConfigPathArg string
+	var bundleSigningKeyPathArg string
+	var bundleOutputPathArg string
+	var bundleValidForArg time.Duration
+	bundleExportCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "export",
+		Short:        "Export a signed verification bundle so verify can run offline",
+		Long: `Export fetches the discovery document and JWKS of every provider in the providers file and writes them, along with the providers, to a verification bundle signed with an SSH private key.
+
+Copy the bundle to servers without network access and set verification_bundle in their server config (/etc/opk/config.yml) to the path of the bundle and the public key of the signing key. Verify then uses the providers, discovery documents and JWKS in the bundle rather than /etc/opk/providers and the network.
+
+Discovery documents are fetched from the discovery_urls set in the server config at --config-path, if it exists, and otherwise from the usual location relative to the issuer.
+
+Bundles expire after --valid-for. Export a new bundle before then, and whenever a provider rotates its signing keys.`,
+		Args: cobra.NoArgs,
+		Example: `  opkssh bundle export --signing-key ~/.ssh/bundle_ed25519 --output bundle.json
+  opkssh bundle export --providers ./providers --signing-key ./bundle_ed25519 --output bundle.json --valid-for 2h`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			bundle, err := commands.NewBundleExportCmd(bundleProvidersPathArg, bundleConfigPathArg, bundleSigningKeyPathArg, bundleOutputPathArg, bundleValidForArg).Run(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to export verification bundle: %v\n", err)
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Wrote verification bundle for %d issuers to %s, valid until %s\n", len(bundle.Issuers), bundleOutputPathArg, bundle.ExpiresAt.Format(time.RFC3339))
+			return nil
+		},
+	}
+	bundleExportCmd.Flags().StringVar(&bundleProvidersPathArg, "providers", "/etc/opk/providers", "Path to the providers file listing the providers to trust.")
+	_ = bundleExportCmd.MarkFlagFilename("providers")
+	bundleExportCmd.Flags().StringVar(&bundleConfigPathArg, "config-path", "/etc/opk/config.yml", "Path to the server config file whose discovery_urls are used to fetch the discovery documents, if it exists.")
+	_ = bundleExportCmd.MarkFlagFilename("config-path")
+	bundleExportCmd.Flags().StringVar(&bundleSigningKeyPathArg, "signing-key", "", "Path to the unencrypted SSH private key to sign the bundle with.")
+	_ = bundleExportCmd.MarkFlagFilename("signing-key")
+	bundleExportCmd.Flags().StringVar(&bundleOutputPathArg, "output", "", "Path to write the verification bundle to.")
+	_ = bundleExportCmd.MarkFlagFilename("output")
+	bundleExportCmd.Flags().DurationVar(&bundleValidForArg, "valid-for", commands.DefaultBundleValidFor, "How long the bundle is valid for.")
+	_ = bundleExportCmd.MarkFlagRequired("signing-key")
+	_ = bundleExportCmd.MarkFlagRequired("output")
+	bundleCmd.AddCommand(bundleExportCmd)
+	rootCmd.AddCommand(bundleCmd)
+
+	var certValidKeyPathArg string
+	var minValidArg time.Duration
+	var certValidExpirationPolicyArg string
+	certValidCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "cert-valid",
+		Short:        "Check if the local opkssh key is valid for at least a minimum duration",
+		Long: `Cert-valid inspects the local opkssh SSH key and exits with status 0 if it will remain valid for at least the duration set by --min, and a non-zero status otherwise.
+
+The expiration policy determines when the SSH server will stop accepting the key and should match the expiration policy for the provider in /etc/opk/providers on the server.
+
+This makes it easy to only login when needed, for instance from cron.
+`,
+		Args: cobra.NoArgs,
+		Example: `  opkssh cert-valid --min 10m || opkssh login
+  opkssh cert-valid --min 1h --expiration-policy oidc -i ~/.ssh/opkssh_server_group1`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			certValid := commands.NewCertValidCmd(certValidKeyPathArg, minValidArg, certValidExpirationPolicyArg)
+			if err := certValid.Run(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return err
+			}
+			return nil
+		},
+	}
+	certValidCmd.Flags().DurationVar(&minValidArg, "min", 0, "Minimum duration the key must remain valid for, e.g. 10m")
+	certValidCmd.Flags().StringVar(&certValidExpirationPolicyArg, "expiration-policy", "24h", "Expiration policy used by the server, options are: 24h, 48h, 1week, oidc")
+	certValidCmd.Flags().StringVarP(&certValidKeyPathArg, "private-key-file", "i", "", "Path of the private key to check. Default: the opkssh key at ~/.ssh/id_ecdsa or ~/.ssh/id_ed25519")
+	_ = certValidCmd.MarkFlagFilename("private-key-file")
+	rootCmd.AddCommand(certValidCmd)
+
+	var tokenKeyPathArg string
+	tokenCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "token",
+		Short:        "Print the ID Token from the local opkssh key",
+		Long: `Token prints the ID Token embedded in the PK Token of the local opkssh SSH key so it can be passed to services that accept the ID Token directly.
+
+It refuses to print an ID Token that has expired, run opkssh login to get a new one.
+`,
+		Args: cobra.NoArgs,
+		Example: `  curl -H "Authorization: Bearer $(opkssh token)" https://example.com
+  opkssh token -i ~/.ssh/opkssh_server_group1`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			token := commands.NewTokenCmd(tokenKeyPathArg)
+			if err := token.Run(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return err
+			}
+			return nil
+		},
+	}
+	tokenCmd.Flags().StringVarP(&tokenKeyPathArg, "private-key-file", "i", "", "Path of the private key whose ID Token to print. Default: the opkssh key at ~/.ssh/id_ecdsa or ~/.ssh/id_ed25519")
+	_ = tokenCmd.MarkFlagFilename("private-key-file")
+	rootCmd.AddCommand(tokenCmd)
+
+	var whoamiKeyPathArg string
+	var whoamiExpirationPolicyArg string
+	var whoamiShortArg bool
+	whoamiCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "whoami",
+		Short:        "Print the identity of the local opkssh key",
+		Long: `Whoami prints the identity in the local opkssh SSH key and when the key expires. It only reads the key from disk and makes no network requests.
+
+With --short it prints only the email, or the sub if the ID Token has no email, which is suited to shell prompts. It exits with a non-zero status if there is no opkssh key or the key has expired.
+
+The expiration policy determines when the SSH server will stop accepting the key and should match the expiration policy for the provider in /etc/opk/providers on the server.
+`,
+		Args: cobra.NoArgs,
+		Example: `  opkssh whoami
+  PS1='$(opkssh whoami --short 2>/dev/null || echo logged-out) \$ '`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			whoami := commands.NewWhoamiCmd(whoamiKeyPathArg, whoamiExpirationPolicyArg, whoamiShortArg)
+			if err := whoami.Run(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return err
+			}
+			return nil
+		},
+	}
+	whoamiCmd.Flags().BoolVar(&whoamiShortArg, "short", false, "Print only the email, or the sub if there is no email")
+	whoamiCmd.Flags().StringVar(&whoamiExpirationPolicyArg, "expiration-policy", "24h", "Expiration policy used by the server, options are: 24h, 48h, 1week, oidc")
+	whoamiCmd.Flags().StringVarP(&whoamiKeyPathArg, "private-key-file", "i", "", "Path of the private key whose identity to print. Default: the opkssh key at ~/.ssh/id_ecdsa or ~/.ssh/id_ed25519")
+	_ = whoamiCmd.MarkFlagFilename("private-key-file")
+	rootCmd.AddCommand(whoamiCmd)
+
 	readhomeCmd := &cobra.Command{
 		SilenceUsage: true,
 		Use:          "readhome <PRINCIPAL>",
@@ -198,6 +803,7 @@ You should not call this command directly. It is called by the opkssh verify com
 	rootCmd.AddCommand(readhomeCmd)
 
 	var serverConfigPathArg string
+	var verifyIdentityClaimArg string
 	verifyCmd := &cobra.Command{
 		SilenceUsage: true,
 		Use:          "verify <PRINCIPAL> <CERT> <KEY_TYPE>",
@@ -219,7 +825,7 @@ Where the tokens in /etc/ssh/sshd_config are defined as:
 Verification checks performed:
   1. Ensures the PK token is properly formed, signed, and issued by the specified OpenID Provider (OP).
   2. Confirms the PK token's issue (iss) and client ID (audience) are listed in the allowed provider file (/etc/opk/providers) and the token is not expired.
-  3. Validates the identity (email or sub) in the PK token against user policies (/etc/opk/auth_id or ~/.opk/auth_id) to ensure it can assume the requested username (principal).
+  3. Validates the identity (email or sub) in the PK token against user policies (/etc/opk/auth_id or ~/.opk/auth_id) to ensure it can assume the requested username (principal). With --identity-claim, email entries are matched against that claim instead of the email claim.
 
 If all checks pass, Verify authorizes the SSH connection.
 
@@ -254,25 +860,49 @@ Arguments:
 			certB64Arg := args[1]
 			typArg := args[2]
 
-			providerPolicyPath := "/etc/opk/providers"
-			providerPolicy, err := policy.NewProviderFileLoader().LoadProviderPolicy(providerPolicyPath)
-			if err != nil {
-				log.Println("Failed to open /etc/opk/providers:", err)
+			// The server config is read first as it may point verify at a
+			// verification bundle to use instead of /etc/opk/providers
+			v := commands.NewVerifyCmd(verifier.Verifier{}, nil, serverConfigPathArg)
+			if err := v.ApplyServerConfig(); err != nil {
+				log.Println("Failed to load server config:", err)
 				return err
 			}
 
-			printConfigProblems()
-			log.Println("Providers loaded: ", providerPolicy.ToString())
+			// If a verify daemon is configured it checks the cert, unless it
+			// can't be reached in which case we check it ourselves
+			if socket := v.VerifyDaemonSocket(); socket != "" {
+				authKey, err := commands.VerifyWithDaemon(ctx, socket, userArg, typArg, certB64Arg)
+				if err == nil {
+					log.Println("successfully verified by verify daemon")
+					fmt.Println(authKey)
+					return nil
+				} else if !errors.Is(err, commands.ErrVerifyDaemonUnavailable) {
+					log.Println("failed to verify:", err)
+					return err
+				}
+				log.Println("Warning: verifying without the verify daemon:", err)
+			}
 
-			pktVerifier, err := providerPolicy.CreateVerifier()
+			providerPolicy, pktVerifier, err := v.LoadProviderPolicy("/etc/opk/providers")
 			if err != nil {
-				log.Println("Failed to create pk token verifier (likely bad configuration):", err)
+				log.Println("Failed to load providers:", err)
 				return err
 			}
 
-			v := commands.NewVerifyCmd(*pktVerifier, commands.OpkPolicyEnforcerFunc(userArg), serverConfigPathArg)
-			if err := v.SetEnvVarInConfig(); err != nil {
-				log.Println("Failed to set environment variables in config:", err)
+			printConfigProblems()
+			log.Println("Providers loaded: ", providerPolicy.ToString())
+
+			v.PktVerifier = *pktVerifier
+			v.CheckPolicy = commands.OpkPolicyEnforcerFunc(userArg, providerPolicy, verifyIdentityClaimArg, v.CaseSensitiveEmailLocalPart(), v.AllowMissingEmailVerified())
+
+			// Read the policy and drop privileges before parsing the untrusted
+			// SSH certificate to limit what a bug in parsing could be used for
+			if v.DropsPrivileges() {
+				v.CheckPolicy = commands.PreloadedOpkPolicyEnforcerFunc(userArg, providerPolicy, verifyIdentityClaimArg, v.CaseSensitiveEmailLocalPart(), v.AllowMissingEmailVerified())
+				if err := v.DropPrivileges(); err != nil {
+					log.Println("Failed to drop privileges:", err)
+					return err
+				}
 			}
 
 			if authKey, err := v.AuthorizedKeysCommand(ctx, userArg, typArg, certB64Arg); err != nil {
@@ -287,15 +917,351 @@ Arguments:
 		},
 	}
 	verifyCmd.Flags().StringVar(&serverConfigPathArg, "config-path", "/etc/opk/config.yml", "Path to the server config file. Default: /etc/opk/config.yml.")
+	_ = verifyCmd.MarkFlagFilename("config-path")
+	verifyCmd.Flags().StringVar(&verifyIdentityClaimArg, "identity-claim", "", "Match email entries in the policy against this ID Token claim, e.g. preferred_username, instead of the email claim. WARNING: only use a claim users cannot edit themselves, otherwise anyone can claim any email or *@domain entry")
 	rootCmd.AddCommand(verifyCmd)
 
+	var serveVerifyConfigPathArg string
+	var serveVerifySocketArg string
+	var serveVerifyIdentityClaimArg string
+	serveVerifyCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "serve-verify",
+		Short:        "Run a daemon that verifies certs for opkssh verify",
+		Long: `Serve-verify runs a long-running daemon that performs the checks of opkssh verify. When verify_daemon is set in the server config (/etc/opk/config.yml), opkssh verify forwards the arguments it gets from sshd to the daemon over a Unix socket and prints the daemon's answer. This saves each SSH connection from loading the config and providers and fetching the JWKS of the OpenID Provider.
+
+The daemon loads the server config and the allowed providers file (/etc/opk/providers) when it starts, restart it after changing them. The policy files are read for every request. The JWKS of each OpenID Provider are kept for 5 minutes.
+
+If opkssh verify can't reach the daemon it checks the cert itself, so the daemon being down does not stop logins.
+
+Run the daemon as the AuthorizedKeysCommandUser, usually opksshuser. The socket can only be connected to by its owner and group. drop_privileges in the server config is ignored by the daemon.`,
+		Args:    cobra.NoArgs,
+		Example: `  sudo -u opksshuser opkssh serve-verify --socket /run/opk/verify.sock`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			logFile, err := os.OpenFile(logFilePathServer, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0660)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening log file, logging to stderr: %v\n", err)
+			} else {
+				defer logFile.Close()
+				log.SetOutput(logFile)
+			}
+
+			daemon, err := commands.NewVerifyDaemon(serveVerifyConfigPathArg, "/etc/opk/providers", serveVerifyIdentityClaimArg)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+			printConfigProblems()
+
+			socket := serveVerifySocketArg
+			if socket == "" {
+				socket = daemon.Socket()
+			}
+			listener, err := commands.ListenVerifySocket(socket)
+			if err != nil {
+				log.Println("Failed to listen on verify socket:", err)
+				return err
+			}
+			log.Println("Verify daemon listening on", socket)
+			return daemon.Serve(ctx, listener)
+		},
+	}
+	serveVerifyCmd.Flags().StringVar(&serveVerifyConfigPathArg, "config-path", "/etc/opk/config.yml", "Path to the server config file.")
+	_ = serveVerifyCmd.MarkFlagFilename("config-path")
+	serveVerifyCmd.Flags().StringVar(&serveVerifySocketArg, "socket", "", "Unix socket to listen on. Defaults to the socket set by verify_daemon in the server config, or "+commands.DefaultVerifySocket)
+	_ = serveVerifyCmd.MarkFlagFilename("socket")
+	serveVerifyCmd.Flags().StringVar(&serveVerifyIdentityClaimArg, "identity-claim", "", "As for opkssh verify --identity-claim, which is ignored when verify forwards to the daemon")
+	rootCmd.AddCommand(serveVerifyCmd)
+
+	var exportKeysArg string
+	var exportOutputArg string
+	var exportConfigPathArg string
+	var exportProvidersArg string
+	var exportValidForArg time.Duration
+	exportAuthorizedKeysCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "export-authorized-keys <PRINCIPAL>",
+		Short:        "Export a static authorized_keys file as a fallback for opkssh verify",
+		Long: `Export-authorized-keys verifies each opkssh public key in --keys, as opkssh verify would for PRINCIPAL, and writes an authorized_keys line for each key the policy allows. Keys that fail verification or are not allowed are skipped with a warning.
+
+Pointing sshd at the exported file lets those keys keep logging in when opkssh verify can not run, for instance when the OpenID Provider is unreachable:
+  AuthorizedKeysFile .ssh/authorized_keys /etc/opk/fallback/%u
+
+The policy is evaluated at export time. Policy entries restricted with hours= and policy plugins are not re-checked when sshd uses the exported file, and removing a key from the policy does not remove it from the file. --valid-for makes sshd stop accepting the exported keys after a while, 24h by default.
+
+Arguments:
+  PRINCIPAL    Target username the keys are exported for.`,
+		Args:    cobra.ExactArgs(1),
+		Example: `  sudo opkssh export-authorized-keys root --keys ./keys --output /etc/opk/fallback/root --valid-for 72h`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := context.Background()
+			principalArg := args[0]
+
+			v := commands.NewVerifyCmd(verifier.Verifier{}, nil, exportConfigPathArg)
+			if err := v.ApplyServerConfig(); err != nil {
+				return fmt.Errorf("failed to load server config: %w", err)
+			}
+			providerPolicy, pktVerifier, err := v.LoadProviderPolicy(exportProvidersArg)
+			if err != nil {
+				return fmt.Errorf("failed to load providers: %w", err)
+			}
+			v.PktVerifier = *pktVerifier
+			v.CheckPolicy = commands.OpkPolicyEnforcerFunc(principalArg, providerPolicy, "", v.CaseSensitiveEmailLocalPart(), v.AllowMissingEmailVerified())
+
+			var out strings.Builder
+			e := commands.NewExportAuthorizedKeysCmd(v, exportKeysArg, exportValidForArg)
+			exported, err := e.Run(ctx, principalArg, &out)
+			if err != nil {
+				return err
+			}
+			if exportOutputArg == "" {
+				fmt.Print(out.String())
+			} else {
+				if err := os.WriteFile(exportOutputArg, []byte(out.String()), 0644); err != nil {
+					return fmt.Errorf("failed to write %s: %w", exportOutputArg, err)
+				}
+			}
+			fmt.Fprintf(os.Stderr, "Exported %d key(s) for %s\n", exported, principalArg)
+			return nil
+		},
+	}
+	exportAuthorizedKeysCmd.Flags().StringVar(&exportKeysArg, "keys", "", "File of opkssh public keys (*-cert.pub), one per line, or a directory of such files")
+	_ = exportAuthorizedKeysCmd.MarkFlagFilename("keys")
+	exportAuthorizedKeysCmd.Flags().StringVarP(&exportOutputArg, "output", "o", "", "Write the authorized_keys file to this path instead of stdout")
+	_ = exportAuthorizedKeysCmd.MarkFlagFilename("output")
+	exportAuthorizedKeysCmd.Flags().StringVar(&exportConfigPathArg, "config-path", "/etc/opk/config.yml", "Path to the server config file.")
+	_ = exportAuthorizedKeysCmd.MarkFlagFilename("config-path")
+	exportAuthorizedKeysCmd.Flags().StringVar(&exportProvidersArg, "providers", "/etc/opk/providers", "Path to the allowed providers file.")
+	_ = exportAuthorizedKeysCmd.MarkFlagFilename("providers")
+	exportAuthorizedKeysCmd.Flags().DurationVar(&exportValidForArg, "valid-for", commands.DefaultExportValidFor, "Make sshd stop accepting the exported keys after this duration, e.g. 72h")
+	_ = exportAuthorizedKeysCmd.MarkFlagRequired("keys")
+	rootCmd.AddCommand(exportAuthorizedKeysCmd)
+
+	var providersConfigPathArg string
+	var providersOutputArg string
+	providersCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "providers",
+		Short:        "Show the OpenID Providers in the client config file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+	providersListCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "list",
+		Short:        "List the provider aliases in the client config file",
+		Long: `List prints each provider alias in the client config file with the issuer it logs in to, sorted by alias. The default provider is marked (default).
+
+If there is no client config file the providers built into opkssh are listed, as they are the providers opkssh login uses.
+
+With --output json a JSON array of objects with the fields alias, issuer and default is printed instead, for completion scripts and other tools.`,
+		Args: cobra.NoArgs,
+		Example: `  opkssh providers list
+  opkssh providers list --output json`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listings, err := commands.NewConfigCmd(providersConfigPathArg).ListProviders()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to list providers: %v\n", err)
+				return err
+			}
+			return commands.WriteProviderList(os.Stdout, listings, providersOutputArg)
+		},
+	}
+	providersListCmd.Flags().StringVar(&providersConfigPathArg, "config-path", "", "Path to the client config file. Default: ~/.opk/config.yml on linux and %APPDATA%\\.opk\\config.yml on windows.")
+	_ = providersListCmd.MarkFlagFilename("config-path")
+	providersListCmd.Flags().StringVarP(&providersOutputArg, "output", "o", commands.ProvidersOutputText, "Output format, text or json")
+	providersCmd.AddCommand(providersListCmd)
+	rootCmd.AddCommand(providersCmd)
+
+	serverCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "server",
+		Short:        "Manage the opkssh configuration of an SSH server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+
+	var testConfigPathArg string
+	var testConfigProvidersPathArg string
+	var testConfigPolicyPathArg string
+	testConfigCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "test-config",
+		Short:        "Check the server config, providers and policy files before reloading sshd",
+		Long: `Test-config checks the files opkssh verify reads on the SSH server and prints whether each of them passed or failed.
+
+It checks that the server config (/etc/opk/config.yml), the allowed providers file (/etc/opk/providers) and the system policy file (/etc/opk/auth_id):
+  1. Can be read and are owned by root:opksshuser with permissions 640.
+  2. Are well-formed. Lines that opkssh verify would skip are reported as problems.
+
+Test-config exits with a non-zero exit code if any file failed.`,
+		Args:    cobra.NoArgs,
+		Example: `  sudo opkssh server test-config`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			results := commands.NewTestConfigCmd(testConfigPathArg, testConfigProvidersPathArg, testConfigPolicyPathArg).Run()
+			return commands.WriteTestConfigReport(os.Stdout, results)
+		},
+	}
+	testConfigCmd.Flags().StringVar(&testConfigPathArg, "config-path", "/etc/opk/config.yml", "Path to the server config file.")
+	_ = testConfigCmd.MarkFlagFilename("config-path")
+	testConfigCmd.Flags().StringVar(&testConfigProvidersPathArg, "providers", "/etc/opk/providers", "Path to the allowed providers file.")
+	_ = testConfigCmd.MarkFlagFilename("providers")
+	testConfigCmd.Flags().StringVar(&testConfigPolicyPathArg, "policy", policy.SystemDefaultPolicyPath, "Path to the system policy file.")
+	_ = testConfigCmd.MarkFlagFilename("policy")
+	serverCmd.AddCommand(testConfigCmd)
+
+	var testVerifyPolicyPathArg string
+	var testVerifyExplainArg bool
+	testVerifyCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "test-verify <PRINCIPAL> <CLAIMS_JSON_FILE>",
+		Short:        "Check whether the claims of an ID Token are allowed to assume a principal",
+		Long: `Test-verify evaluates the policy file for the ID Token claims in CLAIMS_JSON_FILE and PRINCIPAL and prints whether access is allowed or denied.
+
+The claims are not verified and there is no SSH cert, so policy entries that require a cert extension never match and policy plugins are not run. Use --explain to print the rule that decided and why it took precedence.
+
+Test-verify exits with a non-zero exit code if access is denied.`,
+		Args: cobra.ExactArgs(2),
+		Example: `  opkssh server test-verify root claims.json --explain
+  opkssh server test-verify dev claims.json --policy ./auth_id`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return commands.NewTestVerifyCmd(testVerifyPolicyPathArg, testVerifyExplainArg).Run(os.Stdout, args[0], args[1])
+		},
+	}
+	testVerifyCmd.Flags().StringVar(&testVerifyPolicyPathArg, "policy", policy.SystemDefaultPolicyPath, "Path to the policy file.")
+	_ = testVerifyCmd.MarkFlagFilename("policy")
+	testVerifyCmd.Flags().BoolVar(&testVerifyExplainArg, "explain", false, "Print the policy rule that decided and why it took precedence.")
+	serverCmd.AddCommand(testVerifyCmd)
+
+	verifyAuditChainCmd := &cobra.Command{
+		SilenceUsage: true,
+		Use:          "verify-audit-chain <PATH>",
+		Short:        "Check the audit chain written by verify has not been tampered with",
+		Long: `Verify-audit-chain checks each record of the audit chain that opkssh verify writes when audit_chain is set in the server config.
+
+Each record includes the hash of the record before it, so editing, removing or reordering records breaks the chain. The first broken record is reported and verify-audit-chain exits with a non-zero exit code.
+
+Records removed from the end of the chain leave a valid chain. To detect this, keep the number of records and the hash of the last record printed by verify-audit-chain somewhere the SSH server can't write to and check the chain still contains them.`,
+		Args:    cobra.ExactArgs(1),
+		Example: `  sudo opkssh server verify-audit-chain /var/log/opkssh/audit-chain.jsonl`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			count, lastHash, err := commands.VerifyAuditChain(file)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Audit chain %s is broken after %d valid records: %v\n", args[0], count, err)
+				return err
+			}
+			fmt.Fprintf(os.Stdout, "Audit chain %s is valid, %d records, last hash %s\n", args[0], count, lastHash)
+			return nil
+		},
+	}
+	serverCmd.AddCommand(verifyAuditChainCmd)
+	rootCmd.AddCommand(serverCmd)
+
 	err := rootCmd.Execute()
 	if err != nil {
+		var exitErr *commands.ExitCodeError
+		if errors.As(err, &exitErr) {
+			return exitErr.Code
+		}
 		return 1
 	}
 	return 0
 }
 
+// loginExitRefreshSessionExpired is the exit code of opkssh login
+// --auto-refresh when the refresh token expired or was revoked, so that a
+// supervising process can tell the user needs to log in again interactively
+const loginExitRefreshSessionExpired = 2
+
+// diffPolicyExitDiffers is the exit code of opkssh diff-policy when the
+// policies differ. Errors exit with 1.
+const diffPolicyExitDiffers = 2
+
+// Exit codes of opkssh add --check. Entries that are already present exit
+// with 0 and errors exit with 1.
+const (
+	addCheckExitWouldAdd = 2
+	addCheckExitConflict = 3
+)
+
+// runAddCheck reports what adding the entry would do, using the exit code to
+// distinguish entries that are already present from those that would be
+// added or that conflict
+func runAddCheck(cmd *cobra.Command, add commands.AddCmd, principal string, userEmail string, issuer string) error {
+	result, err := add.Check(principal, userEmail, issuer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check policy: %v\n", err)
+		return err
+	}
+	entry := principal + " " + userEmail + " " + issuer
+	// The outcome is printed here, cobra should not print it again as an error
+	cmd.SilenceErrors = true
+	switch result.Status {
+	case policy.AddPresent:
+		fmt.Fprintf(os.Stdout, "Already present: %s in %s\n", entry, result.PolicyPath)
+		return nil
+	case policy.AddConflict:
+		fmt.Fprintf(os.Stdout, "Conflict: %s in %s, %s\n", entry, result.PolicyPath, result.Reason)
+		return &commands.ExitCodeError{Code: addCheckExitConflict, Msg: "entry conflicts with the policy"}
+	default:
+		fmt.Fprintf(os.Stdout, "Would add: %s to %s\n", entry, result.PolicyPath)
+		return &commands.ExitCodeError{Code: addCheckExitWouldAdd, Msg: "entry would be added to the policy"}
+	}
+}
+
+// runAddFromFile adds the entries in the file at path, reporting the result
+// of each line
+func runAddFromFile(path string, issuerArg string, comment string, strict bool) error {
+	issuer, err := expandIssuerAlias(issuerArg)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	add := commands.AddCmd{
+		HomePolicyLoader:   policy.NewHomePolicyLoader(),
+		SystemPolicyLoader: policy.NewSystemPolicyLoader(),
+		Comment:            comment,
+	}
+	results, policyFilePath, err := add.RunFromFile(content, issuer, strict)
+	for _, result := range results {
+		entry := result.Principal + " " + result.Identity + " " + issuer
+		switch {
+		case result.Err != nil && strict:
+			fmt.Fprintf(os.Stderr, "Line %d of %s is malformed: %v\n", result.Line, path, result.Err)
+		case result.Err != nil:
+			fmt.Fprintf(os.Stderr, "Warning: skipping line %d of %s: %v\n", result.Line, path, result.Err)
+		case err != nil:
+			// Nothing was written
+		case result.Status == policy.AddPresent:
+			fmt.Fprintf(os.Stdout, "Line %d: already present: %s\n", result.Line, entry)
+		case result.Status == policy.AddConflict:
+			fmt.Fprintf(os.Stdout, "Line %d: added: %s, but %s\n", result.Line, entry, result.Reason)
+		default:
+			fmt.Fprintf(os.Stdout, "Line %d: added: %s\n", result.Line, entry)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add to policy: %v\n", err)
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "Successfully updated policy %s\n", policyFilePath)
+	return nil
+}
+
 func printConfigProblems() {
 	problems := files.ConfigProblems().GetProblems()
 	if len(problems) > 0 {
@@ -348,11 +1314,40 @@ func isOpenSSHVersion8Dot1OrGreater(opensshVersion string) (bool, error) {
 		return false, errors.New("invalid OpenSSH version")
 	}
 
-	version := matches[1]
-
-	if version >= "8.1" {
-		return true, nil
+	// Compare the major and minor versions as numbers, comparing the version
+	// strings would put 10.0 before 8.1
+	parts := strings.Split(matches[1], ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false, errors.New("invalid OpenSSH version")
+	}
+	minor := 0
+	if len(parts) > 1 {
+		if minor, err = strconv.Atoi(parts[1]); err != nil {
+			return false, errors.New("invalid OpenSSH version")
+		}
 	}
 
-	return false, nil
+	return major > 8 || (major == 8 && minor >= 1), nil
+}
+
+// expandPathFlags expands ~ and environment variables in the flags of cmd
+// that are marked as filenames or directories, see commands.ExpandPath
+func expandPathFlags(cmd *cobra.Command) error {
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		_, isFile := flag.Annotations[cobra.BashCompFilenameExt]
+		_, isDir := flag.Annotations[cobra.BashCompSubdirsInDir]
+		if err != nil || !flag.Changed || !(isFile || isDir) {
+			return
+		}
+		var path string
+		if path, err = commands.ExpandPath(flag.Value.String()); err == nil {
+			err = flag.Value.Set(path)
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid --%s: %w", flag.Name, err)
+		}
+	})
+	return err
 }
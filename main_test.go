@@ -69,6 +69,18 @@ func TestIsOpenSSHVersion8Dot1OrGreater(t *testing.T) {
 			wantIsGreater: false,
 			wantErr:       nil,
 		},
+		{
+			name:          "Above 8.1 with two digit major version (10.0p2)",
+			input:         "OpenSSH_10.0p2",
+			wantIsGreater: true,
+			wantErr:       nil,
+		},
+		{
+			name:          "Major version only (9)",
+			input:         "OpenSSH_9",
+			wantIsGreater: true,
+			wantErr:       nil,
+		},
 		{
 			name:          "Malformed version string",
 			input:         "OpenSSH_, something not right",
@@ -148,6 +160,33 @@ func RunCliAndCaptureResult(t *testing.T, args []string) (string, int) {
 	return cmdOutput.String(), exitCode
 }
 
+func TestExpandIssuerAlias(t *testing.T) {
+	tests := []struct {
+		issuer         string
+		expectedIssuer string
+		errorString    string
+	}{
+		{issuer: "google", expectedIssuer: "https://accounts.google.com"},
+		{issuer: "gitlab", expectedIssuer: "https://gitlab.com"},
+		{issuer: "gitlab:gitlab.example.com", expectedIssuer: "https://gitlab.example.com"},
+		{issuer: "gitlab:https://example.com/gitlab/", expectedIssuer: "https://example.com/gitlab"},
+		{issuer: "gitlab:http://gitlab.example.com", errorString: "expected it to start with 'https://'"},
+		{issuer: "https://issuer.example.com", expectedIssuer: "https://issuer.example.com"},
+		{issuer: "", expectedIssuer: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.issuer, func(t *testing.T) {
+			issuer, err := expandIssuerAlias(tt.issuer)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedIssuer, issuer)
+		})
+	}
+}
+
 func TestRun(t *testing.T) {
 	tests := []struct {
 		name       string
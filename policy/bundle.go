@@ -0,0 +1,272 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openpubkey/openpubkey/verifier"
+	"golang.org/x/crypto/ssh"
+)
+
+// VerificationBundleVersion is the version of the verification bundle format
+const VerificationBundleVersion = 1
+
+// bundleSignatureNamespace is prepended to the bundle payload before it is
+// signed so that a bundle signature can't be confused with a signature made
+// with the same key for another purpose
+const bundleSignatureNamespace = "opkssh-verification-bundle-v1\n"
+
+// VerificationBundle holds everything verify needs to verify PK Tokens
+// without network access: the providers it trusts and the discovery document
+// and JWKS of each of their issuers. Bundles are exported by an online step
+// and signed so that they can't be tampered with before verify uses them.
+type VerificationBundle struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Providers is the trusted providers in the format of /etc/opk/providers
+	Providers string         `json:"providers"`
+	Issuers   []BundleIssuer `json:"issuers"`
+}
+
+// BundleIssuer is the discovery document and JWKS of an issuer as they were
+// served when the bundle was exported
+type BundleIssuer struct {
+	Issuer    string          `json:"issuer"`
+	Discovery json.RawMessage `json:"discovery"`
+	Jwks      json.RawMessage `json:"jwks"`
+}
+
+// SignedVerificationBundle is the file a verification bundle is written to.
+// The signature is over the exact payload bytes so that the bundle does not
+// need to be canonicalized to be verified.
+type SignedVerificationBundle struct {
+	Payload         []byte `json:"payload"`
+	SignatureFormat string `json:"signature_format"`
+	Signature       []byte `json:"signature"`
+}
+
+// ExportVerificationBundle fetches the discovery document and JWKS of every
+// issuer, including fallback issuers, in providerPolicy and returns a bundle
+// valid for validFor. If httpClient is nil, http.DefaultClient is used.
+// Discovery documents are fetched from the discovery URLs set with
+// SetDiscoveryURLs, but are kept in the bundle under the conventional URL
+// that the verifier created from the bundle requests.
+func ExportVerificationBundle(ctx context.Context, providerPolicy *ProviderPolicy, httpClient *http.Client, validFor time.Duration) (*VerificationBundle, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if len(providerPolicy.rows) == 0 {
+		return nil, fmt.Errorf("no providers configured")
+	}
+	if validFor <= 0 {
+		return nil, fmt.Errorf("bundle validity must be positive, got %s", validFor)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	bundle := &VerificationBundle{
+		Version:   VerificationBundleVersion,
+		CreatedAt: now,
+		ExpiresAt: now.Add(validFor),
+		Providers: ProvidersFileLoader{}.ToTable(*providerPolicy).ToString(),
+	}
+	seen := map[string]bool{}
+	for _, row := range providerPolicy.rows {
+		for _, issuer := range row.Issuers() {
+			if seen[issuer] {
+				continue
+			}
+			seen[issuer] = true
+			bundleIssuer, err := fetchBundleIssuer(ctx, providerPolicy.httpClientFor(issuer, httpClient), issuer)
+			if err != nil {
+				return nil, err
+			}
+			bundle.Issuers = append(bundle.Issuers, *bundleIssuer)
+		}
+	}
+	return bundle, nil
+}
+
+func fetchBundleIssuer(ctx context.Context, httpClient *http.Client, issuer string) (*BundleIssuer, error) {
+	discoveryJson, err := httpGet(ctx, httpClient, discoveryURL(issuer))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document of %s: %w", issuer, err)
+	}
+	discovery, err := parseDiscovery(discoveryJson)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery document of %s: %w", issuer, err)
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document of %s is for issuer %s", issuer, discovery.Issuer)
+	}
+	jwksJson, err := httpGet(ctx, httpClient, discovery.JwksURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS of %s: %w", issuer, err)
+	}
+	if !json.Valid(jwksJson) {
+		return nil, fmt.Errorf("JWKS of %s is not valid JSON", issuer)
+	}
+	return &BundleIssuer{
+		Issuer:    issuer,
+		Discovery: discoveryJson,
+		Jwks:      jwksJson,
+	}, nil
+}
+
+func httpGet(ctx context.Context, httpClient *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received %s from %s", resp.Status, url)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// discoveryURL returns the URL of the OpenID Connect discovery document of
+// issuer, built the same way as when verifying ID Tokens online
+func discoveryURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+}
+
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+func parseDiscovery(discoveryJson []byte) (*discoveryDocument, error) {
+	var discovery discoveryDocument
+	if err := json.Unmarshal(discoveryJson, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.JwksURI == "" {
+		return nil, fmt.Errorf("missing jwks_uri")
+	}
+	return &discovery, nil
+}
+
+// Sign returns the bundle signed with signer, ready to be written to a file
+func (b *VerificationBundle) Sign(signer ssh.Signer) ([]byte, error) {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	message := append([]byte(bundleSignatureNamespace), payload...)
+
+	var sig *ssh.Signature
+	if algSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// Don't fall back to SHA-1 signatures for RSA keys
+		sig, err = algSigner.SignWithAlgorithm(rand.Reader, message, ssh.KeyAlgoRSASHA256)
+	} else {
+		sig, err = signer.Sign(rand.Reader, message)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign verification bundle: %w", err)
+	}
+	return json.MarshalIndent(SignedVerificationBundle{
+		Payload:         payload,
+		SignatureFormat: sig.Format,
+		Signature:       sig.Blob,
+	}, "", "  ")
+}
+
+// OpenVerificationBundle checks the signature of a signed bundle against
+// pubkey and returns the bundle. It returns an error if the bundle has been
+// tampered with, was signed by another key or has expired.
+func OpenVerificationBundle(signedBundle []byte, pubkey ssh.PublicKey) (*VerificationBundle, error) {
+	var signed SignedVerificationBundle
+	if err := json.Unmarshal(signedBundle, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse verification bundle: %w", err)
+	}
+	message := append([]byte(bundleSignatureNamespace), signed.Payload...)
+	if err := pubkey.Verify(message, &ssh.Signature{Format: signed.SignatureFormat, Blob: signed.Signature}); err != nil {
+		return nil, fmt.Errorf("verification bundle signature is invalid: %w", err)
+	}
+
+	var bundle VerificationBundle
+	if err := json.Unmarshal(signed.Payload, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to parse verification bundle payload: %w", err)
+	}
+	if bundle.Version != VerificationBundleVersion {
+		return nil, fmt.Errorf("unsupported verification bundle version %d, expected %d", bundle.Version, VerificationBundleVersion)
+	}
+	if time.Now().After(bundle.ExpiresAt) {
+		return nil, fmt.Errorf("verification bundle expired at %s", bundle.ExpiresAt.Format(time.RFC3339))
+	}
+	return &bundle, nil
+}
+
+// ProviderPolicy returns the trusted providers in the bundle. Path is used
+// only for logging problems with the providers.
+func (b *VerificationBundle) ProviderPolicy(path string) *ProviderPolicy {
+	return (&ProvidersFileLoader{}).FromTable([]byte(b.Providers), path)
+}
+
+// CreateVerifier returns a PK Token verifier for the providers in the bundle
+// that uses the discovery documents and JWKS in the bundle rather than
+// fetching them from the issuers
+func (b *VerificationBundle) CreateVerifier(path string) (*verifier.Verifier, error) {
+	responses := map[string][]byte{}
+	for _, issuer := range b.Issuers {
+		discovery, err := parseDiscovery(issuer.Discovery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid discovery document of %s in verification bundle: %w", issuer.Issuer, err)
+		}
+		responses[discoveryURL(issuer.Issuer)] = issuer.Discovery
+		responses[discovery.JwksURI] = issuer.Jwks
+	}
+	httpClient := &http.Client{Transport: bundleTransport{responses: responses}}
+	return b.ProviderPolicy(path).createVerifier(func(issuer string, clientID string) verifier.ProviderVerifier {
+		return newProviderVerifier(issuer, clientID, httpClient)
+	})
+}
+
+// bundleTransport answers requests from the responses in a verification
+// bundle so that nothing is fetched over the network
+type bundleTransport struct {
+	responses map[string][]byte
+}
+
+func (t bundleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := t.responses[req.URL.String()]
+	if !ok || req.Method != http.MethodGet {
+		return nil, fmt.Errorf("%s %s is not in the verification bundle", req.Method, req.URL)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// mockIssuerServer serves the discovery document and JWKS of a mock OP and
+// returns a PK Token issued by it
+func mockIssuerServer(t *testing.T) (*httptest.Server, *pktoken.PKToken) {
+	var jwks []byte
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   srv.URL,
+			"jwks_uri": srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	})
+
+	opts := providers.DefaultMockProviderOpts()
+	opts.Issuer = srv.URL
+	op, backend, idtTemplate, err := providers.NewMockProvider(opts)
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+	jwks, err = backend.GetPublicKeyFinder().JwksFunc(context.Background(), srv.URL)
+	require.NoError(t, err)
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	return srv, pkt
+}
+
+func newBundleSigner(t *testing.T) ssh.Signer {
+	_, seckey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(seckey)
+	require.NoError(t, err)
+	return signer
+}
+
+func TestVerificationBundleRoundTrip(t *testing.T) {
+	srv, pkt := mockIssuerServer(t)
+	otherSrv, otherPkt := mockIssuerServer(t)
+
+	providersFile := srv.URL + " test_client_id 24h\n"
+	providerPolicy := (&ProvidersFileLoader{}).FromTable([]byte(providersFile), "providers")
+	bundle, err := ExportVerificationBundle(context.Background(), providerPolicy, srv.Client(), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, bundle.Issuers, 1)
+	require.Equal(t, srv.URL, bundle.Issuers[0].Issuer)
+	require.WithinDuration(t, time.Now().Add(time.Hour), bundle.ExpiresAt, time.Minute)
+
+	signer := newBundleSigner(t)
+	signedBundle, err := bundle.Sign(signer)
+	require.NoError(t, err)
+
+	// Verifying must not need the issuer
+	srv.Close()
+	otherSrv.Close()
+
+	openedBundle, err := OpenVerificationBundle(signedBundle, signer.PublicKey())
+	require.NoError(t, err)
+	require.Equal(t, providerPolicy.ToString(), openedBundle.ProviderPolicy("bundle.json").ToString())
+
+	ver, err := openedBundle.CreateVerifier("bundle.json")
+	require.NoError(t, err)
+	require.NoError(t, ver.VerifyPKToken(context.Background(), pkt))
+
+	// Issuers not trusted by the bundle are rejected
+	require.Error(t, ver.VerifyPKToken(context.Background(), otherPkt))
+}
+
+func TestExportVerificationBundleDiscoveryURL(t *testing.T) {
+	// The OP only serves its discovery document at a custom location
+	var jwks []byte
+	mux := http.NewServeMux()
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/oidc/custom-discovery", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   srv.URL,
+			"jwks_uri": srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	})
+
+	opts := providers.DefaultMockProviderOpts()
+	opts.Issuer = srv.URL
+	op, backend, _, err := providers.NewMockProvider(opts)
+	require.NoError(t, err)
+	jwks, err = backend.GetPublicKeyFinder().JwksFunc(context.Background(), srv.URL)
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	providersFile := srv.URL + " test_client_id 24h\n"
+	providerPolicy := (&ProvidersFileLoader{}).FromTable([]byte(providersFile), "providers")
+	_, err = ExportVerificationBundle(context.Background(), providerPolicy, srv.Client(), time.Hour)
+	require.ErrorContains(t, err, "failed to fetch discovery document")
+
+	require.NoError(t, providerPolicy.SetDiscoveryURLs(map[string]string{srv.URL: srv.URL + "/oidc/custom-discovery"}))
+	bundle, err := ExportVerificationBundle(context.Background(), providerPolicy, srv.Client(), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, bundle.Issuers, 1)
+
+	// The verifier from the bundle finds the document at the usual location
+	srv.Close()
+	signer := newBundleSigner(t)
+	signedBundle, err := bundle.Sign(signer)
+	require.NoError(t, err)
+	openedBundle, err := OpenVerificationBundle(signedBundle, signer.PublicKey())
+	require.NoError(t, err)
+	ver, err := openedBundle.CreateVerifier("bundle.json")
+	require.NoError(t, err)
+	require.NoError(t, ver.VerifyPKToken(context.Background(), pkt))
+}
+
+func TestOpenVerificationBundle(t *testing.T) {
+	signer := newBundleSigner(t)
+	newBundle := func() *VerificationBundle {
+		return &VerificationBundle{
+			Version:   VerificationBundleVersion,
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour),
+			Providers: "https://accounts.example.com test_client_id 24h\n",
+			Issuers: []BundleIssuer{{
+				Issuer:    "https://accounts.example.com",
+				Discovery: json.RawMessage(`{"issuer":"https://accounts.example.com","jwks_uri":"https://accounts.example.com/keys"}`),
+				Jwks:      json.RawMessage(`{"keys":[]}`),
+			}},
+		}
+	}
+
+	signedBundle, err := newBundle().Sign(signer)
+	require.NoError(t, err)
+	_, err = OpenVerificationBundle(signedBundle, signer.PublicKey())
+	require.NoError(t, err)
+
+	// A bundle signed by another key is rejected
+	_, err = OpenVerificationBundle(signedBundle, newBundleSigner(t).PublicKey())
+	require.ErrorContains(t, err, "verification bundle signature is invalid")
+
+	// As is a bundle that has been changed after it was signed
+	var signed SignedVerificationBundle
+	require.NoError(t, json.Unmarshal(signedBundle, &signed))
+	tamperedBundle := newBundle()
+	tamperedBundle.Providers = "https://evil.example.com test_client_id 24h\n"
+	signed.Payload, err = json.Marshal(tamperedBundle)
+	require.NoError(t, err)
+	tamperedSignedBundle, err := json.Marshal(signed)
+	require.NoError(t, err)
+	_, err = OpenVerificationBundle(tamperedSignedBundle, signer.PublicKey())
+	require.ErrorContains(t, err, "verification bundle signature is invalid")
+
+	expiredBundle := newBundle()
+	expiredBundle.ExpiresAt = time.Now().Add(-time.Minute)
+	signedBundle, err = expiredBundle.Sign(signer)
+	require.NoError(t, err)
+	_, err = OpenVerificationBundle(signedBundle, signer.PublicKey())
+	require.ErrorContains(t, err, "verification bundle expired at")
+
+	futureBundle := newBundle()
+	futureBundle.Version = VerificationBundleVersion + 1
+	signedBundle, err = futureBundle.Sign(signer)
+	require.NoError(t, err)
+	_, err = OpenVerificationBundle(signedBundle, signer.PublicKey())
+	require.ErrorContains(t, err, "unsupported verification bundle version")
+}
+
+func TestBundleTransport(t *testing.T) {
+	transport := bundleTransport{responses: map[string][]byte{
+		"https://accounts.example.com/keys": []byte(`{"keys":[]}`),
+	}}
+	httpClient := &http.Client{Transport: transport}
+
+	resp, err := httpClient.Get("https://accounts.example.com/keys")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Nothing outside the bundle is fetched
+	_, err = httpClient.Get("https://accounts.example.com/other")
+	require.ErrorContains(t, err, "is not in the verification bundle")
+}
@@ -0,0 +1,164 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// PolicyDiff is the semantic difference between two policies. Entries are
+// compared row by row, one principal, identity and issuer at a time, so
+// comments, the order of rows and how principals are grouped are ignored.
+type PolicyDiff struct {
+	// Added are the rows only in the new policy
+	Added []User
+	// Removed are the rows only in the old policy
+	Removed []User
+	// Changed are the rows whose options, such as deny, command or hours,
+	// differ between the policies
+	Changed []ChangedEntry
+}
+
+// ChangedEntry is a row for the same principal, identity and issuer in both
+// policies with different options
+type ChangedEntry struct {
+	Old User
+	New User
+}
+
+// Empty returns true if the policies are equivalent
+func (d *PolicyDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// entryKey identifies the rows of a policy that can be compared
+type entryKey struct {
+	principal         string
+	identityAttribute string
+	issuer            string
+}
+
+// Diff returns the rows added, removed and changed going from oldPolicy to
+// newPolicy. Duplicate rows are treated as a single row.
+func Diff(oldPolicy *Policy, newPolicy *Policy) *PolicyDiff {
+	oldRows := policyRows(oldPolicy)
+	newRows := policyRows(newPolicy)
+
+	keys := []entryKey{}
+	for key := range oldRows {
+		keys = append(keys, key)
+	}
+	for key := range newRows {
+		if _, ok := oldRows[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.principal != b.principal {
+			return a.principal < b.principal
+		}
+		if a.identityAttribute != b.identityAttribute {
+			return a.identityAttribute < b.identityAttribute
+		}
+		return a.issuer < b.issuer
+	})
+
+	diff := &PolicyDiff{}
+	for _, key := range keys {
+		removed := rowsNotIn(oldRows[key], newRows[key])
+		added := rowsNotIn(newRows[key], oldRows[key])
+		// A single row on each side is the same entry with new options,
+		// otherwise it is ambiguous which rows replaced which
+		if len(removed) == 1 && len(added) == 1 {
+			diff.Changed = append(diff.Changed, ChangedEntry{Old: removed[0], New: added[0]})
+			continue
+		}
+		diff.Removed = append(diff.Removed, removed...)
+		diff.Added = append(diff.Added, added...)
+	}
+	return diff
+}
+
+// policyRows splits the entries of policy into one row per principal, as
+// they are written in the policy file, keyed by principal, identity and
+// issuer. Duplicate rows are dropped.
+func policyRows(policy *Policy) map[entryKey][]User {
+	rows := map[entryKey][]User{}
+	for _, user := range policy.Users {
+		for _, principal := range user.Principals {
+			row := user
+			row.Principals = []string{principal}
+			row.Comment = ""
+			key := entryKey{principal: principal, identityAttribute: user.IdentityAttribute, issuer: user.Issuer}
+			if !slices.ContainsFunc(rows[key], func(u User) bool { return sameOptions(u, row) }) {
+				rows[key] = append(rows[key], row)
+			}
+		}
+	}
+	return rows
+}
+
+// rowsNotIn returns the rows in rows with options that no row in other has
+func rowsNotIn(rows []User, other []User) []User {
+	notIn := []User{}
+	for _, row := range rows {
+		if !slices.ContainsFunc(other, func(u User) bool { return sameOptions(u, row) }) {
+			notIn = append(notIn, row)
+		}
+	}
+	return notIn
+}
+
+// sameOptions returns true if a and b have the same options
+func sameOptions(a User, b User) bool {
+	return slices.Equal(a.options(), b.options())
+}
+
+// String returns the diff with a line for each row, prefixed with + if it
+// was added, - if it was removed and ~ if its options changed
+func (d *PolicyDiff) String() string {
+	var b strings.Builder
+	for _, row := range d.Removed {
+		fmt.Fprintf(&b, "- %s\n", diffRow(row))
+	}
+	for _, row := range d.Added {
+		fmt.Fprintf(&b, "+ %s\n", diffRow(row))
+	}
+	for _, change := range d.Changed {
+		fmt.Fprintf(&b, "~ %s: %s -> %s\n", strings.Join([]string{change.Old.Principals[0], change.Old.IdentityAttribute, change.Old.Issuer}, " "),
+			diffOptions(change.Old), diffOptions(change.New))
+	}
+	return b.String()
+}
+
+// diffRow returns row as it is written in the policy file, without its comment
+func diffRow(row User) string {
+	return strings.Join(append([]string{row.Principals[0], row.IdentityAttribute, row.Issuer}, row.options()...), " ")
+}
+
+// diffOptions returns the options of row, or (none) if it has none
+func diffOptions(row User) string {
+	if options := row.options(); len(options) > 0 {
+		return strings.Join(options, " ")
+	}
+	return "(none)"
+}
@@ -0,0 +1,96 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	oldTable := `# Admins
+root alice@example.com https://accounts.google.com # JIRA-1
+root bob@example.com https://accounts.google.com
+dev bob@example.com https://accounts.google.com
+dev oidc:groups:ssh-users https://accounts.google.com
+backup carol@example.com https://accounts.google.com command=/usr/bin/backup
+`
+
+	tests := []struct {
+		name     string
+		newTable string
+		added    []string
+		removed  []string
+		changed  []string
+	}{
+		{
+			name: "Reordered with new comments and whitespace",
+			newTable: `backup  carol@example.com  https://accounts.google.com  command=/usr/bin/backup
+dev oidc:groups:ssh-users https://accounts.google.com
+# Developers
+dev bob@example.com https://accounts.google.com # JIRA-2
+root bob@example.com https://accounts.google.com
+root alice@example.com https://accounts.google.com
+root alice@example.com https://accounts.google.com
+`,
+		},
+		{
+			name: "Added, removed and changed",
+			newTable: `root alice@example.com https://accounts.google.com deny
+root bob@example.com https://accounts.google.com
+dev oidc:groups:ssh-users https://accounts.google.com
+backup carol@example.com https://accounts.google.com command=/usr/bin/backup hours=mon-fri,09:00-17:00
+ops dave@example.com https://accounts.google.com
+`,
+			added:   []string{"ops dave@example.com https://accounts.google.com"},
+			removed: []string{"dev bob@example.com https://accounts.google.com"},
+			changed: []string{
+				"backup carol@example.com https://accounts.google.com: command=/usr/bin/backup -> command=/usr/bin/backup hours=mon-fri,09:00-17:00",
+				"root alice@example.com https://accounts.google.com: (none) -> deny",
+			},
+		},
+		{
+			name: "Deny rule added next to an allow rule",
+			newTable: oldTable + `dev bob@example.com https://accounts.google.com deny
+`,
+			added: []string{"dev bob@example.com https://accounts.google.com deny"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := Diff(FromTable([]byte(oldTable), "old"), FromTable([]byte(tt.newTable), "new"))
+
+			added := []string{}
+			for _, row := range diff.Added {
+				added = append(added, diffRow(row))
+			}
+			removed := []string{}
+			for _, row := range diff.Removed {
+				removed = append(removed, diffRow(row))
+			}
+			changed := []string{}
+			for _, change := range diff.Changed {
+				changed = append(changed, change.Old.Principals[0]+" "+change.Old.IdentityAttribute+" "+change.Old.Issuer+": "+diffOptions(change.Old)+" -> "+diffOptions(change.New))
+			}
+			require.ElementsMatch(t, tt.added, added)
+			require.ElementsMatch(t, tt.removed, removed)
+			require.ElementsMatch(t, tt.changed, changed)
+			require.Equal(t, len(tt.added)+len(tt.removed)+len(tt.changed) == 0, diff.Empty())
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ValidateDiscoveryURL checks that discoveryURL is an https URL that the
+// discovery document of an issuer can be fetched from
+func ValidateDiscoveryURL(discoveryURL string) error {
+	u, err := url.Parse(discoveryURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid discovery_url (%s)", discoveryURL)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("invalid discovery_url (%s), expected it to start with https://", discoveryURL)
+	}
+	return nil
+}
+
+// discoveryTransport fetches the discovery document of issuer from
+// discoveryURL rather than from the conventional location relative to the
+// issuer. The JWKS and other endpoints are then taken from that document as
+// usual. The document must still name issuer as its issuer.
+type discoveryTransport struct {
+	base         http.RoundTripper
+	issuer       string
+	discoveryURL *url.URL
+}
+
+func (t *discoveryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.URL.String() != discoveryURL(t.issuer) {
+		return t.base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request it is given
+	req = req.Clone(req.Context())
+	req.URL = t.discoveryURL
+	req.Host = t.discoveryURL.Host
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var discovery discoveryDocument
+	if err := json.Unmarshal(body, &discovery); err != nil {
+		return nil, fmt.Errorf("failed to parse discovery document at %s: %w", t.discoveryURL, err)
+	}
+	if discovery.Issuer != t.issuer {
+		return nil, fmt.Errorf("discovery document at %s is for issuer (%s), expected (%s)", t.discoveryURL, discovery.Issuer, t.issuer)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+// WithDiscoveryURL returns an http.Client, based on httpClient if it is not
+// nil, that fetches the discovery document of issuer from discoveryURL, see
+// discoveryTransport
+func WithDiscoveryURL(httpClient *http.Client, issuer string, discoveryURL string) (*http.Client, error) {
+	if err := ValidateDiscoveryURL(discoveryURL); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient := &http.Client{}
+	if httpClient != nil {
+		*discoveryClient = *httpClient
+	}
+	base := discoveryClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	discoveryClient.Transport = &discoveryTransport{base: base, issuer: issuer, discoveryURL: u}
+	return discoveryClient, nil
+}
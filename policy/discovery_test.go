@@ -0,0 +1,113 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/verifier"
+	"github.com/stretchr/testify/require"
+)
+
+// customDiscoveryIssuer serves the discovery document and JWKS of a mock OP
+// over TLS, with the discovery document at /custom/discovery rather than
+// under .well-known, and returns a PK Token issued by it. A discovery
+// document naming another issuer is served at /custom/wrong-issuer.
+func customDiscoveryIssuer(t *testing.T) (*httptest.Server, *pktoken.PKToken) {
+	var jwks []byte
+	mux := http.NewServeMux()
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/custom/discovery", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   srv.URL,
+			"jwks_uri": srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/custom/wrong-issuer", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   "https://evil.example.com",
+			"jwks_uri": srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(jwks)
+	})
+
+	opts := providers.DefaultMockProviderOpts()
+	opts.Issuer = srv.URL
+	op, backend, idtTemplate, err := providers.NewMockProvider(opts)
+	require.NoError(t, err)
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+	jwks, err = backend.GetPublicKeyFinder().JwksFunc(context.Background(), srv.URL)
+	require.NoError(t, err)
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	return srv, pkt
+}
+
+func TestProviderPolicyDiscoveryURLs(t *testing.T) {
+	srv, pkt := customDiscoveryIssuer(t)
+	providersFile := srv.URL + " test_client_id 24h\n"
+
+	tests := []struct {
+		name          string
+		discoveryURLs map[string]string
+		errorString   string
+	}{
+		{name: "Custom discovery URL", discoveryURLs: map[string]string{srv.URL: srv.URL + "/custom/discovery"}},
+		{name: "No discovery URL", errorString: "failed to call OIDC discovery endpoint"},
+		{name: "Discovery URL of another issuer", discoveryURLs: map[string]string{"https://other.example.com": srv.URL + "/custom/discovery"}, errorString: "failed to call OIDC discovery endpoint"},
+		{name: "Discovery document for another issuer", discoveryURLs: map[string]string{srv.URL: srv.URL + "/custom/wrong-issuer"}, errorString: "is for issuer (https://evil.example.com)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := (&ProvidersFileLoader{}).FromTable([]byte(providersFile), "providers")
+			require.NoError(t, policy.SetDiscoveryURLs(tt.discoveryURLs))
+			ver, err := policy.createVerifier(func(issuer string, clientID string) verifier.ProviderVerifier {
+				// Trust the test server's TLS certificate
+				return newProviderVerifier(issuer, clientID, policy.httpClientFor(issuer, srv.Client()))
+			})
+			require.NoError(t, err)
+
+			err = ver.VerifyPKToken(context.Background(), pkt)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSetDiscoveryURLsInvalid(t *testing.T) {
+	policy := &ProviderPolicy{}
+	err := policy.SetDiscoveryURLs(map[string]string{"https://accounts.example.com": "http://accounts.example.com/discovery"})
+	require.ErrorContains(t, err, "expected it to start with https://")
+	err = policy.SetDiscoveryURLs(map[string]string{"https://accounts.example.com": "not a url"})
+	require.ErrorContains(t, err, "invalid discovery_url")
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/opkssh/policy/plugins"
@@ -31,27 +32,174 @@ import (
 // permitted
 type Enforcer struct {
 	PolicyLoader Loader
+	// ProviderPolicy, if set, lets a policy entry for one issuer of a
+	// provider match ID Tokens from any of the provider's fallback issuers
+	ProviderPolicy *ProviderPolicy
+	// IdentityClaim, if set, is the claim matched against email entries in
+	// the policy instead of the email claim, for OPs that put an email-like
+	// value in a claim such as preferred_username. Email entries still only
+	// grant access if email_verified is true, as nothing in the ID Token says
+	// whether the OP verified the other claim.
+	IdentityClaim string
+	// CaseSensitiveEmailLocalPart makes the part of an email before the @
+	// case-sensitive when matching email entries. The domain is always
+	// case-insensitive.
+	CaseSensitiveEmailLocalPart bool
+	// AllowMissingEmailVerified lets email entries in the policy match ID
+	// Tokens without an email_verified claim, for OPs that don't send it. ID
+	// Tokens with email_verified set to false never match email entries.
+	AllowMissingEmailVerified bool
+	// Now returns the current time, used to check the hours of policy
+	// entries. Defaults to time.Now.
+	Now func() time.Time
+	// PolicyPlugins, if set, runs the policy plugins in PolicyPluginDir.
+	// Defaults to plugins.NewPolicyPluginEnforcer().
+	PolicyPlugins *plugins.PolicyPluginEnforcer
 }
 
+// PolicyPluginDir is the directory the policy plugin configs are read from
+const PolicyPluginDir = "/etc/opk/policy.d"
+
 // type for Identity Token checkedClaims
 type checkedClaims struct {
 	Email  string   `json:"email"`
 	Sub    string   `json:"sub"`
 	Groups []string `json:"groups"`
+	// EmailVerified is the email_verified claim. Some OPs send it as a string.
+	EmailVerified any `json:"email_verified"`
+	// All claims in the ID Token, used to match nested claims
+	raw map[string]any
+	// caseSensitiveLocalPart is set from Enforcer.CaseSensitiveEmailLocalPart
+	caseSensitiveLocalPart bool
+	// emailUnverified is set when the email can't be used to grant access
+	// because the OP has not verified it
+	emailUnverified bool
+	// identityClaim is Enforcer.IdentityClaim, the claim used as the email
+	identityClaim string
+}
+
+// isEmailClaim returns true if the top level claim name holds the email, either
+// the email claim or the claim configured to be used in its place
+func (c *checkedClaims) isEmailClaim(name string) bool {
+	return name == "email" || (c.identityClaim != "" && name == c.identityClaim)
 }
 
+// oidcClaimPrefix is the prefix of an identity attribute that matches on a
+// claim in the ID Token, e.g. `oidc:groups:ssh-users` or
+// `oidc:realm_access.roles:admin`
+const oidcClaimPrefix = "oidc:"
+
 // Validates that the server defined identity attribute matches the
-// respective claim from the identity token
-func validateClaim(claims *checkedClaims, user *User) bool {
+// respective claim from the identity token. If grantingAccess is true, email
+// entries do not match an email the OP has not verified, as anyone could have
+// put it in their account. Deny rules match unverified emails too.
+func validateClaim(claims *checkedClaims, user *User, grantingAccess bool) bool {
 	if strings.HasPrefix(user.IdentityAttribute, "oidc:groups") {
 		oidcGroupSections := strings.Split(user.IdentityAttribute, ":")
 
 		return slices.Contains(claims.Groups, oidcGroupSections[len(oidcGroupSections)-1])
 	}
 
-	// email should be a case-insensitive check
+	// oidc:<claim path>:<value> matches any other claim, where the claim path
+	// is a dot separated list of keys such as realm_access.roles
+	if strings.HasPrefix(user.IdentityAttribute, oidcClaimPrefix) {
+		sections := strings.SplitN(strings.TrimPrefix(user.IdentityAttribute, oidcClaimPrefix), ":", 2)
+		if len(sections) == 2 && sections[0] != "" {
+			// oidc:email:<address> is an email entry by another name
+			if grantingAccess && claims.emailUnverified && claims.isEmailClaim(sections[0]) {
+				return false
+			}
+			return slices.Contains(lookupClaim(claims.raw, strings.Split(sections[0], ".")), sections[1])
+		}
+	}
+
+	// *@domain matches any email at that domain. This is a case-insensitive check
+	if strings.HasPrefix(user.IdentityAttribute, "*@") {
+		if grantingAccess && claims.emailUnverified {
+			return false
+		}
+		return claims.Email != "" && strings.HasSuffix(strings.ToLower(claims.Email), strings.ToLower(user.IdentityAttribute[1:]))
+	}
+
+	// email should be a case-insensitive check, unless the local part is
+	// configured to be case-sensitive
 	// sub should be a case-sensitive check
-	return strings.EqualFold(claims.Email, user.IdentityAttribute) || string(claims.Sub) == user.IdentityAttribute
+	if string(claims.Sub) == user.IdentityAttribute {
+		return true
+	}
+	if grantingAccess && claims.emailUnverified {
+		return false
+	}
+	return emailsEqual(claims.Email, user.IdentityAttribute, claims.caseSensitiveLocalPart)
+}
+
+// isEmailVerified returns true if the email_verified claim is true. A missing
+// claim counts as verified only if allowMissing is true.
+func (c *checkedClaims) isEmailVerified(allowMissing bool) bool {
+	switch v := c.EmailVerified.(type) {
+	case nil:
+		return allowMissing
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	default:
+		return false
+	}
+}
+
+// emailsEqual compares two email addresses. The domain is compared
+// case-insensitively, and so is the local part unless caseSensitiveLocalPart
+// is true. Values without an @ are compared case-insensitively.
+func emailsEqual(a string, b string, caseSensitiveLocalPart bool) bool {
+	if !caseSensitiveLocalPart {
+		return strings.EqualFold(a, b)
+	}
+	aAt := strings.LastIndex(a, "@")
+	bAt := strings.LastIndex(b, "@")
+	if aAt < 0 || bAt < 0 {
+		return strings.EqualFold(a, b)
+	}
+	return a[:aAt] == b[:bAt] && strings.EqualFold(a[aAt+1:], b[bAt+1:])
+}
+
+// identityClaimValue returns the string value of the top level claim, or an
+// empty string, which matches no email entries, if it is missing or not a
+// string
+func identityClaimValue(claims map[string]any, claim string) string {
+	value, _ := claims[claim].(string)
+	return value
+}
+
+// lookupClaim follows path through the nested claims and returns the values
+// found at the end of it. Arrays along the path are traversed element by
+// element, so a path can reach into a list of objects. Only string, number
+// and boolean values are returned, formatted as strings.
+func lookupClaim(claim any, path []string) []string {
+	switch v := claim.(type) {
+	case []any:
+		values := []string{}
+		for _, elem := range v {
+			values = append(values, lookupClaim(elem, path)...)
+		}
+		return values
+	case map[string]any:
+		if len(path) == 0 {
+			return nil
+		}
+		next, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookupClaim(next, path[1:])
+	case string, float64, bool:
+		if len(path) != 0 {
+			return nil
+		}
+		return []string{fmt.Sprint(v)}
+	default:
+		return nil
+	}
 }
 
 // CheckPolicy loads opkssh policy and checks to see if there is a policy
@@ -63,9 +211,90 @@ func validateClaim(claims *checkedClaims, user *User) bool {
 // This is because if this function is called first, a timing channel exists which
 // allows an attacker check what identities and principals are allowed by the policy.F
 func (p *Enforcer) CheckPolicy(principalDesired string, pkt *pktoken.PKToken, sshCert string, keyType string) error {
-	pluginPolicy := plugins.NewPolicyPluginEnforcer()
+	_, err := p.CheckPolicyCommand(principalDesired, pkt, sshCert, keyType)
+	return err
+}
+
+// CheckPolicyCommand is CheckPolicy but also returns the command that the
+// policy restricts principalDesired to, or an empty string if it is not
+// restricted. If several entries allow access the principal is only
+// restricted if all of them restrict it, in which case the command of the
+// first entry is used. Access granted by a policy plugin is never restricted.
+func (p *Enforcer) CheckPolicyCommand(principalDesired string, pkt *pktoken.PKToken, sshCert string, keyType string) (string, error) {
+	match, err := p.CheckPolicyMatch(principalDesired, pkt, sshCert, keyType)
+	if err != nil {
+		return "", err
+	}
+	return match.Command, nil
+}
+
+// Match describes what in the policy allowed an identity to assume a
+// principal
+type Match struct {
+	// Entry is the policy entry that allowed access, nil if access was
+	// granted by a policy plugin
+	Entry *User
+	// Source is where the policy containing Entry was read from
+	Source string
+	// Plugin is the path of the policy plugin that allowed access, if any
+	Plugin string
+	// Command is the command the principal is restricted to, empty if it is
+	// not restricted
+	Command string
+}
 
-	results, err := pluginPolicy.CheckPolicies("/etc/opk/policy.d", pkt, principalDesired, sshCert, keyType)
+// CheckPolicyMatch is CheckPolicyCommand but returns what in the policy
+// allowed access. If an unrestricted entry allows access it is the matched
+// entry, otherwise it is the first restricted entry.
+func (p *Enforcer) CheckPolicyMatch(principalDesired string, pkt *pktoken.PKToken, sshCert string, keyType string) (*Match, error) {
+	var claims checkedClaims
+
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return nil, fmt.Errorf("error unmarshalling pk token payload: %w", err)
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims.raw); err != nil {
+		return nil, fmt.Errorf("error unmarshalling pk token payload: %w", err)
+	}
+	if p.IdentityClaim != "" {
+		claims.Email = identityClaimValue(claims.raw, p.IdentityClaim)
+	}
+	claims.identityClaim = p.IdentityClaim
+	claims.caseSensitiveLocalPart = p.CaseSensitiveEmailLocalPart
+	claims.emailUnverified = !claims.isEmailVerified(p.AllowMissingEmailVerified)
+	issuer, err := pkt.Issuer()
+	if err != nil {
+		return nil, fmt.Errorf("error getting issuer from pk token: %w", err)
+	}
+
+	issuers := []string{issuer}
+	if p.ProviderPolicy != nil {
+		issuers = p.ProviderPolicy.IssuersFor(issuer)
+	}
+
+	now := time.Now
+	if p.Now != nil {
+		now = p.Now
+	}
+	extensions := certExtensions(sshCert, keyType)
+
+	// Deny rules are checked before anything else, including policy plugins,
+	// so that only an explicit allow rule can override a wildcard deny rule
+	policy, source, loadErr := p.PolicyLoader.Load()
+	if loadErr == nil {
+		if decision := checkDenyRules(policy, &claims, issuers, principalDesired, now(), extensions); decision != nil {
+			if !decision.Allowed {
+				return nil, decision.denyErr(claims.Email, issuer, principalDesired)
+			}
+			log.Printf("Access %s\n", decision.Reason)
+			return &Match{Entry: decision.Rule, Source: source.Source(), Command: decision.Rule.Command}, nil
+		}
+	}
+
+	pluginPolicy := p.PolicyPlugins
+	if pluginPolicy == nil {
+		pluginPolicy = plugins.NewPolicyPluginEnforcer()
+	}
+	results, err := pluginPolicy.CheckPolicies(PolicyPluginDir, pkt, principalDesired, sshCert, keyType)
 	if err != nil {
 		log.Printf("Error checking policy plugins: %v \n", err)
 		// Despite the error, we don't fail here because we still want to check
@@ -78,13 +307,19 @@ func (p *Enforcer) CheckPolicy(principalDesired string, pkt *pktoken.PKToken, ss
 		}
 		if results.Allowed() {
 			log.Printf("Access granted by policy plugin\n")
-			return nil
+			match := &Match{}
+			for _, result := range results {
+				if result.Allowed {
+					match.Plugin = result.Path
+					break
+				}
+			}
+			return match, nil
 		}
 	}
 
-	policy, source, err := p.PolicyLoader.Load()
-	if err != nil {
-		return fmt.Errorf("error loading policy: %w", err)
+	if loadErr != nil {
+		return nil, fmt.Errorf("error loading policy: %w", loadErr)
 	}
 
 	sourceStr := source.Source()
@@ -92,28 +327,230 @@ func (p *Enforcer) CheckPolicy(principalDesired string, pkt *pktoken.PKToken, ss
 		sourceStr = "<policy source unknown>"
 	}
 
-	var claims checkedClaims
+	if entry := checkAllowRules(policy, &claims, issuers, principalDesired, now(), extensions); entry != nil {
+		// access granted
+		return &Match{Entry: entry, Source: sourceStr, Command: entry.Command}, nil
+	}
 
-	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
-		return fmt.Errorf("error unmarshalling pk token payload: %w", err)
+	if claims.emailUnverified {
+		return nil, fmt.Errorf("no policy to allow %s with (issuer=%s) to assume %s, email entries were not checked as email_verified is not true in the ID Token, check policy config at %s", claims.Email, issuer, principalDesired, sourceStr)
 	}
-	issuer, err := pkt.Issuer()
-	if err != nil {
-		return fmt.Errorf("error getting issuer from pk token: %w", err)
+	if missing := missingClaims(policy, &claims, issuers, principalDesired); len(missing) > 0 {
+		return nil, fmt.Errorf("no policy to allow %s with (issuer=%s) to assume %s, the ID Token has no %s claim for the policy to match, some OPs only return it from the UserInfo endpoint and must be configured to put it in the ID Token, check policy config at %s", claims.Email, issuer, principalDesired, strings.Join(missing, ", "), sourceStr)
 	}
+	return nil, fmt.Errorf("no policy to allow %s with (issuer=%s) to assume %s, check policy config at %s", claims.Email, issuer, principalDesired, sourceStr)
+}
+
+// missingClaims returns the claims that allow rules for principalDesired
+// match on with oidc: but that are not in the ID Token. opkssh only trusts
+// claims signed by the OP in the ID Token, so it can't fall back to the
+// UserInfo endpoint for them.
+func missingClaims(policy *Policy, claims *checkedClaims, issuers []string, principalDesired string) []string {
+	missing := []string{}
 	for _, user := range policy.Users {
+		if user.Deny || !strings.HasPrefix(user.IdentityAttribute, oidcClaimPrefix) || !slices.Contains(issuers, user.Issuer) {
+			continue
+		}
+		if !slices.Contains(user.Principals, principalDesired) && !user.hasPrincipalTemplate() {
+			continue
+		}
+		claimPath, _, _ := strings.Cut(strings.TrimPrefix(user.IdentityAttribute, oidcClaimPrefix), ":")
+		if claimPath != "" && !hasClaim(claims.raw, strings.Split(claimPath, ".")) && !slices.Contains(missing, claimPath) {
+			missing = append(missing, claimPath)
+		}
+	}
+	return missing
+}
+
+// hasClaim returns true if the nested claims contain a claim at path. As in
+// lookupClaim, each element of an array along the path is checked.
+func hasClaim(claim any, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	switch v := claim.(type) {
+	case map[string]any:
+		nested, ok := v[path[0]]
+		return ok && hasClaim(nested, path[1:])
+	case []any:
+		return slices.ContainsFunc(v, func(element any) bool { return hasClaim(element, path) })
+	default:
+		return false
+	}
+}
+
+// Decision is the outcome of evaluating the policy for an identity and a
+// principal
+type Decision struct {
+	Allowed bool
+	// Rule is the policy entry that decided, nil if no entry matched
+	Rule *User
+	// Reason says which rule decided and why it took precedence
+	Reason string
+
+	err error
+}
+
+// denyErr returns the error CheckPolicy returns for a decision that denies
+// access
+func (d *Decision) denyErr(identity string, issuer string, principalDesired string) error {
+	if d.Rule == nil {
+		return fmt.Errorf("no policy to allow %s with (issuer=%s) to assume %s", identity, issuer, principalDesired)
+	}
+	return fmt.Errorf("policy denies %s with (issuer=%s) from assuming %s, matched deny rule for %s", identity, issuer, principalDesired, d.Rule.IdentityAttribute)
+}
+
+// checkDenyRules applies the deny rules in the policy and returns the
+// decision, or nil if no deny rule matches and the allow rules decide. issuers
+// are the issuers treated as the issuer of the ID Token, the first being the
+// ID Token's iss claim.
+//
+// Rules take precedence in the order explicit deny, explicit allow, wildcard
+// deny, wildcard allow, regardless of their order in the policy. A wildcard
+// rule matches on a pattern, *@domain or an oidc: claim, while an explicit
+// rule names a single email or sub. So a wildcard deny rule denies access
+// unless an explicit allow rule allows it.
+func checkDenyRules(policy *Policy, claims *checkedClaims, issuers []string, principalDesired string, now time.Time, extensions map[string]string) *Decision {
+	var wildcardDeny *User
+	for i := range policy.Users {
+		user := &policy.Users[i]
+		if !user.Deny || !slices.Contains(issuers, user.Issuer) || !validateClaim(claims, user, false) ||
+			!(slices.Contains(user.Principals, principalDesired) || slices.Contains(user.Principals, AnyPrincipal)) {
+			continue
+		}
+		if !user.isWildcard() {
+			return &Decision{Rule: user, Reason: fmt.Sprintf("denied by the explicit deny rule %q", user.describe())}
+		}
+		if wildcardDeny == nil {
+			wildcardDeny = user
+		}
+	}
+	if wildcardDeny == nil {
+		return nil
+	}
+
+	explicit := &Policy{}
+	for _, user := range policy.Users {
+		if !user.Deny && !user.isWildcard() {
+			explicit.Users = append(explicit.Users, user)
+		}
+	}
+	if entry := checkAllowRules(explicit, claims, issuers, principalDesired, now, extensions); entry != nil {
+		return &Decision{Allowed: true, Rule: entry, Reason: fmt.Sprintf("allowed by the explicit allow rule %q which takes precedence over the wildcard deny rule %q", entry.describe(), wildcardDeny.describe())}
+	}
+	return &Decision{Rule: wildcardDeny, Reason: fmt.Sprintf("denied by the wildcard deny rule %q, no explicit allow rule matched", wildcardDeny.describe())}
+}
+
+// checkAllowRules returns the allow rule in the policy that permits the
+// identity to assume principalDesired at the time now with an SSH cert that
+// has extensions, or nil if none do. An entry that does not restrict the
+// principal to a command is preferred over one that does, as it lifts the
+// restriction.
+func checkAllowRules(policy *Policy, claims *checkedClaims, issuers []string, principalDesired string, now time.Time, extensions map[string]string) *User {
+	var matched *User
+	for i := range policy.Users {
+		user := &policy.Users[i]
+		if user.Deny {
+			continue
+		}
 		// check each entry to see if the user in the checkedClaims is included
-		if validateClaim(&claims, &user) {
-			if issuer != user.Issuer {
+		if !validateClaim(claims, user, true) || !slices.Contains(issuers, user.Issuer) {
+			continue
+		}
+		// if they are, then check if the desired principal is allowed, either
+		// listed or derived from the claims by a templated principal
+		derived := false
+		if IsPrincipalTemplate(principalDesired) || !slices.Contains(user.Principals, principalDesired) {
+			if !user.derivesPrincipal(claims.templateClaims(), principalDesired) {
 				continue
 			}
-			// if they are, then check if the desired principal is allowed
-			if slices.Contains(user.Principals, principalDesired) {
-				// access granted
-				return nil
+			derived = true
+		}
+		if user.Hours != nil && !user.Hours.Contains(now) {
+			log.Printf("Policy entry for %s only allows %s during %s, skipping outside those hours\n", user.IdentityAttribute, principalDesired, user.Hours)
+			continue
+		}
+		if missing := user.missingExtension(extensions); missing != nil {
+			log.Printf("Policy entry for %s requires the SSH cert extension %s to allow %s, skipping\n", user.IdentityAttribute, missing, principalDesired)
+			continue
+		}
+		if derived && user.UniquePrincipal {
+			if err := checkPrincipalCollision(policy, claims, issuers, user, principalDesired); err != nil {
+				log.Printf("Policy entry for %s derives %s but requires it to be unique and %v, skipping\n", user.IdentityAttribute, principalDesired, err)
+				continue
 			}
 		}
+		// An unrestricted entry lifts any command restriction
+		if user.Command == "" {
+			return user
+		}
+		if matched == nil {
+			matched = user
+		}
+	}
+	return matched
+}
+
+// EvaluateFromBytes evaluates the policy in policyBytes, using the same
+// format as the auth_id files, against the claims of an ID Token and returns
+// nil if the identity is allowed to assume principal. identity is the JSON
+// encoded payload of an ID Token. Unlike CheckPolicy, the policy is never read
+// from disk and policy plugins are not run, which makes it suitable for
+// testing candidate policies. As with CheckPolicy, email entries only match
+// if the email_verified claim is true. There is no SSH cert, so entries that
+// require a cert extension never match.
+//
+// The identity is not verified, this function must not be used to make
+// access decisions.
+func EvaluateFromBytes(policyBytes []byte, identity []byte, principal string) error {
+	decision, err := ExplainFromBytes(policyBytes, identity, principal)
+	if err != nil {
+		return err
 	}
+	if !decision.Allowed {
+		return decision.err
+	}
+	return nil
+}
 
-	return fmt.Errorf("no policy to allow %s with (issuer=%s) to assume %s, check policy config at %s", claims.Email, issuer, principalDesired, sourceStr)
+// ExplainFromBytes is EvaluateFromBytes but returns the decision, including
+// the rule that decided and why it took precedence. An error is only returned
+// if the identity can't be parsed.
+func ExplainFromBytes(policyBytes []byte, identity []byte, principal string) (*Decision, error) {
+	var claims checkedClaims
+	if err := json.Unmarshal(identity, &claims); err != nil {
+		return nil, fmt.Errorf("error unmarshalling identity claims: %w", err)
+	}
+	if err := json.Unmarshal(identity, &claims.raw); err != nil {
+		return nil, fmt.Errorf("error unmarshalling identity claims: %w", err)
+	}
+	claims.emailUnverified = !claims.isEmailVerified(false)
+	var issuerClaim struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(identity, &issuerClaim); err != nil {
+		return nil, fmt.Errorf("error unmarshalling identity claims: %w", err)
+	}
+	if issuerClaim.Issuer == "" {
+		return nil, fmt.Errorf("identity claims are missing the iss claim")
+	}
+
+	policy := FromTable(policyBytes, "<policy bytes>")
+	issuers := []string{issuerClaim.Issuer}
+	decision := checkDenyRules(policy, &claims, issuers, principal, time.Now(), nil)
+	if decision == nil {
+		if entry := checkAllowRules(policy, &claims, issuers, principal, time.Now(), nil); entry != nil {
+			kind := "explicit"
+			if entry.isWildcard() {
+				kind = "wildcard"
+			}
+			decision = &Decision{Allowed: true, Rule: entry, Reason: fmt.Sprintf("allowed by the %s allow rule %q", kind, entry.describe())}
+		} else {
+			decision = &Decision{Reason: fmt.Sprintf("no rule allows %s with (issuer=%s) to assume %s", claims.Email, issuerClaim.Issuer, principal)}
+		}
+	}
+	if !decision.Allowed {
+		decision.err = decision.denyErr(claims.Email, issuerClaim.Issuer, principal)
+	}
+	return decision, nil
 }
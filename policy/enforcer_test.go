@@ -18,19 +18,26 @@ package policy_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
 	"testing"
+	"time"
 
 	"github.com/openpubkey/openpubkey/client"
 	"github.com/openpubkey/openpubkey/providers"
 	"github.com/openpubkey/openpubkey/providers/mocks"
 	"github.com/openpubkey/opkssh/policy"
+	"github.com/openpubkey/opkssh/policy/files"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func NewMockOpenIdProvider() (providers.OpenIdProvider, error) {
 	providerOpts := providers.DefaultMockProviderOpts()
 	op, _, idTokenTemplate, err := providers.NewMockProvider(providerOpts)
-	idTokenTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com"}
+	idTokenTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
 
 	return op, err
 }
@@ -38,7 +45,7 @@ func NewMockOpenIdProvider() (providers.OpenIdProvider, error) {
 func NewMockOpenIdProviderGroups(groups []string) (providers.OpenIdProvider, error) {
 	providerOpts := providers.DefaultMockProviderOpts()
 	op, _, idTokenTemplate, err := providers.NewMockProvider(providerOpts)
-	idTokenTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "groups": groups}
+	idTokenTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true, "groups": groups}
 
 	return op, err
 }
@@ -189,6 +196,436 @@ func TestPolicyEmailDifferentCase(t *testing.T) {
 	require.NoError(t, err, "user should have access despite email capitalization differences")
 }
 
+func TestPolicyEmailCaseSensitiveLocalPart(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		identityAttribute string
+		caseSensitive     bool
+		allowed           bool
+	}{
+		{name: "Default ignores case of local part", identityAttribute: "ArThuR.AArdVARK@example.com", caseSensitive: false, allowed: true},
+		{name: "Default ignores case of domain", identityAttribute: "arthur.aardvark@Example.COM", caseSensitive: false, allowed: true},
+		{name: "Case-sensitive local part matches exactly", identityAttribute: "arthur.aardvark@example.com", caseSensitive: true, allowed: true},
+		{name: "Case-sensitive local part ignores case of domain", identityAttribute: "arthur.aardvark@Example.COM", caseSensitive: true, allowed: true},
+		{name: "Case-sensitive local part rejects different case", identityAttribute: "ArThuR.AArdVARK@example.com", caseSensitive: true, allowed: false},
+		{name: "Case-sensitive local part still matches domain wildcard", identityAttribute: "*@EXAMPLE.com", caseSensitive: true, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{
+					Users: []policy.User{
+						{
+							IdentityAttribute: tt.identityAttribute,
+							Principals:        []string{"test"},
+							Issuer:            "https://accounts.example.com",
+						},
+					},
+				}},
+				CaseSensitiveEmailLocalPart: tt.caseSensitive,
+			}
+
+			err := policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicyEmailVerified(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name              string
+		emailVerified     any // nil leaves the claim out of the ID Token
+		allowMissing      bool
+		identityClaim     string
+		identityAttribute string
+		deny              bool
+		allowed           bool
+	}{
+		{name: "Verified email allowed", emailVerified: true, identityAttribute: "arthur.aardvark@example.com", allowed: true},
+		{name: "Verified email as string allowed", emailVerified: "true", identityAttribute: "arthur.aardvark@example.com", allowed: true},
+		{name: "Unverified email denied", emailVerified: false, identityAttribute: "arthur.aardvark@example.com", allowed: false},
+		{name: "Unverified email as string denied", emailVerified: "false", identityAttribute: "arthur.aardvark@example.com", allowed: false},
+		{name: "Unverified email denied for domain", emailVerified: false, identityAttribute: "*@example.com", allowed: false},
+		{name: "Unverified email denied when missing allowed", emailVerified: false, allowMissing: true, identityAttribute: "arthur.aardvark@example.com", allowed: false},
+		{name: "Missing email_verified denied by default", identityAttribute: "arthur.aardvark@example.com", allowed: false},
+		{name: "Missing email_verified denied by default for domain", identityAttribute: "*@example.com", allowed: false},
+		{name: "Missing email_verified allowed when configured", allowMissing: true, identityAttribute: "arthur.aardvark@example.com", allowed: true},
+		{name: "Missing email_verified allowed when configured for domain", allowMissing: true, identityAttribute: "*@example.com", allowed: true},
+		{name: "Wrong type for email_verified denied", emailVerified: 1, allowMissing: true, identityAttribute: "arthur.aardvark@example.com", allowed: false},
+		{name: "Sub matches unverified email", emailVerified: false, identityAttribute: "me", allowed: true},
+		{name: "Verified email allowed for oidc:email", emailVerified: true, identityAttribute: "oidc:email:arthur.aardvark@example.com", allowed: true},
+		{name: "Unverified email denied for oidc:email", emailVerified: false, identityAttribute: "oidc:email:arthur.aardvark@example.com", allowed: false},
+		{name: "Unverified email denied for oidc: on the identity claim", emailVerified: false, identityClaim: "preferred_username", identityAttribute: "oidc:preferred_username:arthur.aardvark@example.com", allowed: false},
+		{name: "Other claims match unverified email", emailVerified: false, identityAttribute: "oidc:preferred_username:arthur.aardvark@example.com", allowed: true},
+		{name: "Deny rule matches unverified email", emailVerified: false, identityAttribute: "arthur.aardvark@example.com", deny: true, allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extraClaims := map[string]any{"email": "arthur.aardvark@example.com", "preferred_username": "arthur.aardvark@example.com"}
+			if tt.emailVerified != nil {
+				extraClaims["email_verified"] = tt.emailVerified
+			}
+			op, _, err := NewMockOpenIdProvider2(false, "https://accounts.example.com", "test_client_id", extraClaims)
+			require.NoError(t, err)
+			opkClient, err := client.New(op)
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			require.NoError(t, err)
+
+			users := []policy.User{{
+				IdentityAttribute: tt.identityAttribute,
+				Principals:        []string{"test"},
+				Issuer:            "https://accounts.example.com",
+				Deny:              tt.deny,
+			}}
+			if tt.deny {
+				// Allowed by sub unless the deny rule matches
+				users = append(users, policy.User{IdentityAttribute: "me", Principals: []string{"test"}, Issuer: "https://accounts.example.com"})
+			}
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader:              &MockPolicyLoader{Policy: &policy.Policy{Users: users}},
+				AllowMissingEmailVerified: tt.allowMissing,
+				IdentityClaim:             tt.identityClaim,
+			}
+
+			err = policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
+			if tt.allowed {
+				require.NoError(t, err)
+			} else if tt.deny {
+				require.ErrorContains(t, err, "policy denies")
+			} else {
+				require.ErrorContains(t, err, "email_verified is not true")
+			}
+		})
+	}
+}
+
+func TestPolicyHours(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	businessHours, err := policy.ParseSchedule("Mon-Fri,09:00-17:00,TZ=America/New_York")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		unrestricted bool
+		allowed      bool
+	}{
+		// 2025-06-04 is a Wednesday, New York is on EDT (UTC-4)
+		{name: "In window allowed", now: time.Date(2025, 6, 4, 14, 0, 0, 0, time.UTC), allowed: true},
+		{name: "Out of window denied", now: time.Date(2025, 6, 4, 22, 0, 0, 0, time.UTC), allowed: false},
+		{name: "Weekend denied", now: time.Date(2025, 6, 7, 14, 0, 0, 0, time.UTC), allowed: false},
+		{name: "In window in EDT but not in EST", now: time.Date(2025, 6, 4, 13, 30, 0, 0, time.UTC), allowed: true},
+		{name: "In window in EST but not in EDT", now: time.Date(2025, 6, 4, 21, 30, 0, 0, time.UTC), allowed: false},
+		{name: "Unrestricted entry still allows", now: time.Date(2025, 6, 4, 22, 0, 0, 0, time.UTC), unrestricted: true, allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := []policy.User{{
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            "https://accounts.example.com",
+				Hours:             businessHours,
+			}}
+			if tt.unrestricted {
+				users = append(users, policy.User{
+					IdentityAttribute: "me",
+					Principals:        []string{"test"},
+					Issuer:            "https://accounts.example.com",
+				})
+			}
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{Users: users}},
+				Now:          func() time.Time { return tt.now },
+			}
+
+			err := policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "no policy to allow")
+			}
+		})
+	}
+}
+
+// newCertWithExtensions returns a base64 encoded SSH cert with extensions
+// and its type, as passed to the AuthorizedKeysCommand
+func newCertWithExtensions(t *testing.T, extensions map[string]string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions:     ssh.Permissions{Extensions: extensions},
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, signer))
+	return base64.StdEncoding.EncodeToString(cert.Marshal()), cert.Type()
+}
+
+func TestPolicyExtensions(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		required     []policy.RequiredExtension
+		extensions   map[string]string
+		unrestricted bool
+		allowed      bool
+	}{
+		{
+			name:       "Extension present",
+			required:   []policy.RequiredExtension{{Name: "mfa@opkssh"}},
+			extensions: map[string]string{"mfa@opkssh": "", "permit-pty": ""},
+			allowed:    true,
+		},
+		{
+			name:       "Extension absent",
+			required:   []policy.RequiredExtension{{Name: "mfa@opkssh"}},
+			extensions: map[string]string{"permit-pty": ""},
+			allowed:    false,
+		},
+		{
+			name:       "Extension value matches",
+			required:   []policy.RequiredExtension{{Name: "role@example.com", Value: "admin", MatchValue: true}},
+			extensions: map[string]string{"role@example.com": "admin"},
+			allowed:    true,
+		},
+		{
+			name:       "Extension value differs",
+			required:   []policy.RequiredExtension{{Name: "role@example.com", Value: "admin", MatchValue: true}},
+			extensions: map[string]string{"role@example.com": "dev"},
+			allowed:    false,
+		},
+		{
+			name:       "All extensions required",
+			required:   []policy.RequiredExtension{{Name: "mfa@opkssh"}, {Name: "role@example.com"}},
+			extensions: map[string]string{"mfa@opkssh": ""},
+			allowed:    false,
+		},
+		{
+			name:         "Unrestricted entry still allows",
+			required:     []policy.RequiredExtension{{Name: "mfa@opkssh"}},
+			extensions:   map[string]string{},
+			unrestricted: true,
+			allowed:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := []policy.User{{
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            "https://accounts.example.com",
+				Extensions:        tt.required,
+			}}
+			if tt.unrestricted {
+				users = append(users, policy.User{
+					IdentityAttribute: "me",
+					Principals:        []string{"test"},
+					Issuer:            "https://accounts.example.com",
+				})
+			}
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{Users: users}},
+			}
+
+			certB64, certType := newCertWithExtensions(t, tt.extensions)
+			err := policyEnforcer.CheckPolicy("test", pkt, certB64, certType)
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "no policy to allow")
+			}
+		})
+	}
+}
+
+func TestPolicyPrincipalTemplate(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProviderGroups([]string{"dev"})
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	issuer := "https://accounts.example.com"
+	unverifiedOp, _, err := NewMockOpenIdProvider2(false, issuer, "test_client_id", map[string]any{
+		"email": "root@attacker.example", "email_verified": false, "groups": []string{"dev"},
+	})
+	require.NoError(t, err)
+	opkClient, err = client.New(unverifiedOp)
+	require.NoError(t, err)
+	unverifiedPkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		policy      string
+		principal   string
+		unverified  bool
+		errorString string
+	}{
+		{
+			name:      "Derived principal",
+			policy:    "'{{localpart .email}}' *@example.com " + issuer,
+			principal: "arthur.aardvark",
+		},
+		{
+			name:        "Other principal",
+			policy:      "'{{localpart .email}}' *@example.com " + issuer,
+			principal:   "root",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Template is not a principal",
+			policy:      "'{{localpart .email}}' *@example.com " + issuer,
+			principal:   "{{localpart .email}}",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Missing claim",
+			policy:      "'{{.preferred_username}}' *@example.com " + issuer,
+			principal:   "",
+			errorString: "no policy to allow",
+		},
+		{
+			name:      "Collision allowed without unique",
+			policy:    "'{{localpart .email}}' *@example.com " + issuer + "\n'{{localpart .email}}' *@example.org " + issuer,
+			principal: "arthur.aardvark",
+		},
+		{
+			name:      "Unique derived principal",
+			policy:    "'{{lower (localpart .email)}}' *@example.com " + issuer + " unique",
+			principal: "arthur.aardvark",
+		},
+		{
+			// arthur.aardvark@example.org would also get arthur.aardvark
+			name:        "Unique collides with another domain",
+			policy:      "'{{localpart .email}}' *@example.com " + issuer + " unique\n'{{localpart .email}}' *@example.org " + issuer + " unique",
+			principal:   "arthur.aardvark",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Unique collides with an entry for someone else",
+			policy:      "'{{localpart .email}}' *@example.com " + issuer + " unique\narthur.aardvark bob@example.com " + issuer,
+			principal:   "arthur.aardvark",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Unique collides with an entry at another issuer",
+			policy:      "'{{localpart .email}}' *@example.com " + issuer + " unique\narthur.aardvark me https://other.example.com",
+			principal:   "arthur.aardvark",
+			errorString: "no policy to allow",
+		},
+		{
+			name:      "Unique with an entry for the same identity",
+			policy:    "'{{localpart .email}}' *@example.com " + issuer + " unique\narthur.aardvark me " + issuer + "\nroot bob@example.com " + issuer,
+			principal: "arthur.aardvark",
+		},
+		{
+			name:        "Unique with a group",
+			policy:      "'{{localpart .email}}' oidc:groups:dev " + issuer + " unique",
+			principal:   "arthur.aardvark",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Unique but not the local part",
+			policy:      "'{{slice (localpart .email) 0 6}}' *@example.com " + issuer + " unique",
+			principal:   "arthur",
+			errorString: "no policy to allow",
+		},
+		{
+			name:      "Unique for a single identity",
+			policy:    "'{{slice (localpart .email) 0 6}}' arthur.aardvark@example.com " + issuer + " unique",
+			principal: "arthur",
+		},
+		{
+			name:        "Unverified email with a group",
+			policy:      "'{{localpart .email}}' oidc:groups:dev " + issuer,
+			principal:   "root",
+			unverified:  true,
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Unverified email with a sub",
+			policy:      "'{{localpart .email}}' me " + issuer + " unique",
+			principal:   "root",
+			unverified:  true,
+			errorString: "no policy to allow",
+		},
+		{
+			name:       "Unverified email with a template not using it",
+			policy:     "'{{.sub}}' oidc:groups:dev " + issuer,
+			principal:  "me",
+			unverified: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := &files.ConfigLog{}
+			pol := policy.FromTableWithLog([]byte(tt.policy), "test", problems)
+			require.True(t, problems.NoProblems(), problems.GetProblems())
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: pol},
+			}
+
+			testPkt := pkt
+			if tt.unverified {
+				testPkt = unverifiedPkt
+			}
+			err := policyEnforcer.CheckPolicy(tt.principal, testPkt, "example-base64Cert", "ssh-rsa")
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestPolicyDeniedBadUser(t *testing.T) {
 	t.Parallel()
 
@@ -324,6 +761,7 @@ func TestPolicyDeniedOidcGroups(t *testing.T) {
 
 	err = policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
 	require.Error(t, err, "user should not as they don't have group 'c'")
+	require.NotContains(t, err.Error(), "the ID Token has no groups claim")
 }
 
 func TestPolicyDeniedMissingOidcGroupsClaim(t *testing.T) {
@@ -344,4 +782,695 @@ func TestPolicyDeniedMissingOidcGroupsClaim(t *testing.T) {
 
 	err = policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
 	require.Error(t, err, "user should not as the token is missing the groups claim")
+	require.ErrorContains(t, err, "the ID Token has no groups claim for the policy to match")
+}
+
+func TestPolicyDenyRules(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	issuer := "https://accounts.example.com"
+	domainAllow := policy.User{
+		IdentityAttribute: "*@example.com",
+		Principals:        []string{"test", "admin"},
+		Issuer:            issuer,
+	}
+
+	tests := []struct {
+		name        string
+		users       []policy.User
+		principal   string
+		errorString string
+	}{
+		{
+			name:      "Domain wildcard allow",
+			users:     []policy.User{domainAllow},
+			principal: "test",
+		},
+		{
+			name: "Domain wildcard is case-insensitive",
+			users: []policy.User{{
+				IdentityAttribute: "*@EXAMPLE.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+			}},
+			principal: "test",
+		},
+		{
+			name: "Domain wildcard does not match other domain",
+			users: []policy.User{{
+				IdentityAttribute: "*@ample.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+			}},
+			principal:   "test",
+			errorString: "no policy to allow",
+		},
+		{
+			name: "Deny wins over domain wildcard allow",
+			users: []policy.User{domainAllow, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+				Deny:              true,
+			}},
+			principal:   "test",
+			errorString: "policy denies arthur.aardvark@example.com",
+		},
+		{
+			name: "Deny wins regardless of order",
+			users: []policy.User{{
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{policy.AnyPrincipal},
+				Issuer:            issuer,
+				Deny:              true,
+			}, domainAllow, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"admin"},
+				Issuer:            issuer,
+			}},
+			principal:   "admin",
+			errorString: "policy denies arthur.aardvark@example.com",
+		},
+		{
+			name: "Deny for a different principal does not block",
+			users: []policy.User{domainAllow, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"admin"},
+				Issuer:            issuer,
+				Deny:              true,
+			}},
+			principal: "test",
+		},
+		{
+			name: "Deny for a different user does not block",
+			users: []policy.User{domainAllow, {
+				IdentityAttribute: "mallory@example.com",
+				Principals:        []string{policy.AnyPrincipal},
+				Issuer:            issuer,
+				Deny:              true,
+			}},
+			principal: "test",
+		},
+		{
+			name: "Deny for a different issuer does not block",
+			users: []policy.User{domainAllow, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{policy.AnyPrincipal},
+				Issuer:            "https://other.example.com",
+				Deny:              true,
+			}},
+			principal: "test",
+		},
+		{
+			name: "Deny rule never grants access",
+			users: []policy.User{{
+				IdentityAttribute: "mallory@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+				Deny:              true,
+			}},
+			principal:   "test",
+			errorString: "no policy to allow",
+		},
+		{
+			name: "Explicit allow wins over wildcard deny",
+			users: []policy.User{{
+				IdentityAttribute: "*@example.com",
+				Principals:        []string{policy.AnyPrincipal},
+				Issuer:            issuer,
+				Deny:              true,
+			}, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+			}},
+			principal: "test",
+		},
+		{
+			name: "Explicit deny wins over explicit allow",
+			users: []policy.User{{
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+			}, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+				Deny:              true,
+			}, {
+				IdentityAttribute: "*@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+				Deny:              true,
+			}},
+			principal:   "test",
+			errorString: "policy denies arthur.aardvark@example.com with (issuer=https://accounts.example.com) from assuming test, matched deny rule for arthur.aardvark@example.com",
+		},
+		{
+			name: "Wildcard deny wins over wildcard allow",
+			users: []policy.User{domainAllow, {
+				IdentityAttribute: "*@example.com",
+				Principals:        []string{"admin"},
+				Issuer:            issuer,
+				Deny:              true,
+			}},
+			principal:   "admin",
+			errorString: "matched deny rule for *@example.com",
+		},
+		{
+			name: "Explicit allow for a different principal does not override wildcard deny",
+			users: []policy.User{{
+				IdentityAttribute: "*@example.com",
+				Principals:        []string{"admin"},
+				Issuer:            issuer,
+				Deny:              true,
+			}, {
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{"test"},
+				Issuer:            issuer,
+			}},
+			principal:   "admin",
+			errorString: "matched deny rule for *@example.com",
+		},
+		{
+			name: "Wildcard principal only applies to deny rules",
+			users: []policy.User{{
+				IdentityAttribute: "arthur.aardvark@example.com",
+				Principals:        []string{policy.AnyPrincipal},
+				Issuer:            issuer,
+			}},
+			principal:   "test",
+			errorString: "no policy to allow",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{Users: tt.users}},
+			}
+			err := policyEnforcer.CheckPolicy(tt.principal, pkt, "example-base64Cert", "ssh-rsa")
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicyNestedClaims(t *testing.T) {
+	t.Parallel()
+
+	extraClaims := map[string]any{
+		"email":          "arthur.aardvark@example.com",
+		"email_verified": true,
+		"realm_access": map[string]any{
+			"roles": []string{"offline_access", "admin"},
+		},
+		"resource_access": map[string]any{
+			"servers": map[string]any{"roles": []string{"ops"}},
+		},
+		"memberships": []any{
+			map[string]any{"team": "infra", "level": 2},
+			map[string]any{"team": "web", "level": 1},
+		},
+		"department": "engineering",
+	}
+	op, _, err := NewMockOpenIdProvider2(false, "https://accounts.example.com", "test_client_id", extraClaims)
+	require.NoError(t, err)
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		identityAttribute string
+		allowed           bool
+		missingClaim      string
+	}{
+		{name: "Nested roles array contains value", identityAttribute: "oidc:realm_access.roles:admin", allowed: true},
+		{name: "Nested roles array does not contain value", identityAttribute: "oidc:realm_access.roles:superuser", allowed: false},
+		{name: "Deeply nested roles", identityAttribute: "oidc:resource_access.servers.roles:ops", allowed: true},
+		{name: "Array of objects along the path", identityAttribute: "oidc:memberships.team:web", allowed: true},
+		{name: "Number in array of objects", identityAttribute: "oidc:memberships.level:2", allowed: true},
+		{name: "Top level string claim", identityAttribute: "oidc:department:engineering", allowed: true},
+		{name: "Top level string claim mismatch", identityAttribute: "oidc:department:sales", allowed: false},
+		{name: "Path ends at an object", identityAttribute: "oidc:realm_access:admin", allowed: false},
+		{name: "Path continues past a value", identityAttribute: "oidc:department.name:engineering", allowed: false, missingClaim: "department.name"},
+		{name: "Missing claim", identityAttribute: "oidc:realm_access.missing:admin", allowed: false, missingClaim: "realm_access.missing"},
+		{name: "Missing claim in array of objects", identityAttribute: "oidc:memberships.role:admin", allowed: false, missingClaim: "memberships.role"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{
+					Users: []policy.User{{
+						IdentityAttribute: tt.identityAttribute,
+						Principals:        []string{"test"},
+						Issuer:            "https://accounts.example.com",
+					}},
+				}},
+			}
+			err := policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "no policy to allow")
+			}
+			if tt.missingClaim != "" {
+				require.ErrorContains(t, err, "the ID Token has no "+tt.missingClaim+" claim")
+			} else if err != nil {
+				require.NotContains(t, err.Error(), "the ID Token has no")
+			}
+		})
+	}
+}
+
+func TestExplainFromBytes(t *testing.T) {
+	t.Parallel()
+
+	policyBytes := []byte(`# email/sub principal issuer
+* *@example.com https://accounts.example.com deny
+test arthur.aardvark@example.com https://accounts.example.com
+dev oidc:groups:dev https://accounts.example.com
+dev *@example.org https://accounts.example.com
+dev mallory@example.org https://accounts.example.com deny
+`)
+
+	tests := []struct {
+		name      string
+		identity  string
+		principal string
+		allowed   bool
+		reason    string
+	}{
+		{
+			name:      "Explicit allow overrides wildcard deny",
+			identity:  `{"iss":"https://accounts.example.com","sub":"me","email":"arthur.aardvark@example.com","email_verified":true}`,
+			principal: "test",
+			allowed:   true,
+			reason:    `allowed by the explicit allow rule "test arthur.aardvark@example.com https://accounts.example.com" which takes precedence over the wildcard deny rule "* *@example.com https://accounts.example.com deny"`,
+		},
+		{
+			name:      "Wildcard deny overrides wildcard allow",
+			identity:  `{"iss":"https://accounts.example.com","sub":"bob","email":"bob@example.com","email_verified":true,"groups":["dev"]}`,
+			principal: "dev",
+			reason:    `denied by the wildcard deny rule "* *@example.com https://accounts.example.com deny", no explicit allow rule matched`,
+		},
+		{
+			name:      "Wildcard allow",
+			identity:  `{"iss":"https://accounts.example.com","sub":"carol","email":"carol@example.org","email_verified":true}`,
+			principal: "dev",
+			allowed:   true,
+			reason:    `allowed by the wildcard allow rule "dev *@example.org https://accounts.example.com"`,
+		},
+		{
+			name:      "Explicit deny",
+			identity:  `{"iss":"https://accounts.example.com","sub":"mallory","email":"mallory@example.org","email_verified":true}`,
+			principal: "dev",
+			reason:    `denied by the explicit deny rule "dev mallory@example.org https://accounts.example.com deny"`,
+		},
+		{
+			name:      "No rule matches",
+			identity:  `{"iss":"https://accounts.example.com","sub":"dave","email":"dave@example.net","email_verified":true}`,
+			principal: "dev",
+			reason:    "no rule allows dave@example.net with (issuer=https://accounts.example.com) to assume dev",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := policy.ExplainFromBytes(policyBytes, []byte(tt.identity), tt.principal)
+			require.NoError(t, err)
+			require.Equal(t, tt.allowed, decision.Allowed)
+			require.Equal(t, tt.reason, decision.Reason)
+			if tt.allowed {
+				require.NotNil(t, decision.Rule)
+			}
+		})
+	}
+}
+
+func TestEvaluateFromBytes(t *testing.T) {
+	t.Parallel()
+
+	policyBytes := []byte(`# email/sub principal issuer
+test arthur.aardvark@example.com https://accounts.example.com
+dev *@example.com https://accounts.example.com
+admin oidc:realm_access.roles:admin https://accounts.example.com
+* mallory@example.com https://accounts.example.com deny
+bad-row-missing-issuer alice@example.com
+`)
+
+	tests := []struct {
+		name        string
+		identity    string
+		principal   string
+		errorString string
+	}{
+		{
+			name:      "Email allowed",
+			identity:  `{"iss":"https://accounts.example.com","sub":"me","email":"arthur.aardvark@example.com","email_verified":true}`,
+			principal: "test",
+		},
+		{
+			name:      "Domain wildcard allowed",
+			identity:  `{"iss":"https://accounts.example.com","sub":"bob","email":"bob@example.com","email_verified":true}`,
+			principal: "dev",
+		},
+		{
+			name:      "Nested claim allowed",
+			identity:  `{"iss":"https://accounts.example.com","sub":"carol","realm_access":{"roles":["admin"]}}`,
+			principal: "admin",
+		},
+		{
+			name:        "Wrong principal",
+			identity:    `{"iss":"https://accounts.example.com","sub":"me","email":"arthur.aardvark@example.com","email_verified":true}`,
+			principal:   "admin",
+			errorString: "no policy to allow arthur.aardvark@example.com with (issuer=https://accounts.example.com) to assume admin",
+		},
+		{
+			name:        "Wrong issuer",
+			identity:    `{"iss":"https://other.example.com","sub":"me","email":"arthur.aardvark@example.com","email_verified":true}`,
+			principal:   "test",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Denied",
+			identity:    `{"iss":"https://accounts.example.com","sub":"mallory","email":"mallory@example.com","email_verified":true}`,
+			principal:   "dev",
+			errorString: "policy denies mallory@example.com",
+		},
+		{
+			name:        "Unverified email",
+			identity:    `{"iss":"https://accounts.example.com","sub":"me","email":"arthur.aardvark@example.com","email_verified":false}`,
+			principal:   "test",
+			errorString: "no policy to allow",
+		},
+		{
+			name:        "Missing issuer",
+			identity:    `{"sub":"me","email":"arthur.aardvark@example.com","email_verified":true}`,
+			principal:   "test",
+			errorString: "identity claims are missing the iss claim",
+		},
+		{
+			name:        "Invalid JSON",
+			identity:    `{"iss":`,
+			principal:   "test",
+			errorString: "error unmarshalling identity claims",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.EvaluateFromBytes(policyBytes, []byte(tt.identity), tt.principal)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicyFallbackIssuers(t *testing.T) {
+	t.Parallel()
+
+	providerPolicy := &policy.ProviderPolicy{}
+	providerPolicy.AddRow(policy.ProvidersRow{
+		Issuer:           "https://new.example.com",
+		FallbackIssuers:  []string{"https://old.example.com"},
+		ClientID:         "test_client_id",
+		ExpirationPolicy: "24h",
+	})
+
+	tests := []struct {
+		name             string
+		tokenIssuer      string
+		policyIssuer     string
+		deny             bool
+		errorString      string
+		noProviderPolicy bool
+	}{
+		{
+			name:         "New issuer token with new issuer policy",
+			tokenIssuer:  "https://new.example.com",
+			policyIssuer: "https://new.example.com",
+		},
+		{
+			name:         "Old issuer token with new issuer policy",
+			tokenIssuer:  "https://old.example.com",
+			policyIssuer: "https://new.example.com",
+		},
+		{
+			name:         "New issuer token with old issuer policy",
+			tokenIssuer:  "https://new.example.com",
+			policyIssuer: "https://old.example.com",
+		},
+		{
+			name:         "Deny rule for old issuer applies to new issuer token",
+			tokenIssuer:  "https://new.example.com",
+			policyIssuer: "https://old.example.com",
+			deny:         true,
+			errorString:  "policy denies arthur.aardvark@example.com with (issuer=https://new.example.com)",
+		},
+		{
+			name:             "Old issuer policy without provider policy",
+			tokenIssuer:      "https://new.example.com",
+			policyIssuer:     "https://old.example.com",
+			noProviderPolicy: true,
+			errorString:      "no policy to allow arthur.aardvark@example.com with (issuer=https://new.example.com)",
+		},
+		{
+			name:         "Unrelated issuer",
+			tokenIssuer:  "https://other.example.com",
+			policyIssuer: "https://old.example.com",
+			errorString:  "no policy to allow arthur.aardvark@example.com with (issuer=https://other.example.com)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op, _, err := NewMockOpenIdProvider2(false, tt.tokenIssuer, "test_client_id", map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true})
+			require.NoError(t, err)
+			opkClient, err := client.New(op)
+			require.NoError(t, err)
+			pkt, err := opkClient.Auth(context.Background())
+			require.NoError(t, err)
+
+			testPolicy := &policy.Policy{
+				Users: []policy.User{
+					{
+						IdentityAttribute: "arthur.aardvark@example.com",
+						Principals:        []string{"test"},
+						Issuer:            tt.policyIssuer,
+					},
+				},
+			}
+			if tt.deny {
+				testPolicy.Users = append(testPolicy.Users, policy.User{
+					IdentityAttribute: "arthur.aardvark@example.com",
+					Principals:        []string{"test"},
+					Issuer:            tt.policyIssuer,
+					Deny:              true,
+				})
+			}
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader:   &MockPolicyLoader{Policy: testPolicy},
+				ProviderPolicy: providerPolicy,
+			}
+			if tt.noProviderPolicy {
+				policyEnforcer.ProviderPolicy = nil
+			}
+
+			err = policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicyCommands(t *testing.T) {
+	t.Parallel()
+
+	op, err := NewMockOpenIdProvider()
+	require.NoError(t, err)
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+	issuer := op.Issuer()
+
+	tests := []struct {
+		name            string
+		users           []policy.User
+		principal       string
+		expectedCommand string
+		errorString     string
+	}{
+		{
+			name: "Unrestricted principal",
+			users: []policy.User{
+				{IdentityAttribute: "arthur.aardvark@example.com", Principals: []string{"test"}, Issuer: issuer},
+			},
+			principal: "test",
+		},
+		{
+			name: "Restricted principal",
+			users: []policy.User{
+				{IdentityAttribute: "arthur.aardvark@example.com", Principals: []string{"test"}, Issuer: issuer, Command: "/usr/bin/uptime"},
+			},
+			principal:       "test",
+			expectedCommand: "/usr/bin/uptime",
+		},
+		{
+			name: "First restricted entry wins",
+			users: []policy.User{
+				{IdentityAttribute: "*@example.com", Principals: []string{"test"}, Issuer: issuer, Command: "/usr/bin/uptime"},
+				{IdentityAttribute: "arthur.aardvark@example.com", Principals: []string{"test"}, Issuer: issuer, Command: "/usr/bin/id"},
+			},
+			principal:       "test",
+			expectedCommand: "/usr/bin/uptime",
+		},
+		{
+			name: "Unrestricted entry lifts restriction",
+			users: []policy.User{
+				{IdentityAttribute: "*@example.com", Principals: []string{"test"}, Issuer: issuer, Command: "/usr/bin/uptime"},
+				{IdentityAttribute: "arthur.aardvark@example.com", Principals: []string{"test"}, Issuer: issuer},
+			},
+			principal: "test",
+		},
+		{
+			name: "Restriction on another principal",
+			users: []policy.User{
+				{IdentityAttribute: "arthur.aardvark@example.com", Principals: []string{"backup"}, Issuer: issuer, Command: "/usr/bin/rsync"},
+				{IdentityAttribute: "arthur.aardvark@example.com", Principals: []string{"test"}, Issuer: issuer},
+			},
+			principal: "test",
+		},
+		{
+			name: "Restriction on another identity",
+			users: []policy.User{
+				{IdentityAttribute: "bob@example.com", Principals: []string{"test"}, Issuer: issuer, Command: "/usr/bin/uptime"},
+			},
+			principal:   "test",
+			errorString: "no policy to allow arthur.aardvark@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{Users: tt.users}},
+			}
+			command, err := policyEnforcer.CheckPolicyCommand(tt.principal, pkt, "example-base64Cert", "ssh-rsa")
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedCommand, command)
+
+				// The matched entry is the one whose command is used
+				match, err := policyEnforcer.CheckPolicyMatch(tt.principal, pkt, "example-base64Cert", "ssh-rsa")
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedCommand, match.Command)
+				require.Equal(t, tt.expectedCommand, match.Entry.Command)
+				require.Contains(t, match.Entry.Principals, tt.principal)
+				require.Empty(t, match.Plugin)
+			}
+		})
+	}
+}
+
+func TestPolicyIdentityClaim(t *testing.T) {
+	t.Parallel()
+
+	extraClaims := map[string]any{
+		"email":              "a1b2c3@idp.example.com",
+		"email_verified":     true,
+		"preferred_username": "Alice@Example.com",
+	}
+	op, _, err := NewMockOpenIdProvider2(false, "https://accounts.example.com", "test_client_id", extraClaims)
+	require.NoError(t, err)
+
+	opkClient, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		identityClaim     string
+		identityAttribute string
+		allowed           bool
+	}{
+		{name: "Email claim by default", identityAttribute: "a1b2c3@idp.example.com", allowed: true},
+		{name: "Identity claim not used by default", identityAttribute: "alice@example.com", allowed: false},
+		{name: "Identity claim", identityClaim: "preferred_username", identityAttribute: "alice@example.com", allowed: true},
+		{name: "Identity claim replaces email", identityClaim: "preferred_username", identityAttribute: "a1b2c3@idp.example.com", allowed: false},
+		{name: "Identity claim domain", identityClaim: "preferred_username", identityAttribute: "*@example.com", allowed: true},
+		{name: "Sub still matches", identityClaim: "preferred_username", identityAttribute: "me", allowed: true},
+		{name: "Missing identity claim", identityClaim: "upn", identityAttribute: "alice@example.com", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policyEnforcer := &policy.Enforcer{
+				PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{
+					Users: []policy.User{{
+						IdentityAttribute: tt.identityAttribute,
+						Principals:        []string{"test"},
+						Issuer:            "https://accounts.example.com",
+					}},
+				}},
+				IdentityClaim: tt.identityClaim,
+			}
+			err := policyEnforcer.CheckPolicy("test", pkt, "example-base64Cert", "ssh-rsa")
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "no policy to allow")
+			}
+		})
+	}
+
+	// email_verified is still required when matching email entries against
+	// the identity claim
+	extraClaims["email_verified"] = false
+	op, _, err = NewMockOpenIdProvider2(false, "https://accounts.example.com", "test_client_id", extraClaims)
+	require.NoError(t, err)
+	opkClient, err = client.New(op)
+	require.NoError(t, err)
+	unverifiedPkt, err := opkClient.Auth(context.Background())
+	require.NoError(t, err)
+
+	for _, identityAttribute := range []string{"alice@example.com", "*@example.com"} {
+		policyEnforcer := &policy.Enforcer{
+			PolicyLoader: &MockPolicyLoader{Policy: &policy.Policy{
+				Users: []policy.User{{
+					IdentityAttribute: identityAttribute,
+					Principals:        []string{"test"},
+					Issuer:            "https://accounts.example.com",
+				}},
+			}},
+			IdentityClaim: "preferred_username",
+		}
+		err := policyEnforcer.CheckPolicy("test", unverifiedPkt, "example-base64Cert", "ssh-rsa")
+		require.ErrorContains(t, err, "email_verified is not true", identityAttribute)
+	}
 }
@@ -0,0 +1,93 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openpubkey/opkssh/sshcert"
+)
+
+// ExtensionOptionPrefix is the prefix of the policy row option that requires
+// the SSH cert to have an extension, e.g. `extension=mfa@opkssh`, or to have
+// an extension with a value, e.g. `extension=role@example.com=admin`
+const ExtensionOptionPrefix = "extension="
+
+// RequiredExtension is an SSH cert extension a policy entry requires
+type RequiredExtension struct {
+	Name string
+	// Value is the value the extension must have if MatchValue is true,
+	// otherwise any value is accepted
+	Value      string
+	MatchValue bool
+}
+
+// ParseRequiredExtension parses the value of an extension option, either
+// the name of the extension or name=value
+func ParseRequiredExtension(text string) (RequiredExtension, error) {
+	name, value, matchValue := strings.Cut(text, "=")
+	if err := sshcert.ValidateExtensionName(name); err != nil {
+		return RequiredExtension{}, err
+	}
+	return RequiredExtension{Name: name, Value: value, MatchValue: matchValue}, nil
+}
+
+// String returns the extension as written in the policy
+func (e RequiredExtension) String() string {
+	if e.MatchValue {
+		return e.Name + "=" + e.Value
+	}
+	return e.Name
+}
+
+// missingExtension returns the first extension required by the entry that
+// is not in extensions, the extensions of the presented SSH cert, or nil if
+// the cert has all of them
+func (u *User) missingExtension(extensions map[string]string) *RequiredExtension {
+	for i, required := range u.Extensions {
+		value, ok := extensions[required.Name]
+		if !ok || (required.MatchValue && value != required.Value) {
+			return &u.Extensions[i]
+		}
+	}
+	return nil
+}
+
+// certExtensions returns the extensions of the base64 encoded SSH cert
+// sshCert of type keyType. If it can not be parsed as an SSH cert it is
+// treated as having no extensions.
+func certExtensions(sshCert string, keyType string) map[string]string {
+	cert, err := sshcert.NewFromAuthorizedKey(keyType, sshCert)
+	if err != nil {
+		return nil
+	}
+	return cert.SshCert.Extensions
+}
+
+// validateExtensions returns an error if the same extension is required more
+// than once
+func validateExtensions(extensions []RequiredExtension) error {
+	seen := map[string]bool{}
+	for _, extension := range extensions {
+		if seen[extension.Name] {
+			return fmt.Errorf("extension %s is required more than once", extension.Name)
+		}
+		seen[extension.Name] = true
+	}
+	return nil
+}
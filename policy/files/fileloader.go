@@ -87,3 +87,36 @@ func (l *FileLoader) Dump(fileBytes []byte, path string) error {
 	}
 	return nil
 }
+
+// DumpAtomic writes the bytes in fileBytes to a temporary file next to path
+// and then renames it over path, so that readers see either the old or the
+// new contents and never a partially written file. The owner of an existing
+// file at path is kept.
+func (l *FileLoader) DumpAtomic(fileBytes []byte, path string) error {
+	tmp, err := afero.TempFile(l.Fs, filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	// Removing the temporary file fails harmlessly once it has been renamed
+	defer func() { _ = l.Fs.Remove(tmpPath) }()
+
+	if _, err := tmp.Write(fileBytes); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := l.Fs.Chmod(tmpPath, l.RequiredPerm); err != nil {
+		return fmt.Errorf("failed to set file permissions: %w", err)
+	}
+	if info, err := l.Fs.Stat(path); err == nil {
+		if uid, gid, ok := fileOwner(info); ok {
+			if err := l.Fs.Chown(tmpPath, uid, gid); err != nil {
+				return fmt.Errorf("failed to set file owner: %w", err)
+			}
+		}
+	}
+	return l.Fs.Rename(tmpPath, path)
+}
@@ -25,13 +25,28 @@ import (
 
 type Table struct {
 	rows [][]string
+	// comments holds the trailing # comment of each row, or an empty string
+	// if the row has no comment
+	comments []string
 }
 
+// NewTable parses content into a table, dropping # comments
 func NewTable(content []byte) *Table {
+	return newTable(content, false)
+}
+
+// NewCommentedTable is NewTable but keeps the trailing # comment of each row,
+// so that it is written back out by ToString
+func NewCommentedTable(content []byte) *Table {
+	return newTable(content, true)
+}
+
+func newTable(content []byte, keepComments bool) *Table {
 	table := [][]string{}
+	comments := []string{}
 	rows := strings.Split(string(content), "\n")
-	for _, row := range rows {
-		row := CleanRow(row)
+	for _, line := range rows {
+		row := CleanRow(line)
 		if row == "" {
 			continue
 		}
@@ -42,8 +57,13 @@ func NewTable(content []byte) *Table {
 			continue
 		}
 		table = append(table, columns)
+		comment := ""
+		if keepComments {
+			comment = RowComment(line)
+		}
+		comments = append(comments, comment)
 	}
-	return &Table{rows: table}
+	return &Table{rows: table, comments: comments}
 }
 
 func CleanRow(row string) string {
@@ -54,14 +74,34 @@ func CleanRow(row string) string {
 	return rowFixed
 }
 
+// RowComment returns the text of the trailing # comment on a row
+func RowComment(row string) string {
+	_, comment, found := strings.Cut(row, "#")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(comment)
+}
+
 func (t *Table) AddRow(row ...string) {
+	t.AddCommentedRow("", row...)
+}
+
+// AddCommentedRow adds a row that is written with a trailing # comment. An
+// empty comment adds the row without a comment.
+func (t *Table) AddCommentedRow(comment string, row ...string) {
 	t.rows = append(t.rows, row)
+	t.comments = append(t.comments, comment)
 }
 
 func (t Table) ToString() string {
 	var sb strings.Builder
-	for _, row := range t.rows {
-		sb.WriteString(shellquote.Join(row...) + "\n")
+	for i, row := range t.rows {
+		sb.WriteString(shellquote.Join(row...))
+		if t.comments[i] != "" {
+			sb.WriteString(" # " + t.comments[i])
+		}
+		sb.WriteString("\n")
 	}
 	return sb.String()
 }
@@ -73,3 +113,9 @@ func (t Table) ToBytes() []byte {
 func (t Table) GetRows() [][]string {
 	return t.rows
 }
+
+// GetComments returns the trailing comment of each row, in the same order as
+// GetRows
+func (t Table) GetComments() []string {
+	return t.comments
+}
@@ -91,3 +91,16 @@ func TestToTable(t *testing.T) {
 		})
 	}
 }
+
+func TestCommentedTable(t *testing.T) {
+	input := "1 2 3\n 4 5#comment \n# whole line\n6 7 # another comment\n"
+	table := NewCommentedTable([]byte(input))
+
+	assert.Equal(t, [][]string{{"1", "2", "3"}, {"4", "5"}, {"6", "7"}}, table.GetRows())
+	assert.Equal(t, []string{"", "comment", "another comment"}, table.GetComments())
+	assert.Equal(t, "1 2 3\n4 5 # comment\n6 7 # another comment\n", table.ToString())
+
+	table.AddRow("8")
+	table.AddCommentedRow("added", "9")
+	assert.Equal(t, "1 2 3\n4 5 # comment\n6 7 # another comment\n8\n9 # added\n", table.ToString())
+}
@@ -0,0 +1,108 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/openpubkey/openpubkey/verifier"
+)
+
+// CreateCachingVerifier is CreateVerifier but keeps the discovery documents
+// and JWKS it fetches for ttl, for long running processes that verify many
+// PK Tokens. A key the OP starts signing with is not found until the cached
+// JWKS expires.
+func (p *ProviderPolicy) CreateCachingVerifier(ttl time.Duration) (*verifier.Verifier, error) {
+	httpClient := newJwksHttpClient()
+	httpClient.Transport = &cachingTransport{base: httpClient.Transport, ttl: ttl}
+	return p.createVerifier(func(issuer string, clientID string) verifier.ProviderVerifier {
+		return newProviderVerifier(issuer, clientID, p.httpClientFor(issuer, httpClient))
+	})
+}
+
+// cachingTransport answers GET requests from earlier successful responses to
+// the same URL that are less than ttl old
+type cachingTransport struct {
+	base http.RoundTripper
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+	// now returns the current time, time.Now if nil
+	now func() time.Time
+}
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	key := req.URL.String()
+
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	t.mu.Unlock()
+	if ok && now().Before(entry.expires) {
+		return entry.response(req), nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	entry = cachedResponse{header: resp.Header.Clone(), body: body, expires: now().Add(t.ttl)}
+	t.mu.Lock()
+	if t.entries == nil {
+		t.entries = map[string]cachedResponse{}
+	}
+	t.entries[key] = entry
+	t.mu.Unlock()
+	return entry.response(req), nil
+}
+
+// response returns a new response to req with the cached header and body
+func (c cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
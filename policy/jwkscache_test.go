@@ -0,0 +1,72 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachingTransport(t *testing.T) {
+	var requests atomic.Int32
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	now := time.Date(2025, 6, 4, 12, 0, 0, 0, time.UTC)
+	transport := &cachingTransport{base: http.DefaultTransport, ttl: time.Minute, now: func() time.Time { return now }}
+	httpClient := &http.Client{Transport: transport}
+	get := func() (int, string) {
+		resp, err := httpClient.Get(server.URL + "/jwks")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// Failed responses are not cached
+	code, _ := get()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	status = http.StatusOK
+	code, body := get()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, `{"keys":[]}`, body)
+	require.Equal(t, int32(2), requests.Load())
+
+	// Until the ttl passes the response is served from the cache
+	now = now.Add(59 * time.Second)
+	code, body = get()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, `{"keys":[]}`, body)
+	require.Equal(t, int32(2), requests.Load())
+
+	now = now.Add(time.Second)
+	code, _ = get()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, int32(3), requests.Load())
+}
@@ -0,0 +1,89 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// jwksFetchRetries is how many times verify retries fetching the
+	// discovery document or JWKS of an issuer after a failed attempt
+	jwksFetchRetries = 2
+	// jwksFetchBackoff is the wait before the first retry, doubled before
+	// each later retry
+	jwksFetchBackoff = 100 * time.Millisecond
+	// jwksFetchTimeout bounds the time spent fetching a discovery document
+	// or JWKS, including retries, so sshd is not left waiting on verify
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// newJwksHttpClient returns the http.Client verify uses to fetch the
+// discovery documents and JWKS of issuers. sshd runs verify on every login,
+// so a brief network problem would otherwise deny the user.
+func newJwksHttpClient() *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{
+			base:    http.DefaultTransport,
+			retries: jwksFetchRetries,
+			backoff: jwksFetchBackoff,
+		},
+		Timeout: jwksFetchTimeout,
+	}
+}
+
+// retryTransport retries GET requests that fail with a network error or a
+// response that says the server is temporarily unable to answer. Any other
+// response, including one whose contents later fail verification, is
+// returned without retrying. The request's context, which http.Client
+// cancels after its Timeout, ends the retries early.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.retries || req.Method != http.MethodGet || !retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable returns true if a request that got resp or err may succeed if
+// it is sent again
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,136 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openpubkey/openpubkey/discover"
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyIssuer returns an issuer whose JWKS endpoint responds with status
+// to the first failures requests
+func newFlakyIssuer(t *testing.T, failures int32, status int) (*httptest.Server, *atomic.Int32) {
+	var jwksRequests atomic.Int32
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   server.URL,
+			"jwks_uri": server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		if jwksRequests.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	})
+	return server, &jwksRequests
+}
+
+func TestJwksFetchRetry(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int32
+		status           int
+		expectedStatus   int
+		expectedRequests int32
+	}{
+		{
+			name:             "Succeeds first time",
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 1,
+		},
+		{
+			name:             "Succeeds on retry",
+			failures:         1,
+			status:           http.StatusServiceUnavailable,
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 2,
+		},
+		{
+			name:             "Succeeds on last retry",
+			failures:         2,
+			status:           http.StatusTooManyRequests,
+			expectedStatus:   http.StatusOK,
+			expectedRequests: 3,
+		},
+		{
+			name:             "Gives up after retries",
+			failures:         3,
+			status:           http.StatusInternalServerError,
+			expectedStatus:   http.StatusInternalServerError,
+			expectedRequests: 3,
+		},
+		{
+			name:             "Does not retry client errors",
+			failures:         1,
+			status:           http.StatusNotFound,
+			expectedStatus:   http.StatusNotFound,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, jwksRequests := newFlakyIssuer(t, tt.failures, tt.status)
+			resp, err := newJwksHttpClient().Get(server.URL + "/jwks")
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedRequests, jwksRequests.Load())
+		})
+	}
+}
+
+func TestJwksFetchRetryVerifier(t *testing.T) {
+	// Failed JWKS fetches do not stop the issuer's keys from being found
+	server, _ := newFlakyIssuer(t, 2, http.StatusServiceUnavailable)
+	jwks, err := discover.GetJwksByIssuer(context.Background(), server.URL, newJwksHttpClient())
+	require.NoError(t, err)
+	require.JSONEq(t, `{"keys":[]}`, string(jwks))
+
+	// Without retries the same failures are an error
+	server, _ = newFlakyIssuer(t, 2, http.StatusServiceUnavailable)
+	_, err = discover.GetJwksByIssuer(context.Background(), server.URL, http.DefaultClient)
+	require.Error(t, err)
+}
+
+func TestJwksFetchRetryDeadline(t *testing.T) {
+	// An issuer that is always down must not hold verify past the deadline
+	server, _ := newFlakyIssuer(t, 100, http.StatusServiceUnavailable)
+	httpClient := &http.Client{
+		Transport: &retryTransport{base: http.DefaultTransport, retries: 100, backoff: 50 * time.Millisecond},
+		Timeout:   200 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err := discover.GetJwksByIssuer(context.Background(), server.URL, httpClient)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
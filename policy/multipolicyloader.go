@@ -96,6 +96,31 @@ func (l *MultiPolicyLoader) Load() (*Policy, Source, error) {
 	return policy, FileSource(strings.Join(readPaths, ", ")), nil
 }
 
+// PreloadedLoader implements policy.Loader by returning the result of loading
+// a policy once, when the PreloadedLoader was created. This lets the policy be
+// read before the process drops the privileges needed to read it.
+type PreloadedLoader struct {
+	policy *Policy
+	source Source
+	err    error
+}
+
+var _ Loader = &PreloadedLoader{}
+
+// NewPreloadedLoader calls loader.Load immediately and returns a Loader that
+// returns its result
+func NewPreloadedLoader(loader Loader) *PreloadedLoader {
+	policy, source, err := loader.Load()
+	return &PreloadedLoader{policy: policy, source: source, err: err}
+}
+
+func (l *PreloadedLoader) Load() (*Policy, Source, error) {
+	if l.err != nil {
+		return nil, nil, l.err
+	}
+	return l.policy, l.source, nil
+}
+
 // ReadWithSudoScript specifies additional way of loading the policy in the
 // user's home directory (`~/.opk/auth_id`). This is needed when the
 // AuthorizedKeysCommand user does not have privileges to transverse the user's
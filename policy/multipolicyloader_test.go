@@ -242,3 +242,36 @@ func TestLoad(t *testing.T) {
 func MockTestSudoScript(_ *policy.HomePolicyLoader, username string) ([]byte, error) {
 	return []byte{}, fmt.Errorf("mock error")
 }
+
+type countingLoader struct {
+	calls int
+	err   error
+}
+
+func (l *countingLoader) Load() (*policy.Policy, policy.Source, error) {
+	l.calls++
+	if l.err != nil {
+		return nil, nil, l.err
+	}
+	return &policy.Policy{Users: []policy.User{{IdentityAttribute: "alice@example.com", Principals: []string{"root"}, Issuer: "https://example.com"}}}, policy.FileSource("/etc/opk/auth_id"), nil
+}
+
+func TestPreloadedLoader(t *testing.T) {
+	loader := &countingLoader{}
+	preloaded := policy.NewPreloadedLoader(loader)
+	require.Equal(t, 1, loader.calls, "policy should be loaded when the preloaded loader is created")
+
+	for i := 0; i < 2; i++ {
+		p, source, err := preloaded.Load()
+		require.NoError(t, err)
+		require.Len(t, p.Users, 1)
+		require.Equal(t, "/etc/opk/auth_id", source.Source())
+	}
+	require.Equal(t, 1, loader.calls, "policy should not be loaded again")
+
+	preloaded = policy.NewPreloadedLoader(&countingLoader{err: fmt.Errorf("permission denied")})
+	p, source, err := preloaded.Load()
+	require.ErrorContains(t, err, "permission denied")
+	require.Nil(t, p)
+	require.Nil(t, source)
+}
@@ -89,6 +89,15 @@ type PolicyPluginEnforcer struct {
 	Fs          afero.Fs
 	cmdExecutor CmdExecutor // This lets us mock command exec in unit tests
 	permChecker files.PermsChecker
+	// preloaded is set by Preload
+	preloaded *preloadedPlugins
+}
+
+// preloadedPlugins are the plugin configs Preload loaded from dir
+type preloadedPlugins struct {
+	dir     string
+	results PluginResults
+	err     error
 }
 
 func NewPolicyPluginEnforcer() *PolicyPluginEnforcer {
@@ -161,6 +170,32 @@ func (p *PolicyPluginEnforcer) loadPlugins(dir string) (pluginResults PluginResu
 	return pluginResults, nil
 }
 
+// Preload loads the plugin configs in the directory dir immediately, so that
+// CheckPolicies uses them rather than reading dir itself. Verify uses this to
+// read the configs before it drops privileges.
+func (p *PolicyPluginEnforcer) Preload(dir string) {
+	results, err := p.loadPlugins(dir)
+	p.preloaded = &preloadedPlugins{dir: dir, results: results, err: err}
+}
+
+// plugins returns the plugin configs in the directory dir, using the ones
+// loaded by Preload if it was called for dir. Each call returns new
+// PluginResults as checkPolicies records the outcome of the plugin in them.
+func (p *PolicyPluginEnforcer) plugins(dir string) (PluginResults, error) {
+	if p.preloaded == nil || p.preloaded.dir != dir {
+		return p.loadPlugins(dir)
+	}
+	if p.preloaded.err != nil {
+		return nil, p.preloaded.err
+	}
+	var pluginResults PluginResults
+	for _, result := range p.preloaded.results {
+		pluginResult := *result
+		pluginResults = append(pluginResults, &pluginResult)
+	}
+	return pluginResults, nil
+}
+
 // CheckPolicies loads the policies plugin configs in the directory dir
 // and then runs the policy command specified in which policy plugin config
 // to determine if the user is allowed to assume access as the given principal.
@@ -183,7 +218,7 @@ func (p *PolicyPluginEnforcer) CheckPolicies(dir string, pkt *pktoken.PKToken, p
 }
 
 func (p *PolicyPluginEnforcer) checkPolicies(dir string, tokens map[string]string) (PluginResults, error) {
-	pluginResults, err := p.loadPlugins(dir)
+	pluginResults, err := p.plugins(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load policy commands: %w", err)
 	}
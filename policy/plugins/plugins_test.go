@@ -392,6 +392,60 @@ command: /usr/bin/local/opk/bad-perms-policy-cmd`}}
 	}
 }
 
+func TestPreloadPolicyPlugins(t *testing.T) {
+	mockCmdExecutor := func(name string, arg ...string) ([]byte, error) {
+		if name == "/usr/bin/local/opk/policy-cmd" {
+			return []byte("allow"), nil
+		}
+		return nil, fmt.Errorf("command '%s' not found", name)
+	}
+
+	mockFs := afero.NewMemMapFs()
+	tempDir, _ := afero.TempDir(mockFs, "", "policy_test")
+	err := afero.WriteFile(mockFs, filepath.Join(tempDir, "valid_policy.yml"), []byte(`
+name: Example Policy Command
+command: /usr/bin/local/opk/policy-cmd arg1`), 0640)
+	require.NoError(t, err)
+	err = afero.WriteFile(mockFs, "/usr/bin/local/opk/policy-cmd", []byte(""), 0755)
+	require.NoError(t, err)
+
+	enforcer := &PolicyPluginEnforcer{
+		Fs:          mockFs,
+		cmdExecutor: mockCmdExecutor,
+		permChecker: files.PermsChecker{
+			Fs: mockFs,
+			CmdRunner: func(name string, arg ...string) ([]byte, error) {
+				return []byte("root" + " " + "group"), nil
+			},
+		},
+	}
+	enforcer.Preload(tempDir)
+
+	// The plugin config is not read again, e.g. once verify has dropped the
+	// privileges needed to read it
+	require.NoError(t, mockFs.Remove(filepath.Join(tempDir, "valid_policy.yml")))
+	for range 2 {
+		res, err := enforcer.checkPolicies(tempDir, map[string]string{})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+		require.Empty(t, res.Errors())
+		require.True(t, res.Allowed())
+	}
+	require.Equal(t, "Example Policy Command", enforcer.preloaded.results[0].PluginConfig.Name)
+	require.False(t, enforcer.preloaded.results[0].Allowed, "preloaded results should not record the outcome of a check")
+
+	// Other directories are still read when checked
+	otherDir, _ := afero.TempDir(mockFs, "", "other_policy_test")
+	res, err := enforcer.checkPolicies(otherDir, map[string]string{})
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	// An error preloading is returned when the plugins are checked
+	enforcer.Preload("/missing")
+	_, err = enforcer.checkPolicies("/missing", map[string]string{})
+	require.ErrorContains(t, err, "failed to load policy commands")
+}
+
 func TestPluginPanics(t *testing.T) {
 	result := &PluginResult{
 		Allowed:      true,
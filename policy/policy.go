@@ -29,6 +29,8 @@ type User struct {
 	// IdentityAttribute is a string that is either structured or unstructured.
 	// Structured: <IdentityProtocolMatching>:<Attribute>:<Value>
 	// E.g. `oidc:groups:ssh-users`
+	// The attribute may be a dot separated path to a nested claim, e.g.
+	// `oidc:realm_access.roles:admin`.
 	// Using the structured identifier allows the capability of constructing
 	// complex user matchers.
 	//
@@ -43,8 +45,38 @@ type User struct {
 	Principals []string
 	// Sub        string
 	Issuer string
+	// Deny marks this entry as a deny rule. Deny rules are evaluated before
+	// allow rules so a matching deny rule always wins. In a deny rule the
+	// principal `*` matches every principal.
+	Deny bool
+	// Comment is an optional annotation, such as a ticket number, that is
+	// written as a trailing # comment on the entry's rows. It is ignored
+	// when evaluating the policy.
+	Comment string
+	// Command, if set, is the only command the principals may run. It is
+	// enforced by sshd through the command option of the authorized_keys
+	// line returned by verify.
+	Command string
+	// Hours, if set, is the only time the entry allows access
+	Hours *Schedule
+	// UniquePrincipal makes the templated principals of the entry only grant
+	// a derived principal if the policy can't grant it to anyone else
+	UniquePrincipal bool
+	// Extensions are the extensions the SSH cert must have for the entry to
+	// allow access
+	Extensions []RequiredExtension
 }
 
+// DenyOption is the policy row option that marks a row as a deny rule
+const DenyOption = "deny"
+
+// CommandOptionPrefix is the prefix of the policy row option that restricts
+// the principal to a command, e.g. `command="/usr/bin/rsync --server"`
+const CommandOptionPrefix = "command="
+
+// AnyPrincipal is the principal that matches every principal in deny rules
+const AnyPrincipal = "*"
+
 // Policy represents an opkssh policy
 type Policy struct {
 	// Users is a list of all user entries in the policy
@@ -53,11 +85,18 @@ type Policy struct {
 
 // FromTable decodes whitespace delimited input into policy.Policy
 func FromTable(input []byte, path string) *Policy {
-	table := files.NewTable(input)
+	return FromTableWithLog(input, path, files.ConfigProblems())
+}
+
+// FromTableWithLog is like FromTable but records problems with the rows it
+// skips in problems rather than the global config log
+func FromTableWithLog(input []byte, path string, problems *files.ConfigLog) *Policy {
+	table := files.NewCommentedTable(input)
+	comments := table.GetComments()
 	policy := &Policy{}
 	for i, row := range table.GetRows() {
 		// Error should not break everyone's ability to login, skip those rows
-		if len(row) != 3 {
+		if len(row) < 3 {
 			configProblem := files.ConfigProblem{
 				Filepath:            path,
 				OffendingLine:       strings.Join(row, " "),
@@ -65,62 +104,271 @@ func FromTable(input []byte, path string) *Policy {
 				ErrorMessage:        fmt.Sprintf("wrong number of arguments (expected=3, got=%d)", len(row)),
 				Source:              "user policy file",
 			}
-			files.ConfigProblems().RecordProblem(configProblem)
+			problems.RecordProblem(configProblem)
 			continue
 		}
 		user := User{
 			Principals:        []string{row[0]},
 			IdentityAttribute: row[1],
 			Issuer:            row[2],
+			Comment:           comments[i],
+		}
+		if err := user.parseOptions(row[3:]); err != nil {
+			configProblem := files.ConfigProblem{
+				Filepath:            path,
+				OffendingLine:       strings.Join(row, " "),
+				OffendingLineNumber: i,
+				ErrorMessage:        err.Error(),
+				Source:              "user policy file",
+			}
+			problems.RecordProblem(configProblem)
+			continue
 		}
 		policy.Users = append(policy.Users, user)
 	}
 	return policy
 }
 
+// parseOptions parses the optional columns that follow the issuer in a policy row
+func (u *User) parseOptions(options []string) error {
+	for _, option := range options {
+		switch {
+		case option == DenyOption:
+			u.Deny = true
+		case strings.HasPrefix(option, CommandOptionPrefix):
+			command := strings.TrimPrefix(option, CommandOptionPrefix)
+			if err := validateCommand(command); err != nil {
+				return err
+			}
+			u.Command = command
+		case strings.HasPrefix(option, HoursOptionPrefix):
+			schedule, err := ParseSchedule(strings.TrimPrefix(option, HoursOptionPrefix))
+			if err != nil {
+				return err
+			}
+			u.Hours = schedule
+		case option == UniquePrincipalOption:
+			u.UniquePrincipal = true
+		case strings.HasPrefix(option, ExtensionOptionPrefix):
+			extension, err := ParseRequiredExtension(strings.TrimPrefix(option, ExtensionOptionPrefix))
+			if err != nil {
+				return err
+			}
+			u.Extensions = append(u.Extensions, extension)
+		default:
+			return fmt.Errorf("unknown policy option (%s)", option)
+		}
+	}
+	if u.Deny && u.Command != "" {
+		return fmt.Errorf("command can not be used in a deny rule")
+	}
+	if u.Deny && u.Hours != nil {
+		return fmt.Errorf("hours can not be used in a deny rule")
+	}
+	if u.Deny && len(u.Extensions) > 0 {
+		return fmt.Errorf("extension can not be used in a deny rule")
+	}
+	if err := validateExtensions(u.Extensions); err != nil {
+		return err
+	}
+	for _, principal := range u.Principals {
+		if !IsPrincipalTemplate(principal) {
+			continue
+		}
+		if u.Deny {
+			return fmt.Errorf("templated principals can not be used in a deny rule")
+		}
+		if _, err := ParsePrincipalTemplate(principal); err != nil {
+			return err
+		}
+	}
+	if u.UniquePrincipal && !u.hasPrincipalTemplate() {
+		return fmt.Errorf("unique can only be used with a templated principal")
+	}
+	return nil
+}
+
+// validateCommand returns an error if command can not be used as the command
+// option of an authorized_keys line
+func validateCommand(command string) error {
+	if command == "" {
+		return fmt.Errorf("command must not be empty")
+	}
+	if strings.ContainsAny(command, "\r\n") {
+		return fmt.Errorf("command must be a single line")
+	}
+	// sshd would read a trailing backslash as escaping the closing quote of
+	// the command option
+	if strings.HasSuffix(command, `\`) {
+		return fmt.Errorf("command must not end with a backslash")
+	}
+	return nil
+}
+
+// options returns the optional columns to write after the issuer in a policy row
+func (u *User) options() []string {
+	options := []string{}
+	if u.Deny {
+		options = append(options, DenyOption)
+	}
+	if u.Command != "" {
+		options = append(options, CommandOptionPrefix+u.Command)
+	}
+	if u.Hours != nil {
+		options = append(options, HoursOptionPrefix+u.Hours.String())
+	}
+	if u.UniquePrincipal {
+		options = append(options, UniquePrincipalOption)
+	}
+	for _, extension := range u.Extensions {
+		options = append(options, ExtensionOptionPrefix+extension.String())
+	}
+	return options
+}
+
 // AddAllowedPrincipal adds a new allowed principal to the user whose email is
 // equal to userEmail. If no user can be found with the email userEmail, then a
 // new user entry is added with an initial allowed principals list containing
 // principal. No changes are made if the principal is already allowed for this
 // user.
 func (p *Policy) AddAllowedPrincipal(principal string, userEmail string, issuer string) {
-	userExists := false
-	if len(p.Users) != 0 {
-		// search to see if the current user already has an entry in the policy
-		// file
-		for i := range p.Users {
-			user := &p.Users[i]
-			if user.IdentityAttribute == userEmail && user.Issuer == issuer {
-				principalExists := false
-				for _, p := range user.Principals {
-					// if the principal already exists for this user, then skip
-					if p == principal {
-						log.Printf("User with email %s already has access under the principal %s, skipping...\n", userEmail, principal)
-						principalExists = true
-					}
+	p.AddAllowedPrincipalWithComment(principal, userEmail, issuer, "")
+}
+
+// AddAllowedPrincipalWithComment is AddAllowedPrincipal but only adds the
+// principal to an existing user entry that has the same comment, so that
+// each comment stays attached to the principals it was added with
+func (p *Policy) AddAllowedPrincipalWithComment(principal string, userEmail string, issuer string, comment string) {
+	for _, user := range p.Users {
+		if !user.Deny && user.IdentityAttribute == userEmail && user.Issuer == issuer {
+			for _, p := range user.Principals {
+				// if the principal already exists for this user, then skip
+				if p == principal {
+					log.Printf("User with email %s already has access under the principal %s, skipping...\n", userEmail, principal)
+					return
 				}
+			}
+		}
+	}
+
+	// search to see if the current user already has an entry in the policy
+	// file
+	for i := range p.Users {
+		user := &p.Users[i]
+		// Entries restricted to a command, to hours or to certs with an
+		// extension are not extended, as the new principal would inherit the
+		// restriction, nor are entries with templated principals
+		if !user.Deny && user.Command == "" && user.Hours == nil && len(user.Extensions) == 0 && !user.hasPrincipalTemplate() && user.IdentityAttribute == userEmail && user.Issuer == issuer && user.Comment == comment {
+			user.Principals = append(user.Principals, principal)
+			log.Printf("Successfully added user with email %s with principal %s to the policy file\n", userEmail, principal)
+			return
+		}
+	}
+
+	// if no user found with userEmail, then create a new entry
+	newUser := User{
+		IdentityAttribute: userEmail,
+		Principals:        []string{principal},
+		Issuer:            issuer,
+		Comment:           comment,
+	}
+	// add the new user to the list of users in the policy
+	p.Users = append(p.Users, newUser)
+}
+
+// AddStatus describes what adding an allowed principal would do to a policy
+type AddStatus int
 
-				if !principalExists {
-					user.Principals = append(user.Principals, principal)
-					user.Issuer = issuer
-					log.Printf("Successfully added user with email %s with principal %s to the policy file\n", userEmail, principal)
+const (
+	// AddPresent means the principal is already allowed, so adding it would
+	// not change the policy
+	AddPresent AddStatus = iota
+	// AddWouldAdd means adding the principal would change the policy
+	AddWouldAdd
+	// AddConflict means the policy contains an entry that contradicts the
+	// principal being allowed
+	AddConflict
+)
+
+// CheckAllowedPrincipal reports what AddAllowedPrincipalWithComment would do
+// without changing the policy. For conflicts, the reason describes the
+// conflicting entry.
+func (p *Policy) CheckAllowedPrincipal(principal string, userEmail string, issuer string) (AddStatus, string) {
+	for _, user := range p.Users {
+		if user.IdentityAttribute != userEmail || user.Issuer != issuer {
+			continue
+		}
+		for _, userPrincipal := range user.Principals {
+			if user.Deny && (userPrincipal == principal || userPrincipal == AnyPrincipal) {
+				return AddConflict, fmt.Sprintf("a deny rule for the principal %s denies %s", userPrincipal, userEmail)
+			}
+		}
+	}
+	for _, user := range p.Users {
+		if user.Deny || user.IdentityAttribute != userEmail || user.Issuer != issuer {
+			continue
+		}
+		for _, userPrincipal := range user.Principals {
+			if userPrincipal == principal {
+				if user.Command != "" {
+					return AddConflict, fmt.Sprintf("%s is already allowed the principal %s but only to run %s", userEmail, principal, user.Command)
+				}
+				if user.Hours != nil {
+					return AddConflict, fmt.Sprintf("%s is already allowed the principal %s but only during %s", userEmail, principal, user.Hours)
+				}
+				if len(user.Extensions) > 0 {
+					return AddConflict, fmt.Sprintf("%s is already allowed the principal %s but only with the SSH cert extension %s", userEmail, principal, user.Extensions[0])
 				}
-				userExists = true
+				return AddPresent, ""
 			}
 		}
 	}
+	return AddWouldAdd, ""
+}
 
-	// if the policy is empty or if no user found with userEmail, then create a
-	// new entry
-	if len(p.Users) == 0 || !userExists {
-		newUser := User{
-			IdentityAttribute: userEmail,
-			Principals:        []string{principal},
-			Issuer:            issuer,
+// RemoveAllowedPrincipals removes every allowed principal that matches
+// principal, identity, issuer and comment, where an empty argument matches
+// any value. Deny rules are never removed. User entries left without any
+// principals are dropped. Returns the number of principals removed.
+func (p *Policy) RemoveAllowedPrincipals(principal string, identity string, issuer string, comment string) int {
+	removed := 0
+	users := []User{}
+	for _, user := range p.Users {
+		if user.Deny || !matchesOrEmpty(identity, user.IdentityAttribute) || !matchesOrEmpty(issuer, user.Issuer) || !matchesOrEmpty(comment, user.Comment) {
+			users = append(users, user)
+			continue
+		}
+		principals := []string{}
+		for _, p := range user.Principals {
+			if matchesOrEmpty(principal, p) {
+				removed++
+			} else {
+				principals = append(principals, p)
+			}
+		}
+		if len(principals) > 0 {
+			user.Principals = principals
+			users = append(users, user)
 		}
-		// add the new user to the list of users in the policy
-		p.Users = append(p.Users, newUser)
 	}
+	p.Users = users
+	return removed
+}
+
+// isWildcard returns true if the entry matches on a pattern, *@domain or an
+// oidc: claim, rather than naming a single email or sub
+func (u *User) isWildcard() bool {
+	return strings.HasPrefix(u.IdentityAttribute, "*@") || strings.HasPrefix(u.IdentityAttribute, oidcClaimPrefix)
+}
+
+// describe returns the entry as it is written in the policy, with its
+// principals comma separated
+func (u *User) describe() string {
+	return strings.Join(append([]string{strings.Join(u.Principals, ","), u.IdentityAttribute, u.Issuer}, u.options()...), " ")
+}
+
+func matchesOrEmpty(want string, got string) bool {
+	return want == "" || want == got
 }
 
 // ToTable encodes the policy into a whitespace delimited table
@@ -128,7 +376,8 @@ func (p *Policy) ToTable() ([]byte, error) {
 	table := files.Table{}
 	for _, user := range p.Users {
 		for _, principal := range user.Principals {
-			table.AddRow(principal, user.IdentityAttribute, user.Issuer)
+			row := append([]string{principal, user.IdentityAttribute, user.Issuer}, user.options()...)
+			table.AddCommentedRow(user.Comment, row...)
 		}
 	}
 	return table.ToBytes(), nil
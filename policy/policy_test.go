@@ -20,7 +20,9 @@ import (
 	"testing"
 
 	"github.com/openpubkey/opkssh/policy"
+	"github.com/openpubkey/opkssh/policy/files"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAddAllowedPrincipal(t *testing.T) {
@@ -132,3 +134,268 @@ func TestAddAllowedPrincipal(t *testing.T) {
 		})
 	}
 }
+
+func TestPolicyTableDenyRules(t *testing.T) {
+	input := []byte(`# principal identity issuer options
+root alice@example.com https://example.com
+* mallory@example.com https://example.com deny
+root bob@example.com https://example.com deny
+root eve@example.com https://example.com bogus
+`)
+
+	p := policy.FromTable(input, "test-path")
+	expected := []policy.User{
+		{
+			IdentityAttribute: "alice@example.com",
+			Principals:        []string{"root"},
+			Issuer:            "https://example.com",
+		},
+		{
+			IdentityAttribute: "mallory@example.com",
+			Principals:        []string{"*"},
+			Issuer:            "https://example.com",
+			Deny:              true,
+		},
+		{
+			IdentityAttribute: "bob@example.com",
+			Principals:        []string{"root"},
+			Issuer:            "https://example.com",
+			Deny:              true,
+		},
+	}
+	assert.Equal(t, expected, p.Users)
+
+	// Round trip through ToTable should keep deny rules
+	tableBytes, err := p.ToTable()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, policy.FromTable(tableBytes, "test-path").Users)
+
+	// Adding an allowed principal must never turn a deny rule into an allow
+	p.AddAllowedPrincipal("admin", "bob@example.com", "https://example.com")
+	assert.Equal(t, policy.User{
+		IdentityAttribute: "bob@example.com",
+		Principals:        []string{"root"},
+		Issuer:            "https://example.com",
+		Deny:              true,
+	}, p.Users[2])
+	assert.Equal(t, policy.User{
+		IdentityAttribute: "bob@example.com",
+		Principals:        []string{"admin"},
+		Issuer:            "https://example.com",
+	}, p.Users[3])
+}
+
+func TestPolicyTableCommands(t *testing.T) {
+	input := []byte(`# principal identity issuer options
+backup alice@example.com https://example.com "command=/usr/bin/rsync --server --sender ."
+root alice@example.com https://example.com
+* mallory@example.com https://example.com deny command=/bin/true
+root eve@example.com https://example.com command=
+root bob@example.com https://example.com 'command=/bin/echo \'
+`)
+
+	p := policy.FromTable(input, "test-path")
+	expected := []policy.User{
+		{
+			IdentityAttribute: "alice@example.com",
+			Principals:        []string{"backup"},
+			Issuer:            "https://example.com",
+			Command:           "/usr/bin/rsync --server --sender .",
+		},
+		{
+			IdentityAttribute: "alice@example.com",
+			Principals:        []string{"root"},
+			Issuer:            "https://example.com",
+		},
+	}
+	assert.Equal(t, expected, p.Users)
+
+	// Round trip through ToTable should keep the command
+	tableBytes, err := p.ToTable()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, policy.FromTable(tableBytes, "test-path").Users)
+
+	// Adding an allowed principal must not extend an entry restricted to a
+	// command
+	p = policy.FromTable(input, "test-path")
+	p.AddAllowedPrincipal("admin", "alice@example.com", "https://example.com")
+	assert.Equal(t, expected[0], p.Users[0])
+	assert.Equal(t, []string{"root", "admin"}, p.Users[1].Principals)
+}
+
+func TestPolicyTableHours(t *testing.T) {
+	input := []byte(`# principal identity issuer options
+dev bob@example.com https://example.com hours=Mon-Fri,09:00-17:00,TZ=America/New_York
+root bob@example.com https://example.com hours=Mon-Fri,25:00-17:00
+* mallory@example.com https://example.com deny hours=Mon-Fri,09:00-17:00
+`)
+
+	problems := &files.ConfigLog{}
+	p := policy.FromTableWithLog(input, "test-path", problems)
+	require.Len(t, p.Users, 1)
+	require.Equal(t, "bob@example.com", p.Users[0].IdentityAttribute)
+	require.Equal(t, []string{"dev"}, p.Users[0].Principals)
+	require.NotNil(t, p.Users[0].Hours)
+	require.Equal(t, "Mon-Fri,09:00-17:00,TZ=America/New_York", p.Users[0].Hours.String())
+	require.Equal(t, "America/New_York", p.Users[0].Hours.Location.String())
+
+	// Invalid hours and hours in a deny rule are reported at load time
+	require.Len(t, problems.GetProblems(), 2)
+	require.Contains(t, problems.GetProblems()[0].ErrorMessage, "invalid time 25:00")
+	require.Contains(t, problems.GetProblems()[1].ErrorMessage, "hours can not be used in a deny rule")
+
+	// Round trip through ToTable should keep the hours
+	tableBytes, err := p.ToTable()
+	require.NoError(t, err)
+	roundTrip := policy.FromTable(tableBytes, "test-path")
+	require.Len(t, roundTrip.Users, 1)
+	require.Equal(t, p.Users[0].Hours.String(), roundTrip.Users[0].Hours.String())
+
+	// Adding an allowed principal must not extend an entry restricted to hours
+	p.AddAllowedPrincipal("admin", "bob@example.com", "https://example.com")
+	require.Len(t, p.Users, 2)
+	require.Equal(t, []string{"dev"}, p.Users[0].Principals)
+	require.Nil(t, p.Users[1].Hours)
+
+	status, reason := p.CheckAllowedPrincipal("dev", "bob@example.com", "https://example.com")
+	require.Equal(t, policy.AddConflict, status)
+	require.Contains(t, reason, "only during Mon-Fri,09:00-17:00,TZ=America/New_York")
+}
+
+func TestPolicyTableExtensions(t *testing.T) {
+	input := []byte(`# principal identity issuer options
+root bob@example.com https://example.com extension=mfa@opkssh extension=role@example.com=admin
+dev bob@example.com https://example.com extension=bad!name
+* mallory@example.com https://example.com deny extension=mfa@opkssh
+ops bob@example.com https://example.com extension=mfa@opkssh extension=mfa@opkssh=yes
+`)
+
+	problems := &files.ConfigLog{}
+	p := policy.FromTableWithLog(input, "test-path", problems)
+	require.Len(t, p.Users, 1)
+	require.Equal(t, []policy.RequiredExtension{
+		{Name: "mfa@opkssh"},
+		{Name: "role@example.com", Value: "admin", MatchValue: true},
+	}, p.Users[0].Extensions)
+
+	// Invalid names, extensions in a deny rule and repeated extensions are
+	// reported at load time
+	require.Len(t, problems.GetProblems(), 3)
+	require.Contains(t, problems.GetProblems()[0].ErrorMessage, "invalid extension name (bad!name)")
+	require.Contains(t, problems.GetProblems()[1].ErrorMessage, "extension can not be used in a deny rule")
+	require.Contains(t, problems.GetProblems()[2].ErrorMessage, "extension mfa@opkssh is required more than once")
+
+	// Round trip through ToTable should keep the extensions
+	tableBytes, err := p.ToTable()
+	require.NoError(t, err)
+	roundTrip := policy.FromTable(tableBytes, "test-path")
+	require.Equal(t, p.Users, roundTrip.Users)
+
+	// Adding an allowed principal must not extend an entry that requires an
+	// extension
+	p.AddAllowedPrincipal("admin", "bob@example.com", "https://example.com")
+	require.Len(t, p.Users, 2)
+	require.Equal(t, []string{"root"}, p.Users[0].Principals)
+	require.Empty(t, p.Users[1].Extensions)
+
+	status, reason := p.CheckAllowedPrincipal("root", "bob@example.com", "https://example.com")
+	require.Equal(t, policy.AddConflict, status)
+	require.Contains(t, reason, "only with the SSH cert extension mfa@opkssh")
+}
+
+func TestPolicyTablePrincipalTemplate(t *testing.T) {
+	input := []byte(`# principal identity issuer options
+'{{localpart .email}}' *@example.com https://example.com unique
+'{{localpart .email' *@example.com https://example.com
+'{{localpart .email}}' mallory@example.com https://example.com deny
+root bob@example.com https://example.com unique
+`)
+
+	problems := &files.ConfigLog{}
+	p := policy.FromTableWithLog(input, "test-path", problems)
+	require.Len(t, p.Users, 1)
+	require.Equal(t, []string{"{{localpart .email}}"}, p.Users[0].Principals)
+	require.True(t, p.Users[0].UniquePrincipal)
+
+	// Invalid templates, templates in a deny rule and unique without a
+	// template are reported at load time
+	require.Len(t, problems.GetProblems(), 3)
+	require.Contains(t, problems.GetProblems()[0].ErrorMessage, "invalid principal template")
+	require.Contains(t, problems.GetProblems()[1].ErrorMessage, "templated principals can not be used in a deny rule")
+	require.Contains(t, problems.GetProblems()[2].ErrorMessage, "unique can only be used with a templated principal")
+
+	// Round trip through ToTable should keep the template and the option
+	tableBytes, err := p.ToTable()
+	require.NoError(t, err)
+	roundTrip := policy.FromTable(tableBytes, "test-path")
+	require.Equal(t, p.Users, roundTrip.Users)
+
+	// Adding an allowed principal must not extend an entry with a template
+	p.AddAllowedPrincipal("admin", "*@example.com", "https://example.com")
+	require.Len(t, p.Users, 2)
+	require.Equal(t, []string{"{{localpart .email}}"}, p.Users[0].Principals)
+}
+
+func TestPolicyComments(t *testing.T) {
+	input := []byte(`# principal identity issuer options
+root alice@example.com https://example.com # JIRA-123 access granted by bob
+dev alice@example.com https://example.com
+* mallory@example.com https://example.com deny #offboarded
+`)
+
+	p := policy.FromTable(input, "test-path")
+	expected := []policy.User{
+		{
+			IdentityAttribute: "alice@example.com",
+			Principals:        []string{"root"},
+			Issuer:            "https://example.com",
+			Comment:           "JIRA-123 access granted by bob",
+		},
+		{
+			IdentityAttribute: "alice@example.com",
+			Principals:        []string{"dev"},
+			Issuer:            "https://example.com",
+		},
+		{
+			IdentityAttribute: "mallory@example.com",
+			Principals:        []string{"*"},
+			Issuer:            "https://example.com",
+			Deny:              true,
+			Comment:           "offboarded",
+		},
+	}
+	assert.Equal(t, expected, p.Users)
+
+	// Comments survive a round trip through ToTable
+	tableBytes, err := p.ToTable()
+	assert.NoError(t, err)
+	assert.Equal(t, "root alice@example.com https://example.com # JIRA-123 access granted by bob\n"+
+		"dev alice@example.com https://example.com\n"+
+		"\\* mallory@example.com https://example.com deny # offboarded\n", string(tableBytes))
+	assert.Equal(t, expected, policy.FromTable(tableBytes, "test-path").Users)
+
+	// A principal added with a comment is only merged into an entry with the same comment
+	p.AddAllowedPrincipalWithComment("admin", "alice@example.com", "https://example.com", "JIRA-123 access granted by bob")
+	p.AddAllowedPrincipalWithComment("ops", "alice@example.com", "https://example.com", "JIRA-456")
+	p.AddAllowedPrincipalWithComment("dev", "alice@example.com", "https://example.com", "JIRA-456")
+	assert.Equal(t, []string{"root", "admin"}, p.Users[0].Principals)
+	assert.Equal(t, []string{"dev"}, p.Users[1].Principals)
+	assert.Equal(t, policy.User{
+		IdentityAttribute: "alice@example.com",
+		Principals:        []string{"ops"},
+		Issuer:            "https://example.com",
+		Comment:           "JIRA-456",
+	}, p.Users[3])
+
+	// Remove matches on the comment and never removes deny rules
+	assert.Equal(t, 0, p.RemoveAllowedPrincipals("", "", "", "offboarded"))
+	assert.Equal(t, 2, p.RemoveAllowedPrincipals("", "", "", "JIRA-123 access granted by bob"))
+	assert.Equal(t, []policy.User{expected[1], expected[2], {
+		IdentityAttribute: "alice@example.com",
+		Principals:        []string{"ops"},
+		Issuer:            "https://example.com",
+		Comment:           "JIRA-456",
+	}}, p.Users)
+	assert.Equal(t, 1, p.RemoveAllowedPrincipals("dev", "alice@example.com", "https://example.com", ""))
+	assert.Len(t, p.Users, 2)
+}
@@ -88,6 +88,21 @@ func (l *PolicyLoader) Dump(policy *Policy, path string) error {
 	return nil
 }
 
+// DumpAtomic is like Dump but replaces the policy file at path in a single
+// step, see files.FileLoader.DumpAtomic
+func (l *PolicyLoader) DumpAtomic(policy *Policy, path string) error {
+	fileBytes, err := policy.ToTable()
+	if err != nil {
+		return err
+	}
+
+	if err := l.FileLoader.DumpAtomic(fileBytes, path); err != nil {
+		return fmt.Errorf("failed to write to policy file %s: %w", path, err)
+	}
+
+	return nil
+}
+
 // NewSystemPolicyLoader returns an opkssh policy loader that uses the os library to
 // read/write system policy from/to the filesystem.
 func NewSystemPolicyLoader() *SystemPolicyLoader {
@@ -182,12 +197,17 @@ func (h *HomePolicyLoader) LoadHomePolicy(username string, skipInvalidEntries bo
 		// from.
 		validUserPolicy := new(Policy)
 		for _, user := range policy.Users {
-			if slices.Contains(user.Principals, username) {
-				// Build clean entry that only gives access to username
+			if slices.Contains(user.Principals, username) || (user.Deny && slices.Contains(user.Principals, AnyPrincipal)) {
+				// Build clean entry that only gives (or denies) access to
+				// username, keeping the restrictions it places on that access
 				validUserPolicy.Users = append(validUserPolicy.Users, User{
 					IdentityAttribute: user.IdentityAttribute,
 					Principals:        []string{username},
 					Issuer:            user.Issuer,
+					Deny:              user.Deny,
+					Command:           user.Command,
+					Hours:             user.Hours,
+					Extensions:        user.Extensions,
 				})
 			}
 		}
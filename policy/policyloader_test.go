@@ -209,6 +209,18 @@ func TestLoadUserPolicy_Success_SkipInvalidEntries(t *testing.T) {
 				Principals:        []string{ValidUser.Username, "test", "test2"},
 				Issuer:            "https://example.com",
 			},
+			{
+				IdentityAttribute: "mallory@example.com",
+				Principals:        []string{policy.AnyPrincipal},
+				Issuer:            "https://example.com",
+				Deny:              true,
+			},
+			{
+				IdentityAttribute: "eve@example.com",
+				Principals:        []string{"test"},
+				Issuer:            "https://example.com",
+				Deny:              true,
+			},
 		},
 	}
 	// Expect only user statements that contain ValidUser.Username
@@ -224,6 +236,12 @@ func TestLoadUserPolicy_Success_SkipInvalidEntries(t *testing.T) {
 				Principals:        []string{ValidUser.Username},
 				Issuer:            "https://example.com",
 			},
+			{
+				IdentityAttribute: "mallory@example.com",
+				Principals:        []string{ValidUser.Username},
+				Issuer:            "https://example.com",
+				Deny:              true,
+			},
 		},
 	}
 	testPolicyFile, err := testPolicy.ToTable()
@@ -238,6 +256,69 @@ func TestLoadUserPolicy_Success_SkipInvalidEntries(t *testing.T) {
 	require.Equal(t, expectedPath, gotPath)
 }
 
+func TestLoadUserPolicy_SkipInvalidEntriesKeepsCommand(t *testing.T) {
+	// Test that the clean entries built for a home policy keep the command
+	// the entry restricts the user to
+	t.Parallel()
+
+	mockUserLookup := &MockUserLookup{User: ValidUser}
+	policyLoader := NewTestHomePolicyLoader(afero.NewMemMapFs(), mockUserLookup)
+	mockFs := policyLoader.FileLoader.Fs
+	testPolicy := &policy.Policy{
+		Users: []policy.User{
+			{
+				IdentityAttribute: "alice@example.com",
+				Principals:        []string{"test", ValidUser.Username},
+				Issuer:            "https://example.com",
+				Command:           "/usr/bin/rsync --server --sender .",
+			},
+		},
+	}
+	testPolicyFile, err := testPolicy.ToTable()
+	require.NoError(t, err)
+	err = afero.WriteFile(mockFs, path.Join(ValidUser.HomeDir, ".opk", "auth_id"), testPolicyFile, 0600)
+	require.NoError(t, err)
+
+	gotPolicy, _, err := policyLoader.LoadHomePolicy(ValidUser.Username, true)
+	require.NoError(t, err)
+	require.Len(t, gotPolicy.Users, 1)
+	require.Equal(t, []string{ValidUser.Username}, gotPolicy.Users[0].Principals)
+	require.Equal(t, "/usr/bin/rsync --server --sender .", gotPolicy.Users[0].Command)
+}
+
+func TestLoadUserPolicy_SkipInvalidEntriesKeepsHours(t *testing.T) {
+	// Test that the clean entries built for a home policy keep the hours the
+	// entry allows access during
+	t.Parallel()
+
+	mockUserLookup := &MockUserLookup{User: ValidUser}
+	policyLoader := NewTestHomePolicyLoader(afero.NewMemMapFs(), mockUserLookup)
+	mockFs := policyLoader.FileLoader.Fs
+	businessHours, err := policy.ParseSchedule("Mon-Fri,09:00-17:00,TZ=America/New_York")
+	require.NoError(t, err)
+	testPolicy := &policy.Policy{
+		Users: []policy.User{
+			{
+				IdentityAttribute: "alice@example.com",
+				Principals:        []string{"test", ValidUser.Username},
+				Issuer:            "https://example.com",
+				Hours:             businessHours,
+			},
+		},
+	}
+	testPolicyFile, err := testPolicy.ToTable()
+	require.NoError(t, err)
+	err = afero.WriteFile(mockFs, path.Join(ValidUser.HomeDir, ".opk", "auth_id"), testPolicyFile, 0600)
+	require.NoError(t, err)
+
+	gotPolicy, _, err := policyLoader.LoadHomePolicy(ValidUser.Username, true)
+	require.NoError(t, err)
+	require.Len(t, gotPolicy.Users, 1)
+	require.Equal(t, []string{ValidUser.Username}, gotPolicy.Users[0].Principals)
+	require.NotNil(t, gotPolicy.Users[0].Hours)
+	require.Equal(t, businessHours.String(), gotPolicy.Users[0].Hours.String())
+}
+
 func TestLoadPolicyAtPath_FileMissing(t *testing.T) {
 	// Test that LoadPolicyAtPath returns an error when the file cannot be
 	// found at the specified path
@@ -372,3 +453,39 @@ func TestDump_Success(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expectedContents, gotContents)
 }
+
+func TestDumpAtomic_Success(t *testing.T) {
+	// Test that DumpAtomic replaces an existing policy file and leaves no
+	// temporary file behind
+	t.Parallel()
+
+	mockUserLookup := &MockUserLookup{User: ValidUser}
+	testPolicy := &policy.Policy{
+		Users: []policy.User{
+			{
+				IdentityAttribute: "alice@example.com",
+				Principals:        []string{"test"},
+				Issuer:            "https://example.com",
+			},
+		},
+	}
+	expectedContents, err := testPolicy.ToTable()
+	require.NoError(t, err)
+	policyLoader := NewTestSystemPolicyLoader(afero.NewMemMapFs(), mockUserLookup)
+	mockFs := policyLoader.FileLoader.Fs
+	err = afero.WriteFile(mockFs, policy.SystemDefaultPolicyPath, []byte("root bob@example.com https://example.com\n"), 0600)
+	require.NoError(t, err)
+
+	err = policyLoader.DumpAtomic(testPolicy, policy.SystemDefaultPolicyPath)
+
+	require.NoError(t, err)
+	gotContents, err := afero.ReadFile(mockFs, policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Equal(t, expectedContents, gotContents)
+	info, err := mockFs.Stat(policy.SystemDefaultPolicyPath)
+	require.NoError(t, err)
+	require.Equal(t, files.ModeSystemPerms, info.Mode().Perm())
+	entries, err := afero.ReadDir(mockFs, path.Dir(policy.SystemDefaultPolicyPath))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
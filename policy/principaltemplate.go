@@ -0,0 +1,152 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"golang.org/x/exp/slices"
+)
+
+// UniquePrincipalOption is the policy row option that makes an entry with a
+// templated principal only grant the principal it derives if the policy can
+// not grant that principal to anyone else
+const UniquePrincipalOption = "unique"
+
+// PrincipalTemplateFuncs are the functions available in principal templates,
+// both the templated principals of the policy and default_principal in the
+// client config
+var PrincipalTemplateFuncs = template.FuncMap{
+	// localpart returns the part of an email address before the @
+	"localpart": func(email string) string {
+		local, _, _ := strings.Cut(email, "@")
+		return local
+	},
+	"lower": strings.ToLower,
+}
+
+// IsPrincipalTemplate returns true if the principal of a policy entry is a
+// template, such as {{localpart .email}}, giving the principal for each
+// identity from the claims in its ID Token
+func IsPrincipalTemplate(principal string) bool {
+	return strings.Contains(principal, "{{")
+}
+
+// ParsePrincipalTemplate parses a principal template. Templates use Go
+// template syntax with the ID Token claims as the data. Referencing a claim
+// the ID Token does not have is an error rather than an empty principal.
+func ParsePrincipalTemplate(tmpl string) (*template.Template, error) {
+	t, err := template.New("principal").Funcs(PrincipalTemplateFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid principal template %q: %w", tmpl, err)
+	}
+	return t, nil
+}
+
+// templateClaims returns the claims principal templates are executed on. An
+// email the OP has not verified is left out, so that templates using it
+// derive nothing rather than a principal anyone could pick.
+func (c *checkedClaims) templateClaims() map[string]any {
+	if !c.emailUnverified {
+		return c.raw
+	}
+	claims := make(map[string]any, len(c.raw))
+	for name, value := range c.raw {
+		if name != "email" {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// derivesPrincipal returns true if one of the templated principals of the
+// entry gives principal for the claims
+func (u *User) derivesPrincipal(claims map[string]any, principal string) bool {
+	for _, userPrincipal := range u.Principals {
+		if !IsPrincipalTemplate(userPrincipal) {
+			continue
+		}
+		t, err := ParsePrincipalTemplate(userPrincipal)
+		if err != nil {
+			continue
+		}
+		var derived strings.Builder
+		// An ID Token without the claims the template uses derives nothing
+		if err := t.Execute(&derived, claims); err != nil {
+			continue
+		}
+		if derived.String() == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// isSingleIdentity returns true if the entry matches exactly one identity, an
+// email or a sub, rather than a group of identities
+func (u *User) isSingleIdentity() bool {
+	return !strings.HasPrefix(u.IdentityAttribute, oidcClaimPrefix) && !strings.HasPrefix(u.IdentityAttribute, "*@")
+}
+
+// checkPrincipalCollision returns an error if principal, derived for the
+// identity in claims by the templated principal of entry, could also be
+// granted to a different identity, either by entry itself or by another
+// entry in the policy. Such a collision, e.g. a@example.com and a@example.org
+// both deriving the principal a, would let two people log in to the same
+// account.
+func checkPrincipalCollision(policy *Policy, claims *checkedClaims, issuers []string, entry *User, principal string) error {
+	switch {
+	case strings.HasPrefix(entry.IdentityAttribute, oidcClaimPrefix):
+		return fmt.Errorf("the entry matches a group of identities, any of whom could derive %s", principal)
+	case strings.HasPrefix(entry.IdentityAttribute, "*@"):
+		// Emails are unique at a domain, so the local part of the email is
+		// unique among the identities the entry matches
+		localPart, _, _ := strings.Cut(claims.Email, "@")
+		if !(principal == localPart || (!claims.caseSensitiveLocalPart && strings.EqualFold(principal, localPart))) {
+			return fmt.Errorf("%s is not the local part of %s, so others at %s could derive it", principal, claims.Email, entry.IdentityAttribute[2:])
+		}
+	}
+
+	for i := range policy.Users {
+		other := &policy.Users[i]
+		if other == entry || other.Deny {
+			continue
+		}
+		if !slices.Contains(other.Principals, principal) && !other.hasPrincipalTemplate() {
+			continue
+		}
+		// Entries for this identity alone can't give its principal to anyone else
+		if other.isSingleIdentity() && slices.Contains(issuers, other.Issuer) && validateClaim(claims, other, true) {
+			continue
+		}
+		return fmt.Errorf("the policy entry for %s (issuer=%s) could also grant %s", other.IdentityAttribute, other.Issuer, principal)
+	}
+	return nil
+}
+
+// hasPrincipalTemplate returns true if any principal of the entry is a
+// template
+func (u *User) hasPrincipalTemplate() bool {
+	for _, principal := range u.Principals {
+		if IsPrincipalTemplate(principal) {
+			return true
+		}
+	}
+	return false
+}
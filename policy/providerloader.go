@@ -18,6 +18,7 @@ package policy
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 
 	"github.com/openpubkey/openpubkey/providers"
@@ -27,11 +28,19 @@ import (
 )
 
 type ProvidersRow struct {
-	Issuer           string
+	Issuer string
+	// FallbackIssuers are also accepted for this provider, e.g. while
+	// migrating from an old issuer to Issuer
+	FallbackIssuers  []string
 	ClientID         string
 	ExpirationPolicy string
 }
 
+// Issuers returns the primary issuer followed by any fallback issuers
+func (p ProvidersRow) Issuers() []string {
+	return append([]string{p.Issuer}, p.FallbackIssuers...)
+}
+
 func (p ProvidersRow) GetExpirationPolicy() (verifier.ExpirationPolicy, error) {
 	switch p.ExpirationPolicy {
 	case "24h":
@@ -52,59 +61,124 @@ func (p ProvidersRow) GetExpirationPolicy() (verifier.ExpirationPolicy, error) {
 }
 
 func (p ProvidersRow) ToString() string {
-	return p.Issuer + " " + p.ClientID + " " + p.ExpirationPolicy
+	return strings.Join(p.Issuers(), ",") + " " + p.ClientID + " " + p.ExpirationPolicy
 }
 
 type ProviderPolicy struct {
 	rows []ProvidersRow
+	// discoveryURLs maps issuers to the URL their discovery document is
+	// fetched from, see SetDiscoveryURLs
+	discoveryURLs map[string]string
 }
 
 func (p *ProviderPolicy) AddRow(row ProvidersRow) {
 	p.rows = append(p.rows, row)
 }
 
+// IssuersFor returns every issuer of the provider that issuer belongs to,
+// including issuer itself. If issuer is not configured it is returned alone.
+func (p *ProviderPolicy) IssuersFor(issuer string) []string {
+	for _, row := range p.rows {
+		for _, rowIssuer := range row.Issuers() {
+			if rowIssuer == issuer {
+				return row.Issuers()
+			}
+		}
+	}
+	return []string{issuer}
+}
+
+// SetDiscoveryURLs makes the verifiers created for the providers fetch the
+// discovery document of each issuer in discoveryURLs from the URL it maps
+// to, for OPs that do not serve it at the conventional location relative to
+// the issuer. The issuer in the document must still match.
+func (p *ProviderPolicy) SetDiscoveryURLs(discoveryURLs map[string]string) error {
+	for issuer, discoveryURL := range discoveryURLs {
+		if err := ValidateDiscoveryURL(discoveryURL); err != nil {
+			return fmt.Errorf("issuer %s: %w", issuer, err)
+		}
+	}
+	p.discoveryURLs = discoveryURLs
+	return nil
+}
+
+// httpClientFor returns httpClient, or if a discovery URL is set for issuer
+// a copy of it that fetches the discovery document from there
+func (p *ProviderPolicy) httpClientFor(issuer string, httpClient *http.Client) *http.Client {
+	discoveryURL, ok := p.discoveryURLs[issuer]
+	if !ok {
+		return httpClient
+	}
+	discoveryClient, err := WithDiscoveryURL(httpClient, issuer, discoveryURL)
+	if err != nil {
+		// SetDiscoveryURLs only accepts valid URLs
+		return httpClient
+	}
+	return discoveryClient
+}
+
+// CreateVerifier returns a PK Token verifier for the providers. Fetching the
+// discovery document and JWKS of an issuer is retried briefly, see
+// newJwksHttpClient.
 func (p *ProviderPolicy) CreateVerifier() (*verifier.Verifier, error) {
+	httpClient := newJwksHttpClient()
+	return p.createVerifier(func(issuer string, clientID string) verifier.ProviderVerifier {
+		return newProviderVerifier(issuer, clientID, p.httpClientFor(issuer, httpClient))
+	})
+}
+
+// newProviderVerifier returns the verifier for ID Tokens from issuer. If
+// httpClient is nil, http.DefaultClient is used to fetch the issuer's JWKS.
+func newProviderVerifier(issuer string, clientID string, httpClient *http.Client) verifier.ProviderVerifier {
+	// TODO: We should handle this issuer matching in a more generic way
+	// oidc.local and localhost: are a test issuers
+	if issuer == "https://accounts.google.com" ||
+		strings.HasPrefix(issuer, "http://oidc.local") ||
+		strings.HasPrefix(issuer, "http://localhost:") {
+
+		opts := providers.GetDefaultGoogleOpOptions()
+		opts.Issuer = issuer
+		opts.ClientID = clientID
+		opts.HttpClient = httpClient
+		return providers.NewGoogleOpWithOptions(opts)
+	} else if strings.HasPrefix(issuer, "https://login.microsoftonline.com") {
+		opts := providers.GetDefaultAzureOpOptions()
+		opts.Issuer = issuer
+		opts.ClientID = clientID
+		opts.HttpClient = httpClient
+		return providers.NewAzureOpWithOptions(opts)
+	} else if issuer == "https://gitlab.com" {
+		opts := providers.GetDefaultGitlabOpOptions()
+		opts.Issuer = issuer
+		opts.ClientID = clientID
+		opts.HttpClient = httpClient
+		return providers.NewGitlabOpWithOptions(opts)
+	} else {
+		opts := providers.GetDefaultGoogleOpOptions()
+		opts.Issuer = issuer
+		opts.ClientID = clientID
+		opts.HttpClient = httpClient
+		return providers.NewGoogleOpWithOptions(opts)
+	}
+}
+
+func (p *ProviderPolicy) createVerifier(newVerifier func(issuer string, clientID string) verifier.ProviderVerifier) (*verifier.Verifier, error) {
 	pvs := []verifier.ProviderVerifier{}
 	var expirationPolicy verifier.ExpirationPolicy
 	var err error
 	for _, row := range p.rows {
-		var provider verifier.ProviderVerifier
-		// TODO: We should handle this issuer matching in a more generic way
-		// oidc.local and localhost: are a test issuers
-		if row.Issuer == "https://accounts.google.com" ||
-			strings.HasPrefix(row.Issuer, "http://oidc.local") ||
-			strings.HasPrefix(row.Issuer, "http://localhost:") {
-
-			opts := providers.GetDefaultGoogleOpOptions()
-			opts.Issuer = row.Issuer
-			opts.ClientID = row.ClientID
-			provider = providers.NewGoogleOpWithOptions(opts)
-		} else if strings.HasPrefix(row.Issuer, "https://login.microsoftonline.com") {
-			opts := providers.GetDefaultAzureOpOptions()
-			opts.Issuer = row.Issuer
-			opts.ClientID = row.ClientID
-			provider = providers.NewAzureOpWithOptions(opts)
-		} else if row.Issuer == "https://gitlab.com" {
-			opts := providers.GetDefaultGitlabOpOptions()
-			opts.Issuer = row.Issuer
-			opts.ClientID = row.ClientID
-			provider = providers.NewGitlabOpWithOptions(opts)
-		} else {
-			opts := providers.GetDefaultGoogleOpOptions()
-			opts.Issuer = row.Issuer
-			opts.ClientID = row.ClientID
-			provider = providers.NewGoogleOpWithOptions(opts)
-		}
-
 		expirationPolicy, err = row.GetExpirationPolicy()
 		if err != nil {
 			return nil, err
 		}
-		pv := verifier.ProviderVerifierExpires{
-			ProviderVerifier: provider,
-			Expiration:       expirationPolicy,
+		// Fallback issuers are verified exactly like the primary issuer
+		for _, issuer := range row.Issuers() {
+			pv := verifier.ProviderVerifierExpires{
+				ProviderVerifier: newVerifier(issuer, row.ClientID),
+				Expiration:       expirationPolicy,
+			}
+			pvs = append(pvs, pv)
 		}
-		pvs = append(pvs, pv)
 	}
 
 	if len(pvs) == 0 {
@@ -155,7 +229,7 @@ func (o *ProvidersFileLoader) LoadProviderPolicy(path string) (*ProviderPolicy,
 func (o ProvidersFileLoader) ToTable(opPolicies ProviderPolicy) files.Table {
 	table := files.Table{}
 	for _, opPolicy := range opPolicies.rows {
-		table.AddRow(opPolicy.Issuer, opPolicy.ClientID, opPolicy.ExpirationPolicy)
+		table.AddRow(strings.Join(opPolicy.Issuers(), ","), opPolicy.ClientID, opPolicy.ExpirationPolicy)
 	}
 	return table
 }
@@ -163,6 +237,12 @@ func (o ProvidersFileLoader) ToTable(opPolicies ProviderPolicy) files.Table {
 // FromTable decodes whitespace delimited input into policy.Policy
 // Path is passed only for logging purposes
 func (o *ProvidersFileLoader) FromTable(input []byte, path string) *ProviderPolicy {
+	return o.FromTableWithLog(input, path, files.ConfigProblems())
+}
+
+// FromTableWithLog is like FromTable but records problems with the rows it
+// skips in problems rather than the global config log
+func (o *ProvidersFileLoader) FromTableWithLog(input []byte, path string, problems *files.ConfigLog) *ProviderPolicy {
 	table := files.NewTable(input)
 	policy := &ProviderPolicy{
 		rows: []ProvidersRow{},
@@ -177,11 +257,21 @@ func (o *ProvidersFileLoader) FromTable(input []byte, path string) *ProviderPoli
 				ErrorMessage:        fmt.Sprintf("wrong number of arguments (expected=3, got=%d)", len(row)),
 				Source:              "providers policy file",
 			}
-			files.ConfigProblems().RecordProblem(configProblem)
+			problems.RecordProblem(configProblem)
 			continue
 		}
+		// The issuer column may list fallback issuers after the primary
+		// issuer, separated by commas
+		issuers := strings.Split(row[0], ",")
+		var fallbackIssuers []string
+		for _, issuer := range issuers[1:] {
+			if issuer != "" {
+				fallbackIssuers = append(fallbackIssuers, issuer)
+			}
+		}
 		policyRow := ProvidersRow{
-			Issuer:           row[0],
+			Issuer:           issuers[0],
+			FallbackIssuers:  fallbackIssuers,
 			ClientID:         row[1],
 			ExpirationPolicy: row[2], //TODO: Validate this so that we can determine the line number that has the error
 		}
@@ -19,9 +19,14 @@ package policy
 // Note: These tests were originally generated by o3-mini and then heavily modified
 
 import (
+	"context"
 	"strings"
 	"testing"
 
+	"github.com/openpubkey/openpubkey/client"
+	"github.com/openpubkey/openpubkey/pktoken"
+	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/providers/mocks"
 	"github.com/openpubkey/openpubkey/verifier"
 	"github.com/stretchr/testify/require"
 )
@@ -175,3 +180,108 @@ func TestProvidersFileLoader_ToTable(t *testing.T) {
 		t.Error("second row in table does not match expected values")
 	}
 }
+
+func TestProvidersFileLoader_FallbackIssuers(t *testing.T) {
+	input := []byte("https://new.example.com,https://old.example.com test-client 24h\n" +
+		"https://accounts.google.com test-google 24h\n")
+	loader := ProvidersFileLoader{}
+	policy := loader.FromTable(input, "dummy-path")
+	require.Equal(t, 2, len(policy.rows))
+	require.Equal(t, "https://new.example.com", policy.rows[0].Issuer)
+	require.Equal(t, []string{"https://old.example.com"}, policy.rows[0].FallbackIssuers)
+	require.Nil(t, policy.rows[1].FallbackIssuers)
+
+	require.Equal(t, []string{"https://new.example.com", "https://old.example.com"}, policy.IssuersFor("https://old.example.com"))
+	require.Equal(t, []string{"https://new.example.com", "https://old.example.com"}, policy.IssuersFor("https://new.example.com"))
+	require.Equal(t, []string{"https://accounts.google.com"}, policy.IssuersFor("https://accounts.google.com"))
+	require.Equal(t, []string{"https://unknown.example.com"}, policy.IssuersFor("https://unknown.example.com"))
+
+	require.Equal(t, string(input), policy.ToString())
+	require.Equal(t, string(input), string(loader.ToTable(*policy).ToBytes()))
+}
+
+func TestProviderPolicy_CreateVerifier_FallbackIssuers(t *testing.T) {
+	clientID := "test_client_id"
+	backends := map[string]*mocks.MockProviderBackend{}
+	pkts := map[string]*pktoken.PKToken{}
+	for _, issuer := range []string{"https://new.example.com", "https://old.example.com", "https://other.example.com"} {
+		opts := providers.DefaultMockProviderOpts()
+		opts.Issuer = issuer
+		opts.ClientID = clientID
+		op, backend, idtTemplate, err := providers.NewMockProvider(opts)
+		require.NoError(t, err)
+		idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+		backends[issuer] = backend
+
+		opkClient, err := client.New(op)
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(context.Background())
+		require.NoError(t, err)
+		pkts[issuer] = pkt
+	}
+
+	policy := &ProviderPolicy{}
+	policy.AddRow(ProvidersRow{
+		Issuer:           "https://new.example.com",
+		FallbackIssuers:  []string{"https://old.example.com"},
+		ClientID:         clientID,
+		ExpirationPolicy: "24h",
+	})
+	ver, err := policy.createVerifier(func(issuer string, clientID string) verifier.ProviderVerifier {
+		backend, ok := backends[issuer]
+		require.True(t, ok, "unexpected issuer %s", issuer)
+		return providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{
+			CommitType:        providers.CommitTypesEnum.NONCE_CLAIM,
+			ClientID:          clientID,
+			DiscoverPublicKey: backend.GetPublicKeyFinder(),
+		})
+	})
+	require.NoError(t, err)
+
+	// ID Tokens from both the new and old issuer verify
+	require.NoError(t, ver.VerifyPKToken(context.Background(), pkts["https://new.example.com"]))
+	require.NoError(t, ver.VerifyPKToken(context.Background(), pkts["https://old.example.com"]))
+
+	// ID Tokens from an issuer not listed for the provider do not
+	require.Error(t, ver.VerifyPKToken(context.Background(), pkts["https://other.example.com"]))
+}
+
+func TestProviderPolicy_CreateVerifier_SelfHostedGitlab(t *testing.T) {
+	clientID := "test_client_id"
+	backends := map[string]*mocks.MockProviderBackend{}
+	pkts := map[string]*pktoken.PKToken{}
+	for _, issuer := range []string{"https://gitlab.example.com", "https://gitlab.example.org", "https://gitlab.com"} {
+		opts := providers.DefaultMockProviderOpts()
+		opts.Issuer = issuer
+		opts.ClientID = clientID
+		op, backend, idtTemplate, err := providers.NewMockProvider(opts)
+		require.NoError(t, err)
+		idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com", "email_verified": true}
+		backends[issuer] = backend
+
+		opkClient, err := client.New(op)
+		require.NoError(t, err)
+		pkt, err := opkClient.Auth(context.Background())
+		require.NoError(t, err)
+		pkts[issuer] = pkt
+	}
+
+	providersFile := "https://gitlab.example.com " + clientID + " 24h\n"
+	policy := (&ProvidersFileLoader{}).FromTable([]byte(providersFile), "providers")
+	ver, err := policy.createVerifier(func(issuer string, clientID string) verifier.ProviderVerifier {
+		backend, ok := backends[issuer]
+		require.True(t, ok, "unexpected issuer %s", issuer)
+		return providers.NewProviderVerifier(issuer, providers.ProviderVerifierOpts{
+			CommitType:        providers.CommitTypesEnum.NONCE_CLAIM,
+			ClientID:          clientID,
+			DiscoverPublicKey: backend.GetPublicKeyFinder(),
+		})
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, ver.VerifyPKToken(context.Background(), pkts["https://gitlab.example.com"]))
+
+	// ID Tokens from another GitLab host are rejected, including gitlab.com
+	require.Error(t, ver.VerifyPKToken(context.Background(), pkts["https://gitlab.example.org"]))
+	require.Error(t, ver.VerifyPKToken(context.Background(), pkts["https://gitlab.com"]))
+}
@@ -0,0 +1,170 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Servers, such as minimal containers, may not have a time zone database
+	_ "time/tzdata"
+)
+
+// HoursOptionPrefix is the prefix of the policy row option that restricts an
+// entry to a weekly schedule, e.g. `hours=Mon-Fri,09:00-17:00,TZ=America/New_York`
+const HoursOptionPrefix = "hours="
+
+// Schedule is a weekly window of time during which a policy entry applies
+type Schedule struct {
+	// Days are the days of the week the window starts on, indexed by
+	// time.Weekday
+	Days [7]bool
+	// Start and End are the times of day the window starts and ends, as an
+	// offset from midnight. If End is not after Start the window ends on the
+	// following day.
+	Start time.Duration
+	End   time.Duration
+	// Location is the time zone Days, Start and End are in
+	Location *time.Location
+
+	// text is the schedule as written in the policy
+	text string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedule parses a comma separated schedule made up of days or ranges
+// of days such as Mon-Fri, a time range such as 09:00-17:00 and optionally
+// the time zone as TZ=America/New_York. Without days the window applies
+// every day and without a time zone the server's local time zone is used.
+// A time range that ends before it starts, such as 22:00-06:00, ends on the
+// following day.
+func ParseSchedule(text string) (*Schedule, error) {
+	schedule := &Schedule{text: text}
+	hasDays, hasTimes := false, false
+	for _, part := range strings.Split(text, ",") {
+		switch {
+		case strings.HasPrefix(part, "TZ="):
+			if schedule.Location != nil {
+				return nil, fmt.Errorf("invalid hours (%s): time zone set more than once", text)
+			}
+			name := strings.TrimPrefix(part, "TZ=")
+			// LoadLocation treats an empty name as UTC
+			location, err := time.LoadLocation(name)
+			if err != nil || name == "" {
+				return nil, fmt.Errorf("invalid hours (%s): unknown time zone %s", text, name)
+			}
+			schedule.Location = location
+		case strings.Contains(part, ":"):
+			if hasTimes {
+				return nil, fmt.Errorf("invalid hours (%s): time range set more than once", text)
+			}
+			startText, endText, ok := strings.Cut(part, "-")
+			if !ok {
+				return nil, fmt.Errorf("invalid hours (%s): time range %s must be written as HH:MM-HH:MM", text, part)
+			}
+			var err error
+			if schedule.Start, err = parseTimeOfDay(startText, false); err != nil {
+				return nil, fmt.Errorf("invalid hours (%s): %w", text, err)
+			}
+			if schedule.End, err = parseTimeOfDay(endText, true); err != nil {
+				return nil, fmt.Errorf("invalid hours (%s): %w", text, err)
+			}
+			if schedule.Start == schedule.End {
+				return nil, fmt.Errorf("invalid hours (%s): time range %s is empty", text, part)
+			}
+			hasTimes = true
+		default:
+			firstText, lastText, isRange := strings.Cut(part, "-")
+			if !isRange {
+				lastText = firstText
+			}
+			first, ok := weekdays[strings.ToLower(firstText)]
+			last, ok2 := weekdays[strings.ToLower(lastText)]
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("invalid hours (%s): unknown day %s, expected days such as Mon or Mon-Fri", text, part)
+			}
+			// Ranges such as Fri-Mon wrap around the end of the week
+			for day := first; ; day = (day + 1) % 7 {
+				schedule.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+			hasDays = true
+		}
+	}
+	if !hasTimes {
+		return nil, fmt.Errorf("invalid hours (%s): missing time range such as 09:00-17:00", text)
+	}
+	if !hasDays {
+		for day := range schedule.Days {
+			schedule.Days[day] = true
+		}
+	}
+	if schedule.Location == nil {
+		schedule.Location = time.Local
+	}
+	return schedule, nil
+}
+
+// parseTimeOfDay parses HH:MM as an offset from midnight. 24:00 is only
+// allowed as the end of a time range.
+func parseTimeOfDay(text string, isEnd bool) (time.Duration, error) {
+	hoursText, minutesText, ok := strings.Cut(text, ":")
+	hours, err := strconv.Atoi(hoursText)
+	if !ok || err != nil || len(hoursText) != 2 || len(minutesText) != 2 {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", text)
+	}
+	minutes, err := strconv.Atoi(minutesText)
+	if err != nil || minutes > 59 || hours > 24 || (hours == 24 && (minutes != 0 || !isEnd)) {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", text)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Contains returns true if t falls within the schedule. Times are compared
+// on the wall clock in the schedule's time zone, so the window follows
+// daylight saving time changes.
+func (s *Schedule) Contains(t time.Time) bool {
+	local := t.In(s.Location)
+	timeOfDay := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond())
+	today := local.Weekday()
+	if s.Start < s.End {
+		return s.Days[today] && timeOfDay >= s.Start && timeOfDay < s.End
+	}
+	// The window runs past midnight, so it is either today's window or the
+	// end of yesterday's
+	yesterday := (today + 6) % 7
+	return (s.Days[today] && timeOfDay >= s.Start) || (s.Days[yesterday] && timeOfDay < s.End)
+}
+
+// String returns the schedule as written in the policy
+func (s *Schedule) String() string {
+	return s.text
+}
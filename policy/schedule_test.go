@@ -0,0 +1,104 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package policy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openpubkey/opkssh/policy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		errorString string
+	}{
+		{name: "Weekdays with time zone", text: "Mon-Fri,09:00-17:00,TZ=America/New_York"},
+		{name: "Single days", text: "Mon,Wed,08:30-12:00"},
+		{name: "Every day", text: "00:00-24:00"},
+		{name: "Overnight", text: "Fri-Mon,22:00-06:00,TZ=UTC"},
+		{name: "Missing time range", text: "Mon-Fri", errorString: "missing time range"},
+		{name: "Two time ranges", text: "09:00-12:00,13:00-17:00", errorString: "time range set more than once"},
+		{name: "Empty time range", text: "09:00-09:00", errorString: "is empty"},
+		{name: "Bad time", text: "9:00-17:00", errorString: "invalid time 9:00"},
+		{name: "Hour out of range", text: "09:00-25:00", errorString: "invalid time 25:00"},
+		{name: "Minute out of range", text: "09:60-17:00", errorString: "invalid time 09:60"},
+		{name: "24:00 only ends a range", text: "24:00-06:00", errorString: "invalid time 24:00"},
+		{name: "Unknown day", text: "Mon-Fry,09:00-17:00", errorString: "unknown day Mon-Fry"},
+		{name: "Unknown time zone", text: "09:00-17:00,TZ=America/Gotham", errorString: "unknown time zone America/Gotham"},
+		{name: "Empty time zone", text: "09:00-17:00,TZ=", errorString: "unknown time zone"},
+		{name: "Two time zones", text: "09:00-17:00,TZ=UTC,TZ=UTC", errorString: "time zone set more than once"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := policy.ParseSchedule(tt.text)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.text, schedule.String())
+		})
+	}
+}
+
+func TestScheduleContains(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		schedule string
+		time     time.Time
+		contains bool
+	}{
+		{name: "In window", schedule: "Mon-Fri,09:00-17:00,TZ=UTC", time: time.Date(2025, 6, 4, 12, 0, 0, 0, time.UTC), contains: true},
+		{name: "Start is in window", schedule: "Mon-Fri,09:00-17:00,TZ=UTC", time: time.Date(2025, 6, 4, 9, 0, 0, 0, time.UTC), contains: true},
+		{name: "End is out of window", schedule: "Mon-Fri,09:00-17:00,TZ=UTC", time: time.Date(2025, 6, 4, 17, 0, 0, 0, time.UTC), contains: false},
+		{name: "Before window", schedule: "Mon-Fri,09:00-17:00,TZ=UTC", time: time.Date(2025, 6, 4, 8, 59, 59, 0, time.UTC), contains: false},
+		{name: "Weekend", schedule: "Mon-Fri,09:00-17:00,TZ=UTC", time: time.Date(2025, 6, 7, 12, 0, 0, 0, time.UTC), contains: false},
+		{name: "Time zone applied", schedule: "Mon-Fri,09:00-17:00,TZ=Asia/Tokyo", time: time.Date(2025, 6, 4, 1, 0, 0, 0, time.UTC), contains: true},
+		{name: "Time zone moves the day", schedule: "Mon-Fri,09:00-17:00,TZ=Asia/Tokyo", time: time.Date(2025, 6, 6, 23, 0, 0, 0, time.UTC), contains: false},
+		{name: "Overnight before midnight", schedule: "Fri,22:00-06:00,TZ=UTC", time: time.Date(2025, 6, 6, 23, 0, 0, 0, time.UTC), contains: true},
+		{name: "Overnight after midnight", schedule: "Fri,22:00-06:00,TZ=UTC", time: time.Date(2025, 6, 7, 5, 0, 0, 0, time.UTC), contains: true},
+		{name: "Overnight starts on listed days only", schedule: "Fri,22:00-06:00,TZ=UTC", time: time.Date(2025, 6, 6, 5, 0, 0, 0, time.UTC), contains: false},
+		{name: "Days wrap around the week", schedule: "Sat-Sun,00:00-24:00,TZ=UTC", time: time.Date(2025, 6, 8, 23, 59, 0, 0, time.UTC), contains: true},
+
+		// New York moved from EST (UTC-5) to EDT (UTC-4) on 2025-03-09 and
+		// back on 2025-11-02. The window follows the wall clock.
+		{name: "Before DST start in window", schedule: "Mon-Fri,09:00-17:00,TZ=America/New_York", time: time.Date(2025, 3, 7, 14, 30, 0, 0, time.UTC), contains: true},
+		{name: "Before DST start out of window", schedule: "Mon-Fri,09:00-17:00,TZ=America/New_York", time: time.Date(2025, 3, 7, 13, 30, 0, 0, time.UTC), contains: false},
+		{name: "After DST start in window", schedule: "Mon-Fri,09:00-17:00,TZ=America/New_York", time: time.Date(2025, 3, 10, 13, 30, 0, 0, time.UTC), contains: true},
+		{name: "After DST start out of window", schedule: "Mon-Fri,09:00-17:00,TZ=America/New_York", time: time.Date(2025, 3, 10, 21, 30, 0, 0, time.UTC), contains: false},
+		{name: "After DST end in window", schedule: "Mon-Fri,09:00-17:00,TZ=America/New_York", time: time.Date(2025, 11, 3, 21, 30, 0, 0, time.UTC), contains: true},
+		{name: "After DST end out of window", schedule: "Mon-Fri,09:00-17:00,TZ=America/New_York", time: time.Date(2025, 11, 3, 13, 30, 0, 0, time.UTC), contains: false},
+		{name: "Skipped hour on DST start", schedule: "Sun,02:00-03:00,TZ=America/New_York", time: time.Date(2025, 3, 9, 1, 59, 0, 0, newYork).Add(time.Minute), contains: false},
+		{name: "Repeated hour on DST end", schedule: "Sun,01:00-02:00,TZ=America/New_York", time: time.Date(2025, 11, 2, 6, 30, 0, 0, time.UTC), contains: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := policy.ParseSchedule(tt.schedule)
+			require.NoError(t, err)
+			require.Equal(t, tt.contains, schedule.Contains(tt.time))
+		})
+	}
+}
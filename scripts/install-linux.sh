@@ -62,6 +62,7 @@ RESTART_SSH=true
 OVERWRITE_ACTIVE_CONFIG=false
 LOCAL_INSTALL_FILE=""
 INSTALL_VERSION="latest"
+DRY_RUN=false
 for arg in "$@"; do
     if [[ "$arg" == "--no-home-policy" ]]; then
         HOME_POLICY=false
@@ -73,6 +74,8 @@ for arg in "$@"; do
         LOCAL_INSTALL_FILE="${arg#*=}"
     elif [[ "$arg" == --install-version=* ]]; then
         INSTALL_VERSION="${arg#*=}"
+    elif [ "$arg" == "--dry-run" ]; then
+        DRY_RUN=true
     fi
 done
 
@@ -86,6 +89,7 @@ if [[ "$1" == "--help" ]]; then
     echo "  --overwrite-config       Overwrite the currently active sshd configuration for AuthorizedKeysCommand and AuthorizedKeysCommandUser directives. This may be necessary if the script cannot create a configuration with higher priority in /etc/ssh/sshd_config.d/."
     echo "  --install-from=FILEPATH  Install using a local file"
     echo "  --install-version=VER    Install a specific version from GitHub"
+    echo "  --dry-run                Print a unified diff of the changes that would be made to the sshd configuration, /etc/opk and the sudoers file, including modes and owners, without making them"
     echo "  --help                   Display this help message"
     exit 0
 fi
@@ -110,14 +114,89 @@ if ! command -v wget &> /dev/null; then
     exit 1
 fi
 
+# The configuration is written under ROOT. For a dry run ROOT is a staging copy
+# of the files the install changes, which is compared against the real files
+# at the end instead of being applied.
+ROOT=""
+# Paths, relative to /, whose contents, modes and owners a dry run reports on
+CONFIG_PATHS="etc/opk etc/ssh/sshd_config etc/ssh/sshd_config.d ${SUDOERS_PATH#/}"
+# Owners set in the staging copy, as the group they refer to may not exist yet
+declare -A STAGED_OWNERS
+
+set_owner_and_mode() {
+    local owner="$1" mode="$2" path="$3"
+    if [ "$DRY_RUN" = true ]; then
+        STAGED_OWNERS["${path#"$ROOT"/}"]="$owner"
+    else
+        chown "$owner" "$path"
+    fi
+    chmod "$mode" "$path"
+}
+
+# Lists the mode and owner of each configuration path that exists under the
+# directory $1, one "<mode> <owner> <path>" line per path
+list_modes_and_owners() {
+    local dir="$1" path owner
+    (cd "$dir" && find $CONFIG_PATHS 2>/dev/null || true) | sort | while read -r path; do
+        owner=$(stat -c '%U:%G' "$dir/$path")
+        if [ "$dir" == "$ROOT" ] && [ -n "${STAGED_OWNERS[$path]}" ]; then
+            owner="${STAGED_OWNERS[$path]}"
+        fi
+        echo "$(stat -c '%a' "$dir/$path") $owner /$path"
+    done
+}
+
+# Prints a unified diff of the file contents, then of the modes and owners,
+# between the real configuration and the staging copy
+print_planned_changes() {
+    local path before after
+    echo "Planned changes to file contents:"
+    { (cd / && find $CONFIG_PATHS -type f 2>/dev/null || true)
+      (cd "$ROOT" && find $CONFIG_PATHS -type f 2>/dev/null || true)
+    } | sort -u | while read -r path; do
+        before="/$path"
+        after="$ROOT/$path"
+        [ -f "$before" ] || before=/dev/null
+        [ -f "$after" ] || after=/dev/null
+        diff -u --label "a/$path" --label "b/$path" "$before" "$after" || true
+    done
+    echo "Planned modes and owners:"
+    diff -U 9999 --label a --label b <(list_modes_and_owners /) <(list_modes_and_owners "$ROOT") || true
+}
+
+if [ "$DRY_RUN" = true ]; then
+    if ! command -v diff &> /dev/null; then
+        echo "Error: diff is not installed. It is needed for --dry-run."
+        exit 1
+    fi
+    echo "--dry-run option supplied, no changes will be made"
+    ROOT=$(mktemp -d)
+    trap 'rm -rf "$ROOT"' EXIT
+    mkdir -p "$ROOT/etc/ssh"
+    if [ -d "$(dirname "$SUDOERS_PATH")" ]; then
+        mkdir -p "$ROOT$(dirname "$SUDOERS_PATH")"
+    fi
+    for path in $CONFIG_PATHS; do
+        if [ -e "/$path" ]; then
+            cp -a "/$path" "$ROOT/$(dirname "$path")/"
+        fi
+    done
+fi
+
 # Checks if the group and user used by the AuthorizedKeysCommand exists if not creates it
 if ! getent group "$AUTH_CMD_GROUP" >/dev/null; then
-    groupadd --system "$AUTH_CMD_GROUP"
-    echo "Created group: $AUTH_CMD_GROUP"
+    if [ "$DRY_RUN" = true ]; then
+        echo "Would create group: $AUTH_CMD_GROUP"
+    else
+        groupadd --system "$AUTH_CMD_GROUP"
+        echo "Created group: $AUTH_CMD_GROUP"
+    fi
 fi
 
 # If the AuthorizedKeysCommand user does not exist, create it and add it to the group
-if ! getent passwd "$AUTH_CMD_USER" >/dev/null; then
+if [ "$DRY_RUN" = true ]; then
+    echo "Would ensure user $AUTH_CMD_USER exists and is in group: $AUTH_CMD_GROUP"
+elif ! getent passwd "$AUTH_CMD_USER" >/dev/null; then
     useradd -r -M -s /sbin/nologin -g "$AUTH_CMD_GROUP" "$AUTH_CMD_USER"
     echo "Created user: $AUTH_CMD_USER with group: $AUTH_CMD_GROUP"
 else
@@ -143,22 +222,34 @@ else
     fi
 
     # Download the binary
-    echo "Downloading version $INSTALL_VERSION of $BINARY_NAME from $BINARY_URL..."
-    wget -q --show-progress -O "$BINARY_NAME" "$BINARY_URL"
+    if [ "$DRY_RUN" = true ]; then
+        echo "Would download version $INSTALL_VERSION of $BINARY_NAME from $BINARY_URL"
+    else
+        echo "Downloading version $INSTALL_VERSION of $BINARY_NAME from $BINARY_URL..."
+        wget -q --show-progress -O "$BINARY_NAME" "$BINARY_URL"
+    fi
 
     BINARY_PATH="$BINARY_NAME"
 fi
 
-# Move to installation directory
-mv "$BINARY_PATH" "$INSTALL_DIR/$BINARY_NAME"
+if [ "$DRY_RUN" = true ]; then
+    echo "Would install $BINARY_NAME to $INSTALL_DIR/$BINARY_NAME"
+else
+    # Move to installation directory
+    mv "$BINARY_PATH" "$INSTALL_DIR/$BINARY_NAME"
 
-# Make the binary executable, correct permissions/ownership
-chmod +x "$INSTALL_DIR/$BINARY_NAME"
-chown root:${AUTH_CMD_GROUP} "$INSTALL_DIR/$BINARY_NAME"
-chmod 755 "$INSTALL_DIR/$BINARY_NAME"
+    # Make the binary executable, correct permissions/ownership
+    chmod +x "$INSTALL_DIR/$BINARY_NAME"
+    chown root:${AUTH_CMD_GROUP} "$INSTALL_DIR/$BINARY_NAME"
+    chmod 755 "$INSTALL_DIR/$BINARY_NAME"
+fi
 
 # Checks if SELinux is enabled and if so, ensures the context is set correctly
-if command -v getenforce >/dev/null 2>&1; then
+if [ "$DRY_RUN" = true ]; then
+    if command -v getenforce >/dev/null 2>&1 && [ "$(getenforce)" != "Disabled" ]; then
+        echo "SELinux detected. Would install the opkssh SELinux module"
+    fi
+elif command -v getenforce >/dev/null 2>&1; then
     if [ "$(getenforce)" != "Disabled" ]; then
         echo "SELinux detected. Configuring SELinux for opkssh"
         echo "  Restoring context for $INSTALL_DIR/$BINARY_NAME..."
@@ -251,65 +342,62 @@ EOF
     fi
 fi
 
-echo "Installed $BINARY_NAME to $INSTALL_DIR/$BINARY_NAME"
+if [ "$DRY_RUN" != true ]; then
+    echo "Installed $BINARY_NAME to $INSTALL_DIR/$BINARY_NAME"
+fi
 
 # Verify installation
-if command -v $INSTALL_DIR/$BINARY_NAME &> /dev/null; then
+if [ "$DRY_RUN" = true ] || command -v $INSTALL_DIR/$BINARY_NAME &> /dev/null; then
     # Setup configuration
     echo "Configuring opkssh:"
 
-    if [ ! -e "/etc/opk" ]; then
-        mkdir -p /etc/opk
-        chown root:${AUTH_CMD_GROUP} /etc/opk
-        chmod 750 /etc/opk
+    if [ ! -e "$ROOT/etc/opk" ]; then
+        mkdir -p "$ROOT/etc/opk"
+        set_owner_and_mode root:${AUTH_CMD_GROUP} 750 "$ROOT/etc/opk"
     fi
 
-    if [ ! -e "/etc/opk/policy.d" ]; then
-        mkdir -p /etc/opk/policy.d
-        chown root:${AUTH_CMD_GROUP} /etc/opk/policy.d
-        chmod 750 /etc/opk/policy.d
+    if [ ! -e "$ROOT/etc/opk/policy.d" ]; then
+        mkdir -p "$ROOT/etc/opk/policy.d"
+        set_owner_and_mode root:${AUTH_CMD_GROUP} 750 "$ROOT/etc/opk/policy.d"
     fi
 
-    if [ ! -e "/etc/opk/auth_id" ]; then
-        touch /etc/opk/auth_id
-        chown root:${AUTH_CMD_GROUP} /etc/opk/auth_id
-        chmod 640 /etc/opk/auth_id
+    if [ ! -e "$ROOT/etc/opk/auth_id" ]; then
+        touch "$ROOT/etc/opk/auth_id"
+        set_owner_and_mode root:${AUTH_CMD_GROUP} 640 "$ROOT/etc/opk/auth_id"
     fi
 
-    if [ ! -e "/etc/opk/config.yml" ]; then
-        touch /etc/opk/config.yml
-        chown root:${AUTH_CMD_GROUP} /etc/opk/config.yml
-        chmod 640 /etc/opk/config.yml
+    if [ ! -e "$ROOT/etc/opk/config.yml" ]; then
+        touch "$ROOT/etc/opk/config.yml"
+        set_owner_and_mode root:${AUTH_CMD_GROUP} 640 "$ROOT/etc/opk/config.yml"
     fi
 
-    if [ ! -e "/etc/opk/providers" ]; then
-        touch /etc/opk/providers
-        chown root:${AUTH_CMD_GROUP} /etc/opk/providers
-        chmod 640 /etc/opk/providers
+    if [ ! -e "$ROOT/etc/opk/providers" ]; then
+        touch "$ROOT/etc/opk/providers"
+        set_owner_and_mode root:${AUTH_CMD_GROUP} 640 "$ROOT/etc/opk/providers"
     fi
 
-    if [ -s /etc/opk/providers ]; then
+    if [ -s "$ROOT/etc/opk/providers" ]; then
         echo "  The providers policy file (/etc/opk/providers) is not empty. Keeping existing values"
     else
-        echo "$PROVIDER_GOOGLE" >> /etc/opk/providers
-        echo "$PROVIDER_MICROSOFT" >> /etc/opk/providers
-        echo "$PROVIDER_GITLAB" >> /etc/opk/providers
+        echo "$PROVIDER_GOOGLE" >> "$ROOT/etc/opk/providers"
+        echo "$PROVIDER_MICROSOFT" >> "$ROOT/etc/opk/providers"
+        echo "$PROVIDER_GITLAB" >> "$ROOT/etc/opk/providers"
     fi
 
     AUTH_KEY_CMD="AuthorizedKeysCommand /usr/local/bin/opkssh verify %u %k %t"
     AUTH_KEY_USER="AuthorizedKeysCommandUser ${AUTH_CMD_USER}"
 
     # Add the directives in the correct configuration, taking priorities into account
-    if ! grep -q '^Include /etc/ssh/sshd_config\.d/\*\.conf' /etc/ssh/sshd_config \
-    || ! grep -q '^AuthorizedKeysCommand\|^AuthorizedKeysCommandUser' /etc/ssh/sshd_config.d/*.conf ; then
+    if ! grep -q '^Include /etc/ssh/sshd_config\.d/\*\.conf' "$ROOT/etc/ssh/sshd_config" \
+    || ! grep -q '^AuthorizedKeysCommand\|^AuthorizedKeysCommandUser' "$ROOT"/etc/ssh/sshd_config.d/*.conf ; then
         # The directives in 'sshd_config' are active
-        sed -i '/^AuthorizedKeysCommand /s/^/#/' /etc/ssh/sshd_config
-        sed -i '/^AuthorizedKeysCommandUser /s/^/#/' /etc/ssh/sshd_config
-        echo "$AUTH_KEY_CMD" >> /etc/ssh/sshd_config
-        echo "$AUTH_KEY_USER" >> /etc/ssh/sshd_config
+        sed -i '/^AuthorizedKeysCommand /s/^/#/' "$ROOT/etc/ssh/sshd_config"
+        sed -i '/^AuthorizedKeysCommandUser /s/^/#/' "$ROOT/etc/ssh/sshd_config"
+        echo "$AUTH_KEY_CMD" >> "$ROOT/etc/ssh/sshd_config"
+        echo "$AUTH_KEY_USER" >> "$ROOT/etc/ssh/sshd_config"
     else
         # Find active configuration file with the directives we're interested in (sorted numerically)
-        active_config=$(find /etc/ssh/sshd_config.d/*.conf -exec grep -l '^AuthorizedKeysCommand\|^AuthorizedKeysCommandUser' {} \; | sort -V | head -n 1)
+        active_config=$(find "$ROOT"/etc/ssh/sshd_config.d/*.conf -exec grep -l '^AuthorizedKeysCommand\|^AuthorizedKeysCommandUser' {} \; | sort -V | head -n 1)
         opk_config_suffix="opk-ssh.conf"
 
         if [[ "$active_config" == *"$opk_config_suffix" ]] || [ "$OVERWRITE_ACTIVE_CONFIG" = true ]; then
@@ -321,20 +409,22 @@ if command -v $INSTALL_DIR/$BINARY_NAME &> /dev/null; then
         elif [[ "$(basename "$active_config")" =~ ^0+[^0-9]+ ]]; then
             # The active config starts with all zeros and is therefore the one with the
             # highest priority. We cannot add a new file with even higher priority.
-            echo "  Cannot create configuration with higher priority. Remove $active_config or rerun the script with the --overwrite-config flag to overwrite"
+            echo "  Cannot create configuration with higher priority. Remove ${active_config#"$ROOT"} or rerun the script with the --overwrite-config flag to overwrite"
             exit 1
         else
             # Create a new config file with higher priority
             prefix=$(basename "$active_config" | grep -o '^[0-9]*')
             new_prefix=$((prefix - 1))
-            new_config="/etc/ssh/sshd_config.d/${new_prefix}-$opk_config_suffix"
+            new_config="$ROOT/etc/ssh/sshd_config.d/${new_prefix}-$opk_config_suffix"
 
             echo "$AUTH_KEY_CMD" > "$new_config"
             echo "$AUTH_KEY_USER" >> "$new_config"
         fi
     fi
 
-    if [ "$RESTART_SSH" = true ]; then
+    if [ "$DRY_RUN" = true ]; then
+        echo "  Would restart SSH unless --no-sshd-restart is supplied"
+    elif [ "$RESTART_SSH" = true ]; then
         if [ "$OS_TYPE" == "debian" ]; then
             systemctl restart ssh
         elif [ "$OS_TYPE" == "redhat" ] || [ "$OS_TYPE" == "arch" ]; then
@@ -348,21 +438,27 @@ if command -v $INSTALL_DIR/$BINARY_NAME &> /dev/null; then
     fi
 
     if [ "$HOME_POLICY" = true ]; then
-        if [ ! -f "$SUDOERS_PATH" ]; then
+        if [ ! -f "$ROOT$SUDOERS_PATH" ]; then
             echo "  Creating sudoers file at $SUDOERS_PATH..."
-            touch "$SUDOERS_PATH"
-            chmod 440 "$SUDOERS_PATH"
+            touch "$ROOT$SUDOERS_PATH"
+            chmod 440 "$ROOT$SUDOERS_PATH"
         fi
         SUDOERS_RULE_READ_HOME="$AUTH_CMD_USER ALL=(ALL) NOPASSWD: /usr/local/bin/opkssh readhome *"
-        if ! grep -qxF "$SUDOERS_RULE_READ_HOME" "$SUDOERS_PATH"; then
+        if ! grep -qxF "$SUDOERS_RULE_READ_HOME" "$ROOT$SUDOERS_PATH"; then
             echo "  Adding sudoers rule for $AUTH_CMD_USER..."
-            echo "# This allows opkssh to call opkssh readhome <username> to read the user's policy file in /home/<username>/auth_id" >> "$SUDOERS_PATH"
-            echo "$SUDOERS_RULE_READ_HOME" >> "$SUDOERS_PATH"
+            echo "# This allows opkssh to call opkssh readhome <username> to read the user's policy file in /home/<username>/auth_id" >> "$ROOT$SUDOERS_PATH"
+            echo "$SUDOERS_RULE_READ_HOME" >> "$ROOT$SUDOERS_PATH"
         fi
     else
         echo "  Skipping sudoers configuration as it is only needed for home policy (--no-home-policy option supplied)"
     fi
 
+    if [ "$DRY_RUN" = true ]; then
+        print_planned_changes
+        echo "Dry run complete, no changes were made"
+        exit 0
+    fi
+
     touch /var/log/opkssh.log
     chown root:${AUTH_CMD_GROUP} /var/log/opkssh.log
     chmod 660 /var/log/opkssh.log
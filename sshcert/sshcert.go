@@ -17,10 +17,13 @@
 package sshcert
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwk"
@@ -33,7 +36,115 @@ type SshCertSmuggler struct {
 	SshCert *ssh.Certificate
 }
 
-func New(pkt *pktoken.PKToken, principals []string) (*SshCertSmuggler, error) {
+// CertOption customizes the SSH certificate created by New before it is signed
+type CertOption func(cert *ssh.Certificate) error
+
+// WithCriticalOption sets a critical option on the SSH certificate
+func WithCriticalOption(name string, value string) CertOption {
+	return func(cert *ssh.Certificate) error {
+		if cert.CriticalOptions == nil {
+			cert.CriticalOptions = map[string]string{}
+		}
+		cert.CriticalOptions[name] = value
+		return nil
+	}
+}
+
+// WithKeyId sets the key ID of the SSH certificate, which sshd logs when the
+// certificate is used. The default key ID is the email in the ID Token.
+func WithKeyId(keyId string) CertOption {
+	return func(cert *ssh.Certificate) error {
+		cert.KeyId = keyId
+		return nil
+	}
+}
+
+// IssuerKeyId returns a key ID made up of the email, or the sub if the ID
+// Token has no email, and the issuer of the PK Token, so that the OP that
+// minted a certificate is recorded in sshd's logs. The key ID is not
+// verified by opkssh verify and must not be used to make security decisions.
+func IssuerKeyId(pkt *pktoken.PKToken) (string, error) {
+	var claims struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(pkt.Payload, &claims); err != nil {
+		return "", err
+	}
+	identity := claims.Email
+	if identity == "" {
+		identity = claims.Subject
+	}
+	return identity + " " + claims.Issuer, nil
+}
+
+// WithSourceAddress sets the source-address critical option on the SSH
+// certificate so that the SSH server only accepts the certificate from the
+// supplied comma separated list of addresses or CIDR ranges.
+func WithSourceAddress(sourceAddress string) CertOption {
+	return func(cert *ssh.Certificate) error {
+		if err := ValidateSourceAddress(sourceAddress); err != nil {
+			return err
+		}
+		return WithCriticalOption("source-address", sourceAddress)(cert)
+	}
+}
+
+// ValidateSourceAddress checks that sourceAddress is a comma separated list
+// of IP addresses or CIDR ranges as expected by the source-address critical option
+func ValidateSourceAddress(sourceAddress string) error {
+	if sourceAddress == "" {
+		return fmt.Errorf("source-address must not be empty")
+	}
+	for _, addr := range strings.Split(sourceAddress, ",") {
+		if strings.Contains(addr, "/") {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return fmt.Errorf("invalid CIDR (%s) in source-address: %w", addr, err)
+			}
+		} else if net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid IP address (%s) in source-address", addr)
+		}
+	}
+	return nil
+}
+
+// pktExtension is the extension of the SSH certificate that holds the PK Token
+const pktExtension = "openpubkey-pkt"
+
+// WithExtension sets an extension on the SSH certificate. The SSH server
+// ignores extensions it does not recognize, so extensions can carry values for
+// other consumers of the certificate. The extension holding the PK Token can
+// not be replaced.
+func WithExtension(name string, value string) CertOption {
+	return func(cert *ssh.Certificate) error {
+		if err := ValidateExtensionName(name); err != nil {
+			return err
+		}
+		cert.Extensions[name] = value
+		return nil
+	}
+}
+
+// ValidateExtensionName checks that name can be used as the name of an SSH
+// certificate extension. Names may only contain ASCII letters, digits and
+// the characters -_.@, custom extensions should use the name@domain form.
+func ValidateExtensionName(name string) error {
+	if name == "" {
+		return fmt.Errorf("extension name must not be empty")
+	}
+	if name == pktExtension {
+		return fmt.Errorf("extension %s is reserved for the PK Token", pktExtension)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.@", c)) {
+			return fmt.Errorf("invalid extension name (%s), names may only contain letters, digits and -_.@", name)
+		}
+	}
+	return nil
+}
+
+func New(pkt *pktoken.PKToken, principals []string, opts ...CertOption) (*SshCertSmuggler, error) {
 
 	// TODO: assumes email exists in ID Token,
 	// this will break for OPs like Azure that do not have email as a claim
@@ -71,6 +182,11 @@ func New(pkt *pktoken.PKToken, principals []string) (*SshCertSmuggler, error) {
 			},
 		},
 	}
+	for _, opt := range opts {
+		if err := opt(sshSmuggler.SshCert); err != nil {
+			return nil, err
+		}
+	}
 	return &sshSmuggler, nil
 }
 
@@ -135,8 +251,11 @@ func (s *SshCertSmuggler) VerifySshPktCert(ctx context.Context, pktVerifier veri
 	}
 	upk := cic.PublicKey()
 
-	cryptoCertKey := (s.SshCert.Key.(ssh.CryptoPublicKey)).CryptoPublicKey()
-	jwkCertKey, err := jwk.FromRaw(cryptoCertKey)
+	certKey, ok := s.SshCert.Key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key in certificate is of an unsupported type (%s)", s.SshCert.Key.Type())
+	}
+	jwkCertKey, err := jwk.FromRaw(certKey.CryptoPublicKey())
 	if err != nil {
 		return nil, err
 	}
@@ -148,6 +267,24 @@ func (s *SshCertSmuggler) VerifySshPktCert(ctx context.Context, pktVerifier veri
 	}
 }
 
+// VerifySelfSigned checks that the cert is signed by its own public key. As
+// VerifySshPktCert checks that this public key is the key bound in the PK
+// Token, this ensures the cert can not pair a PK Token with a different
+// signing key.
+func (s *SshCertSmuggler) VerifySelfSigned() error {
+	if s.SshCert.SignatureKey == nil || s.SshCert.Signature == nil {
+		return fmt.Errorf("certificate is not signed")
+	}
+	if !bytes.Equal(s.SshCert.SignatureKey.Marshal(), s.SshCert.Key.Marshal()) {
+		return fmt.Errorf("certificate is signed by a key (%s) other than the public key in the certificate (%s)",
+			ssh.FingerprintSHA256(s.SshCert.SignatureKey), ssh.FingerprintSHA256(s.SshCert.Key))
+	}
+	if err := s.VerifyCaSig(s.SshCert.Key); err != nil {
+		return fmt.Errorf("certificate signature does not verify with the public key in the certificate: %w", err)
+	}
+	return nil
+}
+
 func sshPubkeyFromPKT(pkt *pktoken.PKToken) (ssh.PublicKey, error) {
 	cic, err := pkt.GetCicValues()
 	if err != nil {
@@ -24,10 +24,12 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/openpubkey/openpubkey/client"
 	"github.com/openpubkey/openpubkey/pktoken"
 	"github.com/openpubkey/openpubkey/providers"
+	"github.com/openpubkey/openpubkey/util"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 )
@@ -169,3 +171,148 @@ func TestSshCertCreation(t *testing.T) {
 		t.Error(fmt.Errorf("expected upk to be equal to the value in sshCert.Key"))
 	}
 }
+
+func TestVerifySelfSigned(t *testing.T) {
+	t.Parallel()
+
+	alg := jwa.ES256
+	signer, err := util.GenKeyPair(alg)
+	require.NoError(t, err)
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	client, err := client.New(op, client.WithSigner(signer, alg))
+	require.NoError(t, err)
+	pkt, err := client.Auth(context.Background())
+	require.NoError(t, err)
+
+	cert, err := New(pkt, []string{})
+	require.NoError(t, err)
+	require.ErrorContains(t, cert.VerifySelfSigned(), "certificate is not signed")
+
+	// Signed by a CA key rather than the key bound in the PK Token
+	caSigner, err := newSshSignerFromPem(caSecretKey)
+	require.NoError(t, err)
+	_, err = cert.SignCert(caSigner)
+	require.NoError(t, err)
+	require.ErrorContains(t, cert.VerifySelfSigned(), "certificate is signed by a key")
+
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	require.NoError(t, err)
+	signerMas, err := ssh.NewSignerWithAlgorithms(sshSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoECDSA256})
+	require.NoError(t, err)
+	_, err = cert.SignCert(signerMas)
+	require.NoError(t, err)
+	require.NoError(t, cert.VerifySelfSigned())
+
+	// A signature that does not verify is rejected
+	cert.SshCert.Signature.Blob[len(cert.SshCert.Signature.Blob)-1] ^= 0xff
+	require.ErrorContains(t, cert.VerifySelfSigned(), "certificate signature does not verify")
+}
+
+func TestIssuerKeyId(t *testing.T) {
+	t.Parallel()
+
+	op, _, idtTemplate, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	client, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := client.Auth(context.Background())
+	require.NoError(t, err)
+
+	// Without an email the sub is used
+	keyId, err := IssuerKeyId(pkt)
+	require.NoError(t, err)
+	require.Equal(t, "me https://accounts.example.com", keyId)
+
+	idtTemplate.ExtraClaims = map[string]any{"email": "arthur.aardvark@example.com"}
+	pkt, err = client.Auth(context.Background())
+	require.NoError(t, err)
+	keyId, err = IssuerKeyId(pkt)
+	require.NoError(t, err)
+	require.Equal(t, "arthur.aardvark@example.com https://accounts.example.com", keyId)
+
+	cert, err := New(pkt, []string{}, WithKeyId(keyId))
+	require.NoError(t, err)
+	require.Equal(t, keyId, cert.SshCert.KeyId)
+}
+
+func TestValidateSourceAddress(t *testing.T) {
+	tests := []struct {
+		name          string
+		sourceAddress string
+		errorString   string
+	}{
+		{name: "Single CIDR", sourceAddress: "10.0.0.0/8"},
+		{name: "Single IP", sourceAddress: "192.168.1.1"},
+		{name: "IPv6 CIDR", sourceAddress: "2001:db8::/32"},
+		{name: "Many", sourceAddress: "10.0.0.0/8,192.168.1.1,2001:db8::/32"},
+		{name: "Empty", sourceAddress: "", errorString: "source-address must not be empty"},
+		{name: "Bad CIDR", sourceAddress: "10.0.0.0/33", errorString: "invalid CIDR (10.0.0.0/33)"},
+		{name: "Bad IP", sourceAddress: "10.0.0.256", errorString: "invalid IP address (10.0.0.256)"},
+		{name: "Space after comma", sourceAddress: "10.0.0.0/8, 192.168.1.1", errorString: "invalid IP address ( 192.168.1.1)"},
+		{name: "Trailing comma", sourceAddress: "10.0.0.0/8,", errorString: "invalid IP address ()"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateSourceAddress(tt.sourceAddress)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestWithExtension(t *testing.T) {
+	t.Parallel()
+
+	op, _, _, err := providers.NewMockProvider(providers.DefaultMockProviderOpts())
+	require.NoError(t, err)
+	client, err := client.New(op)
+	require.NoError(t, err)
+	pkt, err := client.Auth(context.Background())
+	require.NoError(t, err)
+
+	cert, err := New(pkt, []string{}, WithExtension("role@example.com", "admin"))
+	require.NoError(t, err)
+	require.Equal(t, "admin", cert.SshCert.Extensions["role@example.com"])
+
+	// Custom extensions do not get in the way of reading the PK Token
+	certPkt, err := cert.GetPKToken()
+	require.NoError(t, err)
+	require.Equal(t, pkt.Payload, certPkt.Payload)
+
+	_, err = New(pkt, []string{}, WithExtension("openpubkey-pkt", "forged"))
+	require.ErrorContains(t, err, "extension openpubkey-pkt is reserved for the PK Token")
+}
+
+func TestValidateExtensionName(t *testing.T) {
+	tests := []struct {
+		name          string
+		extensionName string
+		errorString   string
+	}{
+		{name: "Domain suffixed", extensionName: "role@example.com"},
+		{name: "Standard extension", extensionName: "permit-pty"},
+		{name: "Underscore and dot", extensionName: "my_ext.v1"},
+		{name: "Empty", extensionName: "", errorString: "extension name must not be empty"},
+		{name: "Whitespace", extensionName: "my role", errorString: "invalid extension name (my role)"},
+		{name: "Equals sign", extensionName: "a=b", errorString: "invalid extension name (a=b)"},
+		{name: "Non-ASCII", extensionName: "rôle", errorString: "invalid extension name (rôle)"},
+		{name: "PK Token", extensionName: "openpubkey-pkt", errorString: "reserved for the PK Token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateExtensionName(tt.extensionName)
+			if tt.errorString != "" {
+				require.ErrorContains(t, err, tt.errorString)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
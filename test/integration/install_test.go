@@ -0,0 +1,133 @@
+// Copyright 2025 OpenPubkey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build integration
+
+package integration
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openpubkey/opkssh/internal/projectpath"
+	"github.com/openpubkey/opkssh/test/integration/ssh_server"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+)
+
+// installPaths are the paths, relative to /, that the install script
+// configures
+const installPaths = "etc/opk etc/ssh/sshd_config etc/ssh/sshd_config.d etc/sudoers.d/opkssh"
+
+// listModesAndOwners returns a "<mode> <owner> <path>" line for each path the
+// install script configures under dir, in the same format as the script's
+// --dry-run output
+func listModesAndOwners(t *testing.T, container testcontainers.Container, dir string) string {
+	cmd := "cd " + dir + " && find " + installPaths + " 2>/dev/null | sort | while read -r p; do echo \"$(stat -c '%a %U:%G' \"$p\") /$p\"; done"
+	code, out := executeCommandAsUser(t, container, []string{"bash", "-c", cmd}, RootUser)
+	require.Equal(t, 0, code)
+	return out
+}
+
+// requireSameContents fails the test if the files the install script
+// configures differ between / and dir
+func requireSameContents(t *testing.T, container testcontainers.Container, dir string) {
+	for _, p := range strings.Fields(installPaths) {
+		before, after := filepath.Join(dir, p), "/"+p
+		cmd := "[ ! -e " + before + " ] && [ ! -e " + after + " ] || diff -rN " + before + " " + after
+		code, _ := executeCommandAsUser(t, container, []string{"bash", "-c", cmd}, RootUser)
+		require.Equal(t, 0, code, "contents of /%s differ", p)
+	}
+}
+
+func TestInstallDryRun(t *testing.T) {
+	// Test that the changes printed by install-linux.sh --dry-run are the
+	// changes a real run makes
+	container, err := ssh_server.RunOpkSshContainer(
+		TestCtx,
+		// This test is only running the install script, so we don't need to
+		// set these arguments
+		"",
+		"",
+		"",
+		false,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, container.Terminate(TestCtx), "failed to terminate install_test container")
+	})
+
+	script := filepath.Join(projectpath.Root, "scripts", "install-linux.sh")
+	err = container.CopyFileToContainer(TestCtx, script, "/tmp/install-linux.sh", 0o755)
+	require.NoError(t, err)
+
+	// The image is already installed. Undo part of the install so the dry run
+	// has files to create, and snapshot what is left.
+	code, _ := executeCommandAsUser(t, container.Container, []string{"bash", "-c",
+		"rm -rf /etc/opk/config.yml /etc/opk/policy.d /etc/sudoers.d/opkssh && : > /etc/opk/providers && " +
+			"mkdir -p /tmp/before/etc/ssh /tmp/before/etc/sudoers.d && cp -a /etc/opk /tmp/before/etc/ && " +
+			"cp -a /etc/ssh/sshd_config /etc/ssh/sshd_config.d /tmp/before/etc/ssh/"}, RootUser)
+	require.Equal(t, 0, code)
+	before := listModesAndOwners(t, container.Container, "/")
+
+	install := "cp /usr/local/bin/opkssh /tmp/opkssh-install && /tmp/install-linux.sh --install-from=/tmp/opkssh-install --no-sshd-restart"
+
+	code, out := executeCommandAsUser(t, container.Container, []string{"bash", "-c", install + " --dry-run"}, RootUser)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "Dry run complete, no changes were made")
+
+	// The dry run must not have changed anything
+	requireSameContents(t, container.Container, "/tmp/before")
+	require.Equal(t, before, listModesAndOwners(t, container.Container, "/"))
+
+	_, planned, found := strings.Cut(out, "Planned changes to file contents:\n")
+	require.True(t, found)
+	contentDiff, metadataDiff, found := strings.Cut(planned, "Planned modes and owners:\n")
+	require.True(t, found)
+	metadataDiff, _, found = strings.Cut(metadataDiff, "Dry run complete")
+	require.True(t, found)
+	require.Contains(t, contentDiff, "+++ b/etc/opk/providers")
+	require.Contains(t, metadataDiff, "+750 root:opksshuser /etc/opk/policy.d")
+
+	// Apply the planned contents to the snapshot
+	err = container.CopyToContainer(TestCtx, []byte(contentDiff), "/tmp/planned.patch", 0o644)
+	require.NoError(t, err)
+	code, _ = executeCommandAsUser(t, container.Container, []string{"bash", "-c", "cd /tmp/before && patch -p1 < /tmp/planned.patch"}, RootUser)
+	require.Equal(t, 0, code)
+
+	// The planned modes and owners are the unchanged and added lines of the
+	// listing diff
+	expected := before
+	if metadataDiff != "" {
+		var b strings.Builder
+		for _, line := range strings.Split(strings.TrimSuffix(metadataDiff, "\n"), "\n") {
+			if strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "@@") {
+				continue
+			}
+			if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "+") {
+				b.WriteString(line[1:] + "\n")
+			}
+		}
+		expected = b.String()
+	}
+
+	code, _ = executeCommandAsUser(t, container.Container, []string{"bash", "-c", install}, RootUser)
+	require.Equal(t, 0, code)
+
+	requireSameContents(t, container.Container, "/tmp/before")
+	require.Equal(t, expected, listModesAndOwners(t, container.Container, "/"))
+}